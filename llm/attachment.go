@@ -0,0 +1,54 @@
+package llm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attachment is a file the user sent with a request, already saved to disk.
+type Attachment struct {
+	// Path is the absolute path of the saved file.
+	Path string
+	// Name is the original file name, when known.
+	Name string
+	MIME string
+}
+
+// IsImage reports whether the attachment can be passed to a CLI as an image.
+func (a Attachment) IsImage() bool {
+	return strings.HasPrefix(strings.ToLower(a.MIME), "image/")
+}
+
+// imagePaths returns the paths of the image attachments.
+func imagePaths(attachments []Attachment) []string {
+	var paths []string
+	for _, attachment := range attachments {
+		if attachment.IsImage() {
+			paths = append(paths, attachment.Path)
+		}
+	}
+	return paths
+}
+
+// attachmentsPromptSection lists the attachments for the agent prompt.
+func attachmentsPromptSection(attachments []Attachment) string {
+	if len(attachments) == 0 {
+		return ""
+	}
+	lines := []string{"The user attached these files. Read them from disk when they are relevant:"}
+	for _, attachment := range attachments {
+		details := make([]string, 0, 2)
+		if attachment.Name != "" {
+			details = append(details, attachment.Name)
+		}
+		if attachment.MIME != "" {
+			details = append(details, attachment.MIME)
+		}
+		line := "- " + attachment.Path
+		if len(details) > 0 {
+			line += fmt.Sprintf(" (%s)", strings.Join(details, ", "))
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildAgentPrompt_ListsAttachments(t *testing.T) {
+	got := buildAgentPrompt("why does this fail?", nil, []Attachment{
+		{Path: "/repo/.gocode/attachments/shot.jpg", Name: "shot.jpg", MIME: "image/jpeg"},
+		{Path: "/repo/.gocode/attachments/build.log"},
+	})
+	want := "The user attached these files. Read them from disk when they are relevant:\n" +
+		"- /repo/.gocode/attachments/shot.jpg (shot.jpg, image/jpeg)\n" +
+		"- /repo/.gocode/attachments/build.log\n\n" +
+		"User request:\nwhy does this fail?"
+	if !strings.HasSuffix(got, want) {
+		t.Fatalf("buildAgentPrompt() = %q, want suffix %q", got, want)
+	}
+}
+
+func TestCodexSend_PassesImageAttachments(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "codex-stub.sh")
+	argsPath := filepath.Join(repoDir, "args.txt")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > \"" + argsPath + "\"\necho ok\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	store, err := NewSessionStore("")
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	client := &CodexClient{bin: binPath, store: store, sessions: make(map[string]bool)}
+	_, err = client.Send(context.Background(), Request{
+		RepoPath: repoDir,
+		Message:  "what is wrong here?",
+		Attachments: []Attachment{
+			{Path: "/tmp/shot.png", MIME: "image/png"},
+			{Path: "/tmp/build.log", MIME: "text/plain"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+
+	raw, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("failed to read captured args: %v", err)
+	}
+	args := string(raw)
+	if !strings.Contains(args, "--image=/tmp/shot.png\n") {
+		t.Fatalf("expected image flag, got %q", args)
+	}
+	if strings.Contains(args, "--image=/tmp/build.log") || !strings.Contains(args, "/tmp/build.log") {
+		t.Fatalf("expected the log to be listed in the prompt only, got %q", args)
+	}
+}
+
+func TestCLIClient_ExpandsImageArgs(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args.txt")
+	binPath := filepath.Join(dir, "tool-stub.sh")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > \"" + argsPath + "\"\necho ok\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	client, err := NewCLIClient(CLIAgentConfig{ID: "tool", Bin: binPath, Args: []string{"run"}, ImageArgs: []string{"--image={{path}}"}}, nil)
+	if err != nil {
+		t.Fatalf("NewCLIClient returned error: %v", err)
+	}
+	if _, err := client.Send(context.Background(), Request{
+		RepoPath:    dir,
+		Message:     "look",
+		Attachments: []Attachment{{Path: "/tmp/a.png", MIME: "image/png"}},
+	}); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+
+	raw, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("failed to read captured args: %v", err)
+	}
+	if !strings.HasPrefix(string(raw), "--image=/tmp/a.png\nrun\n") {
+		t.Fatalf("unexpected args: %q", raw)
+	}
+}
@@ -1,31 +1,50 @@
 package llm
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ClaudeClient struct {
-	bin string
+	bin       string
+	store     *SessionStore
+	isolation IsolationConfig
+	// skipPermissions passes --dangerously-skip-permissions in full mode.
+	skipPermissions bool
 }
 
 const ClaudeID = "claude"
 
-func NewClaudeClient() *ClaudeClient {
+func init() {
+	Register(ClaudeID, func(opts FactoryOptions) (Client, error) {
+		client := NewClaudeClient(opts.Sessions)
+		client.isolation = opts.Isolation
+		return client, nil
+	})
+}
+
+// NewClaudeClient creates a Claude CLI client. The per-repo session generation
+// bumped by Clear is persisted in store so resets survive restarts. Setting
+// CLAUDE_SKIP_PERMISSIONS lets full-mode runs skip Claude's permission checks.
+func NewClaudeClient(store *SessionStore) *ClaudeClient {
 	bin := os.Getenv("CLAUDE_BIN")
 	if bin == "" {
 		bin = "claude"
 	}
 
+	skip, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv("CLAUDE_SKIP_PERMISSIONS")))
 	return &ClaudeClient{
-		bin: bin,
+		bin:             bin,
+		store:           store,
+		skipPermissions: skip,
 	}
 }
 
@@ -34,6 +53,10 @@ func (c *ClaudeClient) ID() string {
 }
 
 func (c *ClaudeClient) Send(ctx context.Context, req Request) (Response, error) {
+	return c.Stream(ctx, req, nil)
+}
+
+func (c *ClaudeClient) Stream(ctx context.Context, req Request, onChunk func(chunk string)) (Response, error) {
 	if strings.TrimSpace(req.Message) == "" {
 		return Response{}, errors.New("missing prompt")
 	}
@@ -43,20 +66,30 @@ func (c *ClaudeClient) Send(ctx context.Context, req Request) (Response, error)
 		return Response{}, err
 	}
 
-	prompt := buildAgentPrompt(req.Message, req.AvailableAgents)
+	prompt := buildAgentPrompt(req.Message, req.AvailableAgents, req.Attachments)
 	args := []string{
 		"-p",
 		prompt,
 		"--session-id",
-		sessionIDFromRepo(repoPath),
+		sessionIDFromRepo(repoPath, c.generation(repoPath)),
+		"--output-format",
+		"stream-json",
+		"--verbose",
+	}
+	args = append(args, claudeSandboxArgs(req.Sandbox, c.skipPermissions)...)
+	if model := strings.TrimSpace(req.Model); model != "" {
+		args = append(args, "--model", model)
 	}
 
-	out, err := c.run(ctx, repoPath, args...)
+	out, usage, err := c.run(ctx, repoPath, req.Isolation, onChunk, args...)
+	if usage.Model == "" {
+		usage.Model = strings.TrimSpace(req.Model)
+	}
 	if err != nil {
-		return Response{Text: out}, err
+		return Response{Text: out, Usage: usage}, err
 	}
 
-	return Response{Text: out}, nil
+	return Response{Text: out, Usage: usage}, nil
 }
 
 func (c *ClaudeClient) Clear(ctx context.Context, repoPath string) error {
@@ -69,42 +102,157 @@ func (c *ClaudeClient) Clear(ctx context.Context, repoPath string) error {
 	if err != nil {
 		return err
 	}
-	_ = absPath
 
-	return nil
+	next := c.generation(absPath) + 1
+	return c.store.Set(ClaudeID, absPath, strconv.Itoa(next))
 }
 
-func (c *ClaudeClient) run(ctx context.Context, repoPath string, args ...string) (string, error) {
-	cmd := exec.CommandContext(ctx, c.bin, args...)
-	if repoPath != "" {
-		cmd.Dir = repoPath
+// generation returns how many times the repo's conversation has been cleared.
+func (c *ClaudeClient) generation(repoPath string) int {
+	value := c.store.Get(ClaudeID, repoPath)
+	if value == "" {
+		return 0
+	}
+	gen, err := strconv.Atoi(value)
+	if err != nil || gen < 0 {
+		return 0
 	}
+	return gen
+}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmdline := strings.TrimSpace(strings.Join(append([]string{cmd.Path}, args...), " "))
+func (c *ClaudeClient) run(ctx context.Context, repoPath string, isolation IsolationMode, onChunk func(chunk string), args ...string) (string, Usage, error) {
+	cmd, err := c.isolation.command(ctx, isolation, commandSpec{Bin: c.bin, Args: args, RepoPath: repoPath, Dir: repoPath})
+	if err != nil {
+		return "", Usage{}, err
+	}
+
+	decoder := &claudeEventDecoder{}
+	stdout, stderr := newEventWriters(decoder, onChunk)
+	cmdline := strings.TrimSpace(strings.Join(append([]string{cmd.Path}, cmd.Args[1:]...), " "))
 	fmt.Fprintf(os.Stdout, "[claude] exec: %s\n", cmdline)
 
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	started := time.Now()
+	runErr := cmd.Run()
+	stdout.Flush()
+
+	usage := decoder.usage
+	usage.Duration = time.Since(started)
+	usage.ExitCode = exitCode(runErr)
 
-	if err := cmd.Run(); err != nil {
-		out := stdout.String()
+	out := stdout.Text()
+	if runErr != nil {
 		if out == "" {
 			out = stderr.String()
 		}
-		return out, err
+		return out, usage, classifyError(ctx, runErr, stderr.String()+"\n"+stdout.Failure())
+	}
+
+	if out == "" && stderr.Len() > 0 {
+		return stderr.String(), usage, nil
+	}
+
+	return out, usage, nil
+}
+
+// claudeEventDecoder reads the events printed by
+// `claude -p --output-format stream-json --verbose`. The closing result event
+// carries the answer, token usage and cost.
+type claudeEventDecoder struct {
+	text    string
+	done    bool
+	errText string
+	usage   Usage
+}
+
+type claudeTokenUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+}
+
+func (d *claudeEventDecoder) decode(line string) (string, bool) {
+	if !strings.HasPrefix(line, "{") {
+		return "", false
 	}
 
-	if stdout.Len() == 0 && stderr.Len() > 0 {
-		return stderr.String(), nil
+	var event struct {
+		Type    string `json:"type"`
+		Model   string `json:"model"`
+		Message struct {
+			Model   string `json:"model"`
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+				Name string `json:"name"`
+			} `json:"content"`
+		} `json:"message"`
+		Result       string           `json:"result"`
+		IsError      bool             `json:"is_error"`
+		TotalCostUSD float64          `json:"total_cost_usd"`
+		Usage        claudeTokenUsage `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(line), &event); err != nil || event.Type == "" {
+		return "", false
 	}
 
-	return stdout.String(), nil
+	switch event.Type {
+	case "system":
+		if event.Model != "" {
+			d.usage.Model = event.Model
+		}
+	case "assistant":
+		if event.Message.Model != "" {
+			d.usage.Model = event.Message.Model
+		}
+		var b strings.Builder
+		for _, block := range event.Message.Content {
+			switch block.Type {
+			case "text":
+				if strings.TrimSpace(block.Text) != "" {
+					b.WriteString(block.Text)
+					b.WriteString("\n")
+				}
+			case "tool_use":
+				if block.Name != "" {
+					b.WriteString("[" + block.Name + "]\n")
+				}
+			}
+		}
+		return b.String(), true
+	case "result":
+		d.done = true
+		d.text = event.Result
+		d.usage.InputTokens = event.Usage.InputTokens + event.Usage.CacheCreationInputTokens + event.Usage.CacheReadInputTokens
+		d.usage.OutputTokens = event.Usage.OutputTokens
+		d.usage.CostUSD = event.TotalCostUSD
+		if event.IsError {
+			d.errText = event.Result
+		}
+	}
+	return "", true
+}
+
+func (d *claudeEventDecoder) result() (string, bool) {
+	return d.text, d.done
+}
+
+func (d *claudeEventDecoder) failure() string {
+	return d.errText
 }
 
-func sessionIDFromRepo(repoPath string) string {
-	hash := sha256.Sum256([]byte(repoPath))
+// sessionIDFromRepo derives a stable session UUID for repoPath. Generation 0
+// keeps the original repo-only hash; later generations mix in the counter so
+// a cleared repo gets a fresh Claude session.
+func sessionIDFromRepo(repoPath string, generation int) string {
+	seed := repoPath
+	if generation > 0 {
+		seed = fmt.Sprintf("%s#%d", repoPath, generation)
+	}
+	hash := sha256.Sum256([]byte(seed))
 	b := hash[:16]
 	b[6] = (b[6] & 0x0f) | 0x50 // pseudo-v5 style
 	b[8] = (b[8] & 0x3f) | 0x80
@@ -10,8 +10,8 @@ import (
 
 func TestSessionIDFromRepo_Deterministic(t *testing.T) {
 	repoPath := "/tmp/my-repo"
-	id1 := sessionIDFromRepo(repoPath)
-	id2 := sessionIDFromRepo(repoPath)
+	id1 := sessionIDFromRepo(repoPath, 0)
+	id2 := sessionIDFromRepo(repoPath, 0)
 	if id1 != id2 {
 		t.Fatalf("expected deterministic session id, got %q and %q", id1, id2)
 	}
@@ -20,6 +20,16 @@ func TestSessionIDFromRepo_Deterministic(t *testing.T) {
 	}
 }
 
+func TestSessionIDFromRepo_GenerationChangesID(t *testing.T) {
+	repoPath := "/tmp/my-repo"
+	if sessionIDFromRepo(repoPath, 0) == sessionIDFromRepo(repoPath, 1) {
+		t.Fatalf("expected a new generation to produce a different session id")
+	}
+	if sessionIDFromRepo(repoPath, 2) != sessionIDFromRepo(repoPath, 2) {
+		t.Fatalf("expected session id to be deterministic per generation")
+	}
+}
+
 func TestClaudeSend_UsesRepoContextAndSessionID(t *testing.T) {
 	repoDir := t.TempDir()
 	binPath := filepath.Join(repoDir, "claude-stub.sh")
@@ -58,7 +68,10 @@ func TestClaudeSend_UsesRepoContextAndSessionID(t *testing.T) {
 	if !strings.Contains(args, "--session-id") {
 		t.Fatalf("expected --session-id arg, got %q", args)
 	}
-	if !strings.Contains(args, sessionIDFromRepo(repoDir)) {
+	if !strings.Contains(args, "--output-format\nstream-json\n--verbose") {
+		t.Fatalf("expected stream-json output format args, got %q", args)
+	}
+	if !strings.Contains(args, sessionIDFromRepo(repoDir, 0)) {
 		t.Fatalf("expected deterministic session id in args, got %q", args)
 	}
 	if !strings.Contains(args, "Available agents: claude, codex.") {
@@ -85,3 +98,130 @@ func TestClaudeSend_EmptyPrompt(t *testing.T) {
 		t.Fatalf("expected error for empty prompt")
 	}
 }
+
+func TestClaudeStream_ForwardsChunks(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "claude-stub.sh")
+
+	script := "#!/bin/sh\n" +
+		"echo \"step one\"\n" +
+		"echo \"step two\"\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	client := &ClaudeClient{bin: binPath}
+	var streamed strings.Builder
+	resp, err := client.Stream(context.Background(), Request{
+		RepoPath: repoDir,
+		Message:  "do work",
+	}, func(chunk string) {
+		streamed.WriteString(chunk)
+	})
+	if err != nil {
+		t.Fatalf("Stream returned error: %v", err)
+	}
+	if resp.Text != "step one\nstep two\n" {
+		t.Fatalf("response text = %q, want full output", resp.Text)
+	}
+	if streamed.String() != resp.Text {
+		t.Fatalf("streamed output = %q, want %q", streamed.String(), resp.Text)
+	}
+}
+
+func TestClaudeClear_StartsFreshSession(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "claude-stub.sh")
+	argsPath := filepath.Join(repoDir, "args.txt")
+
+	script := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > \"" + argsPath + "\"\n" +
+		"echo \"claude-ok\"\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	storePath := filepath.Join(repoDir, "sessions.json")
+	store, err := NewSessionStore(storePath)
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	client := &ClaudeClient{bin: binPath, store: store}
+
+	sessionArg := func() string {
+		t.Helper()
+		if _, err := client.Send(context.Background(), Request{RepoPath: repoDir, Message: "hello"}); err != nil {
+			t.Fatalf("Send returned error: %v", err)
+		}
+		argsRaw, err := os.ReadFile(argsPath)
+		if err != nil {
+			t.Fatalf("failed to read captured args: %v", err)
+		}
+		args := strings.Split(strings.TrimSpace(string(argsRaw)), "\n")
+		for i, arg := range args {
+			if arg == "--session-id" && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		t.Fatalf("missing --session-id in args %q", args)
+		return ""
+	}
+
+	before := sessionArg()
+	if before != sessionIDFromRepo(repoDir, 0) {
+		t.Fatalf("expected initial session id for generation 0, got %q", before)
+	}
+
+	if err := client.Clear(context.Background(), repoDir); err != nil {
+		t.Fatalf("Clear returned error: %v", err)
+	}
+	after := sessionArg()
+	if after == before {
+		t.Fatalf("expected a fresh session id after Clear, got %q again", after)
+	}
+
+	// The new generation must survive a restart.
+	reloaded, err := NewSessionStore(storePath)
+	if err != nil {
+		t.Fatalf("NewSessionStore reload returned error: %v", err)
+	}
+	client = &ClaudeClient{bin: binPath, store: reloaded}
+	if restarted := sessionArg(); restarted != after {
+		t.Fatalf("session id after restart = %q, want %q", restarted, after)
+	}
+}
+
+func TestClaudeStream_DecodesStreamJSONUsage(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "claude-stub.sh")
+
+	script := "#!/bin/sh\n" +
+		"cat <<'EOF'\n" +
+		`{"type":"system","subtype":"init","model":"claude-sonnet-4-5"}` + "\n" +
+		`{"type":"assistant","message":{"model":"claude-sonnet-4-5","content":[{"type":"text","text":"Looking around."},{"type":"tool_use","name":"Bash","input":{}}]}}` + "\n" +
+		`{"type":"user","message":{"content":[{"type":"tool_result","content":"ok"}]}}` + "\n" +
+		`{"type":"result","subtype":"success","result":"Fixed the bug.","total_cost_usd":0.0421,"usage":{"input_tokens":10,"cache_creation_input_tokens":200,"cache_read_input_tokens":3000,"output_tokens":150}}` + "\n" +
+		"EOF\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	client := &ClaudeClient{bin: binPath}
+	var streamed strings.Builder
+	resp, err := client.Stream(context.Background(), Request{RepoPath: repoDir, Message: "fix"}, func(chunk string) {
+		streamed.WriteString(chunk)
+	})
+	if err != nil {
+		t.Fatalf("Stream returned error: %v", err)
+	}
+	if resp.Text != "Fixed the bug." {
+		t.Fatalf("response text = %q", resp.Text)
+	}
+	if streamed.String() != "Looking around.\n[Bash]\n" {
+		t.Fatalf("streamed output = %q", streamed.String())
+	}
+	usage := resp.Usage
+	if usage.Model != "claude-sonnet-4-5" || usage.InputTokens != 3210 || usage.OutputTokens != 150 || usage.CostUSD != 0.0421 {
+		t.Fatalf("unexpected usage: %#v", usage)
+	}
+}
@@ -0,0 +1,320 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session modes supported by CLIAgentConfig.
+const (
+	// CLISessionNone runs every prompt statelessly (or lets the tool keep its
+	// own history, as Aider does).
+	CLISessionNone = "none"
+	// CLISessionRepo derives a deterministic session UUID from the repo path,
+	// like the Claude client. Clear rotates it.
+	CLISessionRepo = "repo"
+	// CLISessionCapture extracts the session id from the tool output using
+	// SessionPattern and persists it for the next turn.
+	CLISessionCapture = "capture"
+)
+
+// Working directory modes supported by CLIAgentConfig.
+const (
+	CLICwdRepo = "repo"
+	CLICwdNone = "none"
+)
+
+// CLIAgentConfig describes an agent backed by an arbitrary CLI. Args and
+// ResumeArgs are templates: {{prompt}}, {{repo}}, {{session_id}} and
+// {{model}} are substituted before running. When no argument references {{prompt}} the
+// prompt is appended as the last argument. SandboxArgs maps a sandbox mode to
+// the flags placed before the expanded args; modes without an entry add none.
+// ImageArgs is repeated for each image attachment with {{path}} substituted,
+// also before the expanded args.
+type CLIAgentConfig struct {
+	ID             string              `json:"id"`
+	Bin            string              `json:"bin"`
+	Args           []string            `json:"args"`
+	ResumeArgs     []string            `json:"resume_args,omitempty"`
+	Session        string              `json:"session,omitempty"`
+	SessionPattern string              `json:"session_pattern,omitempty"`
+	Cwd            string              `json:"cwd,omitempty"`
+	Env            map[string]string   `json:"env,omitempty"`
+	SandboxArgs    map[string][]string `json:"sandbox_args,omitempty"`
+	ImageArgs      []string            `json:"image_args,omitempty"`
+}
+
+type cliAgentsFile struct {
+	Agents []CLIAgentConfig `json:"agents"`
+}
+
+// LoadCLIAgentConfigs reads agent definitions from a JSON file of the form
+// {"agents": [...]}. A missing file yields no agents.
+func LoadCLIAgentConfigs(path string) ([]CLIAgentConfig, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var file cliAgentsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid agents config %s: %w", path, err)
+	}
+
+	for i := range file.Agents {
+		if err := file.Agents[i].normalize(); err != nil {
+			return nil, fmt.Errorf("invalid agents config %s: %w", path, err)
+		}
+	}
+	return file.Agents, nil
+}
+
+func (cfg *CLIAgentConfig) normalize() error {
+	cfg.ID = strings.ToLower(strings.TrimSpace(cfg.ID))
+	if cfg.ID == "" {
+		return errors.New("agent id is required")
+	}
+	if strings.TrimSpace(cfg.Bin) == "" {
+		return fmt.Errorf("agent %q: bin is required", cfg.ID)
+	}
+
+	if cfg.Session == "" {
+		cfg.Session = CLISessionNone
+	}
+	switch cfg.Session {
+	case CLISessionNone, CLISessionRepo:
+	case CLISessionCapture:
+		if cfg.SessionPattern == "" {
+			return fmt.Errorf("agent %q: session_pattern is required for capture sessions", cfg.ID)
+		}
+		if _, err := regexp.Compile(cfg.SessionPattern); err != nil {
+			return fmt.Errorf("agent %q: invalid session_pattern: %w", cfg.ID, err)
+		}
+	default:
+		return fmt.Errorf("agent %q: unsupported session mode %q", cfg.ID, cfg.Session)
+	}
+
+	if cfg.Cwd == "" {
+		cfg.Cwd = CLICwdRepo
+	}
+	if cfg.Cwd != CLICwdRepo && cfg.Cwd != CLICwdNone {
+		return fmt.Errorf("agent %q: unsupported cwd mode %q", cfg.ID, cfg.Cwd)
+	}
+
+	if len(cfg.SandboxArgs) > 0 {
+		sandboxArgs := make(map[string][]string, len(cfg.SandboxArgs))
+		for name, args := range cfg.SandboxArgs {
+			mode, err := ParseSandboxMode(name)
+			if err != nil {
+				return fmt.Errorf("agent %q: sandbox_args: %w", cfg.ID, err)
+			}
+			sandboxArgs[string(mode)] = args
+		}
+		cfg.SandboxArgs = sandboxArgs
+	}
+	return nil
+}
+
+// CLIClient runs a config-defined CLI agent.
+type CLIClient struct {
+	cfg            CLIAgentConfig
+	store          *SessionStore
+	sessionPattern *regexp.Regexp
+	isolation      IsolationConfig
+}
+
+func NewCLIClient(cfg CLIAgentConfig, store *SessionStore) (*CLIClient, error) {
+	if err := cfg.normalize(); err != nil {
+		return nil, err
+	}
+
+	client := &CLIClient{cfg: cfg, store: store}
+	if cfg.SessionPattern != "" {
+		client.sessionPattern = regexp.MustCompile(cfg.SessionPattern)
+	}
+	return client, nil
+}
+
+// CLIFactory adapts cfg into a registry factory.
+func CLIFactory(cfg CLIAgentConfig) Factory {
+	return func(opts FactoryOptions) (Client, error) {
+		client, err := NewCLIClient(cfg, opts.Sessions)
+		if err != nil {
+			return nil, err
+		}
+		client.isolation = opts.Isolation
+		return client, nil
+	}
+}
+
+func (c *CLIClient) ID() string {
+	return c.cfg.ID
+}
+
+func (c *CLIClient) Send(ctx context.Context, req Request) (Response, error) {
+	return c.Stream(ctx, req, nil)
+}
+
+func (c *CLIClient) Stream(ctx context.Context, req Request, onChunk func(chunk string)) (Response, error) {
+	if strings.TrimSpace(req.Message) == "" {
+		return Response{}, errors.New("missing prompt")
+	}
+
+	repoPath, err := filepath.Abs(req.RepoPath)
+	if err != nil {
+		return Response{}, err
+	}
+
+	sessionID := ""
+	template := c.cfg.Args
+	switch c.cfg.Session {
+	case CLISessionRepo:
+		sessionID = sessionIDFromRepo(repoPath, c.generation(repoPath))
+	case CLISessionCapture:
+		sessionID = c.store.Get(c.cfg.ID, repoPath)
+		if sessionID != "" && len(c.cfg.ResumeArgs) > 0 {
+			template = c.cfg.ResumeArgs
+		}
+	}
+
+	prompt := buildAgentPrompt(req.Message, req.AvailableAgents, req.Attachments)
+	args := expandCLIArgs(template, map[string]string{
+		"prompt":     prompt,
+		"repo":       repoPath,
+		"session_id": sessionID,
+		"model":      strings.TrimSpace(req.Model),
+	})
+	var prefix []string
+	prefix = append(prefix, c.cfg.SandboxArgs[string(req.Sandbox.orDefault())]...)
+	if len(c.cfg.ImageArgs) > 0 {
+		for _, path := range imagePaths(req.Attachments) {
+			for _, arg := range c.cfg.ImageArgs {
+				prefix = append(prefix, strings.ReplaceAll(arg, "{{path}}", path))
+			}
+		}
+	}
+	if len(prefix) > 0 {
+		args = append(prefix, args...)
+	}
+
+	started := time.Now()
+	out, combined, err := c.run(ctx, repoPath, req.Isolation, onChunk, args...)
+	usage := Usage{
+		Model:    strings.TrimSpace(req.Model),
+		Duration: time.Since(started),
+		ExitCode: exitCode(err),
+	}
+	if err != nil {
+		return Response{Text: out, Usage: usage}, err
+	}
+
+	if c.cfg.Session == CLISessionCapture {
+		if match := c.sessionPattern.FindStringSubmatch(combined); len(match) > 1 && match[1] != sessionID {
+			if err := c.store.Set(c.cfg.ID, repoPath, match[1]); err != nil {
+				fmt.Fprintf(os.Stdout, "[%s] failed to persist session id: %v\n", c.cfg.ID, err)
+			}
+		}
+	}
+
+	return Response{Text: out, Usage: usage}, nil
+}
+
+func (c *CLIClient) Clear(ctx context.Context, repoPath string) error {
+	_ = ctx
+	if strings.TrimSpace(repoPath) == "" {
+		return errors.New("missing repo path")
+	}
+
+	absPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return err
+	}
+
+	switch c.cfg.Session {
+	case CLISessionRepo:
+		return c.store.Set(c.cfg.ID, absPath, strconv.Itoa(c.generation(absPath)+1))
+	case CLISessionCapture:
+		return c.store.Delete(c.cfg.ID, absPath)
+	default:
+		return nil
+	}
+}
+
+func (c *CLIClient) generation(repoPath string) int {
+	gen, err := strconv.Atoi(c.store.Get(c.cfg.ID, repoPath))
+	if err != nil || gen < 0 {
+		return 0
+	}
+	return gen
+}
+
+// run executes the CLI and returns the response text plus the combined
+// stdout/stderr used for session id capture.
+func (c *CLIClient) run(ctx context.Context, repoPath string, isolation IsolationMode, onChunk func(chunk string), args ...string) (string, string, error) {
+	spec := commandSpec{Bin: c.cfg.Bin, Args: args, RepoPath: repoPath}
+	if c.cfg.Cwd == CLICwdRepo {
+		spec.Dir = repoPath
+	}
+	for key, value := range c.cfg.Env {
+		spec.Env = append(spec.Env, key+"="+value)
+	}
+	cmd, err := c.isolation.command(ctx, isolation, spec)
+	if err != nil {
+		return "", "", err
+	}
+
+	stdout, stderr := newChunkWriters(onChunk)
+	cmdline := strings.TrimSpace(strings.Join(append([]string{cmd.Path}, cmd.Args[1:]...), " "))
+	fmt.Fprintf(os.Stdout, "[%s] exec: %s\n", c.cfg.ID, cmdline)
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	runErr := cmd.Run()
+	combined := stdout.String() + "\n" + stderr.String()
+	out := stdout.String()
+	if out == "" {
+		out = stderr.String()
+	}
+	return out, combined, classifyError(ctx, runErr, stderr.String())
+}
+
+// expandCLIArgs substitutes {{name}} placeholders in template. The prompt is
+// appended when no argument references it.
+func expandCLIArgs(template []string, values map[string]string) []string {
+	pairs := make([]string, 0, len(values)*2)
+	for name, value := range values {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	// A single replacer pass keeps placeholders inside substituted values
+	// (for example a prompt mentioning {{repo}}) untouched.
+	replacer := strings.NewReplacer(pairs...)
+
+	args := make([]string, 0, len(template)+1)
+	hasPrompt := false
+	for _, arg := range template {
+		if strings.Contains(arg, "{{prompt}}") {
+			hasPrompt = true
+		}
+		args = append(args, replacer.Replace(arg))
+	}
+	if !hasPrompt {
+		args = append(args, values["prompt"])
+	}
+	return args
+}
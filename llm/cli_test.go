@@ -0,0 +1,127 @@
+package llm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandCLIArgs_SubstitutesPlaceholders(t *testing.T) {
+	got := expandCLIArgs(
+		[]string{"--message", "{{prompt}}", "--cwd={{repo}}"},
+		map[string]string{"prompt": "fix {{repo}}", "repo": "/tmp/repo", "session_id": ""},
+	)
+	want := []string{"--message", "fix {{repo}}", "--cwd=/tmp/repo"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("expandCLIArgs() = %#v, want %#v", got, want)
+	}
+}
+
+func TestExpandCLIArgs_AppendsPromptWhenMissing(t *testing.T) {
+	got := expandCLIArgs([]string{"--yes"}, map[string]string{"prompt": "hello"})
+	if len(got) != 2 || got[1] != "hello" {
+		t.Fatalf("expected prompt appended, got %#v", got)
+	}
+}
+
+func TestLoadCLIAgentConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	config := `{"agents":[{"id":"Aider","bin":"aider","args":["--yes-always","--message","{{prompt}}"]}]}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	configs, err := LoadCLIAgentConfigs(path)
+	if err != nil {
+		t.Fatalf("LoadCLIAgentConfigs returned error: %v", err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("configs = %d, want 1", len(configs))
+	}
+	if configs[0].ID != "aider" || configs[0].Session != CLISessionNone || configs[0].Cwd != CLICwdRepo {
+		t.Fatalf("unexpected normalized config: %#v", configs[0])
+	}
+
+	missing, err := LoadCLIAgentConfigs(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || missing != nil {
+		t.Fatalf("expected no agents for missing file, got %#v, %v", missing, err)
+	}
+}
+
+func TestLoadCLIAgentConfigs_RejectsCaptureWithoutPattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	config := `{"agents":[{"id":"tool","bin":"tool","session":"capture"}]}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := LoadCLIAgentConfigs(path); err == nil {
+		t.Fatalf("expected error for capture session without session_pattern")
+	}
+}
+
+func TestCLIClient_CapturesAndResumesSession(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "tool-stub.sh")
+	argsPath := filepath.Join(repoDir, "args.txt")
+	pwdPath := filepath.Join(repoDir, "pwd.txt")
+
+	script := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > \"" + argsPath + "\"\n" +
+		"pwd > \"" + pwdPath + "\"\n" +
+		"echo 'session: abc-123' >&2\n" +
+		"echo \"tool-ok\"\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	store, err := NewSessionStore("")
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	client, err := NewCLIClient(CLIAgentConfig{
+		ID:             "tool",
+		Bin:            binPath,
+		Args:           []string{"run", "{{prompt}}"},
+		ResumeArgs:     []string{"run", "--resume", "{{session_id}}", "{{prompt}}"},
+		Session:        CLISessionCapture,
+		SessionPattern: `session: (\S+)`,
+	}, store)
+	if err != nil {
+		t.Fatalf("NewCLIClient returned error: %v", err)
+	}
+
+	resp, err := client.Send(context.Background(), Request{RepoPath: repoDir, Message: "first"})
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if strings.TrimSpace(resp.Text) != "tool-ok" {
+		t.Fatalf("resp.Text = %q, want tool-ok", resp.Text)
+	}
+	pwdRaw, err := os.ReadFile(pwdPath)
+	if err != nil {
+		t.Fatalf("failed to read captured cwd: %v", err)
+	}
+	if strings.TrimSpace(string(pwdRaw)) != repoDir {
+		t.Fatalf("expected cli cwd %q, got %q", repoDir, strings.TrimSpace(string(pwdRaw)))
+	}
+
+	if _, err := client.Send(context.Background(), Request{RepoPath: repoDir, Message: "second"}); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	argsRaw, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("failed to read captured args: %v", err)
+	}
+	if !strings.HasPrefix(string(argsRaw), "run\n--resume\nabc-123\n") {
+		t.Fatalf("expected resume args with captured session, got %q", string(argsRaw))
+	}
+
+	if err := client.Clear(context.Background(), repoDir); err != nil {
+		t.Fatalf("Clear returned error: %v", err)
+	}
+	if got := store.Get("tool", repoDir); got != "" {
+		t.Fatalf("expected session cleared, got %q", got)
+	}
+}
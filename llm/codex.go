@@ -1,19 +1,22 @@
 package llm
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 type CodexClient struct {
-	bin string
+	bin       string
+	store     *SessionStore
+	isolation IsolationConfig
 
 	mu       sync.Mutex
 	sessions map[string]bool
@@ -21,7 +24,19 @@ type CodexClient struct {
 
 const CodexID = "codex"
 
-func NewCodexClient() *CodexClient {
+func init() {
+	Register(CodexID, func(opts FactoryOptions) (Client, error) {
+		client := NewCodexClient(opts.Sessions)
+		client.isolation = opts.Isolation
+		return client, nil
+	})
+}
+
+var codexSessionIDPattern = regexp.MustCompile(`(?im)^\s*session id:\s*([0-9a-f][0-9a-f-]{7,})\s*$`)
+
+// NewCodexClient creates a Codex CLI client. Session IDs are persisted in
+// store so each repo resumes its own Codex session after a restart.
+func NewCodexClient(store *SessionStore) *CodexClient {
 	bin := os.Getenv("CODEX_BIN")
 	if bin == "" {
 		bin = "codex"
@@ -29,6 +44,7 @@ func NewCodexClient() *CodexClient {
 
 	return &CodexClient{
 		bin:      bin,
+		store:    store,
 		sessions: make(map[string]bool),
 	}
 }
@@ -38,6 +54,10 @@ func (c *CodexClient) ID() string {
 }
 
 func (c *CodexClient) Send(ctx context.Context, req Request) (Response, error) {
+	return c.Stream(ctx, req, nil)
+}
+
+func (c *CodexClient) Stream(ctx context.Context, req Request, onChunk func(chunk string)) (Response, error) {
 	if req.Message == "" {
 		return Response{}, errors.New("missing prompt")
 	}
@@ -47,35 +67,63 @@ func (c *CodexClient) Send(ctx context.Context, req Request) (Response, error) {
 		return Response{}, err
 	}
 
-	shouldResume := c.shouldResume(repoPath)
-	prompt := buildAgentPrompt(req.Message, req.AvailableAgents)
+	sessionID := c.store.Get(CodexID, repoPath)
+	// Fall back to the most recent session when an earlier run in this
+	// process did not report its session id.
+	resumeLast := sessionID == "" && c.shouldResume(repoPath)
+	prompt := buildAgentPrompt(req.Message, req.AvailableAgents, req.Attachments)
 
-	var args []string
-	if shouldResume {
-		args = []string{"exec", "-s", "danger-full-access", "resume", "--last", "--", prompt}
-	} else {
-		args = []string{"exec", "-s", "danger-full-access"}
-		if req.RepoPath != "" {
-			args = append(args, "--cd", req.RepoPath)
-		}
-		args = append(args, "--", prompt)
+	args := codexExecArgs(req, prompt, sessionID, resumeLast)
+	out, reportedID, usage, err := c.run(ctx, repoPath, req.Isolation, onChunk, args...)
+	if usage.Model == "" {
+		usage.Model = strings.TrimSpace(req.Model)
 	}
-
-	out, err := c.run(ctx, repoPath, args...)
 	if err != nil {
-		return Response{Text: out}, err
+		return Response{Text: out, Usage: usage}, err
 	}
 
-	if !shouldResume {
+	isNew := sessionID == "" && !resumeLast
+	if isNew {
 		if out != "" {
 			out += "\n\n"
 		}
 		out += "New session started."
 	}
 
+	if reportedID != "" && reportedID != sessionID {
+		if err := c.store.Set(CodexID, repoPath, reportedID); err != nil {
+			fmt.Fprintf(os.Stdout, "[codex] failed to persist session id: %v\n", err)
+		}
+	}
 	c.markSession(repoPath)
 
-	return Response{Text: out}, nil
+	return Response{Text: out, Usage: usage}, nil
+}
+
+// codexExecArgs builds the `codex exec` arguments for req, resuming sessionID
+// or the last session when set. Images use the --image=<path> form because
+// --image takes several values and would otherwise swallow the resume
+// subcommand and session id that follow it.
+func codexExecArgs(req Request, prompt, sessionID string, resumeLast bool) []string {
+	args := append([]string{"exec", "--json"}, codexSandboxArgs(req.Sandbox)...)
+	if model := strings.TrimSpace(req.Model); model != "" {
+		args = append(args, "-m", model)
+	}
+	for _, path := range imagePaths(req.Attachments) {
+		args = append(args, "--image="+path)
+	}
+	switch {
+	case sessionID != "":
+		args = append(args, "resume", sessionID, "--", prompt)
+	case resumeLast:
+		args = append(args, "resume", "--last", "--", prompt)
+	default:
+		if req.RepoPath != "" {
+			args = append(args, "--cd", req.RepoPath)
+		}
+		args = append(args, "--", prompt)
+	}
+	return args
 }
 
 func (c *CodexClient) Clear(ctx context.Context, repoPath string) error {
@@ -84,42 +132,169 @@ func (c *CodexClient) Clear(ctx context.Context, repoPath string) error {
 		return errors.New("missing repo path")
 	}
 
+	absPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return err
+	}
+
 	c.mu.Lock()
-	delete(c.sessions, repoPath)
+	delete(c.sessions, absPath)
 	c.mu.Unlock()
 
-	return nil
+	return c.store.Delete(CodexID, absPath)
 }
 
-func (c *CodexClient) run(ctx context.Context, repoPath string, args ...string) (string, error) {
-	cmd := exec.CommandContext(ctx, c.bin, args...)
-	if repoPath != "" {
-		cmd.Dir = repoPath
+// run executes the Codex CLI and returns its answer, the session id Codex
+// reported (if any) and the usage of the run.
+func (c *CodexClient) run(ctx context.Context, repoPath string, isolation IsolationMode, onChunk func(chunk string), args ...string) (string, string, Usage, error) {
+	cmd, err := c.isolation.command(ctx, isolation, commandSpec{Bin: c.bin, Args: args, RepoPath: repoPath, Dir: repoPath})
+	if err != nil {
+		return "", "", Usage{}, err
 	}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmdline := strings.TrimSpace(strings.Join(append([]string{cmd.Path}, args...), " "))
+	decoder := &codexEventDecoder{}
+	stdout, stderr := newEventWriters(decoder, onChunk)
+	cmdline := strings.TrimSpace(strings.Join(append([]string{cmd.Path}, cmd.Args[1:]...), " "))
 	fmt.Fprintf(os.Stdout, "[codex] exec: %s\n", cmdline)
 
 	// Capture agent output without mirroring it to process logs to avoid
 	// log spam from long model responses.
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	started := time.Now()
+	runErr := cmd.Run()
+	stdout.Flush()
+
+	usage := decoder.usage
+	usage.Duration = time.Since(started)
+	usage.ExitCode = exitCode(runErr)
 
-	if err := cmd.Run(); err != nil {
-		out := stdout.String()
+	sessionID := parseCodexSessionID(stderr.String())
+	if sessionID == "" {
+		sessionID = parseCodexSessionID(stdout.Raw())
+	}
+
+	out := stdout.Text()
+	if runErr != nil {
 		if out == "" {
 			out = stderr.String()
 		}
-		return out, err
+		return out, sessionID, usage, classifyError(ctx, runErr, stderr.String()+"\n"+stdout.Failure())
+	}
+
+	if out == "" && stderr.Len() > 0 {
+		return stderr.String(), sessionID, usage, nil
+	}
+
+	return out, sessionID, usage, nil
+}
+
+// codexEventDecoder reads the JSONL events printed by `codex exec --json`.
+// Agent messages make up the answer; commands are shown while streaming.
+type codexEventDecoder struct {
+	messages []string
+	errors   []string
+	usage    Usage
+}
+
+func (d *codexEventDecoder) decode(line string) (string, bool) {
+	if !strings.HasPrefix(line, "{") {
+		return "", false
+	}
+
+	var event struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+		Item    struct {
+			Type    string `json:"type"`
+			Text    string `json:"text"`
+			Command string `json:"command"`
+		} `json:"item"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(line), &event); err != nil || event.Type == "" {
+		return "", false
+	}
+
+	switch event.Type {
+	case "item.started":
+		if event.Item.Type == "command_execution" && event.Item.Command != "" {
+			return "$ " + event.Item.Command + "\n", true
+		}
+	case "item.completed":
+		if event.Item.Type == "agent_message" && strings.TrimSpace(event.Item.Text) != "" {
+			d.messages = append(d.messages, strings.TrimSpace(event.Item.Text))
+			return event.Item.Text + "\n", true
+		}
+	case "turn.completed":
+		d.usage.InputTokens += event.Usage.InputTokens
+		d.usage.OutputTokens += event.Usage.OutputTokens
+	case "turn.failed":
+		if event.Error.Message != "" {
+			d.errors = append(d.errors, event.Error.Message)
+			return event.Error.Message + "\n", true
+		}
+	case "error":
+		if event.Message != "" {
+			d.errors = append(d.errors, event.Message)
+			return event.Message + "\n", true
+		}
+	}
+	return "", true
+}
+
+func (d *codexEventDecoder) result() (string, bool) {
+	if len(d.messages) == 0 {
+		return "", false
 	}
+	return strings.Join(d.messages, "\n\n"), true
+}
+
+func (d *codexEventDecoder) failure() string {
+	return strings.Join(d.errors, "\n")
+}
 
-	if stdout.Len() == 0 && stderr.Len() > 0 {
-		return stderr.String(), nil
+// parseCodexSessionID extracts the session id from Codex output. It accepts
+// both the human-readable "session id: <id>" header and JSON events emitted
+// with --json (thread.started / session_configured).
+func parseCodexSessionID(output string) string {
+	if match := codexSessionIDPattern.FindStringSubmatch(output); len(match) == 2 {
+		return match[1]
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+
+		var event struct {
+			Type     string `json:"type"`
+			ThreadID string `json:"thread_id"`
+			Msg      struct {
+				Type      string `json:"type"`
+				SessionID string `json:"session_id"`
+			} `json:"msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			continue
+		}
+		if event.Type == "thread.started" && event.ThreadID != "" {
+			return event.ThreadID
+		}
+		if event.Msg.Type == "session_configured" && event.Msg.SessionID != "" {
+			return event.Msg.SessionID
+		}
 	}
 
-	return stdout.String(), nil
+	return ""
 }
 
 func (c *CodexClient) shouldResume(repoPath string) bool {
@@ -1,12 +1,15 @@
 package llm
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
 
 func TestBuildAgentPrompt_ContainsPreambleAndUserRequest(t *testing.T) {
-	got := buildAgentPrompt("create a changelog", []string{"codex", "claude"})
+	got := buildAgentPrompt("create a changelog", []string{"codex", "claude"}, nil)
 	if !strings.Contains(got, attachmentPromptPreamble) {
 		t.Fatalf("expected prompt preamble to be included")
 	}
@@ -19,8 +22,163 @@ func TestBuildAgentPrompt_ContainsPreambleAndUserRequest(t *testing.T) {
 }
 
 func TestBuildAgentPrompt_EmptyMessage(t *testing.T) {
-	got := buildAgentPrompt("   ", nil)
+	got := buildAgentPrompt("   ", nil, nil)
 	if got != attachmentPromptPreamble {
 		t.Fatalf("expected only preamble for empty message, got %q", got)
 	}
 }
+
+func TestParseCodexSessionID_HumanHeader(t *testing.T) {
+	output := "OpenAI Codex v0.46.0\n--------\nworkdir: /tmp/repo\nsession id: 0199a213-81c0-7800-8aa1-bbab2a035a53\n--------\n"
+	got := parseCodexSessionID(output)
+	if got != "0199a213-81c0-7800-8aa1-bbab2a035a53" {
+		t.Fatalf("parseCodexSessionID() = %q", got)
+	}
+}
+
+func TestParseCodexSessionID_JSONEvents(t *testing.T) {
+	output := `{"type":"thread.started","thread_id":"0199a213-aaaa-7800-8aa1-bbab2a035a53"}` + "\n"
+	if got := parseCodexSessionID(output); got != "0199a213-aaaa-7800-8aa1-bbab2a035a53" {
+		t.Fatalf("parseCodexSessionID() thread.started = %q", got)
+	}
+
+	legacy := `{"id":"0","msg":{"type":"session_configured","session_id":"abc12345-0000"}}`
+	if got := parseCodexSessionID(legacy); got != "abc12345-0000" {
+		t.Fatalf("parseCodexSessionID() session_configured = %q", got)
+	}
+
+	if got := parseCodexSessionID("no session here"); got != "" {
+		t.Fatalf("parseCodexSessionID() = %q, want empty", got)
+	}
+}
+
+func TestCodexSend_ResumesPersistedSession(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "codex-stub.sh")
+	argsPath := filepath.Join(repoDir, "args.txt")
+
+	script := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > \"" + argsPath + "\"\n" +
+		"echo 'session id: 0199a213-81c0-7800-8aa1-bbab2a035a53' >&2\n" +
+		"echo \"codex-ok\"\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	storePath := filepath.Join(repoDir, "sessions.json")
+	store, err := NewSessionStore(storePath)
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+
+	client := &CodexClient{bin: binPath, store: store, sessions: make(map[string]bool)}
+	resp, err := client.Send(context.Background(), Request{RepoPath: repoDir, Message: "first"})
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if !strings.Contains(resp.Text, "New session started.") {
+		t.Fatalf("expected new session marker, got %q", resp.Text)
+	}
+
+	// Simulate a restart: fresh client, store reloaded from disk.
+	reloaded, err := NewSessionStore(storePath)
+	if err != nil {
+		t.Fatalf("NewSessionStore reload returned error: %v", err)
+	}
+	restarted := &CodexClient{bin: binPath, store: reloaded, sessions: make(map[string]bool)}
+	resp, err = restarted.Send(context.Background(), Request{RepoPath: repoDir, Message: "second"})
+	if err != nil {
+		t.Fatalf("Send after restart returned error: %v", err)
+	}
+	if strings.Contains(resp.Text, "New session started.") {
+		t.Fatalf("expected resumed session, got %q", resp.Text)
+	}
+
+	argsRaw, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("failed to read captured args: %v", err)
+	}
+	args := string(argsRaw)
+	if !strings.Contains(args, "resume\n0199a213-81c0-7800-8aa1-bbab2a035a53\n") {
+		t.Fatalf("expected resume with persisted session id, got %q", args)
+	}
+
+	if err := restarted.Clear(context.Background(), repoDir); err != nil {
+		t.Fatalf("Clear returned error: %v", err)
+	}
+	if got := reloaded.Get(CodexID, repoDir); got != "" {
+		t.Fatalf("expected session to be cleared, got %q", got)
+	}
+}
+
+func TestCodexExecArgs_ImagesDoNotSwallowResume(t *testing.T) {
+	req := Request{
+		RepoPath:    "/tmp/repo",
+		Model:       "gpt-5",
+		Attachments: []Attachment{{Path: "/tmp/repo/shot.png", MIME: "image/png"}},
+	}
+	got := codexExecArgs(req, "prompt", "0199a213-81c0-7800-8aa1-bbab2a035a53", false)
+	want := append([]string{"exec", "--json"}, codexSandboxArgs("")...)
+	want = append(want, "-m", "gpt-5", "--image=/tmp/repo/shot.png", "resume", "0199a213-81c0-7800-8aa1-bbab2a035a53", "--", "prompt")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("codexExecArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestCodexStream_DecodesJSONEventsAndUsage(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "codex-stub.sh")
+
+	script := "#!/bin/sh\n" +
+		"cat <<'EOF'\n" +
+		`{"type":"thread.started","thread_id":"0199a213-bbbb-7800-8aa1-bbab2a035a53"}` + "\n" +
+		`{"type":"item.started","item":{"id":"item_1","type":"command_execution","command":"bash -lc ls"}}` + "\n" +
+		`{"type":"item.completed","item":{"id":"item_2","type":"agent_message","text":"All done."}}` + "\n" +
+		`{"type":"turn.completed","usage":{"input_tokens":1200,"cached_input_tokens":1000,"output_tokens":80}}` + "\n" +
+		"EOF\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	store, err := NewSessionStore("")
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	client := &CodexClient{bin: binPath, store: store, sessions: make(map[string]bool)}
+	var streamed strings.Builder
+	resp, err := client.Stream(context.Background(), Request{RepoPath: repoDir, Message: "go", Model: "gpt-5"}, func(chunk string) {
+		streamed.WriteString(chunk)
+	})
+	if err != nil {
+		t.Fatalf("Stream returned error: %v", err)
+	}
+	if resp.Text != "All done.\n\nNew session started." {
+		t.Fatalf("response text = %q", resp.Text)
+	}
+	if streamed.String() != "$ bash -lc ls\nAll done.\n" {
+		t.Fatalf("streamed output = %q", streamed.String())
+	}
+	if resp.Usage.InputTokens != 1200 || resp.Usage.OutputTokens != 80 || resp.Usage.Model != "gpt-5" || resp.Usage.ExitCode != 0 {
+		t.Fatalf("unexpected usage: %#v", resp.Usage)
+	}
+	if got := store.Get(CodexID, repoDir); got != "0199a213-bbbb-7800-8aa1-bbab2a035a53" {
+		t.Fatalf("expected session id from thread.started, got %q", got)
+	}
+}
+
+func TestCodexStream_ReportsExitCode(t *testing.T) {
+	repoDir := t.TempDir()
+	binPath := filepath.Join(repoDir, "codex-stub.sh")
+	if err := os.WriteFile(binPath, []byte("#!/bin/sh\necho 'rate limited' >&2\nexit 3\n"), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	client := &CodexClient{bin: binPath, sessions: make(map[string]bool)}
+	resp, err := client.Send(context.Background(), Request{RepoPath: repoDir, Message: "go"})
+	if err == nil {
+		t.Fatalf("expected error from failing cli")
+	}
+	if resp.Usage.ExitCode != 3 || strings.TrimSpace(resp.Text) != "rate limited" {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+}
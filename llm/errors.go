@@ -0,0 +1,152 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ErrorKind classifies why an agent call failed so callers can decide
+// whether to retry or fall back to another agent.
+type ErrorKind string
+
+const (
+	ErrorRateLimited ErrorKind = "rate_limited"
+	ErrorAuth        ErrorKind = "auth"
+	ErrorTimeout     ErrorKind = "timeout"
+	ErrorCrash       ErrorKind = "crash"
+	ErrorCanceled    ErrorKind = "canceled"
+)
+
+// Retryable reports whether trying the same agent again is safe by default.
+// A rate limit means the agent was turned away, while a timeout or crash may
+// have left edits behind in the worktree; auth failures need a human and
+// cancellations were asked for.
+func (k ErrorKind) Retryable() bool {
+	return k == ErrorRateLimited
+}
+
+// Describe returns a short human-readable label for k.
+func (k ErrorKind) Describe() string {
+	switch k {
+	case ErrorRateLimited:
+		return "rate limited"
+	case ErrorAuth:
+		return "auth failed"
+	case ErrorTimeout:
+		return "timed out"
+	case ErrorCrash:
+		return "crashed"
+	case ErrorCanceled:
+		return "canceled"
+	default:
+		return "failed"
+	}
+}
+
+// Error is an agent failure tagged with its kind. Its message is the message
+// of the wrapped error.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of err. Context errors are classified even when no
+// client wrapped them; other unclassified errors return "".
+func KindOf(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+	var agentErr *Error
+	if errors.As(err, &agentErr) {
+		return agentErr.Kind
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	}
+	return ""
+}
+
+// maxClassifyOutputLen bounds how much trailing output is inspected, so
+// warnings early in a long stderr log do not decide the kind.
+const maxClassifyOutputLen = 2000
+
+var (
+	rateLimitMarkers = []string{"rate limit", "rate_limit", "ratelimit", "too many requests", "quota", "usage limit", "overloaded"}
+	authMarkers      = []string{"unauthorized", "forbidden", "not logged in", "please log in", "login required", "authentication", "invalid api key", "invalid_api_key", "token expired", "expired token"}
+	timeoutMarkers   = []string{"timed out", "timeout", "deadline exceeded"}
+
+	rateLimitStatusPattern = regexp.MustCompile(`\b429\b`)
+	authStatusPattern      = regexp.MustCompile(`\b40[13]\b`)
+)
+
+// classifyError wraps err from a run with its kind. output must only hold
+// what the CLI itself reported (stderr and its error events), never the
+// agent's answer or tool output, which may mention any of the markers.
+// ctx is the context the run used; its state wins over output heuristics.
+func classifyError(ctx context.Context, err error, output string) error {
+	if err == nil {
+		return nil
+	}
+	if KindOf(err) != "" {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		kind := ErrorTimeout
+		if errors.Is(ctxErr, context.Canceled) {
+			kind = ErrorCanceled
+		}
+		return &Error{Kind: kind, Err: err}
+	}
+
+	if len(output) > maxClassifyOutputLen {
+		output = output[len(output)-maxClassifyOutputLen:]
+	}
+	haystack := strings.ToLower(output + "\n" + err.Error())
+	kind := ErrorCrash
+	switch {
+	case containsAny(haystack, rateLimitMarkers) || rateLimitStatusPattern.MatchString(haystack):
+		kind = ErrorRateLimited
+	case containsAny(haystack, authMarkers) || authStatusPattern.MatchString(haystack):
+		kind = ErrorAuth
+	case containsAny(haystack, timeoutMarkers):
+		kind = ErrorTimeout
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// statusErrorKind classifies a failed HTTP response by its status code.
+func statusErrorKind(status int) ErrorKind {
+	switch status {
+	case http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrorAuth
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrorTimeout
+	default:
+		return ErrorCrash
+	}
+}
+
+func containsAny(s string, markers []string) bool {
+	for _, marker := range markers {
+		if strings.Contains(s, marker) {
+			return true
+		}
+	}
+	return false
+}
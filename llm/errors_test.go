@@ -0,0 +1,178 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	runErr := errors.New("exit status 1")
+	cases := []struct {
+		output string
+		want   ErrorKind
+	}{
+		{"stream error: 429 Too Many Requests", ErrorRateLimited},
+		{"You've hit your usage limit. Try again later.", ErrorRateLimited},
+		{"Error: Not logged in. Please run /login", ErrorAuth},
+		{"401 Unauthorized: token expired", ErrorAuth},
+		{"request timed out while contacting the API", ErrorTimeout},
+		{"panic: runtime error: index out of range", ErrorCrash},
+		{"error: build 14290 failed after 4013ms", ErrorCrash},
+		{"", ErrorCrash},
+	}
+	for _, tc := range cases {
+		err := classifyError(context.Background(), runErr, tc.output)
+		if got := KindOf(err); got != tc.want {
+			t.Fatalf("KindOf(classifyError(%q)) = %q, want %q", tc.output, got, tc.want)
+		}
+		if err.Error() != runErr.Error() || !errors.Is(err, runErr) {
+			t.Fatalf("expected classified error to keep %v, got %v", runErr, err)
+		}
+	}
+
+	if err := classifyError(context.Background(), nil, "429"); err != nil {
+		t.Fatalf("expected nil error to stay nil, got %v", err)
+	}
+}
+
+func TestClassifyError_IgnoresMarkersEarlyInLongOutput(t *testing.T) {
+	output := "The handler returns 401 for anonymous users.\n" + strings.Repeat("x", maxClassifyOutputLen)
+	err := classifyError(context.Background(), errors.New("exit status 2"), output)
+	if got := KindOf(err); got != ErrorCrash {
+		t.Fatalf("KindOf() = %q, want %q", got, ErrorCrash)
+	}
+}
+
+func TestClassifyError_UsesContextState(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := KindOf(classifyError(canceled, errors.New("signal: killed"), "rate limit")); got != ErrorCanceled {
+		t.Fatalf("KindOf() = %q, want %q", got, ErrorCanceled)
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-expired.Done()
+	if got := KindOf(classifyError(expired, errors.New("signal: killed"), "")); got != ErrorTimeout {
+		t.Fatalf("KindOf() = %q, want %q", got, ErrorTimeout)
+	}
+}
+
+func TestKindOf_ContextErrorsAndUnclassified(t *testing.T) {
+	if got := KindOf(fmt.Errorf("agent stopped: %w", context.Canceled)); got != ErrorCanceled {
+		t.Fatalf("KindOf(canceled) = %q", got)
+	}
+	if got := KindOf(fmt.Errorf("agent timed out: %w", context.DeadlineExceeded)); got != ErrorTimeout {
+		t.Fatalf("KindOf(deadline) = %q", got)
+	}
+	if got := KindOf(errors.New("agent not configured")); got != "" {
+		t.Fatalf("KindOf(plain) = %q, want empty", got)
+	}
+}
+
+func TestCLIClient_ClassifiesFailedRun(t *testing.T) {
+	dir := t.TempDir()
+	binPath := filepath.Join(dir, "tool-stub.sh")
+	script := "#!/bin/sh\necho 'Error: rate limit reached, retry later' >&2\nexit 3\n"
+	if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write stub cli: %v", err)
+	}
+
+	client, err := NewCLIClient(CLIAgentConfig{ID: "tool", Bin: binPath}, nil)
+	if err != nil {
+		t.Fatalf("NewCLIClient returned error: %v", err)
+	}
+	resp, err := client.Send(context.Background(), Request{RepoPath: dir, Message: "go"})
+	if KindOf(err) != ErrorRateLimited {
+		t.Fatalf("expected rate limited error, got %v (%q)", err, KindOf(err))
+	}
+	if resp.Usage.ExitCode != 3 {
+		t.Fatalf("ExitCode = %d, want 3", resp.Usage.ExitCode)
+	}
+}
+
+func TestOpenAICompatSend_ClassifiesStatus(t *testing.T) {
+	cases := map[int]ErrorKind{
+		http.StatusTooManyRequests:     ErrorRateLimited,
+		http.StatusUnauthorized:        ErrorAuth,
+		http.StatusGatewayTimeout:      ErrorTimeout,
+		http.StatusInternalServerError: ErrorCrash,
+	}
+	for status, want := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", status)
+		}))
+		client := newTestOpenAIClient(server.URL)
+		_, err := client.Send(context.Background(), Request{RepoPath: "/tmp/repo", Message: "go"})
+		server.Close()
+		if got := KindOf(err); got != want {
+			t.Fatalf("status %d: KindOf() = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestClaudeStream_ClassifiesOnlyErrorEvents(t *testing.T) {
+	cases := map[string]ErrorKind{
+		"API Error: 429 rate_limit_error": ErrorRateLimited,
+		"Execution error":                 ErrorCrash,
+	}
+	for result, want := range cases {
+		repoDir := t.TempDir()
+		binPath := filepath.Join(repoDir, "claude-stub.sh")
+		script := "#!/bin/sh\n" +
+			"cat <<'EOF'\n" +
+			`{"type":"assistant","message":{"content":[{"type":"text","text":"The handler returns 401 Unauthorized for anonymous users."}]}}` + "\n" +
+			`{"type":"user","message":{"content":[{"type":"tool_result","content":"HTTP 403 forbidden: quota exceeded"}]}}` + "\n" +
+			`{"type":"result","subtype":"error_during_execution","is_error":true,"result":"` + result + `"}` + "\n" +
+			"EOF\n" +
+			"exit 1\n"
+		if err := os.WriteFile(binPath, []byte(script), 0o755); err != nil {
+			t.Fatalf("failed to write stub cli: %v", err)
+		}
+
+		client := &ClaudeClient{bin: binPath}
+		_, err := client.Send(context.Background(), Request{RepoPath: repoDir, Message: "fix"})
+		if got := KindOf(err); got != want {
+			t.Fatalf("result %q: KindOf() = %q, want %q", result, got, want)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Second}
+	limited := &Error{Kind: ErrorRateLimited, Err: errors.New("exit status 1")}
+	crash := &Error{Kind: ErrorCrash, Err: errors.New("exit status 1")}
+	timeout := &Error{Kind: ErrorTimeout, Err: errors.New("signal: killed")}
+	auth := &Error{Kind: ErrorAuth, Err: errors.New("exit status 1")}
+
+	if !policy.ShouldRetry(limited, 1) || !policy.ShouldRetry(limited, 2) || policy.ShouldRetry(limited, 3) {
+		t.Fatalf("expected rate limits to be retried until MaxAttempts")
+	}
+	if policy.ShouldRetry(crash, 1) || policy.ShouldRetry(timeout, 1) {
+		t.Fatalf("expected crashes and timeouts not to be retried by default")
+	}
+	optIn := RetryPolicy{MaxAttempts: 3, RetryFailures: true}
+	if !optIn.ShouldRetry(crash, 1) || !optIn.ShouldRetry(timeout, 2) || optIn.ShouldRetry(auth, 1) {
+		t.Fatalf("expected RetryFailures to retry crashes and timeouts only")
+	}
+	if policy.ShouldRetry(auth, 1) {
+		t.Fatalf("expected auth failures not to be retried")
+	}
+	if policy.ShouldRetry(errors.New("missing prompt"), 1) {
+		t.Fatalf("expected unclassified errors not to be retried")
+	}
+	if policy.Delay(1) != time.Second || policy.Delay(3) != 4*time.Second {
+		t.Fatalf("unexpected backoff: %s, %s", policy.Delay(1), policy.Delay(3))
+	}
+	if (RetryPolicy{}).ShouldRetry(limited, 1) {
+		t.Fatalf("expected the zero policy to make a single attempt")
+	}
+}
@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// HandoffDirective prefixes the line an agent uses to pass work to another
+// agent, e.g. "HANDOFF @claude: review the auth middleware".
+const HandoffDirective = "HANDOFF"
+
+// handoffFenceInfo is the info string of a fenced handoff block:
+//
+//	```handoff
+//	{"to": "claude", "message": "review the auth middleware"}
+//	```
+const handoffFenceInfo = "handoff"
+
+// Handoff is a request from one agent to forward work to another.
+type Handoff struct {
+	To      string
+	Message string
+}
+
+var (
+	handoffDirectivePattern = regexp.MustCompile(`^(?i:` + HandoffDirective + `)\s+@?([a-zA-Z0-9_-]+)\s*:\s*(.*)$`)
+	legacyHandoffPattern    = regexp.MustCompile(`^@([a-zA-Z0-9_-]+)(?:\s+(.*))?$`)
+)
+
+// ParseHandoff extracts a handoff to one of agents from an agent response.
+//
+// A fenced handoff block wins, then a HANDOFF directive line. For agents still
+// using the old free-text convention, a line that starts with @<agent_id> is
+// accepted as a fallback. Tags inside code fences, blockquotes or mid-sentence
+// (emails, decorators, prose mentions) are never treated as handoffs.
+func ParseHandoff(text string, agents []string) (Handoff, bool) {
+	known := make(map[string]bool, len(agents))
+	for _, id := range agents {
+		if id = strings.ToLower(strings.TrimSpace(id)); id != "" {
+			known[id] = true
+		}
+	}
+	if len(known) == 0 {
+		return Handoff{}, false
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if handoff, ok := parseHandoffBlock(lines, known); ok {
+		return handoff, true
+	}
+	if handoff, ok := parseHandoffLine(lines, known, handoffDirectivePattern); ok {
+		return handoff, true
+	}
+	return parseHandoffLine(lines, known, legacyHandoffPattern)
+}
+
+func parseHandoffBlock(lines []string, known map[string]bool) (Handoff, bool) {
+	inFence := false
+	info := ""
+	start := 0
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "```") {
+			continue
+		}
+		if !inFence {
+			inFence = true
+			info = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(trimmed, "```")))
+			start = i + 1
+			continue
+		}
+		inFence = false
+		if info != handoffFenceInfo {
+			continue
+		}
+
+		var payload struct {
+			To      string `json:"to"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(strings.Join(lines[start:i], "\n")), &payload); err != nil {
+			continue
+		}
+		to := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(payload.To), "@"))
+		message := strings.TrimSpace(payload.Message)
+		if known[to] && message != "" {
+			return Handoff{To: to, Message: message}, true
+		}
+	}
+	return Handoff{}, false
+}
+
+// parseHandoffLine finds the first line outside code fences and blockquotes
+// that matches pattern. The message is the rest of that line plus everything
+// after it.
+func parseHandoffLine(lines []string, known map[string]bool, pattern *regexp.Regexp) (Handoff, bool) {
+	inFence := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inFence = !inFence
+			continue
+		}
+		if inFence || strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+
+		match := pattern.FindStringSubmatch(trimmed)
+		if match == nil {
+			continue
+		}
+		to := strings.ToLower(match[1])
+		if !known[to] {
+			continue
+		}
+
+		rest := append([]string{match[2]}, lines[i+1:]...)
+		message := strings.TrimSpace(strings.Join(rest, "\n"))
+		if message == "" {
+			continue
+		}
+		return Handoff{To: to, Message: message}, true
+	}
+	return Handoff{}, false
+}
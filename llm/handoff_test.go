@@ -0,0 +1,60 @@
+package llm
+
+import "testing"
+
+var handoffTestAgents = []string{CodexID, ClaudeID}
+
+func TestParseHandoff_DirectiveLine(t *testing.T) {
+	text := "I've finished the refactor.\n\nHANDOFF @claude: review the auth middleware\nfocus on token expiry"
+	got, ok := ParseHandoff(text, handoffTestAgents)
+	if !ok {
+		t.Fatalf("expected handoff to be parsed")
+	}
+	if got.To != ClaudeID || got.Message != "review the auth middleware\nfocus on token expiry" {
+		t.Fatalf("unexpected handoff: %#v", got)
+	}
+}
+
+func TestParseHandoff_FencedJSONBlock(t *testing.T) {
+	text := "Plan ready.\n```handoff\n{\"to\": \"@Codex\", \"message\": \"implement step 1\"}\n```\n"
+	got, ok := ParseHandoff(text, handoffTestAgents)
+	if !ok || got.To != CodexID || got.Message != "implement step 1" {
+		t.Fatalf("unexpected handoff: %#v %v", got, ok)
+	}
+}
+
+func TestParseHandoff_BlockWinsOverDirective(t *testing.T) {
+	text := "HANDOFF @claude: first\n```handoff\n{\"to\": \"codex\", \"message\": \"second\"}\n```"
+	got, ok := ParseHandoff(text, handoffTestAgents)
+	if !ok || got.To != CodexID {
+		t.Fatalf("expected fenced block to win, got %#v %v", got, ok)
+	}
+}
+
+func TestParseHandoff_LegacyLineFallback(t *testing.T) {
+	got, ok := ParseHandoff("@claude review this plan", handoffTestAgents)
+	if !ok || got.To != ClaudeID || got.Message != "review this plan" {
+		t.Fatalf("unexpected handoff: %#v %v", got, ok)
+	}
+}
+
+func TestParseHandoff_IgnoresFalsePositives(t *testing.T) {
+	cases := map[string]string{
+		"email":            "Reach the team at dev@claude.ai for access.",
+		"prose mention":    "Earlier @codex wrote this helper, so I kept it.",
+		"decorator":        "@claude_fn\ndef handler():\n    pass",
+		"fenced decorator": "Here is the code:\n```python\n@codex\ndef run():\n    pass\n```",
+		"fenced directive": "Example:\n```\nHANDOFF @claude: do something\n```",
+		"inline code":      "Use `@claude review` to ask for a review.",
+		"blockquote":       "You wrote:\n> @claude review the auth flow\nDone.",
+		"quoted":           "The user said \"@codex fix it\" earlier.",
+		"unknown agent":    "HANDOFF @gemini: take a look",
+		"empty message":    "HANDOFF @claude:",
+		"bad json block":   "```handoff\n{\"to\": \"claude\"\n```",
+	}
+	for name, text := range cases {
+		if got, ok := ParseHandoff(text, handoffTestAgents); ok {
+			t.Fatalf("%s: expected no handoff, got %#v", name, got)
+		}
+	}
+}
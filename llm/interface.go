@@ -6,14 +6,29 @@ type Request struct {
 	RepoPath        string
 	Message         string
 	AvailableAgents []string
+	// Model overrides the client's default model when set.
+	Model string
+	// Sandbox limits what the agent may do; empty uses DefaultSandboxMode.
+	Sandbox SandboxMode
+	// Isolation selects how CLI agents are executed; empty runs on the host.
+	Isolation IsolationMode
+	// Attachments are files the user sent with the request. Their paths are
+	// listed in the prompt and images are passed to CLIs that accept them.
+	Attachments []Attachment
 }
 
 type Response struct {
 	Text string
+	// Usage is filled in as far as the client can report it, including on
+	// failed runs.
+	Usage Usage
 }
 
 type Client interface {
 	ID() string
 	Send(ctx context.Context, req Request) (Response, error)
+	// Stream behaves like Send but calls onChunk with partial output as the
+	// agent produces it. The returned Response still carries the full output.
+	Stream(ctx context.Context, req Request, onChunk func(chunk string)) (Response, error)
 	Clear(ctx context.Context, repoPath string) error
 }
@@ -0,0 +1,293 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// IsolationMode selects how an agent CLI process is executed.
+type IsolationMode string
+
+const (
+	// IsolationHost runs the CLI directly on the host, as the bot user.
+	IsolationHost IsolationMode = "host"
+	// IsolationBwrap runs the CLI in a bubblewrap namespace that only sees
+	// the system directories, the topic repo and the configured binds.
+	IsolationBwrap IsolationMode = "bwrap"
+	// IsolationContainer runs the CLI in a throwaway rootless container with
+	// the topic repo and the configured binds mounted.
+	IsolationContainer IsolationMode = "container"
+)
+
+// IsolationModes lists the supported isolation modes.
+func IsolationModes() []IsolationMode {
+	return []IsolationMode{IsolationHost, IsolationBwrap, IsolationContainer}
+}
+
+// ParseIsolationMode parses an isolation mode name. "podman" and "docker" are
+// accepted as aliases for container.
+func ParseIsolationMode(raw string) (IsolationMode, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "host", "none":
+		return IsolationHost, nil
+	case "bwrap", "bubblewrap":
+		return IsolationBwrap, nil
+	case "container", "podman", "docker":
+		return IsolationContainer, nil
+	default:
+		return "", fmt.Errorf("unknown isolation mode %q (use %s, %s or %s)", raw, IsolationHost, IsolationBwrap, IsolationContainer)
+	}
+}
+
+// Bind is a host path made visible inside an isolated agent at the same path.
+type Bind struct {
+	Path     string
+	ReadOnly bool
+}
+
+// ParseBinds parses a comma-separated list of paths, each optionally suffixed
+// with ":ro". A leading "~" expands to the home directory.
+func ParseBinds(raw string) ([]Bind, error) {
+	var binds []Bind
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bind := Bind{Path: part}
+		if trimmed, ok := strings.CutSuffix(part, ":ro"); ok {
+			bind = Bind{Path: trimmed, ReadOnly: true}
+		}
+		if bind.Path == "~" || strings.HasPrefix(bind.Path, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("cannot expand %q: %w", bind.Path, err)
+			}
+			bind.Path = filepath.Join(home, strings.TrimPrefix(bind.Path, "~"))
+		}
+		if !filepath.IsAbs(bind.Path) {
+			return nil, fmt.Errorf("bind path %q must be absolute", bind.Path)
+		}
+		binds = append(binds, bind)
+	}
+	return binds, nil
+}
+
+const (
+	defaultBwrapBin         = "bwrap"
+	defaultContainerRuntime = "podman"
+)
+
+// bwrapSystemDirs are mounted read-only so the CLI and its interpreter can
+// run. Only the parts of /etc needed for name resolution, TLS, users and
+// Debian's alternatives symlinks are exposed. Missing paths are skipped.
+var bwrapSystemDirs = []string{
+	"/usr", "/bin", "/sbin", "/lib", "/lib64", "/opt",
+	"/etc/alternatives", "/etc/ca-certificates", "/etc/ssl", "/etc/pki",
+	"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf", "/etc/passwd", "/etc/group",
+	"/etc/localtime", "/etc/ld.so.cache", "/etc/gitconfig",
+}
+
+// bwrapBaseEnv are the host variables every bwrap sandbox keeps besides
+// PassEnv, so the CLI can find binaries and its home. Everything else,
+// including the bot's tokens, is cleared.
+var bwrapBaseEnv = []string{"PATH", "HOME", "USER", "LANG", "LC_ALL", "TERM", "TZ"}
+
+// IsolationConfig describes the isolated backends. The zero value supports
+// host execution only.
+type IsolationConfig struct {
+	// BwrapBin is the bubblewrap binary; empty uses "bwrap".
+	BwrapBin string
+	// ContainerRuntime is podman or docker; empty uses "podman".
+	ContainerRuntime string
+	// ContainerImage must contain the agent CLIs. Required for containers.
+	ContainerImage string
+	// Binds are extra paths exposed to isolated agents, typically the CLIs'
+	// login state such as ~/.codex.
+	Binds []Bind
+	// PassEnv names host environment variables passed into containers and
+	// bwrap sandboxes, for example API keys. No other secrets are passed.
+	PassEnv []string
+}
+
+// Validate reports whether mode can be used with this config.
+func (cfg IsolationConfig) Validate(mode IsolationMode) error {
+	switch mode {
+	case "", IsolationHost, IsolationBwrap:
+		return nil
+	case IsolationContainer:
+		if strings.TrimSpace(cfg.ContainerImage) == "" {
+			return errors.New("container isolation needs AGENT_CONTAINER_IMAGE")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown isolation mode %q", mode)
+	}
+}
+
+// commandSpec is an agent CLI invocation before isolation is applied.
+type commandSpec struct {
+	Bin  string
+	Args []string
+	// RepoPath is mounted read-write when isolated.
+	RepoPath string
+	// Dir is the working directory; empty keeps the default.
+	Dir string
+	// Env holds extra KEY=VALUE pairs on top of the bot's environment.
+	Env []string
+}
+
+// command builds the process that runs spec under mode.
+func (cfg IsolationConfig) command(ctx context.Context, mode IsolationMode, spec commandSpec) (*exec.Cmd, error) {
+	if err := cfg.Validate(mode); err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case IsolationBwrap:
+		return cfg.bwrapCommand(ctx, spec), nil
+	case IsolationContainer:
+		return cfg.containerCommand(ctx, spec), nil
+	default:
+		cmd := exec.CommandContext(ctx, spec.Bin, spec.Args...)
+		cmd.Dir = spec.Dir
+		if len(spec.Env) > 0 {
+			cmd.Env = append(os.Environ(), spec.Env...)
+		}
+		return cmd, nil
+	}
+}
+
+func (cfg IsolationConfig) bwrapCommand(ctx context.Context, spec commandSpec) *exec.Cmd {
+	bin := cfg.BwrapBin
+	if bin == "" {
+		bin = defaultBwrapBin
+	}
+
+	args := []string{"--die-with-parent", "--unshare-all", "--share-net", "--new-session", "--clearenv"}
+	for _, key := range append(bwrapBaseEnv, cfg.PassEnv...) {
+		if value, ok := os.LookupEnv(key); ok {
+			args = append(args, "--setenv", key, value)
+		}
+	}
+	for _, kv := range spec.Env {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			args = append(args, "--setenv", key, value)
+		}
+	}
+	for _, dir := range bwrapSystemDirs {
+		args = append(args, "--ro-bind-try", dir, dir)
+	}
+	args = append(args, "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp")
+	if home, err := os.UserHomeDir(); err == nil {
+		// An empty home keeps tools that write dotfiles working without
+		// exposing the bot user's files.
+		args = append(args, "--tmpfs", home)
+	}
+	for _, bind := range cfg.Binds {
+		flag := "--bind-try"
+		if bind.ReadOnly {
+			flag = "--ro-bind-try"
+		}
+		args = append(args, flag, bind.Path, bind.Path)
+	}
+	for _, path := range repoMounts(spec.RepoPath) {
+		args = append(args, "--bind", path, path)
+	}
+	if spec.Dir != "" {
+		args = append(args, "--chdir", spec.Dir)
+	}
+	args = append(args, "--", spec.Bin)
+	args = append(args, spec.Args...)
+
+	return exec.CommandContext(ctx, bin, args...)
+}
+
+// repoMounts returns the paths to mount read-write for repoPath. A linked git
+// worktree keeps its objects in the main repo's .git directory, which has to
+// be mounted too for git to work inside the sandbox.
+func repoMounts(repoPath string) []string {
+	if repoPath == "" {
+		return nil
+	}
+	mounts := []string{repoPath}
+
+	data, err := os.ReadFile(filepath.Join(repoPath, ".git"))
+	if err != nil {
+		return mounts
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir:")
+	if !ok {
+		return mounts
+	}
+	gitDir = strings.TrimSpace(gitDir)
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repoPath, gitDir)
+	}
+	if idx := strings.LastIndex(gitDir, string(filepath.Separator)+".git"+string(filepath.Separator)); idx >= 0 {
+		gitDir = gitDir[:idx+len(".git")+1]
+	}
+	return append(mounts, filepath.Clean(gitDir))
+}
+
+// containerSeq keeps container names unique within the process.
+var containerSeq atomic.Int64
+
+func (cfg IsolationConfig) containerCommand(ctx context.Context, spec commandSpec) *exec.Cmd {
+	runtime := cfg.ContainerRuntime
+	if runtime == "" {
+		runtime = defaultContainerRuntime
+	}
+	name := fmt.Sprintf("gocode-agent-%d-%d", os.Getpid(), containerSeq.Add(1))
+
+	args := []string{"run", "--rm", "-i", "--init", "--name", name, "--network", "host"}
+	if filepath.Base(runtime) == "docker" {
+		args = append(args, "--user", strconv.Itoa(os.Getuid())+":"+strconv.Itoa(os.Getgid()))
+	} else {
+		args = append(args, "--userns", "keep-id")
+	}
+	// Mount everything at its host path so session ids derived from the repo
+	// path stay stable between host and container runs.
+	for _, path := range repoMounts(spec.RepoPath) {
+		args = append(args, "-v", path+":"+path)
+	}
+	for _, bind := range cfg.Binds {
+		volume := bind.Path + ":" + bind.Path
+		if bind.ReadOnly {
+			volume += ":ro"
+		}
+		args = append(args, "-v", volume)
+	}
+	if spec.Dir != "" {
+		args = append(args, "-w", spec.Dir)
+	}
+	for _, key := range cfg.PassEnv {
+		if _, ok := os.LookupEnv(key); ok {
+			args = append(args, "-e", key)
+		}
+	}
+	for _, kv := range spec.Env {
+		args = append(args, "-e", kv)
+	}
+	args = append(args, cfg.ContainerImage, spec.Bin)
+	args = append(args, spec.Args...)
+
+	cmd := exec.CommandContext(ctx, runtime, args...)
+	// Killing the runtime client does not always stop the container, so
+	// remove it explicitly when the run is cancelled.
+	cmd.Cancel = func() error {
+		rmCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_ = exec.CommandContext(rmCtx, runtime, "rm", "-f", name).Run()
+		return cmd.Process.Kill()
+	}
+	return cmd
+}
@@ -0,0 +1,212 @@
+package llm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseIsolationMode(t *testing.T) {
+	cases := map[string]IsolationMode{
+		"host":      IsolationHost,
+		" BWRAP ":   IsolationBwrap,
+		"podman":    IsolationContainer,
+		"container": IsolationContainer,
+	}
+	for raw, want := range cases {
+		got, err := ParseIsolationMode(raw)
+		if err != nil || got != want {
+			t.Fatalf("ParseIsolationMode(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	if _, err := ParseIsolationMode("vm"); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+}
+
+func TestParseBinds(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	binds, err := ParseBinds(" ~/.codex, /opt/tools:ro ,")
+	if err != nil {
+		t.Fatalf("ParseBinds returned error: %v", err)
+	}
+	if len(binds) != 2 || binds[0].Path != filepath.Join(home, ".codex") || binds[0].ReadOnly {
+		t.Fatalf("unexpected binds: %#v", binds)
+	}
+	if binds[1].Path != "/opt/tools" || !binds[1].ReadOnly {
+		t.Fatalf("unexpected read-only bind: %#v", binds[1])
+	}
+	if _, err := ParseBinds("relative/dir"); err == nil {
+		t.Fatalf("expected relative bind to be rejected")
+	}
+}
+
+func TestIsolationConfig_ValidateContainerNeedsImage(t *testing.T) {
+	if err := (IsolationConfig{}).Validate(IsolationContainer); err == nil {
+		t.Fatalf("expected container without image to be rejected")
+	}
+	if err := (IsolationConfig{ContainerImage: "agents:latest"}).Validate(IsolationContainer); err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+}
+
+func TestIsolationConfig_BwrapCommand(t *testing.T) {
+	cfg := IsolationConfig{BwrapBin: "/usr/bin/bwrap", Binds: []Bind{{Path: "/home/bot/.codex"}, {Path: "/opt/tools", ReadOnly: true}}}
+	cmd, err := cfg.command(context.Background(), IsolationBwrap, commandSpec{
+		Bin:      "codex",
+		Args:     []string{"exec", "--", "hi"},
+		RepoPath: "/data/repos/app",
+		Dir:      "/data/repos/app",
+	})
+	if err != nil {
+		t.Fatalf("command returned error: %v", err)
+	}
+	if cmd.Path != "/usr/bin/bwrap" || cmd.Dir != "" {
+		t.Fatalf("unexpected command: %s (dir %q)", cmd.Path, cmd.Dir)
+	}
+	args := strings.Join(cmd.Args[1:], " ")
+	for _, want := range []string{
+		"--unshare-all --share-net",
+		"--bind-try /home/bot/.codex /home/bot/.codex",
+		"--ro-bind-try /opt/tools /opt/tools",
+		"--bind /data/repos/app /data/repos/app",
+		"--chdir /data/repos/app -- codex exec -- hi",
+	} {
+		if !strings.Contains(args, want) {
+			t.Fatalf("expected %q in bwrap args, got %q", want, args)
+		}
+	}
+}
+
+func TestIsolationConfig_BwrapCommandClearsEnv(t *testing.T) {
+	t.Setenv("TELEGRAM_SECRET", "tg-secret")
+	t.Setenv("GITHUB_TOKEN", "gh-secret")
+	t.Setenv("GITLAB_TOKEN", "gl-secret")
+	t.Setenv("GITEA_TOKEN", "gt-secret")
+	t.Setenv("ANTHROPIC_API_KEY", "sk-test")
+	cfg := IsolationConfig{PassEnv: []string{"ANTHROPIC_API_KEY", "UNSET_KEY"}}
+	cmd, err := cfg.command(context.Background(), IsolationBwrap, commandSpec{
+		Bin:      "claude",
+		RepoPath: "/data/repos/app",
+		Env:      []string{"AIDER_MODEL=local"},
+	})
+	if err != nil {
+		t.Fatalf("command returned error: %v", err)
+	}
+	args := strings.Join(cmd.Args[1:], " ")
+	for _, want := range []string{
+		"--new-session --clearenv",
+		"--setenv ANTHROPIC_API_KEY sk-test",
+		"--setenv AIDER_MODEL local",
+	} {
+		if !strings.Contains(args, want) {
+			t.Fatalf("expected %q in bwrap args, got %q", want, args)
+		}
+	}
+	for _, secret := range []string{"TELEGRAM_SECRET", "GITHUB_TOKEN", "GITLAB_TOKEN", "GITEA_TOKEN", "UNSET_KEY", "-secret", "/etc /etc"} {
+		if strings.Contains(args, secret) {
+			t.Fatalf("expected %q not to reach the sandbox, got %q", secret, args)
+		}
+	}
+	if cmd.Env != nil {
+		t.Fatalf("expected bwrap itself to keep the default environment, got %v", cmd.Env)
+	}
+}
+
+func TestIsolationConfig_ContainerCommand(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	cfg := IsolationConfig{ContainerRuntime: "docker", ContainerImage: "agents:latest", PassEnv: []string{"OPENAI_API_KEY", "UNSET_KEY"}}
+	cmd, err := cfg.command(context.Background(), IsolationContainer, commandSpec{
+		Bin:      "aider",
+		Args:     []string{"--yes"},
+		RepoPath: "/data/repos/app",
+		Dir:      "/data/repos/app",
+		Env:      []string{"AIDER_MODEL=local"},
+	})
+	if err != nil {
+		t.Fatalf("command returned error: %v", err)
+	}
+	args := strings.Join(cmd.Args[1:], " ")
+	for _, want := range []string{
+		"run --rm -i --init --name gocode-agent-",
+		"--user ",
+		"-v /data/repos/app:/data/repos/app",
+		"-w /data/repos/app",
+		"-e OPENAI_API_KEY -e AIDER_MODEL=local",
+		"agents:latest aider --yes",
+	} {
+		if !strings.Contains(args, want) {
+			t.Fatalf("expected %q in container args, got %q", want, args)
+		}
+	}
+	if strings.Contains(args, "UNSET_KEY") || strings.Contains(args, "sk-test") {
+		t.Fatalf("expected only set variables to be passed by name, got %q", args)
+	}
+	if cmd.Cancel == nil {
+		t.Fatalf("expected a cancel hook that removes the container")
+	}
+}
+
+func TestRepoMounts_IncludesLinkedWorktreeGitDir(t *testing.T) {
+	root := t.TempDir()
+	mainGit := filepath.Join(root, "repo", ".git")
+	worktree := filepath.Join(root, "worktrees", "codex")
+	if err := os.MkdirAll(filepath.Join(mainGit, "worktrees", "codex"), 0o755); err != nil {
+		t.Fatalf("failed to create git dir: %v", err)
+	}
+	if err := os.MkdirAll(worktree, 0o755); err != nil {
+		t.Fatalf("failed to create worktree: %v", err)
+	}
+	gitFile := "gitdir: " + filepath.Join(mainGit, "worktrees", "codex") + "\n"
+	if err := os.WriteFile(filepath.Join(worktree, ".git"), []byte(gitFile), 0o644); err != nil {
+		t.Fatalf("failed to write .git file: %v", err)
+	}
+
+	mounts := repoMounts(worktree)
+	if len(mounts) != 2 || mounts[0] != worktree || mounts[1] != mainGit {
+		t.Fatalf("repoMounts() = %#v, want worktree and %s", mounts, mainGit)
+	}
+	if mounts := repoMounts(filepath.Join(root, "repo")); len(mounts) != 1 {
+		t.Fatalf("expected a plain repo to mount only itself, got %#v", mounts)
+	}
+}
+
+func TestCLIClient_RunsThroughBwrap(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "bwrap-args.txt")
+	bwrapPath := filepath.Join(dir, "bwrap-stub.sh")
+	// The stub records its arguments, then runs the wrapped command.
+	script := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > \"" + argsPath + "\"\n" +
+		"while [ \"$1\" != \"--\" ]; do shift; done\nshift\nexec \"$@\"\n"
+	if err := os.WriteFile(bwrapPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write bwrap stub: %v", err)
+	}
+
+	client, err := CLIFactory(CLIAgentConfig{ID: "tool", Bin: "echo", Args: []string{"isolated"}})(FactoryOptions{
+		Isolation: IsolationConfig{BwrapBin: bwrapPath},
+	})
+	if err != nil {
+		t.Fatalf("CLIFactory returned error: %v", err)
+	}
+	resp, err := client.Send(context.Background(), Request{RepoPath: dir, Message: "go", Isolation: IsolationBwrap})
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if !strings.HasPrefix(resp.Text, "isolated") {
+		t.Fatalf("resp.Text = %q, want wrapped command output", resp.Text)
+	}
+
+	raw, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("failed to read bwrap args: %v", err)
+	}
+	if !strings.Contains(string(raw), "--bind\n"+dir+"\n"+dir+"\n") {
+		t.Fatalf("expected repo bind in bwrap args, got %q", raw)
+	}
+}
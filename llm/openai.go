@@ -0,0 +1,277 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenAICompatClient talks to any OpenAI-compatible /v1/chat/completions
+// endpoint (llama.cpp server, vLLM, Ollama). It cannot touch the repo itself,
+// so it is best suited to reviewer-style agents.
+type OpenAICompatClient struct {
+	baseURL    string
+	apiKey     string
+	model      string
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	history map[string][]chatMessage
+}
+
+const OpenAICompatID = "openai"
+
+func init() {
+	Register(OpenAICompatID, func(opts FactoryOptions) (Client, error) {
+		return NewOpenAICompatClient(), nil
+	})
+}
+
+const (
+	defaultOpenAIBaseURL     = "http://localhost:8080/v1"
+	maxOpenAIHistoryMessages = 40
+)
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model         string             `json:"model,omitempty"`
+	Messages      []chatMessage      `json:"messages"`
+	Stream        bool               `json:"stream,omitempty"`
+	StreamOptions *chatStreamOptions `json:"stream_options,omitempty"`
+}
+
+type chatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type chatCompletionResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message chatMessage `json:"message"`
+		Delta   chatMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *chatCompletionUsage `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// NewOpenAICompatClient configures the client from OPENAI_BASE_URL,
+// OPENAI_API_KEY and OPENAI_MODEL.
+func NewOpenAICompatClient() *OpenAICompatClient {
+	baseURL := strings.TrimSpace(os.Getenv("OPENAI_BASE_URL"))
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+
+	return &OpenAICompatClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     strings.TrimSpace(os.Getenv("OPENAI_API_KEY")),
+		model:      strings.TrimSpace(os.Getenv("OPENAI_MODEL")),
+		httpClient: &http.Client{},
+		history:    make(map[string][]chatMessage),
+	}
+}
+
+func (c *OpenAICompatClient) ID() string {
+	return OpenAICompatID
+}
+
+func (c *OpenAICompatClient) Send(ctx context.Context, req Request) (Response, error) {
+	return c.Stream(ctx, req, nil)
+}
+
+func (c *OpenAICompatClient) Stream(ctx context.Context, req Request, onChunk func(chunk string)) (Response, error) {
+	if strings.TrimSpace(req.Message) == "" {
+		return Response{}, errors.New("missing prompt")
+	}
+
+	repoPath, err := filepath.Abs(req.RepoPath)
+	if err != nil {
+		return Response{}, err
+	}
+
+	userMsg := chatMessage{Role: "user", Content: req.Message}
+	messages := []chatMessage{{Role: "system", Content: buildAgentPrompt("", req.AvailableAgents, nil)}}
+	messages = append(messages, c.historyFor(repoPath)...)
+	messages = append(messages, userMsg)
+
+	model := c.model
+	if override := strings.TrimSpace(req.Model); override != "" {
+		model = override
+	}
+
+	completionReq := chatCompletionRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   onChunk != nil,
+	}
+	if completionReq.Stream {
+		completionReq.StreamOptions = &chatStreamOptions{IncludeUsage: true}
+	}
+	body, err := json.Marshal(completionReq)
+	if err != nil {
+		return Response{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	fmt.Fprintf(os.Stdout, "[openai] POST %s (model=%s, history=%d)\n", httpReq.URL, model, len(messages)-2)
+	started := time.Now()
+	usage := Usage{Model: model}
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		usage.Duration = time.Since(started)
+		return Response{Usage: usage}, classifyError(ctx, err, "")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		usage.Duration = time.Since(started)
+		return Response{Text: strings.TrimSpace(string(raw)), Usage: usage}, &Error{Kind: statusErrorKind(resp.StatusCode), Err: fmt.Errorf("chat completion failed: %s", resp.Status)}
+	}
+
+	var text string
+	if onChunk != nil {
+		text, err = readChatCompletionStream(resp.Body, onChunk, &usage)
+	} else {
+		text, err = readChatCompletion(resp.Body, &usage)
+	}
+	usage.Duration = time.Since(started)
+	if err != nil {
+		return Response{Text: text, Usage: usage}, classifyError(ctx, err, "")
+	}
+	fmt.Fprintf(os.Stdout, "[openai] completed in %s\n", usage.Duration.Round(time.Millisecond))
+
+	c.appendHistory(repoPath, userMsg, chatMessage{Role: "assistant", Content: text})
+	return Response{Text: text, Usage: usage}, nil
+}
+
+func (c *OpenAICompatClient) Clear(ctx context.Context, repoPath string) error {
+	_ = ctx
+	if strings.TrimSpace(repoPath) == "" {
+		return errors.New("missing repo path")
+	}
+
+	absPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.history, absPath)
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *OpenAICompatClient) historyFor(repoPath string) []chatMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]chatMessage(nil), c.history[repoPath]...)
+}
+
+func (c *OpenAICompatClient) appendHistory(repoPath string, msgs ...chatMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	history := append(c.history[repoPath], msgs...)
+	if len(history) > maxOpenAIHistoryMessages {
+		history = history[len(history)-maxOpenAIHistoryMessages:]
+	}
+	c.history[repoPath] = history
+}
+
+// applyChatUsage copies token counts and the served model into usage.
+func applyChatUsage(parsed chatCompletionResponse, usage *Usage) {
+	if parsed.Model != "" {
+		usage.Model = parsed.Model
+	}
+	if parsed.Usage != nil {
+		usage.InputTokens = parsed.Usage.PromptTokens
+		usage.OutputTokens = parsed.Usage.CompletionTokens
+	}
+}
+
+func readChatCompletion(body io.Reader, usage *Usage) (string, error) {
+	var parsed chatCompletionResponse
+	if err := json.NewDecoder(body).Decode(&parsed); err != nil {
+		return "", fmt.Errorf("invalid chat completion response: %w", err)
+	}
+	applyChatUsage(parsed, usage)
+	if parsed.Error != nil && parsed.Error.Message != "" {
+		return "", errors.New(parsed.Error.Message)
+	}
+	if len(parsed.Choices) == 0 {
+		return "", errors.New("chat completion returned no choices")
+	}
+	return parsed.Choices[0].Message.Content, nil
+}
+
+// readChatCompletionStream consumes a server-sent event stream of completion
+// deltas, forwarding each content delta to onChunk. The usage chunk sent at the
+// end of the stream (when the server supports include_usage) fills usage.
+func readChatCompletionStream(body io.Reader, onChunk func(chunk string), usage *Usage) (string, error) {
+	var out strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var parsed chatCompletionResponse
+		if err := json.Unmarshal([]byte(data), &parsed); err != nil {
+			return out.String(), fmt.Errorf("invalid chat completion chunk: %w", err)
+		}
+		if parsed.Error != nil && parsed.Error.Message != "" {
+			return out.String(), errors.New(parsed.Error.Message)
+		}
+		applyChatUsage(parsed, usage)
+		if len(parsed.Choices) == 0 {
+			continue
+		}
+		delta := parsed.Choices[0].Delta.Content
+		if delta == "" {
+			continue
+		}
+		out.WriteString(delta)
+		onChunk(delta)
+	}
+	if err := scanner.Err(); err != nil {
+		return out.String(), err
+	}
+	return out.String(), nil
+}
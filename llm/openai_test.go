@@ -0,0 +1,152 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestOpenAIServer(t *testing.T, requests *[]chatCompletionRequest) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Authorization = %q, want bearer token", got)
+		}
+
+		var req chatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+			return
+		}
+		*requests = append(*requests, req)
+		answer := fmt.Sprintf("answer %d", len(*requests))
+
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, part := range []string{"answer ", fmt.Sprintf("%d", len(*requests))} {
+				fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", part)
+			}
+			if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+				fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":3}}\n\n")
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+		fmt.Fprintf(w, `{"model":"qwen-served","choices":[{"message":{"role":"assistant","content":%q}}],"usage":{"prompt_tokens":20,"completion_tokens":5}}`, answer)
+	}))
+}
+
+func newTestOpenAIClient(baseURL string) *OpenAICompatClient {
+	return &OpenAICompatClient{
+		baseURL:    baseURL + "/v1",
+		apiKey:     "test-key",
+		model:      "qwen",
+		httpClient: http.DefaultClient,
+		history:    make(map[string][]chatMessage),
+	}
+}
+
+func TestOpenAICompatSend_KeepsPerRepoHistory(t *testing.T) {
+	var requests []chatCompletionRequest
+	server := newTestOpenAIServer(t, &requests)
+	defer server.Close()
+
+	client := newTestOpenAIClient(server.URL)
+	resp, err := client.Send(context.Background(), Request{RepoPath: "/tmp/repo-a", Message: "first", AvailableAgents: []string{"codex"}})
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if resp.Text != "answer 1" {
+		t.Fatalf("resp.Text = %q, want %q", resp.Text, "answer 1")
+	}
+	if resp.Usage.InputTokens != 20 || resp.Usage.OutputTokens != 5 || resp.Usage.Model != "qwen-served" {
+		t.Fatalf("unexpected usage: %#v", resp.Usage)
+	}
+	if _, err := client.Send(context.Background(), Request{RepoPath: "/tmp/repo-a", Message: "second"}); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if _, err := client.Send(context.Background(), Request{RepoPath: "/tmp/repo-b", Message: "other"}); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("requests = %d, want 3", len(requests))
+	}
+	first := requests[0]
+	if first.Model != "qwen" || first.Messages[0].Role != "system" {
+		t.Fatalf("unexpected first request: %#v", first)
+	}
+	if !strings.Contains(first.Messages[0].Content, "Available agents: codex.") {
+		t.Fatalf("expected shared agent prompt in system message, got %q", first.Messages[0].Content)
+	}
+	if got := len(requests[1].Messages); got != 4 {
+		t.Fatalf("second request messages = %d, want system+2 history+user", got)
+	}
+	if requests[1].Messages[2].Content != "answer 1" {
+		t.Fatalf("expected previous answer in history, got %#v", requests[1].Messages)
+	}
+	if got := len(requests[2].Messages); got != 2 {
+		t.Fatalf("other repo messages = %d, want isolated history", got)
+	}
+
+	if err := client.Clear(context.Background(), "/tmp/repo-a"); err != nil {
+		t.Fatalf("Clear returned error: %v", err)
+	}
+	if _, err := client.Send(context.Background(), Request{RepoPath: "/tmp/repo-a", Message: "fresh"}); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if got := len(requests[3].Messages); got != 2 {
+		t.Fatalf("messages after Clear = %d, want 2", got)
+	}
+}
+
+func TestOpenAICompatStream_ForwardsDeltas(t *testing.T) {
+	var requests []chatCompletionRequest
+	server := newTestOpenAIServer(t, &requests)
+	defer server.Close()
+
+	client := newTestOpenAIClient(server.URL)
+	var chunks []string
+	resp, err := client.Stream(context.Background(), Request{RepoPath: "/tmp/repo", Message: "go"}, func(chunk string) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil {
+		t.Fatalf("Stream returned error: %v", err)
+	}
+	if resp.Text != "answer 1" {
+		t.Fatalf("resp.Text = %q, want %q", resp.Text, "answer 1")
+	}
+	if len(chunks) != 2 || chunks[0] != "answer " {
+		t.Fatalf("unexpected chunks: %#v", chunks)
+	}
+	if resp.Usage.InputTokens != 12 || resp.Usage.OutputTokens != 3 || resp.Usage.Model != "qwen" {
+		t.Fatalf("unexpected streamed usage: %#v", resp.Usage)
+	}
+	if !requests[0].Stream {
+		t.Fatalf("expected streaming request")
+	}
+}
+
+func TestOpenAICompatSend_HTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := newTestOpenAIClient(server.URL)
+	resp, err := client.Send(context.Background(), Request{RepoPath: "/tmp/repo", Message: "go"})
+	if err == nil {
+		t.Fatalf("expected error for non-2xx status")
+	}
+	if resp.Text != "model not loaded" {
+		t.Fatalf("resp.Text = %q, want server error body", resp.Text)
+	}
+}
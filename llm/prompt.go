@@ -8,7 +8,7 @@ import (
 
 const attachmentPromptPreamble = "Telegram integration note: only include a standalone file URI in your final response using the format file://path/to/file (repo-relative paths preferred) if the user specifically asks for files. Only reference files that already exist."
 
-func buildAgentPrompt(message string, availableAgents []string) string {
+func buildAgentPrompt(message string, availableAgents []string, attachments []Attachment) string {
 	trimmed := strings.TrimSpace(message)
 	agents := make([]string, 0, len(availableAgents))
 	for _, id := range availableAgents {
@@ -23,11 +23,15 @@ func buildAgentPrompt(message string, availableAgents []string) string {
 	sections := []string{attachmentPromptPreamble}
 	if len(agents) > 0 {
 		sections = append(sections, fmt.Sprintf(
-			"Intra-agent collaboration is enabled. Ask another agent with `@<agent_id> <message>` only when needed. "+
-				"When your answer is complete, do not tag any agent. Available agents: %s.",
+			"Intra-agent collaboration is enabled. Ask another agent only when needed by ending your reply with a line "+
+				"`"+HandoffDirective+" @<agent_id>: <message>`. "+
+				"When your answer is complete, do not include a "+HandoffDirective+" line. Available agents: %s.",
 			strings.Join(agents, ", "),
 		))
 	}
+	if section := attachmentsPromptSection(attachments); section != "" {
+		sections = append(sections, section)
+	}
 	if trimmed != "" {
 		sections = append(sections, "User request:\n"+trimmed)
 	}
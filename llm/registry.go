@@ -0,0 +1,93 @@
+package llm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FactoryOptions carries the shared dependencies handed to client factories.
+type FactoryOptions struct {
+	Sessions *SessionStore
+	// Isolation configures the isolated execution backends for CLI agents.
+	Isolation IsolationConfig
+}
+
+// Factory builds a Client for a registered agent id.
+type Factory func(opts FactoryOptions) (Client, error)
+
+// Registry maps agent ids to client factories.
+type Registry struct {
+	mu        sync.Mutex
+	factories map[string]Factory
+}
+
+var defaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]Factory)}
+}
+
+// Register adds a built-in client factory to the default registry. It is
+// meant to be called from init and panics on duplicate ids.
+func Register(id string, factory Factory) {
+	if err := defaultRegistry.Register(id, factory); err != nil {
+		panic(err)
+	}
+}
+
+// DefaultRegistry returns a copy of the built-in registry that callers can
+// extend without affecting other users.
+func DefaultRegistry() *Registry {
+	return defaultRegistry.Clone()
+}
+
+func (r *Registry) Register(id string, factory Factory) error {
+	if id == "" {
+		return fmt.Errorf("agent id is required")
+	}
+	if factory == nil {
+		return fmt.Errorf("agent %q has no factory", id)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.factories[id]; exists {
+		return fmt.Errorf("agent %q already registered", id)
+	}
+	r.factories[id] = factory
+	return nil
+}
+
+func (r *Registry) New(id string, opts FactoryOptions) (Client, error) {
+	r.mu.Lock()
+	factory, ok := r.factories[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported agent id %q", id)
+	}
+	return factory(opts)
+}
+
+func (r *Registry) IDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]string, 0, len(r.factories))
+	for id := range r.factories {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *Registry) Clone() *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clone := NewRegistry()
+	for id, factory := range r.factories {
+		clone.factories[id] = factory
+	}
+	return clone
+}
@@ -0,0 +1,37 @@
+package llm
+
+import "testing"
+
+func TestDefaultRegistry_HasBuiltInAgents(t *testing.T) {
+	ids := DefaultRegistry().IDs()
+	want := map[string]bool{CodexID: false, ClaudeID: false, OpenAICompatID: false}
+	for _, id := range ids {
+		if _, ok := want[id]; ok {
+			want[id] = true
+		}
+	}
+	for id, found := range want {
+		if !found {
+			t.Fatalf("expected built-in agent %q in registry, got %v", id, ids)
+		}
+	}
+}
+
+func TestRegistry_CloneIsIndependent(t *testing.T) {
+	clone := DefaultRegistry()
+	if err := clone.Register("custom", CLIFactory(CLIAgentConfig{ID: "custom", Bin: "true"})); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if _, err := DefaultRegistry().New("custom", FactoryOptions{}); err == nil {
+		t.Fatalf("expected clone registration not to leak into default registry")
+	}
+	if err := clone.Register(CodexID, CLIFactory(CLIAgentConfig{ID: CodexID, Bin: "true"})); err == nil {
+		t.Fatalf("expected duplicate registration to fail")
+	}
+}
+
+func TestRegistry_UnknownID(t *testing.T) {
+	if _, err := NewRegistry().New("missing", FactoryOptions{}); err == nil {
+		t.Fatalf("expected error for unknown agent id")
+	}
+}
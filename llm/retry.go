@@ -0,0 +1,57 @@
+package llm
+
+import "time"
+
+const (
+	defaultRetryAttempts = 2
+	defaultRetryBackoff  = 5 * time.Second
+)
+
+// RetryPolicy decides whether a failed agent call is tried again on the same
+// agent and how long to wait first.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of calls per agent, including the
+	// first. Values below 1 mean a single attempt.
+	MaxAttempts int
+	// Backoff is the wait before the first retry; it doubles for each
+	// retry after that.
+	Backoff time.Duration
+	// RetryFailures also retries timeouts and crashes. It is off by default
+	// because the failed run may have left partial edits in the worktree.
+	RetryFailures bool
+}
+
+// DefaultRetryPolicy retries a rate-limited call once after a short pause.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: defaultRetryAttempts, Backoff: defaultRetryBackoff}
+}
+
+// Attempts returns the effective number of attempts per agent.
+func (p RetryPolicy) Attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// ShouldRetry reports whether err from attempt (starting at 1) is worth
+// another attempt.
+func (p RetryPolicy) ShouldRetry(err error, attempt int) bool {
+	if err == nil || attempt >= p.Attempts() {
+		return false
+	}
+	kind := KindOf(err)
+	if kind.Retryable() {
+		return true
+	}
+	return p.RetryFailures && (kind == ErrorTimeout || kind == ErrorCrash)
+}
+
+// Delay returns the wait before the retry that follows attempt.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
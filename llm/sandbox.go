@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SandboxMode limits what an agent may do in the repo. Each client maps it
+// onto its own CLI permission flags.
+type SandboxMode string
+
+const (
+	// SandboxReadOnly lets the agent read the repo but not change it.
+	SandboxReadOnly SandboxMode = "read-only"
+	// SandboxWorkspaceWrite lets the agent edit files in the repo but not
+	// run arbitrary commands outside it.
+	SandboxWorkspaceWrite SandboxMode = "workspace-write"
+	// SandboxFull gives the agent unrestricted access.
+	SandboxFull SandboxMode = "full"
+)
+
+// DefaultSandboxMode is used when a request does not set a mode.
+const DefaultSandboxMode = SandboxFull
+
+// SandboxModes lists the supported modes from most to least restrictive.
+func SandboxModes() []SandboxMode {
+	return []SandboxMode{SandboxReadOnly, SandboxWorkspaceWrite, SandboxFull}
+}
+
+// ParseSandboxMode parses a mode name, accepting a few common spellings such
+// as "ro", "write" and Codex's "danger-full-access".
+func ParseSandboxMode(raw string) (SandboxMode, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "read-only", "readonly", "ro":
+		return SandboxReadOnly, nil
+	case "workspace-write", "write", "rw":
+		return SandboxWorkspaceWrite, nil
+	case "full", "danger-full-access":
+		return SandboxFull, nil
+	default:
+		return "", fmt.Errorf("unknown sandbox mode %q (use %s, %s or %s)", raw, SandboxReadOnly, SandboxWorkspaceWrite, SandboxFull)
+	}
+}
+
+// orDefault returns m, or DefaultSandboxMode when m is empty.
+func (m SandboxMode) orDefault() SandboxMode {
+	if m == "" {
+		return DefaultSandboxMode
+	}
+	return m
+}
+
+// codexSandboxArgs maps a mode onto `codex exec -s`.
+func codexSandboxArgs(mode SandboxMode) []string {
+	switch mode.orDefault() {
+	case SandboxReadOnly:
+		return []string{"-s", "read-only"}
+	case SandboxWorkspaceWrite:
+		return []string{"-s", "workspace-write"}
+	default:
+		return []string{"-s", "danger-full-access"}
+	}
+}
+
+// claudeSandboxArgs maps a mode onto Claude Code's permission flags. Plan
+// mode never edits files and acceptEdits allows edits but no unapproved shell
+// commands. Full access adds nothing, so Claude keeps the permissions from its
+// own settings, unless skipPermissions opts in to skipping every check.
+func claudeSandboxArgs(mode SandboxMode, skipPermissions bool) []string {
+	switch mode.orDefault() {
+	case SandboxReadOnly:
+		return []string{"--permission-mode", "plan"}
+	case SandboxWorkspaceWrite:
+		return []string{"--permission-mode", "acceptEdits"}
+	default:
+		if skipPermissions {
+			return []string{"--dangerously-skip-permissions"}
+		}
+		return nil
+	}
+}
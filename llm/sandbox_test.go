@@ -0,0 +1,73 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSandboxMode(t *testing.T) {
+	cases := map[string]SandboxMode{
+		"read-only":          SandboxReadOnly,
+		" RO ":               SandboxReadOnly,
+		"workspace-write":    SandboxWorkspaceWrite,
+		"write":              SandboxWorkspaceWrite,
+		"full":               SandboxFull,
+		"danger-full-access": SandboxFull,
+	}
+	for raw, want := range cases {
+		got, err := ParseSandboxMode(raw)
+		if err != nil || got != want {
+			t.Fatalf("ParseSandboxMode(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	if _, err := ParseSandboxMode("yolo"); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+}
+
+func TestSandboxArgs(t *testing.T) {
+	cases := []struct {
+		mode   SandboxMode
+		codex  string
+		claude string
+	}{
+		{SandboxReadOnly, "-s read-only", "--permission-mode plan"},
+		{SandboxWorkspaceWrite, "-s workspace-write", "--permission-mode acceptEdits"},
+		{SandboxFull, "-s danger-full-access", ""},
+		{"", "-s danger-full-access", ""},
+	}
+	for _, tc := range cases {
+		if got := strings.Join(codexSandboxArgs(tc.mode), " "); got != tc.codex {
+			t.Fatalf("codexSandboxArgs(%q) = %q, want %q", tc.mode, got, tc.codex)
+		}
+		if got := strings.Join(claudeSandboxArgs(tc.mode, false), " "); got != tc.claude {
+			t.Fatalf("claudeSandboxArgs(%q) = %q, want %q", tc.mode, got, tc.claude)
+		}
+	}
+
+	if got := strings.Join(claudeSandboxArgs(SandboxFull, true), " "); got != "--dangerously-skip-permissions" {
+		t.Fatalf("expected the opt-in to skip permissions in full mode, got %q", got)
+	}
+	if got := strings.Join(claudeSandboxArgs(SandboxReadOnly, true), " "); got != "--permission-mode plan" {
+		t.Fatalf("expected the opt-in not to affect read-only mode, got %q", got)
+	}
+}
+
+func TestCLIAgentConfig_NormalizesSandboxArgs(t *testing.T) {
+	cfg := CLIAgentConfig{
+		ID:          "gemini",
+		Bin:         "gemini",
+		SandboxArgs: map[string][]string{"ro": {"--sandbox"}},
+	}
+	if err := cfg.normalize(); err != nil {
+		t.Fatalf("normalize returned error: %v", err)
+	}
+	if got := cfg.SandboxArgs[string(SandboxReadOnly)]; len(got) != 1 || got[0] != "--sandbox" {
+		t.Fatalf("unexpected sandbox args: %#v", cfg.SandboxArgs)
+	}
+
+	cfg.SandboxArgs = map[string][]string{"yolo": {"--x"}}
+	if err := cfg.normalize(); err == nil {
+		t.Fatalf("expected unknown sandbox mode to be rejected")
+	}
+}
@@ -0,0 +1,146 @@
+package llm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SessionStore persists per-agent, per-repo session state (such as the
+// session ID to resume) so conversations survive bot restarts. A store with an
+// empty path keeps state in memory only.
+type SessionStore struct {
+	path string
+
+	mu       sync.Mutex
+	sessions map[string]map[string]string
+}
+
+// NewSessionStore loads the store at path, starting empty if the file does not
+// exist yet.
+func NewSessionStore(path string) (*SessionStore, error) {
+	store := &SessionStore{
+		path:     path,
+		sessions: make(map[string]map[string]string),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	var sessions map[string]map[string]string
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	if sessions != nil {
+		store.sessions = sessions
+	}
+
+	return store, nil
+}
+
+// Get returns the stored value for agentID and repoPath, or "" when unset.
+func (s *SessionStore) Get(agentID, repoPath string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[agentID][repoPath]
+}
+
+func (s *SessionStore) Set(agentID, repoPath, value string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byRepo := s.sessions[agentID]
+	if byRepo == nil {
+		byRepo = make(map[string]string)
+		s.sessions[agentID] = byRepo
+	}
+	byRepo[repoPath] = value
+
+	return s.saveLocked()
+}
+
+func (s *SessionStore) Delete(agentID, repoPath string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if byRepo := s.sessions[agentID]; byRepo != nil {
+		delete(byRepo, repoPath)
+		if len(byRepo) == 0 {
+			delete(s.sessions, agentID)
+		}
+	}
+
+	return s.saveLocked()
+}
+
+// DeleteRepo removes the state of every agent for repoPath.
+func (s *SessionStore) DeleteRepo(repoPath string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for agentID, byRepo := range s.sessions {
+		delete(byRepo, repoPath)
+		if len(byRepo) == 0 {
+			delete(s.sessions, agentID)
+		}
+	}
+
+	return s.saveLocked()
+}
+
+// saveLocked writes the store to disk. Callers must hold s.mu so concurrent
+// updates cannot rename an older snapshot over a newer one.
+func (s *SessionStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o775); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, "agent_sessions_*.json")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), s.path)
+}
@@ -0,0 +1,47 @@
+package llm
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionStore_PersistsAcrossReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	if err := store.Set(CodexID, "/tmp/repo", "session-1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	reloaded, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("NewSessionStore reload returned error: %v", err)
+	}
+	if got := reloaded.Get(CodexID, "/tmp/repo"); got != "session-1" {
+		t.Fatalf("Get() = %q, want %q", got, "session-1")
+	}
+
+	if err := reloaded.Delete(CodexID, "/tmp/repo"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	again, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("NewSessionStore second reload returned error: %v", err)
+	}
+	if got := again.Get(CodexID, "/tmp/repo"); got != "" {
+		t.Fatalf("Get() after delete = %q, want empty", got)
+	}
+}
+
+func TestSessionStore_NilIsNoop(t *testing.T) {
+	var store *SessionStore
+	if err := store.Set(CodexID, "/tmp/repo", "x"); err != nil {
+		t.Fatalf("Set on nil store returned error: %v", err)
+	}
+	if got := store.Get(CodexID, "/tmp/repo"); got != "" {
+		t.Fatalf("Get on nil store = %q, want empty", got)
+	}
+}
@@ -0,0 +1,147 @@
+package llm
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// chunkWriter buffers command output and forwards every write to onChunk so
+// callers can observe long-running agents while they work.
+type chunkWriter struct {
+	mu      *sync.Mutex
+	buf     bytes.Buffer
+	onChunk func(chunk string)
+}
+
+// newChunkWriters returns stdout/stderr writers sharing one lock. exec.Cmd
+// copies each pipe from its own goroutine, so onChunk must be serialized.
+func newChunkWriters(onChunk func(chunk string)) (*chunkWriter, *chunkWriter) {
+	mu := &sync.Mutex{}
+	return &chunkWriter{mu: mu, onChunk: onChunk}, &chunkWriter{mu: mu, onChunk: onChunk}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.buf.Write(p)
+	if w.onChunk != nil && n > 0 {
+		w.onChunk(string(p[:n]))
+	}
+	return n, err
+}
+
+func (w *chunkWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func (w *chunkWriter) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Len()
+}
+
+// eventDecoder understands one line of a CLI's JSON event stream.
+type eventDecoder interface {
+	// decode returns the human-readable text for line and whether line was an
+	// event at all. Lines that are not events are passed through as-is.
+	decode(line string) (display string, ok bool)
+	// result returns the final answer collected from the events, if any.
+	result() (string, bool)
+	// failure returns the text of the error events the CLI reported about
+	// itself, as opposed to what the agent or its tools printed.
+	failure() string
+}
+
+// eventWriter splits stdout into lines, decodes JSON events into readable
+// text for onChunk and keeps plain (non-event) output for CLIs that do not
+// emit events.
+type eventWriter struct {
+	mu      *sync.Mutex
+	decoder eventDecoder
+	onChunk func(chunk string)
+
+	pending []byte
+	raw     bytes.Buffer
+	plain   bytes.Buffer
+}
+
+// newEventWriters returns a decoding stdout writer and a plain stderr writer
+// sharing one lock, like newChunkWriters.
+func newEventWriters(decoder eventDecoder, onChunk func(chunk string)) (*eventWriter, *chunkWriter) {
+	mu := &sync.Mutex{}
+	return &eventWriter{mu: mu, decoder: decoder, onChunk: onChunk}, &chunkWriter{mu: mu, onChunk: onChunk}
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.raw.Write(p)
+	w.pending = append(w.pending, p...)
+	for {
+		idx := bytes.IndexByte(w.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(w.pending[:idx+1])
+		w.pending = w.pending[idx+1:]
+		w.handleLine(line)
+	}
+	return len(p), nil
+}
+
+// Flush handles a trailing line that was not newline-terminated. Call it once
+// the command has exited.
+func (w *eventWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) == 0 {
+		return
+	}
+	line := string(w.pending)
+	w.pending = nil
+	w.handleLine(line)
+}
+
+func (w *eventWriter) handleLine(line string) {
+	text := line
+	if display, ok := w.decoder.decode(strings.TrimSpace(line)); ok {
+		text = display
+	} else {
+		w.plain.WriteString(line)
+	}
+	if w.onChunk != nil && text != "" {
+		w.onChunk(text)
+	}
+}
+
+// Text returns the final answer: the decoded result when the CLI emitted
+// events, otherwise its plain output.
+func (w *eventWriter) Text() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if text, ok := w.decoder.result(); ok {
+		return text
+	}
+	return w.plain.String()
+}
+
+// Failure returns the CLI's own error events, for classifying a failed run.
+func (w *eventWriter) Failure() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.decoder.failure()
+}
+
+// Raw returns everything written, events included.
+func (w *eventWriter) Raw() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.raw.String()
+}
@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+)
+
+// Usage describes what a single agent call consumed. Fields a client cannot
+// report are left zero.
+type Usage struct {
+	Model        string
+	InputTokens  int
+	OutputTokens int
+	CostUSD      float64
+	Duration     time.Duration
+	ExitCode     int
+}
+
+// TotalTokens returns input plus output tokens.
+func (u Usage) TotalTokens() int {
+	return u.InputTokens + u.OutputTokens
+}
+
+// exitCode returns the process exit code carried by err, 0 for a nil error
+// and -1 when the process never reported one (e.g. it failed to start).
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
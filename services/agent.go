@@ -5,24 +5,43 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/requiem-ai/gocode/context"
 	"github.com/requiem-ai/gocode/llm"
+	"github.com/rs/zerolog/log"
 )
 
 type AgentService struct {
 	context.DefaultService
 
 	clients         map[string]llm.Client
+	sessions        *llm.SessionStore
+	usage           *UsageStore
+	budgets         *BudgetStore
 	enabledAgents   []string
 	defaultAgent    string
 	maxHops         int
 	agentHopTimeout time.Duration
+	reviewerAgent   string
+	defaultSandbox  llm.SandboxMode
+	isolation       llm.IsolationConfig
+	// defaultIsolation is AGENT_ISOLATION, used when a topic sets none.
+	defaultIsolation llm.IsolationMode
+	retry            llm.RetryPolicy
+	// fallbacks is the ordered AGENT_FALLBACKS chain tried when an agent
+	// still fails after its retries.
+	fallbacks []string
+	// reviewDiff returns the working tree diff the reviewer is asked to
+	// review. It is wired to GitService.WorkingDiff in Configure.
+	reviewDiff func(repoPath string) (string, error)
 }
 
 type AgentEventType string
@@ -30,17 +49,87 @@ type AgentEventType string
 const (
 	AgentEventForward  AgentEventType = "forward"
 	AgentEventResponse AgentEventType = "response"
+	// AgentEventOutput carries a partial output chunk from the agent in From
+	// while it is still running.
+	AgentEventOutput AgentEventType = "output"
+	// AgentEventReview carries reviewer From's feedback to author To for
+	// review round Round.
+	AgentEventReview AgentEventType = "review"
+	// AgentEventApproved reports that reviewer From approved author To's
+	// change in review round Round.
+	AgentEventApproved AgentEventType = "approved"
+	// AgentEventRetry reports that attempt Round of agent From failed with
+	// Kind and is being retried. Text holds the error.
+	AgentEventRetry AgentEventType = "retry"
+	// AgentEventFallback reports that agent From failed with Kind after its
+	// retries and agent To takes over. Text holds the error.
+	AgentEventFallback AgentEventType = "fallback"
 )
 
 type AgentEvent struct {
-	Type AgentEventType
-	From string
-	To   string
-	Text string
+	Type  AgentEventType
+	From  string
+	To    string
+	Text  string
+	Round int
+	Kind  llm.ErrorKind
+}
+
+// AgentRunRequest describes one user request handled by RunWithEvents.
+type AgentRunRequest struct {
+	RepoPath string
+	Prompt   string
+	// Agent is the agent that receives the prompt first. Empty selects the
+	// service default.
+	Agent string
+	// Model optionally overrides the model of the starting agent.
+	Model string
+	// Topic identifies the Telegram topic for usage accounting.
+	Topic string
+	// Sandbox limits what the agents may do; empty uses AGENT_SANDBOX.
+	Sandbox llm.SandboxMode
+	// Isolation selects how the agent CLIs are executed; empty uses
+	// AGENT_ISOLATION.
+	Isolation llm.IsolationMode
+	// Attachments are files the user sent with the prompt. Every agent in the
+	// run sees them.
+	Attachments []llm.Attachment
+	// Review runs the reviewer loop: the starting agent implements the change
+	// and the reviewer agent reviews the diff until it approves.
+	Review bool
+}
+
+// AgentAnswer is one agent's independent reply in an AskAll fan-out.
+type AgentAnswer struct {
+	Agent    string
+	RepoPath string
+	Text     string
+	Err      error
+	Elapsed  time.Duration
+}
+
+// agentRun tracks one user request across its agent hops.
+type agentRun struct {
+	id    string
+	topic string
+	hops  int
+}
+
+func newAgentRun(topic string) *agentRun {
+	return &agentRun{
+		id:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		topic: topic,
+	}
 }
 
 const Agent_SVC = "Agent_svc"
 
+// ReviewApprovalMarker is the line a reviewer replies with to accept a change.
+const ReviewApprovalMarker = "APPROVED"
+
+// maxReviewDiffLen caps how much of the diff is pasted into the review prompt.
+const maxReviewDiffLen = 60000
+
 const (
 	defaultEnabledAgents = "codex,claude"
 	defaultAgentID       = llm.CodexID
@@ -54,18 +143,55 @@ func (svc AgentService) Id() string {
 	return Agent_SVC
 }
 
+func (svc *AgentService) Configure(c *context.Context) error {
+	if git, ok := c.Service(GIT_SVC).(*GitService); ok {
+		svc.reviewDiff = git.WorkingDiff
+	}
+	return svc.DefaultService.Configure(c)
+}
+
 func (svc *AgentService) Start() error {
+	sessionsPath, err := agentSessionsPath()
+	if err != nil {
+		return err
+	}
+	sessions, err := llm.NewSessionStore(sessionsPath)
+	if err != nil {
+		return fmt.Errorf("failed to load agent sessions: %w", err)
+	}
+
+	usagePath, err := agentUsagePath()
+	if err != nil {
+		return err
+	}
+	usage, err := NewUsageStore(usagePath)
+	if err != nil {
+		return fmt.Errorf("failed to load agent usage: %w", err)
+	}
+
+	budgets, err := loadBudgetStore()
+	if err != nil {
+		return err
+	}
+
+	registry, err := buildAgentRegistry()
+	if err != nil {
+		return err
+	}
+
+	isolation, defaultIsolation, err := loadIsolationConfig()
+	if err != nil {
+		return err
+	}
+
 	enabledAgents := parseEnabledAgents()
 	clients := make(map[string]llm.Client, len(enabledAgents))
 	for _, id := range enabledAgents {
-		switch id {
-		case llm.CodexID:
-			clients[id] = llm.NewCodexClient()
-		case llm.ClaudeID:
-			clients[id] = llm.NewClaudeClient()
-		default:
-			return fmt.Errorf("unsupported agent id %q", id)
+		client, err := registry.New(id, llm.FactoryOptions{Sessions: sessions, Isolation: isolation})
+		if err != nil {
+			return err
 		}
+		clients[id] = client
 	}
 	if len(clients) == 0 {
 		return errors.New("no agents enabled")
@@ -97,6 +223,46 @@ func (svc *AgentService) Start() error {
 		agentHopTimeout = parsed
 	}
 
+	reviewerAgent := strings.ToLower(strings.TrimSpace(os.Getenv("REVIEWER_AGENT")))
+	if reviewerAgent != "" {
+		if _, ok := clients[reviewerAgent]; !ok {
+			return fmt.Errorf("REVIEWER_AGENT %q is not enabled", reviewerAgent)
+		}
+	}
+
+	defaultSandbox := llm.DefaultSandboxMode
+	if value := strings.TrimSpace(os.Getenv("AGENT_SANDBOX")); value != "" {
+		parsed, err := llm.ParseSandboxMode(value)
+		if err != nil {
+			return fmt.Errorf("invalid AGENT_SANDBOX: %w", err)
+		}
+		defaultSandbox = parsed
+	}
+
+	retry := llm.DefaultRetryPolicy()
+	if value := strings.TrimSpace(os.Getenv("AGENT_MAX_ATTEMPTS")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return fmt.Errorf("invalid AGENT_MAX_ATTEMPTS %q", value)
+		}
+		retry.MaxAttempts = parsed
+	}
+	if value := strings.TrimSpace(os.Getenv("AGENT_RETRY_BACKOFF")); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid AGENT_RETRY_BACKOFF %q", value)
+		}
+		retry.Backoff = parsed
+	}
+	retry.RetryFailures = isEnvTrue(os.Getenv("AGENT_RETRY_FAILURES"))
+
+	fallbacks := parseAgentList(os.Getenv("AGENT_FALLBACKS"))
+	for _, id := range fallbacks {
+		if _, ok := clients[id]; !ok {
+			return fmt.Errorf("AGENT_FALLBACKS agent %q is not enabled", id)
+		}
+	}
+
 	agentIDs := make([]string, 0, len(clients))
 	for id := range clients {
 		agentIDs = append(agentIDs, id)
@@ -104,29 +270,125 @@ func (svc *AgentService) Start() error {
 	sort.Strings(agentIDs)
 
 	svc.clients = clients
+	svc.sessions = sessions
+	svc.usage = usage
+	svc.budgets = budgets
 	svc.enabledAgents = agentIDs
 	svc.defaultAgent = defaultAgent
 	svc.maxHops = maxHops
 	svc.agentHopTimeout = agentHopTimeout
+	svc.reviewerAgent = reviewerAgent
+	svc.defaultSandbox = defaultSandbox
+	svc.isolation = isolation
+	svc.defaultIsolation = defaultIsolation
+	svc.retry = retry
+	svc.fallbacks = fallbacks
 	return nil
 }
 
 func (svc *AgentService) Run(repoPath string, msg string) (string, error) {
-	return svc.RunWithEvents(repoPath, msg, nil)
+	return svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: repoPath, Prompt: msg}, nil)
+}
+
+// DefaultAgent returns the agent used when a topic has no preference.
+func (svc *AgentService) DefaultAgent() string {
+	return svc.defaultAgent
+}
+
+// DefaultSandbox returns the sandbox mode used when a topic has none set.
+func (svc *AgentService) DefaultSandbox() llm.SandboxMode {
+	if svc.defaultSandbox == "" {
+		return llm.DefaultSandboxMode
+	}
+	return svc.defaultSandbox
+}
+
+// DefaultIsolation returns the isolation mode used when a topic has none set.
+func (svc *AgentService) DefaultIsolation() llm.IsolationMode {
+	if svc.defaultIsolation == "" {
+		return llm.IsolationHost
+	}
+	return svc.defaultIsolation
+}
+
+// CheckIsolation reports whether mode is configured and can be used.
+func (svc *AgentService) CheckIsolation(mode llm.IsolationMode) error {
+	return svc.isolation.Validate(mode)
+}
+
+// EnabledAgents returns the sorted ids of all enabled agents.
+func (svc *AgentService) EnabledAgents() []string {
+	return append([]string(nil), svc.enabledAgents...)
+}
+
+func (svc *AgentService) HasAgent(id string) bool {
+	_, ok := svc.clients[id]
+	return ok
+}
+
+// Usage summarizes agent usage since the given time. An empty topic covers
+// every topic.
+func (svc *AgentService) Usage(topic string, since time.Time) UsageSummary {
+	return svc.usage.Summary(topic, since)
+}
+
+// Budgets returns the effective budget for topic and the global budget.
+func (svc *AgentService) Budgets(topic string) (AgentBudget, AgentBudget) {
+	return svc.budgets.Topic(topic), svc.budgets.Global()
 }
 
-func (svc *AgentService) RunWithEvents(repoPath string, msg string, onEvent func(AgentEvent)) (string, error) {
-	if strings.TrimSpace(msg) == "" {
+// SetBudget sets one limit of topic's budget, or of the global budget when
+// topic is empty, and returns the updated budget.
+func (svc *AgentService) SetBudget(topic, limit string, value int) (AgentBudget, error) {
+	if svc.budgets == nil {
+		return AgentBudget{}, errors.New("budgets not initialized")
+	}
+
+	if topic == "" {
+		return svc.budgets.SetGlobal(limit, value)
+	}
+	return svc.budgets.SetTopic(topic, limit, value)
+}
+
+// ParseAddressedAgent reports whether text starts by addressing an enabled
+// agent (for example "@claude review this") and returns that agent with the
+// remaining prompt.
+func (svc *AgentService) ParseAddressedAgent(text string) (agentID string, prompt string, ok bool) {
+	return parseDirectAgentAddress(text, svc.clients)
+}
+
+// RunWithEvents sends the prompt to the requested starting agent, following
+// handoffs until an agent answers without tagging another. An agent that keeps
+// failing is replaced by the next agent in AGENT_FALLBACKS. Cancelling runCtx
+// kills the running agent process and stops the collaboration.
+func (svc *AgentService) RunWithEvents(runCtx ctx.Context, req AgentRunRequest, onEvent func(AgentEvent)) (string, error) {
+	if strings.TrimSpace(req.Prompt) == "" {
 		return "", errors.New("missing prompt")
 	}
 	if len(svc.clients) == 0 {
 		return "", errors.New("agent service not initialized")
 	}
 
-	activeID := svc.defaultAgent
-	activeInput := msg
+	startID := strings.ToLower(strings.TrimSpace(req.Agent))
+	if startID == "" {
+		startID = svc.defaultAgent
+	}
+	if _, ok := svc.clients[startID]; !ok {
+		return "", fmt.Errorf("agent %q is not enabled", startID)
+	}
+
+	run := newAgentRun(req.Topic)
+	if req.Review {
+		return svc.runReviewLoop(runCtx, run, req, startID, onEvent)
+	}
+
+	activeID := startID
+	activeInput := req.Prompt
 	for hop := 0; hop < svc.maxHops; hop++ {
-		activeResp, err := svc.sendToAgent(repoPath, activeID, activeInput)
+		activeResp, answeredBy, err := svc.sendWithFallback(runCtx, run, activeID, func(id string) llm.Request {
+			return svc.agentRequest(req, activeInput, id, startID)
+		}, onEvent)
+		activeID = answeredBy
 		if err != nil {
 			return activeResp, err
 		}
@@ -145,7 +407,9 @@ func (svc *AgentService) RunWithEvents(repoPath string, msg string, onEvent func
 			})
 		}
 
-		targetResp, err := svc.sendToAgent(repoPath, targetID, forwardMessage)
+		targetResp, targetID, err := svc.sendWithFallback(runCtx, run, targetID, func(id string) llm.Request {
+			return svc.agentRequest(req, forwardMessage, id, startID)
+		}, onEvent)
 		if onEvent != nil {
 			onEvent(AgentEvent{
 				Type: AgentEventResponse,
@@ -155,13 +419,18 @@ func (svc *AgentService) RunWithEvents(repoPath string, msg string, onEvent func
 			})
 		}
 		if err != nil {
+			// A budget stop before the handoff ran keeps the last real answer.
+			var budgetErr *BudgetExceededError
+			if errors.As(err, &budgetErr) && targetResp == "" {
+				return activeResp, err
+			}
 			return targetResp, err
 		}
 
 		activeInput = fmt.Sprintf(
 			"Feedback received from @%s:\n\n%s\n\nContinue solving the user's task. "+
-				"If more expert feedback is needed, ask one agent using @<agent_id> <message>. "+
-				"If complete, respond directly without any @agent tag.",
+				"If more expert feedback is needed, ask one agent with a line `"+llm.HandoffDirective+" @<agent_id>: <message>`. "+
+				"If complete, respond directly without a "+llm.HandoffDirective+" line.",
 			targetID,
 			strings.TrimSpace(targetResp),
 		)
@@ -170,6 +439,224 @@ func (svc *AgentService) RunWithEvents(repoPath string, msg string, onEvent func
 	return "", fmt.Errorf("agent collaboration stopped: reached MAX_AGENT_HOPS=%d", svc.maxHops)
 }
 
+// ReviewerFor returns the agent that reviews changes made by authorID, where
+// "" means the default agent: REVIEWER_AGENT when set, otherwise the first
+// other enabled agent. It reports false when no agent besides the author is
+// available.
+func (svc *AgentService) ReviewerFor(authorID string) (string, bool) {
+	if authorID == "" {
+		authorID = svc.defaultAgent
+	}
+	reviewerID := svc.reviewerAgent
+	if reviewerID == "" {
+		others := otherAgents(svc.enabledAgents, authorID)
+		if len(others) == 0 {
+			return "", false
+		}
+		reviewerID = others[0]
+	}
+	// An agent never reviews its own diff, even when REVIEWER_AGENT names it.
+	if reviewerID == authorID {
+		return "", false
+	}
+	return reviewerID, true
+}
+
+// runReviewLoop has authorID implement the request, then alternates between
+// the reviewer reviewing the working tree diff and the author addressing the
+// feedback. Every agent turn counts as one hop against MAX_AGENT_HOPS,
+// however many retries it takes.
+func (svc *AgentService) runReviewLoop(runCtx ctx.Context, run *agentRun, req AgentRunRequest, authorID string, onEvent func(AgentEvent)) (string, error) {
+	reviewerID, ok := svc.ReviewerFor(authorID)
+	if !ok {
+		return "", errors.New("review mode needs a second enabled agent or REVIEWER_AGENT")
+	}
+	if svc.reviewDiff == nil {
+		return "", errors.New("review mode is not available: no diff source")
+	}
+
+	startID := authorID
+	authorReq := func(message string) func(id string) llm.Request {
+		return func(id string) llm.Request {
+			agentReq := llm.Request{
+				RepoPath:    req.RepoPath,
+				Message:     message,
+				Sandbox:     svc.sandboxFor(req.Sandbox),
+				Isolation:   svc.isolationFor(req.Isolation),
+				Attachments: req.Attachments,
+			}
+			if id == startID {
+				agentReq.Model = req.Model
+			}
+			return agentReq
+		}
+	}
+	reviewReq := func(message string) func(id string) llm.Request {
+		return func(string) llm.Request {
+			return llm.Request{
+				RepoPath: req.RepoPath,
+				Message:  message,
+				// Reviewers only read the change, whatever the topic allows.
+				Sandbox:     llm.SandboxReadOnly,
+				Isolation:   svc.isolationFor(req.Isolation),
+				Attachments: req.Attachments,
+			}
+		}
+	}
+	// sendAuthor runs an author turn. A fallback agent takes over authorship,
+	// and the reviewer is switched when it would review its own work.
+	sendAuthor := func(message string) (string, error) {
+		text, answeredBy, err := svc.sendWithFallback(runCtx, run, authorID, authorReq(message), onEvent)
+		authorID = answeredBy
+		if authorID == reviewerID {
+			if next, ok := svc.ReviewerFor(authorID); ok {
+				reviewerID = next
+			}
+		}
+		return text, err
+	}
+
+	authorResp, err := sendAuthor(req.Prompt)
+	if err != nil {
+		return authorResp, err
+	}
+
+	for round := 1; run.hops < svc.maxHops; round++ {
+		diff, err := svc.reviewDiff(req.RepoPath)
+		if err != nil {
+			return authorResp, fmt.Errorf("failed to read diff for review: %w", err)
+		}
+
+		// A fallback reviewer is never the author itself.
+		var review string
+		review, reviewerID, err = svc.sendWithFallbackExcept(runCtx, run, reviewerID, authorID, reviewReq(buildReviewPrompt(req.Prompt, authorID, authorResp, diff)), onEvent)
+		if err != nil {
+			return authorResp, err
+		}
+
+		if isReviewApproved(review) {
+			if onEvent != nil {
+				onEvent(AgentEvent{Type: AgentEventApproved, From: reviewerID, To: authorID, Text: review, Round: round})
+			}
+			return fmt.Sprintf("%s\n\nApproved by @%s after %d review round(s).", strings.TrimSpace(authorResp), reviewerID, round), nil
+		}
+		if onEvent != nil {
+			onEvent(AgentEvent{Type: AgentEventReview, From: reviewerID, To: authorID, Text: review, Round: round})
+		}
+		if run.hops >= svc.maxHops {
+			break
+		}
+
+		authorResp, err = sendAuthor(fmt.Sprintf(
+			"Review feedback from @%s:\n\n%s\n\nAddress the feedback by updating the change, then summarize what you did.",
+			reviewerID,
+			strings.TrimSpace(review),
+		))
+		if err != nil {
+			return authorResp, err
+		}
+	}
+
+	return fmt.Sprintf("%s\n\n@%s did not approve before reaching MAX_AGENT_HOPS=%d.", strings.TrimSpace(authorResp), reviewerID, svc.maxHops), nil
+}
+
+func buildReviewPrompt(request, authorID, authorResp, diff string) string {
+	diff = strings.TrimSpace(diff)
+	if diff == "" {
+		diff = "(no changes)"
+	} else if len(diff) > maxReviewDiffLen {
+		diff = diff[:maxReviewDiffLen] + "\n... (diff truncated, inspect the repo for the rest)"
+	}
+
+	return fmt.Sprintf(
+		"You are reviewing a change made by @%s in this repo. Do not modify any files.\n\n"+
+			"User request:\n%s\n\n@%s's summary:\n%s\n\nDiff:\n```diff\n%s\n```\n\n"+
+			"If the change correctly and completely implements the request, reply with a line containing only %s. "+
+			"Otherwise list the concrete problems the author must fix.",
+		authorID,
+		strings.TrimSpace(request),
+		authorID,
+		strings.TrimSpace(authorResp),
+		diff,
+		ReviewApprovalMarker,
+	)
+}
+
+// isReviewApproved reports whether a review contains the approval marker on a
+// line of its own, ignoring markdown emphasis and trailing punctuation.
+func isReviewApproved(review string) bool {
+	for _, line := range strings.Split(review, "\n") {
+		line = strings.Trim(strings.TrimSpace(line), "*_`.!")
+		if strings.EqualFold(line, ReviewApprovalMarker) {
+			return true
+		}
+	}
+	return false
+}
+
+// AskAll sends req.Prompt to every agent in targets concurrently, each working
+// in its own repo path (agent id -> path) instead of req.RepoPath. Handoffs
+// are disabled so the answers stay independent. Every agent gets the
+// attachments, while req.Model only goes to the starting agent, as in
+// RunWithEvents. Answers are returned sorted by agent id.
+func (svc *AgentService) AskAll(runCtx ctx.Context, req AgentRunRequest, targets map[string]string) ([]AgentAnswer, error) {
+	prompt := req.Prompt
+	if strings.TrimSpace(prompt) == "" {
+		return nil, errors.New("missing prompt")
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no agents to ask")
+	}
+	for id := range targets {
+		if _, ok := svc.clients[id]; !ok {
+			return nil, fmt.Errorf("agent %q is not enabled", id)
+		}
+	}
+
+	ids := make([]string, 0, len(targets))
+	for id := range targets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	startID := req.Agent
+	if startID == "" {
+		startID = svc.defaultAgent
+	}
+	requestID := newAgentRun(req.Topic).id
+	answers := make([]AgentAnswer, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			started := time.Now()
+			run := &agentRun{id: requestID, topic: req.Topic}
+			agentReq := llm.Request{
+				RepoPath:    targets[id],
+				Message:     prompt,
+				Sandbox:     svc.sandboxFor(req.Sandbox),
+				Isolation:   svc.isolationFor(req.Isolation),
+				Attachments: req.Attachments,
+			}
+			if id == startID {
+				agentReq.Model = req.Model
+			}
+			text, err := svc.sendToAgent(runCtx, run, id, agentReq, nil)
+			answers[i] = AgentAnswer{
+				Agent:    id,
+				RepoPath: targets[id],
+				Text:     text,
+				Err:      err,
+				Elapsed:  time.Since(started),
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	return answers, runCtx.Err()
+}
+
 func (svc *AgentService) Clear(repoPath string) error {
 	if strings.TrimSpace(repoPath) == "" {
 		return errors.New("missing repo path")
@@ -182,21 +669,240 @@ func (svc *AgentService) Clear(repoPath string) error {
 	return nil
 }
 
-func (svc *AgentService) sendToAgent(repoPath, agentID, message string) (string, error) {
+// ForgetRepo drops all agent session state for repoPath, such as a worktree
+// that is being deleted, so the session store does not keep growing with
+// entries for paths that no longer exist.
+func (svc *AgentService) ForgetRepo(repoPath string) error {
+	if err := svc.Clear(repoPath); err != nil {
+		return err
+	}
+	absPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return err
+	}
+	return svc.sessions.DeleteRepo(absPath)
+}
+
+// agentRequest builds the llm request for agentID within run. The model
+// override only applies to the starting agent; handoff targets keep their own
+// defaults but share the run's sandbox mode.
+func (svc *AgentService) agentRequest(run AgentRunRequest, message, agentID, startID string) llm.Request {
+	req := llm.Request{
+		RepoPath:        run.RepoPath,
+		Message:         message,
+		AvailableAgents: otherAgents(svc.enabledAgents, agentID),
+		Sandbox:         svc.sandboxFor(run.Sandbox),
+		Isolation:       svc.isolationFor(run.Isolation),
+		Attachments:     run.Attachments,
+	}
+	if agentID == startID {
+		req.Model = run.Model
+	}
+	return req
+}
+
+// isolationFor returns mode, or the service default when mode is empty.
+func (svc *AgentService) isolationFor(mode llm.IsolationMode) llm.IsolationMode {
+	if mode == "" {
+		return svc.DefaultIsolation()
+	}
+	return mode
+}
+
+// sandboxFor returns mode, or the service default when mode is empty.
+func (svc *AgentService) sandboxFor(mode llm.SandboxMode) llm.SandboxMode {
+	if mode == "" {
+		return svc.DefaultSandbox()
+	}
+	return mode
+}
+
+// sendWithFallback sends to agentID and, when it still fails after its
+// retries, to the next untried agent in the fallback chain. It returns the
+// response and the agent that produced it. build makes the request for each
+// agent tried.
+func (svc *AgentService) sendWithFallback(parent ctx.Context, run *agentRun, agentID string, build func(agentID string) llm.Request, onEvent func(AgentEvent)) (string, string, error) {
+	return svc.sendWithFallbackExcept(parent, run, agentID, "", build, onEvent)
+}
+
+// sendWithFallbackExcept is sendWithFallback that never falls back to
+// exclude, such as the author of the change under review.
+func (svc *AgentService) sendWithFallbackExcept(parent ctx.Context, run *agentRun, agentID, exclude string, build func(agentID string) llm.Request, onEvent func(AgentEvent)) (string, string, error) {
+	tried := map[string]bool{agentID: true}
+	if exclude != "" {
+		tried[exclude] = true
+	}
+	text, err := svc.sendToAgent(parent, run, agentID, build(agentID), onEvent)
+	for err != nil && parent.Err() == nil {
+		kind := llm.KindOf(err)
+		if kind == "" || kind == llm.ErrorCanceled {
+			break
+		}
+		next, ok := svc.nextFallback(agentID, tried)
+		if !ok {
+			break
+		}
+		if onEvent != nil {
+			onEvent(AgentEvent{Type: AgentEventFallback, From: agentID, To: next, Kind: kind, Text: err.Error()})
+		}
+		log.Warn().Err(err).Str("agent", agentID).Str("fallback", next).Msg("agent failed, falling back")
+
+		tried[next] = true
+		agentID = next
+		text, err = svc.sendToAgent(parent, run, agentID, build(agentID), onEvent)
+	}
+	return text, agentID, err
+}
+
+// nextFallback returns the first untried agent after failed in the fallback
+// chain, or from the start of the chain when failed is not part of it.
+func (svc *AgentService) nextFallback(failed string, tried map[string]bool) (string, bool) {
+	start := 0
+	for i, id := range svc.fallbacks {
+		if id == failed {
+			start = i + 1
+			break
+		}
+	}
+	for _, id := range svc.fallbacks[start:] {
+		if !tried[id] {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// sendToAgent runs one turn of agentID under the retry policy, emitting
+// AgentEventRetry before each retry. The turn counts as a single hop however
+// many attempts it takes.
+func (svc *AgentService) sendToAgent(parent ctx.Context, run *agentRun, agentID string, req llm.Request, onEvent func(AgentEvent)) (string, error) {
+	if err := svc.checkHopBudget(run); err != nil {
+		return "", err
+	}
+	run.hops++
+
+	for attempt := 1; ; attempt++ {
+		text, err := svc.sendAttempt(parent, run, agentID, req, onEvent)
+		if parent.Err() != nil || !svc.retry.ShouldRetry(err, attempt) {
+			return text, err
+		}
+
+		if onEvent != nil {
+			onEvent(AgentEvent{Type: AgentEventRetry, From: agentID, Round: attempt, Kind: llm.KindOf(err), Text: err.Error()})
+		}
+		delay := svc.retry.Delay(attempt)
+		log.Warn().Err(err).Str("agent", agentID).Int("attempt", attempt).Dur("delay", delay).Msg("agent failed, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-parent.Done():
+			timer.Stop()
+			return text, fmt.Errorf("agent %q stopped: %w", agentID, parent.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// sendAttempt runs one attempt of run's current hop on agentID and records
+// its usage.
+func (svc *AgentService) sendAttempt(parent ctx.Context, run *agentRun, agentID string, req llm.Request, onEvent func(AgentEvent)) (string, error) {
 	client, ok := svc.clients[agentID]
 	if !ok {
 		return "", fmt.Errorf("agent %q not configured", agentID)
 	}
+	if err := parent.Err(); err != nil {
+		return "", fmt.Errorf("agent %q not started: %w", agentID, err)
+	}
 
-	runCtx, cancel := ctx.WithTimeout(ctx.Background(), svc.agentHopTimeout)
+	runCtx, cancel := ctx.WithTimeout(parent, svc.agentHopTimeout)
 	defer cancel()
 
-	resp, err := client.Send(runCtx, llm.Request{
-		RepoPath:        repoPath,
-		Message:         message,
-		AvailableAgents: otherAgents(svc.enabledAgents, agentID),
+	if err := svc.checkBudget(run, time.Now()); err != nil {
+		return "", err
+	}
+
+	resp, err := svc.sendToClient(runCtx, client, agentID, req, onEvent)
+	if recErr := svc.usage.Record(newUsageRecord(run, req.RepoPath, agentID, resp.Usage, time.Now())); recErr != nil {
+		log.Warn().Err(recErr).Str("agent", agentID).Msg("failed to record agent usage")
+	}
+	text := resp.Text
+	if err != nil {
+		switch {
+		case parent.Err() != nil:
+			err = fmt.Errorf("agent %q stopped: %w", agentID, parent.Err())
+		case errors.Is(runCtx.Err(), ctx.DeadlineExceeded):
+			err = fmt.Errorf("agent %q timed out after %s: %w", agentID, svc.agentHopTimeout, runCtx.Err())
+		}
+	}
+	return text, err
+}
+
+// budgetScope is one budget a run is checked against.
+type budgetScope struct {
+	name   string
+	topic  string
+	budget AgentBudget
+}
+
+// budgetScopes returns the topic and global budgets that apply to run.
+func (svc *AgentService) budgetScopes(run *agentRun) []budgetScope {
+	if svc.budgets == nil {
+		return nil
+	}
+	scopes := make([]budgetScope, 0, 2)
+	if run.topic != "" {
+		scopes = append(scopes, budgetScope{name: "topic", topic: run.topic, budget: svc.budgets.Topic(run.topic)})
+	}
+	return append(scopes, budgetScope{name: "global", budget: svc.budgets.Global()})
+}
+
+// checkHopBudget reports whether run may start another agent turn under the
+// topic and global hop budgets.
+func (svc *AgentService) checkHopBudget(run *agentRun) error {
+	for _, scope := range svc.budgetScopes(run) {
+		if limit := scope.budget.HopsPerRequest; limit > 0 && run.hops >= limit {
+			return &BudgetExceededError{Scope: scope.name, Limit: BudgetHops, Used: run.hops, Max: limit}
+		}
+	}
+	return nil
+}
+
+// checkBudget reports whether run may make another agent call under the
+// topic and global daily budgets.
+func (svc *AgentService) checkBudget(run *agentRun, now time.Time) error {
+	for _, scope := range svc.budgetScopes(run) {
+		budget := scope.budget
+		if budget.TokensPerDay == 0 && budget.AgentMinutesPerDay == 0 {
+			continue
+		}
+
+		used := svc.usage.Today(scope.topic, now)
+		if budget.TokensPerDay > 0 {
+			if tokens := used.InputTokens + used.OutputTokens; tokens >= budget.TokensPerDay {
+				return &BudgetExceededError{Scope: scope.name, Limit: BudgetTokens, Used: tokens, Max: budget.TokensPerDay}
+			}
+		}
+		if budget.AgentMinutesPerDay > 0 {
+			if minutes := int(used.Duration / time.Minute); minutes >= budget.AgentMinutesPerDay {
+				return &BudgetExceededError{Scope: scope.name, Limit: BudgetMinutes, Used: minutes, Max: budget.AgentMinutesPerDay}
+			}
+		}
+	}
+	return nil
+}
+
+func (svc *AgentService) sendToClient(runCtx ctx.Context, client llm.Client, agentID string, req llm.Request, onEvent func(AgentEvent)) (llm.Response, error) {
+	if onEvent == nil {
+		return client.Send(runCtx, req)
+	}
+
+	return client.Stream(runCtx, req, func(chunk string) {
+		onEvent(AgentEvent{
+			Type: AgentEventOutput,
+			From: agentID,
+			Text: chunk,
+		})
 	})
-	return resp.Text, err
 }
 
 func otherAgents(agents []string, self string) []string {
@@ -210,12 +916,121 @@ func otherAgents(agents []string, self string) []string {
 	return out
 }
 
+// buildAgentRegistry returns the built-in agents plus any CLI agents defined in
+// AGENTS_CONFIG_PATH (default data/agents.json).
+func buildAgentRegistry() (*llm.Registry, error) {
+	path := strings.TrimSpace(os.Getenv("AGENTS_CONFIG_PATH"))
+	if path == "" {
+		path = filepath.Join("data", "agents.json")
+	}
+
+	configs, err := llm.LoadCLIAgentConfigs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := llm.DefaultRegistry()
+	for _, cfg := range configs {
+		if err := registry.Register(cfg.ID, llm.CLIFactory(cfg)); err != nil {
+			return nil, fmt.Errorf("agents config %s: %w", path, err)
+		}
+	}
+	return registry, nil
+}
+
+// agentSessionsPath returns where agent session IDs are persisted. By default
+// the file lives next to the Telegram topic contexts file.
+func agentSessionsPath() (string, error) {
+	return agentDataPath("AGENT_SESSIONS_PATH", "agent_sessions.json")
+}
+
+// loadBudgetStore builds the budget store from BUDGET_* (global) and
+// TOPIC_BUDGET_* (per-topic default) env vars plus persisted overrides.
+func loadBudgetStore() (*BudgetStore, error) {
+	global, err := budgetFromEnv("BUDGET")
+	if err != nil {
+		return nil, err
+	}
+	topicDefault, err := budgetFromEnv("TOPIC_BUDGET")
+	if err != nil {
+		return nil, err
+	}
+	path, err := agentDataPath("AGENT_BUDGETS_PATH", "agent_budgets.json")
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewBudgetStore(path, global, topicDefault)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load agent budgets: %w", err)
+	}
+	return store, nil
+}
+
+// loadIsolationConfig reads the isolated execution backends and the default
+// AGENT_ISOLATION mode from the environment.
+func loadIsolationConfig() (llm.IsolationConfig, llm.IsolationMode, error) {
+	binds, err := llm.ParseBinds(os.Getenv("AGENT_ISOLATION_BINDS"))
+	if err != nil {
+		return llm.IsolationConfig{}, "", fmt.Errorf("invalid AGENT_ISOLATION_BINDS: %w", err)
+	}
+
+	var passEnv []string
+	for _, name := range strings.Split(os.Getenv("AGENT_ISOLATION_ENV"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			passEnv = append(passEnv, name)
+		}
+	}
+
+	cfg := llm.IsolationConfig{
+		BwrapBin:         strings.TrimSpace(os.Getenv("BWRAP_BIN")),
+		ContainerRuntime: strings.TrimSpace(os.Getenv("AGENT_CONTAINER_RUNTIME")),
+		ContainerImage:   strings.TrimSpace(os.Getenv("AGENT_CONTAINER_IMAGE")),
+		Binds:            binds,
+		PassEnv:          passEnv,
+	}
+
+	mode := llm.IsolationHost
+	if value := strings.TrimSpace(os.Getenv("AGENT_ISOLATION")); value != "" {
+		mode, err = llm.ParseIsolationMode(value)
+		if err != nil {
+			return cfg, "", fmt.Errorf("invalid AGENT_ISOLATION: %w", err)
+		}
+	}
+	if err := cfg.Validate(mode); err != nil {
+		return cfg, "", fmt.Errorf("invalid AGENT_ISOLATION: %w", err)
+	}
+	return cfg, mode, nil
+}
+
+func agentUsagePath() (string, error) {
+	return agentDataPath("AGENT_USAGE_PATH", "agent_usage.jsonl")
+}
+
+// agentDataPath resolves the file named by envKey, defaulting to name next to
+// the topic contexts file.
+func agentDataPath(envKey, name string) (string, error) {
+	path := strings.TrimSpace(os.Getenv(envKey))
+	if path == "" {
+		topicsPath := strings.TrimSpace(os.Getenv("TELEGRAM_TOPIC_CONTEXTS_PATH"))
+		if topicsPath == "" {
+			topicsPath = filepath.Join("data", "telegram_topics.json")
+		}
+		path = filepath.Join(filepath.Dir(topicsPath), name)
+	}
+	return filepath.Abs(path)
+}
+
 func parseEnabledAgents() []string {
 	raw := strings.TrimSpace(os.Getenv("ENABLED_AGENTS"))
 	if raw == "" {
 		raw = defaultEnabledAgents
 	}
+	return parseAgentList(raw)
+}
 
+// parseAgentList splits a comma-separated list of agent ids, lowercasing them
+// and dropping blanks and duplicates while keeping order.
+func parseAgentList(raw string) []string {
 	parts := strings.Split(raw, ",")
 	out := make([]string, 0, len(parts))
 	seen := make(map[string]struct{}, len(parts))
@@ -233,22 +1048,42 @@ func parseEnabledAgents() []string {
 	return out
 }
 
-func parseAgentForward(text string, available map[string]llm.Client) (targetID string, payload string, ok bool) {
-	matches := agentTagPattern.FindStringSubmatchIndex(text)
-	if len(matches) < 4 {
+// parseDirectAgentAddress accepts only a leading @agent tag, so a user message
+// that merely mentions an agent later on is not rerouted.
+func parseDirectAgentAddress(text string, available map[string]llm.Client) (string, string, bool) {
+	trimmed := strings.TrimSpace(text)
+	loc := agentTagPattern.FindStringSubmatchIndex(trimmed)
+	if loc == nil || loc[0] != 0 {
+		return "", "", false
+	}
+	// The tag must be a word of its own, as in "@claude review this".
+	if rest := trimmed[loc[1]:]; rest != "" && !unicode.IsSpace(rune(rest[0])) {
 		return "", "", false
 	}
 
-	agentID := strings.ToLower(strings.TrimSpace(text[matches[2]:matches[3]]))
+	agentID := strings.ToLower(trimmed[loc[2]:loc[3]])
 	if _, exists := available[agentID]; !exists {
 		return "", "", false
 	}
 
-	contentStart := matches[1]
-	message := strings.TrimSpace(text[contentStart:])
+	message := strings.TrimSpace(trimmed[loc[1]:])
 	if message == "" {
 		return "", "", false
 	}
-
 	return agentID, message, true
 }
+
+// parseAgentForward looks for a structured handoff to one of the available
+// agents in an agent response. See llm.ParseHandoff for the accepted formats.
+func parseAgentForward(text string, available map[string]llm.Client) (targetID string, payload string, ok bool) {
+	agents := make([]string, 0, len(available))
+	for id := range available {
+		agents = append(agents, id)
+	}
+
+	handoff, ok := llm.ParseHandoff(text, agents)
+	if !ok {
+		return "", "", false
+	}
+	return handoff.To, handoff.Message, true
+}
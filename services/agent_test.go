@@ -2,6 +2,10 @@ package services
 
 import (
 	ctx "context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +16,7 @@ type fakeAgentClient struct {
 	id        string
 	responses []llm.Response
 	errs      []error
+	chunks    [][]string
 	calls     []llm.Request
 }
 
@@ -34,6 +39,16 @@ func (f *fakeAgentClient) Send(_ ctx.Context, req llm.Request) (llm.Response, er
 	return resp, err
 }
 
+func (f *fakeAgentClient) Stream(c ctx.Context, req llm.Request, onChunk func(chunk string)) (llm.Response, error) {
+	idx := len(f.calls)
+	if idx < len(f.chunks) && onChunk != nil {
+		for _, chunk := range f.chunks[idx] {
+			onChunk(chunk)
+		}
+	}
+	return f.Send(c, req)
+}
+
 func (f *fakeAgentClient) Clear(_ ctx.Context, _ string) error {
 	return nil
 }
@@ -44,7 +59,7 @@ func TestParseAgentForward(t *testing.T) {
 		llm.ClaudeID: &fakeAgentClient{id: llm.ClaudeID},
 	}
 
-	target, payload, ok := parseAgentForward("Need a check. @claude review auth middleware.", available)
+	target, payload, ok := parseAgentForward("Need a check.\nHANDOFF @claude: review auth middleware.", available)
 	if !ok {
 		t.Fatalf("expected agent forward to be parsed")
 	}
@@ -54,6 +69,36 @@ func TestParseAgentForward(t *testing.T) {
 	if payload != "review auth middleware." {
 		t.Fatalf("payload = %q, want %q", payload, "review auth middleware.")
 	}
+
+	if _, _, ok := parseAgentForward("Need a check. @claude review auth middleware.", available); ok {
+		t.Fatalf("expected a mid-sentence mention not to be treated as a handoff")
+	}
+}
+
+func TestParseDirectAgentAddress(t *testing.T) {
+	available := map[string]llm.Client{
+		llm.CodexID:  &fakeAgentClient{id: llm.CodexID},
+		llm.ClaudeID: &fakeAgentClient{id: llm.ClaudeID},
+	}
+
+	target, prompt, ok := parseDirectAgentAddress("  @Claude review the auth middleware", available)
+	if !ok || target != llm.ClaudeID || prompt != "review the auth middleware" {
+		t.Fatalf("unexpected parse: %q %q %v", target, prompt, ok)
+	}
+
+	cases := []string{
+		"please ask @claude to review",
+		"@gocode_bot hello",
+		"@claude",
+		"@claude_fn is a decorator",
+		"@claude.ai is down",
+		"email me at dev@claude.ai",
+	}
+	for _, text := range cases {
+		if _, _, ok := parseDirectAgentAddress(text, available); ok {
+			t.Fatalf("expected %q not to be treated as a direct address", text)
+		}
+	}
 }
 
 func TestRunWithEvents_HandoffAndFinalize(t *testing.T) {
@@ -83,7 +128,7 @@ func TestRunWithEvents_HandoffAndFinalize(t *testing.T) {
 	}
 
 	events := make([]AgentEvent, 0, 2)
-	resp, err := svc.RunWithEvents("/tmp/repo", "start", func(event AgentEvent) {
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "start"}, func(event AgentEvent) {
 		events = append(events, event)
 	})
 	if err != nil {
@@ -135,7 +180,7 @@ func TestRunWithEvents_FullFlowMultiHop(t *testing.T) {
 	}
 
 	var events []AgentEvent
-	resp, err := svc.RunWithEvents("/tmp/full-flow-repo", "build feature", func(event AgentEvent) {
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/full-flow-repo", Prompt: "build feature"}, func(event AgentEvent) {
 		events = append(events, event)
 	})
 	if err != nil {
@@ -186,6 +231,70 @@ func TestRunWithEvents_FullFlowMultiHop(t *testing.T) {
 	}
 }
 
+func TestRunWithEvents_StreamsOutputEvents(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "done"}},
+		chunks:    [][]string{{"reading files\n", "writing patch\n"}},
+	}
+
+	svc := &AgentService{
+		clients:         map[string]llm.Client{llm.CodexID: codex},
+		enabledAgents:   []string{llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         2,
+		agentHopTimeout: time.Minute,
+	}
+
+	var events []AgentEvent
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "start"}, func(event AgentEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if resp != "done" {
+		t.Fatalf("resp = %q, want %q", resp, "done")
+	}
+	if len(events) != 2 {
+		t.Fatalf("events len = %d, want 2", len(events))
+	}
+	for i, event := range events {
+		if event.Type != AgentEventOutput || event.From != llm.CodexID {
+			t.Fatalf("unexpected output event[%d]: %#v", i, event)
+		}
+	}
+	if events[1].Text != "writing patch\n" {
+		t.Fatalf("events[1].Text = %q, want %q", events[1].Text, "writing patch\n")
+	}
+}
+
+func TestRunWithEvents_CancelledContextStopsRun(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "never"}},
+	}
+
+	svc := &AgentService{
+		clients:         map[string]llm.Client{llm.CodexID: codex},
+		enabledAgents:   []string{llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         2,
+		agentHopTimeout: time.Minute,
+	}
+
+	runCtx, cancel := ctx.WithCancel(ctx.Background())
+	cancel()
+
+	_, err := svc.RunWithEvents(runCtx, AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "start"}, nil)
+	if !errors.Is(err, ctx.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(codex.calls) != 0 {
+		t.Fatalf("expected no agent calls after cancellation, got %d", len(codex.calls))
+	}
+}
+
 func TestOtherAgents_ExcludesSelf(t *testing.T) {
 	got := otherAgents([]string{llm.CodexID, llm.ClaudeID}, llm.CodexID)
 	if len(got) != 1 || got[0] != llm.ClaudeID {
@@ -203,6 +312,7 @@ func TestStart_DefaultAgentHopTimeoutIsFiveMinutes(t *testing.T) {
 	t.Setenv("DEFAULT_AGENT", "codex")
 	t.Setenv("MAX_AGENT_HOPS", "")
 	t.Setenv("AGENT_HOP_TIMEOUT", "")
+	t.Setenv("AGENT_SESSIONS_PATH", filepath.Join(t.TempDir(), "agent_sessions.json"))
 
 	svc := &AgentService{}
 	if err := svc.Start(); err != nil {
@@ -213,3 +323,770 @@ func TestStart_DefaultAgentHopTimeoutIsFiveMinutes(t *testing.T) {
 		t.Fatalf("agentHopTimeout = %s, want 5m", svc.agentHopTimeout)
 	}
 }
+
+func TestAgentSessionsPath_DefaultsNextToTopicContexts(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AGENT_SESSIONS_PATH", "")
+	t.Setenv("TELEGRAM_TOPIC_CONTEXTS_PATH", filepath.Join(dir, "telegram_topics.json"))
+
+	got, err := agentSessionsPath()
+	if err != nil {
+		t.Fatalf("agentSessionsPath returned error: %v", err)
+	}
+	want := filepath.Join(dir, "agent_sessions.json")
+	if got != want {
+		t.Fatalf("agentSessionsPath() = %q, want %q", got, want)
+	}
+}
+
+func TestStart_EnablesOpenAICompatAgent(t *testing.T) {
+	t.Setenv("ENABLED_AGENTS", "codex,openai")
+	t.Setenv("DEFAULT_AGENT", "codex")
+	t.Setenv("MAX_AGENT_HOPS", "")
+	t.Setenv("AGENT_HOP_TIMEOUT", "")
+	t.Setenv("AGENT_SESSIONS_PATH", filepath.Join(t.TempDir(), "agent_sessions.json"))
+
+	svc := &AgentService{}
+	if err := svc.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if _, ok := svc.clients[llm.OpenAICompatID].(*llm.OpenAICompatClient); !ok {
+		t.Fatalf("expected openai-compatible client to be registered, got %#v", svc.clients)
+	}
+}
+
+func TestStart_RegistersConfiguredCLIAgent(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "agents.json")
+	config := `{"agents":[{"id":"aider","bin":"aider","args":["--yes-always","--message","{{prompt}}"]}]}`
+	if err := os.WriteFile(configPath, []byte(config), 0o644); err != nil {
+		t.Fatalf("write agents config: %v", err)
+	}
+
+	t.Setenv("AGENTS_CONFIG_PATH", configPath)
+	t.Setenv("ENABLED_AGENTS", "codex,aider")
+	t.Setenv("DEFAULT_AGENT", "aider")
+	t.Setenv("MAX_AGENT_HOPS", "")
+	t.Setenv("AGENT_HOP_TIMEOUT", "")
+	t.Setenv("AGENT_SESSIONS_PATH", filepath.Join(dir, "agent_sessions.json"))
+
+	svc := &AgentService{}
+	if err := svc.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if _, ok := svc.clients["aider"].(*llm.CLIClient); !ok {
+		t.Fatalf("expected aider to be a CLI client, got %#v", svc.clients["aider"])
+	}
+	if svc.defaultAgent != "aider" {
+		t.Fatalf("defaultAgent = %q, want aider", svc.defaultAgent)
+	}
+}
+
+func TestStart_RejectsUnknownAgent(t *testing.T) {
+	t.Setenv("AGENTS_CONFIG_PATH", filepath.Join(t.TempDir(), "missing.json"))
+	t.Setenv("ENABLED_AGENTS", "codex,mystery")
+	t.Setenv("DEFAULT_AGENT", "codex")
+	t.Setenv("AGENT_SESSIONS_PATH", filepath.Join(t.TempDir(), "agent_sessions.json"))
+
+	svc := &AgentService{}
+	if err := svc.Start(); err == nil {
+		t.Fatalf("expected Start to reject unknown agent id")
+	}
+}
+
+func TestRunWithEvents_StartsWithRequestedAgentAndModel(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "Codex feedback"}},
+	}
+	claude := &fakeAgentClient{
+		id: llm.ClaudeID,
+		responses: []llm.Response{
+			{Text: "@codex double-check migrations"},
+			{Text: "Claude done"},
+		},
+	}
+
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+	}
+
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{
+		RepoPath: "/tmp/repo",
+		Prompt:   "start",
+		Agent:    llm.ClaudeID,
+		Model:    "opus",
+	}, nil)
+	if err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if resp != "Claude done" {
+		t.Fatalf("resp = %q, want %q", resp, "Claude done")
+	}
+	if len(claude.calls) != 2 || claude.calls[0].Message != "start" {
+		t.Fatalf("expected claude to receive the prompt first, got %#v", claude.calls)
+	}
+	for i, call := range claude.calls {
+		if call.Model != "opus" {
+			t.Fatalf("claude call[%d] model = %q, want opus", i, call.Model)
+		}
+	}
+	if len(codex.calls) != 1 || codex.calls[0].Model != "" {
+		t.Fatalf("expected handoff target to keep its default model, got %#v", codex.calls)
+	}
+}
+
+func TestRunWithEvents_RejectsDisabledAgent(t *testing.T) {
+	svc := &AgentService{
+		clients:         map[string]llm.Client{llm.CodexID: &fakeAgentClient{id: llm.CodexID}},
+		enabledAgents:   []string{llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         2,
+		agentHopTimeout: time.Minute,
+	}
+
+	if _, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "hi", Agent: llm.ClaudeID}, nil); err == nil {
+		t.Fatalf("expected error for disabled starting agent")
+	}
+}
+
+func TestAskAll_SendsPromptToEveryAgentInItsOwnRepo(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "@claude please check"}},
+	}
+	claude := &fakeAgentClient{
+		id:   llm.ClaudeID,
+		errs: []error{errors.New("boom")},
+	}
+
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		enabledAgents:   []string{llm.CodexID, llm.ClaudeID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+	}
+
+	answers, err := svc.AskAll(ctx.Background(), AgentRunRequest{
+		Topic:       "1:2",
+		Prompt:      "fix it",
+		Agent:       llm.CodexID,
+		Model:       "gpt-5",
+		Sandbox:     llm.SandboxWorkspaceWrite,
+		Attachments: []llm.Attachment{{Path: "/tmp/shot.jpg", MIME: "image/jpeg"}},
+	}, map[string]string{
+		llm.CodexID:  "/tmp/wt-codex",
+		llm.ClaudeID: "/tmp/wt-claude",
+	})
+	if err != nil {
+		t.Fatalf("AskAll returned error: %v", err)
+	}
+	if len(answers) != 2 || answers[0].Agent != llm.ClaudeID || answers[1].Agent != llm.CodexID {
+		t.Fatalf("unexpected answers: %#v", answers)
+	}
+	if answers[0].Err == nil {
+		t.Fatalf("expected claude answer to carry its error")
+	}
+	if answers[1].Text != "@claude please check" || answers[1].Err != nil {
+		t.Fatalf("unexpected codex answer: %#v", answers[1])
+	}
+	if len(codex.calls) != 1 || codex.calls[0].RepoPath != "/tmp/wt-codex" || codex.calls[0].Message != "fix it" {
+		t.Fatalf("unexpected codex calls: %#v", codex.calls)
+	}
+	if codex.calls[0].Sandbox != llm.SandboxWorkspaceWrite {
+		t.Fatalf("expected the topic sandbox to be passed on, got %q", codex.calls[0].Sandbox)
+	}
+	if len(codex.calls[0].AvailableAgents) != 0 {
+		t.Fatalf("expected handoffs to be disabled, got %#v", codex.calls[0].AvailableAgents)
+	}
+	if len(claude.calls) != 1 || claude.calls[0].RepoPath != "/tmp/wt-claude" {
+		t.Fatalf("expected claude to be asked exactly once, got %#v", claude.calls)
+	}
+	if len(codex.calls[0].Attachments) != 1 || len(claude.calls[0].Attachments) != 1 {
+		t.Fatalf("expected attachments for every agent, got %#v and %#v", codex.calls[0].Attachments, claude.calls[0].Attachments)
+	}
+	if codex.calls[0].Model != "gpt-5" || claude.calls[0].Model != "" {
+		t.Fatalf("expected the model only for the start agent, got %q and %q", codex.calls[0].Model, claude.calls[0].Model)
+	}
+}
+
+func TestAskAll_RejectsDisabledAgent(t *testing.T) {
+	svc := &AgentService{
+		clients:         map[string]llm.Client{llm.CodexID: &fakeAgentClient{id: llm.CodexID}},
+		enabledAgents:   []string{llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		agentHopTimeout: time.Minute,
+	}
+
+	if _, err := svc.AskAll(ctx.Background(), AgentRunRequest{Topic: "1:2", Prompt: "hi"}, map[string]string{llm.ClaudeID: "/tmp/wt"}); err == nil {
+		t.Fatalf("expected error for disabled agent")
+	}
+}
+
+func TestRunWithEvents_ReviewLoopUntilApproved(t *testing.T) {
+	codex := &fakeAgentClient{
+		id: llm.CodexID,
+		responses: []llm.Response{
+			{Text: "Implemented login."},
+			{Text: "Added the missing test."},
+		},
+	}
+	claude := &fakeAgentClient{
+		id: llm.ClaudeID,
+		responses: []llm.Response{
+			{Text: "Missing a test for expired tokens."},
+			{Text: "**APPROVED**"},
+		},
+	}
+
+	diffs := 0
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         8,
+		agentHopTimeout: time.Minute,
+		reviewDiff: func(repoPath string) (string, error) {
+			diffs++
+			return "diff --git a/login.go b/login.go", nil
+		},
+	}
+
+	var events []AgentEvent
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "add login", Review: true}, func(event AgentEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if resp != "Added the missing test.\n\nApproved by @claude after 2 review round(s)." {
+		t.Fatalf("unexpected response: %q", resp)
+	}
+	if diffs != 2 {
+		t.Fatalf("diff requested %d times, want 2", diffs)
+	}
+	if len(events) != 2 || events[0].Type != AgentEventReview || events[0].Round != 1 || events[1].Type != AgentEventApproved || events[1].Round != 2 {
+		t.Fatalf("unexpected events: %#v", events)
+	}
+	if len(codex.calls) != 2 || !strings.Contains(codex.calls[1].Message, "Missing a test for expired tokens.") {
+		t.Fatalf("expected author to receive review feedback, got %#v", codex.calls)
+	}
+	if !strings.Contains(claude.calls[0].Message, "diff --git a/login.go") || len(claude.calls[0].AvailableAgents) != 0 {
+		t.Fatalf("unexpected reviewer request: %#v", claude.calls[0])
+	}
+	if claude.calls[0].Sandbox != llm.SandboxReadOnly || codex.calls[0].Sandbox != llm.SandboxFull {
+		t.Fatalf("expected read-only reviewer and default author sandbox, got %q and %q", claude.calls[0].Sandbox, codex.calls[0].Sandbox)
+	}
+}
+
+func TestRunWithEvents_ReviewLoopStopsAtMaxHops(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "v1"}, {Text: "v2"}},
+	}
+	claude := &fakeAgentClient{
+		id:        llm.ClaudeID,
+		responses: []llm.Response{{Text: "No."}, {Text: "Still no."}},
+	}
+
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+		reviewDiff:      func(string) (string, error) { return "", nil },
+	}
+
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "add login", Review: true}, nil)
+	if err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if !strings.Contains(resp, "did not approve before reaching MAX_AGENT_HOPS=4") {
+		t.Fatalf("unexpected response: %q", resp)
+	}
+	if len(codex.calls)+len(claude.calls) != 4 {
+		t.Fatalf("expected 4 hops, got codex=%d claude=%d", len(codex.calls), len(claude.calls))
+	}
+}
+
+func TestRunWithEvents_ReviewLoopFallsBackToAnotherReviewer(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "Implemented login."}},
+	}
+	claude := &fakeAgentClient{
+		id:   llm.ClaudeID,
+		errs: []error{&llm.Error{Kind: llm.ErrorAuth, Err: errors.New("exit status 1")}},
+	}
+	openai := &fakeAgentClient{
+		id:        llm.OpenAICompatID,
+		responses: []llm.Response{{Text: "APPROVED"}},
+	}
+
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:        codex,
+			llm.ClaudeID:       claude,
+			llm.OpenAICompatID: openai,
+		},
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID, llm.OpenAICompatID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         8,
+		agentHopTimeout: time.Minute,
+		fallbacks:       []string{llm.ClaudeID, llm.CodexID, llm.OpenAICompatID},
+		reviewDiff:      func(string) (string, error) { return "diff", nil },
+	}
+
+	var events []AgentEvent
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "add login", Review: true}, func(event AgentEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if resp != "Implemented login.\n\nApproved by @openai after 1 review round(s)." {
+		t.Fatalf("unexpected response: %q", resp)
+	}
+	if len(codex.calls) != 1 {
+		t.Fatalf("expected the author never to review its own change, got %d codex calls", len(codex.calls))
+	}
+	if len(openai.calls) != 1 || openai.calls[0].Sandbox != llm.SandboxReadOnly {
+		t.Fatalf("expected a read-only fallback review, got %#v", openai.calls)
+	}
+	if len(events) != 2 || events[0].Type != AgentEventFallback || events[0].To != llm.OpenAICompatID || events[1].Type != AgentEventApproved {
+		t.Fatalf("unexpected events: %#v", events)
+	}
+}
+
+func TestIsReviewApproved(t *testing.T) {
+	approved := []string{"APPROVED", "Looks great.\n\n**Approved.**", "`APPROVED`"}
+	for _, text := range approved {
+		if !isReviewApproved(text) {
+			t.Fatalf("expected %q to be approved", text)
+		}
+	}
+	rejected := []string{"Not APPROVED yet", "I have not approved this", ""}
+	for _, text := range rejected {
+		if isReviewApproved(text) {
+			t.Fatalf("expected %q not to be approved", text)
+		}
+	}
+}
+
+func TestRunWithEvents_RecordsUsagePerHop(t *testing.T) {
+	codex := &fakeAgentClient{
+		id: llm.CodexID,
+		responses: []llm.Response{
+			{Text: "HANDOFF @claude: review", Usage: llm.Usage{InputTokens: 100, OutputTokens: 10}},
+			{Text: "done", Usage: llm.Usage{InputTokens: 200, OutputTokens: 20}},
+		},
+	}
+	claude := &fakeAgentClient{
+		id:        llm.ClaudeID,
+		responses: []llm.Response{{Text: "ok", Usage: llm.Usage{InputTokens: 50, OutputTokens: 5, CostUSD: 0.1}}},
+	}
+
+	usage, err := NewUsageStore("")
+	if err != nil {
+		t.Fatalf("NewUsageStore returned error: %v", err)
+	}
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		usage:           usage,
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+	}
+
+	if _, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "go", Topic: "1:2"}, nil); err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+
+	summary := svc.Usage("1:2", time.Time{})
+	if summary.Requests != 1 || summary.Calls != 3 {
+		t.Fatalf("unexpected counts: %#v", summary)
+	}
+	if summary.InputTokens != 350 || summary.ByAgent[llm.ClaudeID].CostUSD != 0.1 {
+		t.Fatalf("unexpected totals: %#v", summary)
+	}
+
+	hops := make([]int, 0, len(usage.records))
+	for _, rec := range usage.records {
+		hops = append(hops, rec.Hop)
+	}
+	if len(hops) != 3 || hops[0] != 1 || hops[1] != 2 || hops[2] != 3 {
+		t.Fatalf("unexpected hop numbers: %v", hops)
+	}
+	if other := svc.Usage("1:3", time.Time{}); other.Calls != 0 {
+		t.Fatalf("expected other topic to have no usage, got %#v", other)
+	}
+}
+
+func TestRunWithEvents_StopsWhenHopBudgetExceeded(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "HANDOFF @claude: review"}},
+	}
+	claude := &fakeAgentClient{id: llm.ClaudeID}
+
+	budgets, err := NewBudgetStore("", AgentBudget{}, AgentBudget{HopsPerRequest: 1})
+	if err != nil {
+		t.Fatalf("NewBudgetStore returned error: %v", err)
+	}
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		budgets:         budgets,
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+	}
+
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "go", Topic: "1:2"}, nil)
+	var budgetErr *BudgetExceededError
+	if !errors.As(err, &budgetErr) || budgetErr.Scope != "topic" || budgetErr.Limit != BudgetHops {
+		t.Fatalf("expected topic hop budget error, got %v", err)
+	}
+	if resp != "HANDOFF @claude: review" {
+		t.Fatalf("expected last answer to be kept, got %q", resp)
+	}
+	if len(claude.calls) != 0 {
+		t.Fatalf("expected claude not to run, got %d calls", len(claude.calls))
+	}
+}
+
+func TestRunWithEvents_RetriesDoNotUseUpHops(t *testing.T) {
+	rateLimited := &llm.Error{Kind: llm.ErrorRateLimited, Err: errors.New("exit status 1")}
+	codex := &fakeAgentClient{
+		id: llm.CodexID,
+		responses: []llm.Response{
+			{Text: "429 Too Many Requests"},
+			{Text: "429 Too Many Requests"},
+			{Text: "HANDOFF @claude: review"},
+		},
+		errs: []error{rateLimited, rateLimited},
+	}
+	claude := &fakeAgentClient{
+		id:        llm.ClaudeID,
+		responses: []llm.Response{{Text: "looks good"}},
+	}
+
+	budgets, err := NewBudgetStore("", AgentBudget{}, AgentBudget{HopsPerRequest: 2})
+	if err != nil {
+		t.Fatalf("NewBudgetStore returned error: %v", err)
+	}
+	usage, err := NewUsageStore("")
+	if err != nil {
+		t.Fatalf("NewUsageStore returned error: %v", err)
+	}
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		budgets:         budgets,
+		usage:           usage,
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+		retry:           llm.RetryPolicy{MaxAttempts: 3},
+	}
+
+	_, err = svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "go", Topic: "1:2"}, nil)
+	var budgetErr *BudgetExceededError
+	if !errors.As(err, &budgetErr) || budgetErr.Limit != BudgetHops || budgetErr.Used != 2 {
+		t.Fatalf("expected the hop budget to stop the third turn, got %v", err)
+	}
+	if len(codex.calls) != 3 || len(claude.calls) != 1 {
+		t.Fatalf("expected 3 codex attempts and the handoff to claude, got %d and %d", len(codex.calls), len(claude.calls))
+	}
+
+	hops := make([]int, 0, len(usage.records))
+	for _, rec := range usage.records {
+		hops = append(hops, rec.Hop)
+	}
+	if len(hops) != 4 || hops[0] != 1 || hops[1] != 1 || hops[2] != 1 || hops[3] != 2 {
+		t.Fatalf("unexpected hop numbers: %v", hops)
+	}
+}
+
+func TestCheckBudget_DailyTokensAndMinutes(t *testing.T) {
+	usage, err := NewUsageStore("")
+	if err != nil {
+		t.Fatalf("NewUsageStore returned error: %v", err)
+	}
+	now := time.Now()
+	_ = usage.Record(UsageRecord{Time: now, Topic: "1:2", Request: "a", Agent: "codex", InputTokens: 900, OutputTokens: 100, DurationMS: 90_000})
+	_ = usage.Record(UsageRecord{Time: now.AddDate(0, 0, -2), Topic: "1:2", Request: "b", Agent: "codex", InputTokens: 50_000})
+
+	budgets, err := NewBudgetStore("", AgentBudget{AgentMinutesPerDay: 1}, AgentBudget{TokensPerDay: 2000})
+	if err != nil {
+		t.Fatalf("NewBudgetStore returned error: %v", err)
+	}
+	svc := &AgentService{usage: usage, budgets: budgets}
+
+	err = svc.checkBudget(&agentRun{topic: "1:2"}, now)
+	var budgetErr *BudgetExceededError
+	if !errors.As(err, &budgetErr) || budgetErr.Scope != "global" || budgetErr.Limit != BudgetMinutes || budgetErr.Used != 1 {
+		t.Fatalf("expected global minutes budget error, got %v", err)
+	}
+
+	if _, err := svc.SetBudget("", BudgetMinutes, 0); err != nil {
+		t.Fatalf("SetBudget returned error: %v", err)
+	}
+	if err := svc.checkBudget(&agentRun{topic: "1:2"}, now); err != nil {
+		t.Fatalf("expected run within budget after raising limit, got %v", err)
+	}
+
+	if _, err := svc.SetBudget("1:2", BudgetTokens, 1000); err != nil {
+		t.Fatalf("SetBudget returned error: %v", err)
+	}
+	err = svc.checkBudget(&agentRun{topic: "1:2"}, now)
+	if !errors.As(err, &budgetErr) || budgetErr.Scope != "topic" || budgetErr.Limit != BudgetTokens || budgetErr.Used != 1000 {
+		t.Fatalf("expected topic token budget error, got %v", err)
+	}
+}
+
+func TestRunWithEvents_RetriesThenFallsBack(t *testing.T) {
+	rateLimited := &llm.Error{Kind: llm.ErrorRateLimited, Err: errors.New("exit status 1")}
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "429 Too Many Requests"}, {Text: "429 Too Many Requests"}},
+		errs:      []error{rateLimited, rateLimited},
+	}
+	claude := &fakeAgentClient{
+		id:        llm.ClaudeID,
+		responses: []llm.Response{{Text: "fixed by claude"}},
+	}
+
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+		retry:           llm.RetryPolicy{MaxAttempts: 2},
+		fallbacks:       []string{llm.CodexID, llm.ClaudeID},
+	}
+
+	var events []AgentEvent
+	resp, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "fix it", Model: "gpt-5"}, func(event AgentEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if resp != "fixed by claude" {
+		t.Fatalf("resp = %q, want fallback answer", resp)
+	}
+	if len(codex.calls) != 2 || len(claude.calls) != 1 {
+		t.Fatalf("expected 2 codex calls and 1 claude call, got %d and %d", len(codex.calls), len(claude.calls))
+	}
+	if claude.calls[0].Message != "fix it" || claude.calls[0].Model != "" {
+		t.Fatalf("unexpected fallback request: %#v", claude.calls[0])
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected retry and fallback events, got %#v", events)
+	}
+	if events[0].Type != AgentEventRetry || events[0].From != llm.CodexID || events[0].Round != 1 || events[0].Kind != llm.ErrorRateLimited {
+		t.Fatalf("unexpected retry event: %#v", events[0])
+	}
+	if events[1].Type != AgentEventFallback || events[1].From != llm.CodexID || events[1].To != llm.ClaudeID {
+		t.Fatalf("unexpected fallback event: %#v", events[1])
+	}
+}
+
+func TestRunWithEvents_DoesNotRetryAuthFailures(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:   llm.CodexID,
+		errs: []error{&llm.Error{Kind: llm.ErrorAuth, Err: errors.New("exit status 1")}},
+	}
+
+	svc := &AgentService{
+		clients:         map[string]llm.Client{llm.CodexID: codex},
+		enabledAgents:   []string{llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+		retry:           llm.RetryPolicy{MaxAttempts: 3},
+	}
+
+	_, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "go"}, nil)
+	if llm.KindOf(err) != llm.ErrorAuth {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+	if len(codex.calls) != 1 {
+		t.Fatalf("expected a single attempt, got %d", len(codex.calls))
+	}
+}
+
+func TestNextFallback(t *testing.T) {
+	svc := &AgentService{fallbacks: []string{"codex", "claude", "openai"}}
+	cases := []struct {
+		failed string
+		tried  map[string]bool
+		want   string
+		ok     bool
+	}{
+		{failed: "codex", tried: map[string]bool{"codex": true}, want: "claude", ok: true},
+		{failed: "claude", tried: map[string]bool{"codex": true, "claude": true}, want: "openai", ok: true},
+		{failed: "openai", tried: map[string]bool{"openai": true}},
+		{failed: "gemini", tried: map[string]bool{"gemini": true}, want: "codex", ok: true},
+	}
+	for _, tc := range cases {
+		got, ok := svc.nextFallback(tc.failed, tc.tried)
+		if got != tc.want || ok != tc.ok {
+			t.Fatalf("nextFallback(%q) = %q, %v; want %q, %v", tc.failed, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRunWithEvents_PassesSandboxAndIsolationToHandoffTargets(t *testing.T) {
+	codex := &fakeAgentClient{
+		id:        llm.CodexID,
+		responses: []llm.Response{{Text: "HANDOFF @claude: check"}, {Text: "done"}},
+	}
+	claude := &fakeAgentClient{id: llm.ClaudeID, responses: []llm.Response{{Text: "looks fine"}}}
+
+	svc := &AgentService{
+		clients: map[string]llm.Client{
+			llm.CodexID:  codex,
+			llm.ClaudeID: claude,
+		},
+		enabledAgents:   []string{llm.ClaudeID, llm.CodexID},
+		defaultAgent:    llm.CodexID,
+		defaultSandbox:  llm.SandboxWorkspaceWrite,
+		maxHops:         4,
+		agentHopTimeout: time.Minute,
+	}
+
+	if _, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{
+		RepoPath:    "/tmp/repo",
+		Prompt:      "go",
+		Sandbox:     llm.SandboxReadOnly,
+		Isolation:   llm.IsolationBwrap,
+		Attachments: []llm.Attachment{{Path: "/tmp/repo/.gocode/attachments/shot.jpg", MIME: "image/jpeg"}},
+	}, nil); err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if codex.calls[0].Isolation != llm.IsolationBwrap || claude.calls[0].Isolation != llm.IsolationBwrap {
+		t.Fatalf("expected topic isolation on every hop, got %q and %q", codex.calls[0].Isolation, claude.calls[0].Isolation)
+	}
+	if len(codex.calls[0].Attachments) != 1 || len(claude.calls[0].Attachments) != 1 {
+		t.Fatalf("expected attachments on every hop, got %#v and %#v", codex.calls[0].Attachments, claude.calls[0].Attachments)
+	}
+	if codex.calls[0].Sandbox != llm.SandboxReadOnly || claude.calls[0].Sandbox != llm.SandboxReadOnly {
+		t.Fatalf("expected topic sandbox on every hop, got %q and %q", codex.calls[0].Sandbox, claude.calls[0].Sandbox)
+	}
+
+	if _, err := svc.RunWithEvents(ctx.Background(), AgentRunRequest{RepoPath: "/tmp/repo", Prompt: "go"}, nil); err != nil {
+		t.Fatalf("RunWithEvents returned error: %v", err)
+	}
+	if got := codex.calls[len(codex.calls)-1].Sandbox; got != llm.SandboxWorkspaceWrite {
+		t.Fatalf("expected AGENT_SANDBOX default, got %q", got)
+	}
+	if got := codex.calls[len(codex.calls)-1].Isolation; got != llm.IsolationHost {
+		t.Fatalf("expected host isolation by default, got %q", got)
+	}
+}
+
+func TestLoadIsolationConfig(t *testing.T) {
+	t.Setenv("AGENT_ISOLATION", "container")
+	t.Setenv("AGENT_CONTAINER_IMAGE", "")
+	if _, _, err := loadIsolationConfig(); err == nil {
+		t.Fatalf("expected container isolation without an image to be rejected")
+	}
+
+	t.Setenv("AGENT_CONTAINER_IMAGE", "ghcr.io/acme/agents:latest")
+	t.Setenv("AGENT_ISOLATION_BINDS", "/srv/codex,/srv/tools:ro")
+	t.Setenv("AGENT_ISOLATION_ENV", "OPENAI_API_KEY, ANTHROPIC_API_KEY")
+	cfg, mode, err := loadIsolationConfig()
+	if err != nil {
+		t.Fatalf("loadIsolationConfig returned error: %v", err)
+	}
+	if mode != llm.IsolationContainer || cfg.ContainerImage != "ghcr.io/acme/agents:latest" {
+		t.Fatalf("unexpected config: %q %#v", mode, cfg)
+	}
+	if len(cfg.Binds) != 2 || !cfg.Binds[1].ReadOnly || len(cfg.PassEnv) != 2 || cfg.PassEnv[1] != "ANTHROPIC_API_KEY" {
+		t.Fatalf("unexpected binds or env: %#v", cfg)
+	}
+}
+
+func TestAgentService_ForgetRepoDropsSessions(t *testing.T) {
+	sessions, err := llm.NewSessionStore("")
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	worktree := filepath.Join(t.TempDir(), "ask-codex")
+	sessions.Set(llm.CodexID, worktree, "session-1")
+	sessions.Set(llm.ClaudeID, worktree, "2")
+	sessions.Set(llm.CodexID, "/tmp/repo", "session-2")
+
+	svc := &AgentService{
+		clients:  map[string]llm.Client{llm.CodexID: &fakeAgentClient{id: llm.CodexID}},
+		sessions: sessions,
+	}
+	if err := svc.ForgetRepo(worktree); err != nil {
+		t.Fatalf("ForgetRepo returned error: %v", err)
+	}
+	if sessions.Get(llm.CodexID, worktree) != "" || sessions.Get(llm.ClaudeID, worktree) != "" {
+		t.Fatalf("expected the worktree sessions to be removed")
+	}
+	if sessions.Get(llm.CodexID, "/tmp/repo") != "session-2" {
+		t.Fatalf("expected other repos to keep their sessions")
+	}
+}
+
+func TestAgentService_ReviewerForNeverPicksTheAuthor(t *testing.T) {
+	svc := &AgentService{
+		enabledAgents: []string{llm.CodexID, llm.ClaudeID},
+		defaultAgent:  llm.CodexID,
+	}
+	// A topic without its own agent passes "", which is the default agent.
+	if reviewer, ok := svc.ReviewerFor(""); !ok || reviewer != llm.ClaudeID {
+		t.Fatalf("ReviewerFor(\"\") = %q, %v, want %q", reviewer, ok, llm.ClaudeID)
+	}
+
+	svc.reviewerAgent = llm.CodexID
+	if reviewer, ok := svc.ReviewerFor(""); ok {
+		t.Fatalf("expected REVIEWER_AGENT equal to the author to be refused, got %q", reviewer)
+	}
+	if reviewer, ok := svc.ReviewerFor(llm.ClaudeID); !ok || reviewer != llm.CodexID {
+		t.Fatalf("ReviewerFor(claude) = %q, %v", reviewer, ok)
+	}
+
+	solo := &AgentService{enabledAgents: []string{llm.CodexID}, defaultAgent: llm.CodexID}
+	if reviewer, ok := solo.ReviewerFor(""); ok {
+		t.Fatalf("expected no reviewer with a single agent, got %q", reviewer)
+	}
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AgentBudget limits how much agent work may run. Zero means unlimited.
+type AgentBudget struct {
+	TokensPerDay       int `json:"tokens_per_day"`
+	AgentMinutesPerDay int `json:"agent_minutes_per_day"`
+	HopsPerRequest     int `json:"hops_per_request"`
+}
+
+// Budget limit names, as used by /budget and in BudgetExceededError.
+const (
+	BudgetTokens  = "tokens"
+	BudgetMinutes = "minutes"
+	BudgetHops    = "hops"
+)
+
+// With returns a copy of b with the named limit set to value.
+func (b AgentBudget) With(limit string, value int) (AgentBudget, error) {
+	var override budgetOverride
+	if err := override.set(limit, value); err != nil {
+		return b, err
+	}
+	return override.apply(b), nil
+}
+
+// budgetOverride holds the limits set with /budget. Unset (nil) limits keep
+// following the defaults from the environment.
+type budgetOverride struct {
+	TokensPerDay       *int `json:"tokens_per_day,omitempty"`
+	AgentMinutesPerDay *int `json:"agent_minutes_per_day,omitempty"`
+	HopsPerRequest     *int `json:"hops_per_request,omitempty"`
+}
+
+// set sets the named limit to value.
+func (o *budgetOverride) set(limit string, value int) error {
+	if value < 0 {
+		return fmt.Errorf("budget %s must be >= 0", limit)
+	}
+	switch limit {
+	case BudgetTokens:
+		o.TokensPerDay = &value
+	case BudgetMinutes:
+		o.AgentMinutesPerDay = &value
+	case BudgetHops:
+		o.HopsPerRequest = &value
+	default:
+		return fmt.Errorf("unknown budget %q (use %s, %s or %s)", limit, BudgetTokens, BudgetMinutes, BudgetHops)
+	}
+	return nil
+}
+
+// apply returns base with the set limits replaced.
+func (o budgetOverride) apply(base AgentBudget) AgentBudget {
+	if o.TokensPerDay != nil {
+		base.TokensPerDay = *o.TokensPerDay
+	}
+	if o.AgentMinutesPerDay != nil {
+		base.AgentMinutesPerDay = *o.AgentMinutesPerDay
+	}
+	if o.HopsPerRequest != nil {
+		base.HopsPerRequest = *o.HopsPerRequest
+	}
+	return base
+}
+
+func (o budgetOverride) isEmpty() bool {
+	return o.TokensPerDay == nil && o.AgentMinutesPerDay == nil && o.HopsPerRequest == nil
+}
+
+// BudgetExceededError reports which budget stopped an agent run.
+type BudgetExceededError struct {
+	// Scope is "topic" or "global".
+	Scope string
+	// Limit is one of BudgetTokens, BudgetMinutes or BudgetHops.
+	Limit string
+	Used  int
+	Max   int
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s budget exceeded: %d/%d %s", e.Scope, e.Used, e.Max, budgetUnit(e.Limit))
+}
+
+func budgetUnit(limit string) string {
+	switch limit {
+	case BudgetTokens:
+		return "tokens today"
+	case BudgetMinutes:
+		return "agent-minutes today"
+	case BudgetHops:
+		return "hops for this request"
+	default:
+		return limit
+	}
+}
+
+// BudgetStore holds the global budget and per-topic overrides. Defaults come
+// from the environment; limits set with /budget are persisted to path and
+// merged over the defaults, so limits never set keep following the env.
+type BudgetStore struct {
+	path          string
+	globalDefault AgentBudget
+	topicDefault  AgentBudget
+
+	mu     sync.Mutex
+	global budgetOverride
+	topics map[string]budgetOverride
+}
+
+type budgetFile struct {
+	Global *budgetOverride           `json:"global,omitempty"`
+	Topics map[string]budgetOverride `json:"topics,omitempty"`
+}
+
+// NewBudgetStore loads overrides from path on top of the given defaults.
+func NewBudgetStore(path string, global, topicDefault AgentBudget) (*BudgetStore, error) {
+	store := &BudgetStore{
+		path:          path,
+		globalDefault: global,
+		topicDefault:  topicDefault,
+		topics:        make(map[string]budgetOverride),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	var file budgetFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Global != nil {
+		store.global = *file.Global
+	}
+	for topic, override := range file.Topics {
+		store.topics[topic] = override
+	}
+	return store, nil
+}
+
+// Global returns the budget shared by all topics.
+func (s *BudgetStore) Global() AgentBudget {
+	if s == nil {
+		return AgentBudget{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.global.apply(s.globalDefault)
+}
+
+// Topic returns the effective budget for topic.
+func (s *BudgetStore) Topic(topic string) AgentBudget {
+	if s == nil {
+		return AgentBudget{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topics[topic].apply(s.topicDefault)
+}
+
+// SetGlobal sets one limit of the global budget and returns the effective
+// budget.
+func (s *BudgetStore) SetGlobal(limit string, value int) (AgentBudget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	override := s.global
+	if err := override.set(limit, value); err != nil {
+		return s.global.apply(s.globalDefault), err
+	}
+	s.global = override
+	return override.apply(s.globalDefault), s.saveLocked()
+}
+
+// SetTopic sets one limit of topic's budget and returns the effective budget.
+func (s *BudgetStore) SetTopic(topic, limit string, value int) (AgentBudget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	override := s.topics[topic]
+	if err := override.set(limit, value); err != nil {
+		return s.topics[topic].apply(s.topicDefault), err
+	}
+	s.topics[topic] = override
+	return override.apply(s.topicDefault), s.saveLocked()
+}
+
+// saveLocked writes the overrides atomically. Callers must hold s.mu.
+func (s *BudgetStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	file := budgetFile{Topics: s.topics}
+	if !s.global.isEmpty() {
+		global := s.global
+		file.Global = &global
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o775); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, "agent_budgets_*.json")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), s.path)
+}
+
+// budgetFromEnv reads a budget from <prefix>_TOKENS_PER_DAY,
+// <prefix>_AGENT_MINUTES_PER_DAY and <prefix>_HOPS_PER_REQUEST.
+func budgetFromEnv(prefix string) (AgentBudget, error) {
+	var budget AgentBudget
+	fields := []struct {
+		name  string
+		value *int
+	}{
+		{prefix + "_TOKENS_PER_DAY", &budget.TokensPerDay},
+		{prefix + "_AGENT_MINUTES_PER_DAY", &budget.AgentMinutesPerDay},
+		{prefix + "_HOPS_PER_REQUEST", &budget.HopsPerRequest},
+	}
+	for _, field := range fields {
+		raw := strings.TrimSpace(os.Getenv(field.name))
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			return AgentBudget{}, fmt.Errorf("invalid %s %q", field.name, raw)
+		}
+		*field.value = parsed
+	}
+	return budget, nil
+}
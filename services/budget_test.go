@@ -0,0 +1,80 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBudgetStore_OverridesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budgets.json")
+	global := AgentBudget{TokensPerDay: 1000}
+	topicDefault := AgentBudget{HopsPerRequest: 4}
+
+	store, err := NewBudgetStore(path, global, topicDefault)
+	if err != nil {
+		t.Fatalf("NewBudgetStore returned error: %v", err)
+	}
+	if got := store.Topic("1:2"); got != topicDefault {
+		t.Fatalf("Topic() = %#v, want default %#v", got, topicDefault)
+	}
+
+	if _, err := store.SetTopic("1:2", BudgetHops, 8); err != nil {
+		t.Fatalf("SetTopic returned error: %v", err)
+	}
+	if _, err := store.SetGlobal(BudgetTokens, 5000); err != nil {
+		t.Fatalf("SetGlobal returned error: %v", err)
+	}
+
+	reloaded, err := NewBudgetStore(path, global, topicDefault)
+	if err != nil {
+		t.Fatalf("NewBudgetStore reload returned error: %v", err)
+	}
+	if got := reloaded.Topic("1:2").HopsPerRequest; got != 8 {
+		t.Fatalf("topic hops = %d, want 8", got)
+	}
+	if got := reloaded.Topic("1:3"); got != topicDefault {
+		t.Fatalf("other topic = %#v, want default", got)
+	}
+	if got := reloaded.Global().TokensPerDay; got != 5000 {
+		t.Fatalf("global tokens = %d, want 5000", got)
+	}
+}
+
+func TestBudgetStore_UnsetLimitsFollowDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budgets.json")
+	store, err := NewBudgetStore(path, AgentBudget{TokensPerDay: 1000}, AgentBudget{HopsPerRequest: 4})
+	if err != nil {
+		t.Fatalf("NewBudgetStore returned error: %v", err)
+	}
+	if _, err := store.SetGlobal(BudgetMinutes, 60); err != nil {
+		t.Fatalf("SetGlobal returned error: %v", err)
+	}
+	if _, err := store.SetTopic("1:2", BudgetTokens, 0); err != nil {
+		t.Fatalf("SetTopic returned error: %v", err)
+	}
+
+	// The env defaults change after the overrides were saved.
+	reloaded, err := NewBudgetStore(path, AgentBudget{TokensPerDay: 2000, HopsPerRequest: 9}, AgentBudget{TokensPerDay: 300, HopsPerRequest: 6})
+	if err != nil {
+		t.Fatalf("NewBudgetStore reload returned error: %v", err)
+	}
+	if got, want := reloaded.Global(), (AgentBudget{TokensPerDay: 2000, AgentMinutesPerDay: 60, HopsPerRequest: 9}); got != want {
+		t.Fatalf("Global() = %#v, want %#v", got, want)
+	}
+	if got, want := reloaded.Topic("1:2"), (AgentBudget{TokensPerDay: 0, HopsPerRequest: 6}); got != want {
+		t.Fatalf("Topic() = %#v, want %#v", got, want)
+	}
+}
+
+func TestAgentBudgetWith(t *testing.T) {
+	budget, err := AgentBudget{}.With(BudgetMinutes, 30)
+	if err != nil || budget.AgentMinutesPerDay != 30 {
+		t.Fatalf("With(minutes) = %#v, %v", budget, err)
+	}
+	if _, err := budget.With("dollars", 5); err == nil {
+		t.Fatalf("expected unknown limit to be rejected")
+	}
+	if _, err := budget.With(BudgetTokens, -1); err == nil {
+		t.Fatalf("expected negative limit to be rejected")
+	}
+}
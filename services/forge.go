@@ -0,0 +1,913 @@
+package services
+
+import (
+	"bytes"
+	ctx "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Forge is a git hosting service repositories are created on and pull
+// requests are opened against.
+type Forge interface {
+	// Name identifies the forge in messages, e.g. "GitLab".
+	Name() string
+	// CreateRepo creates a private repository and returns its clone URL. An
+	// empty owner creates it under the authenticated user.
+	CreateRepo(runCtx ctx.Context, owner, name string) (string, error)
+	// OpenPullRequest opens a pull (merge) request. When one is already open
+	// for the same branches, that one is updated and returned instead.
+	OpenPullRequest(runCtx ctx.Context, repo ForgeRepo, pr PullRequest) (*PullRequestResult, error)
+}
+
+const (
+	ForgeGitHub = "github"
+	ForgeGitLab = "gitlab"
+	ForgeGitea  = "gitea"
+
+	defaultGitHubURL = "https://github.com"
+	defaultGitLabURL = "https://gitlab.com"
+)
+
+// ForgeRepo identifies a repository on a forge.
+type ForgeRepo struct {
+	// Owner is the user or organization, or the full group path on GitLab.
+	Owner string
+	Name  string
+	// Dir is the local checkout; the gh CLI resolves the repo from it.
+	Dir string
+}
+
+func (r ForgeRepo) FullName() string {
+	return r.Owner + "/" + r.Name
+}
+
+type PullRequest struct {
+	Head  string
+	Base  string
+	Title string
+	Body  string
+	// Draft opens the pull request as a draft. An already open pull request
+	// is converted too, except through the gh CLI; a draft is never marked
+	// ready.
+	Draft bool
+	// Labels are added to the pull request. Gitea ignores them, since its
+	// API takes label IDs.
+	Labels []string
+	// Reviewers are user logins, or "org/team" for GitHub teams, asked to
+	// review. Only GitHub supports them.
+	Reviewers []string
+}
+
+// PullRequestResult describes an opened or updated pull request.
+type PullRequestResult struct {
+	URL    string
+	Number int
+	// Created is false when an already open pull request was reused.
+	Created bool
+	// Updated reports that a reused pull request got the new title and body.
+	Updated bool
+	Draft   bool
+}
+
+// defaultForge returns the forge /new creates repositories on, selected by
+// DEFAULT_FORGE (github when unset), along with its kind.
+func defaultForge() (Forge, string, error) {
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_FORGE")))
+	baseURL := forgeEnvURL(kind)
+	switch kind {
+	case "", ForgeGitHub:
+		kind = ForgeGitHub
+		baseURL = forgeEnvURL(kind)
+		if baseURL == "" {
+			baseURL = defaultGitHubURL
+		}
+	case ForgeGitLab:
+		if baseURL == "" {
+			baseURL = defaultGitLabURL
+		}
+	case ForgeGitea:
+		if baseURL == "" {
+			return nil, "", errors.New("DEFAULT_FORGE=gitea needs GITEA_URL")
+		}
+	}
+	forge, err := newForge(kind, baseURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("DEFAULT_FORGE: %w", err)
+	}
+	return forge, kind, nil
+}
+
+// forgeForRemote returns the forge hosting remoteURL and the repository it
+// points at.
+func forgeForRemote(remoteURL string) (Forge, ForgeRepo, error) {
+	host, path, err := parseRemoteURL(remoteURL)
+	if err != nil {
+		return nil, ForgeRepo{}, err
+	}
+	kind := forgeKindForHost(host)
+	if kind == "" {
+		return nil, ForgeRepo{}, fmt.Errorf("no forge configured for %s; add it to FORGE_HOSTS", host)
+	}
+
+	baseURL := "https://" + host
+	if configured := forgeEnvURL(kind); configured != "" {
+		if u, err := url.Parse(configured); err == nil && strings.EqualFold(u.Hostname(), host) {
+			baseURL = configured
+			// Instances served below a path prefix repeat it in clone URLs.
+			if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+				path = strings.TrimPrefix(path, prefix+"/")
+			}
+		}
+	}
+
+	idx := strings.LastIndex(path, "/")
+	if idx <= 0 || idx == len(path)-1 {
+		return nil, ForgeRepo{}, fmt.Errorf("remote %q does not name an owner and repository", remoteURL)
+	}
+	forge, err := newForge(kind, baseURL)
+	if err != nil {
+		return nil, ForgeRepo{}, err
+	}
+	return forge, ForgeRepo{Owner: path[:idx], Name: path[idx+1:]}, nil
+}
+
+// forgeKindForHost returns the kind of forge serving host, or "" when it is
+// unknown. github.com and gitlab.com are built in, the hosts of GITHUB_URL,
+// GITLAB_URL and GITEA_URL map to their kind, and FORGE_HOSTS adds more as
+// "git.example.com=gitea,gitlab.example.com=gitlab".
+func forgeKindForHost(host string) string {
+	host = strings.ToLower(host)
+	for _, pair := range strings.Split(os.Getenv("FORGE_HOSTS"), ",") {
+		name, kind, ok := strings.Cut(pair, "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), host) {
+			return strings.ToLower(strings.TrimSpace(kind))
+		}
+	}
+	for _, kind := range []string{ForgeGitHub, ForgeGitLab, ForgeGitea} {
+		if u, err := url.Parse(forgeEnvURL(kind)); err == nil && u.Host != "" && strings.EqualFold(u.Hostname(), host) {
+			return kind
+		}
+	}
+	switch host {
+	case "github.com":
+		return ForgeGitHub
+	case "gitlab.com":
+		return ForgeGitLab
+	}
+	return ""
+}
+
+func newForge(kind, baseURL string) (Forge, error) {
+	switch kind {
+	case ForgeGitHub:
+		return newGitHubForge(baseURL), nil
+	case ForgeGitLab:
+		return &GitLabForge{BaseURL: baseURL, Token: forgeToken(kind, urlHost(baseURL))}, nil
+	case ForgeGitea:
+		return &GiteaForge{BaseURL: baseURL, Token: forgeToken(kind, urlHost(baseURL))}, nil
+	default:
+		return nil, fmt.Errorf("unknown forge %q (use %s, %s or %s)", kind, ForgeGitHub, ForgeGitLab, ForgeGitea)
+	}
+}
+
+// newGitHubForge returns the REST client for the GitHub instance at webURL,
+// authenticated with GITHUB_TOKEN when webURL is that token's instance.
+// Without a token it falls back to the gh CLI and its stored login when gh is
+// installed.
+func newGitHubForge(webURL string) Forge {
+	token := forgeToken(ForgeGitHub, urlHost(webURL))
+	if token == "" {
+		if _, err := exec.LookPath("gh"); err == nil {
+			return &GitHubCLIForge{}
+		}
+	}
+	forge := &GitHubForge{Token: token}
+	if u, err := url.Parse(webURL); err == nil && u.Host != "" && !strings.EqualFold(u.Hostname(), "github.com") {
+		// GitHub Enterprise Server serves the API below /api/v3.
+		forge.APIURL = strings.TrimRight(webURL, "/") + "/api/v3"
+	}
+	return forge
+}
+
+func forgeEnvURL(kind string) string {
+	switch kind {
+	case ForgeGitHub:
+		return strings.TrimRight(strings.TrimSpace(os.Getenv("GITHUB_URL")), "/")
+	case ForgeGitLab:
+		return strings.TrimRight(strings.TrimSpace(os.Getenv("GITLAB_URL")), "/")
+	case ForgeGitea:
+		return strings.TrimRight(strings.TrimSpace(os.Getenv("GITEA_URL")), "/")
+	}
+	return ""
+}
+
+// forgeCloneToken returns the API token of the GitLab or Gitea instance
+// hosting repoURL, which both accept as an HTTPS password.
+func forgeCloneToken(repoURL string) string {
+	host, _, err := parseRemoteURL(repoURL)
+	if err != nil {
+		return ""
+	}
+	kind := forgeKindForHost(host)
+	if kind == ForgeGitHub {
+		return ""
+	}
+	return forgeToken(kind, host)
+}
+
+// forgeToken returns the API token of the kind forge at host. GITHUB_TOKEN
+// belongs to the instance at GITHUB_URL (github.com when unset), GITLAB_TOKEN
+// to the one at GITLAB_URL (gitlab.com when unset) and GITEA_TOKEN to the one
+// at GITEA_URL, so other hosts of the same kind, including those mapped with
+// FORGE_HOSTS, never see them.
+func forgeToken(kind, host string) string {
+	var name, instance string
+	switch kind {
+	case ForgeGitHub:
+		name, instance = "GITHUB_TOKEN", forgeEnvURL(kind)
+		if instance == "" {
+			instance = defaultGitHubURL
+		}
+	case ForgeGitLab:
+		name, instance = "GITLAB_TOKEN", forgeEnvURL(kind)
+		if instance == "" {
+			instance = defaultGitLabURL
+		}
+	case ForgeGitea:
+		name, instance = "GITEA_TOKEN", forgeEnvURL(kind)
+	default:
+		return ""
+	}
+	if host == "" || !strings.EqualFold(urlHost(instance), host) {
+		return ""
+	}
+	return strings.TrimSpace(os.Getenv(name))
+}
+
+// urlHost returns the host name of rawURL, or "" when it has none.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// envList splits a comma-separated environment variable, dropping blanks.
+func envList(name string) []string {
+	var out []string
+	for _, part := range strings.Split(os.Getenv(name), ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// parseRemoteURL splits an https, ssh or scp-style ("git@host:owner/repo")
+// remote into its host and repository path without the .git suffix.
+func parseRemoteURL(remote string) (host, path string, err error) {
+	remote = strings.TrimSpace(remote)
+	if !strings.Contains(remote, "://") {
+		userHost, rest, ok := strings.Cut(remote, ":")
+		if !ok {
+			return "", "", fmt.Errorf("unsupported remote URL %q", remote)
+		}
+		if at := strings.LastIndex(userHost, "@"); at >= 0 {
+			userHost = userHost[at+1:]
+		}
+		host, path = userHost, rest
+	} else {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return "", "", fmt.Errorf("unsupported remote URL %q: %w", remote, err)
+		}
+		host, path = u.Hostname(), u.Path
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || path == "" {
+		return "", "", fmt.Errorf("unsupported remote URL %q", remote)
+	}
+	return strings.ToLower(host), path, nil
+}
+
+// ForgeAPIError is a non-2xx response from a forge REST API.
+type ForgeAPIError struct {
+	Forge   string
+	Status  int
+	Message string
+}
+
+func (e *ForgeAPIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s API returned %d", e.Forge, e.Status)
+	}
+	return fmt.Sprintf("%s API returned %d: %s", e.Forge, e.Status, e.Message)
+}
+
+func isForgeStatus(err error, status int) bool {
+	var apiErr *ForgeAPIError
+	return errors.As(err, &apiErr) && apiErr.Status == status
+}
+
+// forgeRequest sends in as JSON to endpoint and decodes the response into out
+// when it is not nil.
+func forgeRequest(runCtx ctx.Context, client *http.Client, forge, method, endpoint string, header http.Header, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(runCtx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s API request failed: %w", forge, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &ForgeAPIError{Forge: forge, Status: resp.StatusCode, Message: forgeErrorMessage(raw)}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s API returned an unexpected response: %w", forge, err)
+	}
+	return nil
+}
+
+// forgeErrorMessage pulls the human readable part out of an API error body.
+// GitLab sends "message" as a string, a list or a field map, and GitHub adds
+// the failed validations under "errors".
+func forgeErrorMessage(raw []byte) string {
+	var parsed map[string]any
+	if err := json.Unmarshal(raw, &parsed); err == nil {
+		for _, key := range []string{"message", "error"} {
+			switch value := parsed[key].(type) {
+			case nil:
+			case string:
+				if details := githubErrorDetails(parsed["errors"]); details != "" {
+					return value + ": " + details
+				}
+				return value
+			default:
+				if encoded, err := json.Marshal(value); err == nil {
+					return string(encoded)
+				}
+			}
+		}
+	}
+	message := strings.TrimSpace(string(raw))
+	if runes := []rune(message); len(runes) > 300 {
+		message = string(runes[:300]) + "…"
+	}
+	return message
+}
+
+func githubErrorDetails(raw any) string {
+	list, _ := raw.([]any)
+	var details []string
+	for _, item := range list {
+		if entry, ok := item.(map[string]any); ok {
+			if message, ok := entry["message"].(string); ok && message != "" {
+				details = append(details, message)
+			}
+		}
+	}
+	return strings.Join(details, "; ")
+}
+
+// GitHubForge talks to the GitHub REST API of github.com or a GitHub
+// Enterprise Server.
+type GitHubForge struct {
+	// APIURL is the API root; empty uses https://api.github.com.
+	APIURL string
+	// Token is a personal access token or app token with repo access.
+	Token string
+	// Client is the HTTP client; nil uses http.DefaultClient.
+	Client *http.Client
+}
+
+// githubPull is the part of a GitHub pull request GoCode reads.
+type githubPull struct {
+	Number  int    `json:"number"`
+	NodeID  string `json:"node_id"`
+	HTMLURL string `json:"html_url"`
+	Draft   bool   `json:"draft"`
+}
+
+func (f *GitHubForge) Name() string {
+	return "GitHub"
+}
+
+func (f *GitHubForge) CreateRepo(runCtx ctx.Context, owner, name string) (string, error) {
+	endpoint := "/user/repos"
+	if owner != "" {
+		var user struct {
+			Login string `json:"login"`
+		}
+		if err := f.request(runCtx, http.MethodGet, "/user", nil, &user); err != nil {
+			return "", fmt.Errorf("failed to resolve the GitHub user: %w", err)
+		}
+		if !strings.EqualFold(user.Login, owner) {
+			endpoint = "/orgs/" + url.PathEscape(owner) + "/repos"
+		}
+	}
+
+	var repo struct {
+		CloneURL string `json:"clone_url"`
+	}
+	if err := f.request(runCtx, http.MethodPost, endpoint, map[string]any{"name": name, "private": true}, &repo); err != nil {
+		return "", fmt.Errorf("failed to create GitHub repository: %w", err)
+	}
+	if repo.CloneURL == "" {
+		return "", errors.New("repository created, but returned an empty URL")
+	}
+	return repo.CloneURL, nil
+}
+
+func (f *GitHubForge) OpenPullRequest(runCtx ctx.Context, repo ForgeRepo, pr PullRequest) (*PullRequestResult, error) {
+	endpoint := "/repos/" + url.PathEscape(repo.Owner) + "/" + url.PathEscape(repo.Name) + "/pulls"
+	var pull githubPull
+	created := true
+	err := f.request(runCtx, http.MethodPost, endpoint, map[string]any{
+		"head":  pr.Head,
+		"base":  pr.Base,
+		"title": pr.Title,
+		"body":  pr.Body,
+		"draft": pr.Draft,
+	}, &pull)
+	if err != nil {
+		// GitHub answers 422 both for an existing pull request and for
+		// branches without new commits, so look before reporting it.
+		if !isForgeStatus(err, http.StatusUnprocessableEntity) {
+			return nil, fmt.Errorf("failed to create PR: %w", err)
+		}
+		query := url.Values{"state": {"open"}, "head": {repo.Owner + ":" + pr.Head}, "base": {pr.Base}}
+		var open []githubPull
+		if listErr := f.request(runCtx, http.MethodGet, endpoint+"?"+query.Encode(), nil, &open); listErr != nil || len(open) == 0 {
+			return nil, fmt.Errorf("failed to create PR: %w", err)
+		}
+		pull, created = open[0], false
+	}
+
+	updated := false
+	if !created {
+		// Bring the reused pull request in line with the new commit.
+		pullPath := endpoint + "/" + strconv.Itoa(pull.Number)
+		if err := f.request(runCtx, http.MethodPatch, pullPath, map[string]any{"title": pr.Title, "body": pr.Body}, &pull); err != nil {
+			log.Warn().Err(err).Str("pr", pull.HTMLURL).Msg("failed to update PR")
+		} else {
+			updated = true
+		}
+		if pr.Draft && !pull.Draft {
+			if err := f.convertToDraft(runCtx, pull.NodeID); err != nil {
+				log.Warn().Err(err).Str("pr", pull.HTMLURL).Msg("failed to convert PR to draft")
+			} else {
+				pull.Draft = true
+			}
+		}
+	}
+
+	// The pull request exists at this point, so labels and reviewers that
+	// cannot be set are logged rather than failing the commit flow.
+	if len(pr.Labels) > 0 {
+		labelsPath := "/repos/" + url.PathEscape(repo.Owner) + "/" + url.PathEscape(repo.Name) + "/issues/" + strconv.Itoa(pull.Number) + "/labels"
+		if err := f.request(runCtx, http.MethodPost, labelsPath, map[string]any{"labels": pr.Labels}, nil); err != nil {
+			log.Warn().Err(err).Str("pr", pull.HTMLURL).Msg("failed to add PR labels")
+		}
+	}
+	if len(pr.Reviewers) > 0 {
+		users, teams := []string{}, []string{}
+		for _, reviewer := range pr.Reviewers {
+			if _, team, ok := strings.Cut(reviewer, "/"); ok {
+				teams = append(teams, team)
+			} else {
+				users = append(users, reviewer)
+			}
+		}
+		reviewersPath := endpoint + "/" + strconv.Itoa(pull.Number) + "/requested_reviewers"
+		if err := f.request(runCtx, http.MethodPost, reviewersPath, map[string]any{"reviewers": users, "team_reviewers": teams}, nil); err != nil {
+			log.Warn().Err(err).Str("pr", pull.HTMLURL).Msg("failed to request PR reviewers")
+		}
+	}
+
+	return &PullRequestResult{URL: pull.HTMLURL, Number: pull.Number, Created: created, Updated: updated, Draft: pull.Draft}, nil
+}
+
+// convertToDraft turns an open pull request back into a draft. The REST API
+// cannot change the draft state, so this goes through GraphQL.
+func (f *GitHubForge) convertToDraft(runCtx ctx.Context, nodeID string) error {
+	if nodeID == "" {
+		return errors.New("pull request has no node id")
+	}
+	// GitHub Enterprise Server serves GraphQL at /api/graphql, next to the
+	// REST API at /api/v3.
+	graphqlURL := strings.TrimRight(f.apiURL(), "/") + "/graphql"
+	if base, ok := strings.CutSuffix(strings.TrimRight(f.apiURL(), "/"), "/api/v3"); ok {
+		graphqlURL = base + "/api/graphql"
+	}
+	var out struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err := f.send(runCtx, http.MethodPost, graphqlURL, map[string]any{
+		"query":     "mutation($id: ID!) { convertPullRequestToDraft(input: {pullRequestId: $id}) { pullRequest { isDraft } } }",
+		"variables": map[string]string{"id": nodeID},
+	}, &out)
+	if err != nil {
+		return err
+	}
+	if len(out.Errors) > 0 {
+		return errors.New(out.Errors[0].Message)
+	}
+	return nil
+}
+
+func (f *GitHubForge) apiURL() string {
+	if f.APIURL == "" {
+		return "https://api.github.com"
+	}
+	return f.APIURL
+}
+
+func (f *GitHubForge) request(runCtx ctx.Context, method, path string, in, out any) error {
+	return f.send(runCtx, method, strings.TrimRight(f.apiURL(), "/")+path, in, out)
+}
+
+func (f *GitHubForge) send(runCtx ctx.Context, method, endpoint string, in, out any) error {
+	if f.Token == "" {
+		return errors.New("GITHUB_TOKEN is not set")
+	}
+	header := http.Header{
+		"Authorization":        {"Bearer " + f.Token},
+		"Accept":               {"application/vnd.github+json"},
+		"X-Github-Api-Version": {"2022-11-28"},
+	}
+	return forgeRequest(runCtx, f.Client, f.Name(), method, endpoint, header, in, out)
+}
+
+// GitHubCLIForge talks to GitHub through the gh CLI and its stored login. It
+// is used when there is no GITHUB_TOKEN for the remote's host.
+type GitHubCLIForge struct{}
+
+func (f *GitHubCLIForge) Name() string {
+	return "GitHub"
+}
+
+func (f *GitHubCLIForge) CreateRepo(runCtx ctx.Context, owner, name string) (string, error) {
+	if _, err := exec.LookPath("gh"); err != nil {
+		return "", errors.New("GitHub CLI (gh) is required to create a repository")
+	}
+	fullName := name
+	if owner != "" {
+		fullName = owner + "/" + name
+	}
+
+	createCmd := exec.CommandContext(runCtx, "gh", "repo", "create", fullName, "--private")
+	createOut, createErr := createCmd.CombinedOutput()
+	if createErr != nil {
+		msg := strings.TrimSpace(string(createOut))
+		if msg == "" {
+			return "", fmt.Errorf("failed to create GitHub repository: %w", createErr)
+		}
+		return "", fmt.Errorf("failed to create GitHub repository: %s", msg)
+	}
+
+	viewCmd := exec.CommandContext(runCtx, "gh", "repo", "view", fullName, "--json", "url", "--jq", ".url")
+	viewOut, viewErr := viewCmd.CombinedOutput()
+	if viewErr != nil {
+		msg := strings.TrimSpace(string(viewOut))
+		if msg == "" {
+			return "", fmt.Errorf("repository created, but failed to resolve its URL: %w", viewErr)
+		}
+		return "", fmt.Errorf("repository created, but failed to resolve its URL: %s", msg)
+	}
+
+	repoURL := strings.TrimSpace(string(viewOut))
+	if repoURL == "" {
+		return "", errors.New("repository created, but returned an empty URL")
+	}
+	return repoURL, nil
+}
+
+func (f *GitHubCLIForge) OpenPullRequest(runCtx ctx.Context, repo ForgeRepo, pr PullRequest) (*PullRequestResult, error) {
+	if _, err := exec.LookPath("gh"); err != nil {
+		return nil, errors.New("set GITHUB_TOKEN or install the GitHub CLI (gh) to open a PR")
+	}
+
+	args := []string{"pr", "create",
+		"--base", pr.Base,
+		"--head", pr.Head,
+		"--title", pr.Title,
+		"--body", pr.Body,
+	}
+	if pr.Draft {
+		args = append(args, "--draft")
+	}
+	for _, label := range pr.Labels {
+		args = append(args, "--label", label)
+	}
+	for _, reviewer := range pr.Reviewers {
+		args = append(args, "--reviewer", reviewer)
+	}
+	cmd := exec.CommandContext(runCtx, "gh", args...)
+	cmd.Dir = repo.Dir
+	output, err := cmd.CombinedOutput()
+	out := strings.TrimSpace(string(output))
+	if url := extractGitHubURL(out); url != "" {
+		return &PullRequestResult{URL: url, Number: pullNumberFromURL(url), Created: err == nil, Draft: pr.Draft && err == nil}, nil
+	}
+	if err == nil {
+		return nil, errors.New("failed to create PR: empty response")
+	}
+
+	existingURL, viewErr := f.existingPullRequestURL(runCtx, repo, pr)
+	if viewErr == nil && existingURL != "" {
+		return &PullRequestResult{URL: existingURL, Number: pullNumberFromURL(existingURL)}, nil
+	}
+
+	if out == "" {
+		return nil, fmt.Errorf("failed to create PR: %w", err)
+	}
+	return nil, fmt.Errorf("failed to create PR: %s", out)
+}
+
+func (f *GitHubCLIForge) existingPullRequestURL(runCtx ctx.Context, repo ForgeRepo, pr PullRequest) (string, error) {
+	cmd := exec.CommandContext(runCtx, "gh", "pr", "list",
+		"--head", pr.Head,
+		"--base", pr.Base,
+		"--state", "open",
+		"--json", "url",
+		"--jq", ".[0].url",
+	)
+	cmd.Dir = repo.Dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// pullNumberFromURL returns the number at the end of a pull request URL, or 0.
+func pullNumberFromURL(prURL string) int {
+	number, err := strconv.Atoi(prURL[strings.LastIndex(prURL, "/")+1:])
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+// GitLabForge talks to the GitLab REST API (v4) of gitlab.com or a
+// self-managed instance.
+type GitLabForge struct {
+	// BaseURL is the instance web URL, e.g. "https://gitlab.example.com".
+	BaseURL string
+	// Token is a personal or project access token with the api scope.
+	Token string
+	// Client is the HTTP client; nil uses http.DefaultClient.
+	Client *http.Client
+}
+
+func (f *GitLabForge) Name() string {
+	return "GitLab"
+}
+
+func (f *GitLabForge) CreateRepo(runCtx ctx.Context, owner, name string) (string, error) {
+	body := map[string]any{
+		"name":       name,
+		"path":       name,
+		"visibility": "private",
+	}
+	if owner != "" {
+		var namespace struct {
+			ID int64 `json:"id"`
+		}
+		if err := f.request(runCtx, http.MethodGet, "/namespaces/"+url.PathEscape(owner), nil, &namespace); err != nil {
+			return "", fmt.Errorf("failed to resolve GitLab namespace %q: %w", owner, err)
+		}
+		body["namespace_id"] = namespace.ID
+	}
+
+	var project struct {
+		HTTPURL string `json:"http_url_to_repo"`
+	}
+	if err := f.request(runCtx, http.MethodPost, "/projects", body, &project); err != nil {
+		return "", fmt.Errorf("failed to create GitLab project: %w", err)
+	}
+	if project.HTTPURL == "" {
+		return "", errors.New("project created, but returned an empty URL")
+	}
+	return project.HTTPURL, nil
+}
+
+// gitlabMergeRequest is the part of a GitLab merge request GoCode reads.
+type gitlabMergeRequest struct {
+	IID    int    `json:"iid"`
+	WebURL string `json:"web_url"`
+	Draft  bool   `json:"draft"`
+}
+
+func (f *GitLabForge) OpenPullRequest(runCtx ctx.Context, repo ForgeRepo, pr PullRequest) (*PullRequestResult, error) {
+	endpoint := "/projects/" + url.PathEscape(repo.FullName()) + "/merge_requests"
+	title := pr.Title
+	if pr.Draft {
+		title = "Draft: " + title
+	}
+	var created gitlabMergeRequest
+	err := f.request(runCtx, http.MethodPost, endpoint, map[string]string{
+		"source_branch": pr.Head,
+		"target_branch": pr.Base,
+		"title":         title,
+		"description":   pr.Body,
+		"labels":        strings.Join(pr.Labels, ","),
+	}, &created)
+	if err == nil {
+		return &PullRequestResult{URL: created.WebURL, Number: created.IID, Created: true, Draft: created.Draft}, nil
+	}
+	if !isForgeStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("failed to create merge request: %w", err)
+	}
+
+	query := url.Values{"state": {"opened"}, "source_branch": {pr.Head}, "target_branch": {pr.Base}}
+	var existing []gitlabMergeRequest
+	if listErr := f.request(runCtx, http.MethodGet, endpoint+"?"+query.Encode(), nil, &existing); listErr != nil || len(existing) == 0 {
+		return nil, fmt.Errorf("failed to create merge request: %w", err)
+	}
+	mr := existing[0]
+
+	// Bring the reused merge request in line with the new commit. GitLab
+	// drafts are marked by the title prefix, so an existing draft keeps it.
+	title = pr.Title
+	if pr.Draft || mr.Draft {
+		title = "Draft: " + title
+	}
+	update := map[string]string{"title": title, "description": pr.Body}
+	if len(pr.Labels) > 0 {
+		update["add_labels"] = strings.Join(pr.Labels, ",")
+	}
+	updated := false
+	if err := f.request(runCtx, http.MethodPut, endpoint+"/"+strconv.Itoa(mr.IID), update, &mr); err != nil {
+		log.Warn().Err(err).Str("mr", mr.WebURL).Msg("failed to update merge request")
+	} else {
+		updated = true
+	}
+	return &PullRequestResult{URL: mr.WebURL, Number: mr.IID, Updated: updated, Draft: mr.Draft}, nil
+}
+
+func (f *GitLabForge) request(runCtx ctx.Context, method, path string, in, out any) error {
+	if f.Token == "" {
+		return errors.New("GITLAB_TOKEN is not set")
+	}
+	header := http.Header{"Private-Token": {f.Token}}
+	return forgeRequest(runCtx, f.Client, f.Name(), method, strings.TrimRight(f.BaseURL, "/")+"/api/v4"+path, header, in, out)
+}
+
+// GiteaForge talks to the REST API (v1) of a Gitea or Forgejo instance.
+type GiteaForge struct {
+	// BaseURL is the instance web URL, e.g. "https://git.example.com".
+	BaseURL string
+	// Token is an access token with repository write access.
+	Token string
+	// Client is the HTTP client; nil uses http.DefaultClient.
+	Client *http.Client
+}
+
+func (f *GiteaForge) Name() string {
+	return "Gitea"
+}
+
+func (f *GiteaForge) CreateRepo(runCtx ctx.Context, owner, name string) (string, error) {
+	endpoint := "/user/repos"
+	if owner != "" {
+		var user struct {
+			Login string `json:"login"`
+		}
+		if err := f.request(runCtx, http.MethodGet, "/user", nil, &user); err != nil {
+			return "", fmt.Errorf("failed to resolve the Gitea user: %w", err)
+		}
+		if !strings.EqualFold(user.Login, owner) {
+			endpoint = "/orgs/" + url.PathEscape(owner) + "/repos"
+		}
+	}
+
+	var repo struct {
+		CloneURL string `json:"clone_url"`
+	}
+	if err := f.request(runCtx, http.MethodPost, endpoint, map[string]any{"name": name, "private": true}, &repo); err != nil {
+		return "", fmt.Errorf("failed to create Gitea repository: %w", err)
+	}
+	if repo.CloneURL == "" {
+		return "", errors.New("repository created, but returned an empty URL")
+	}
+	return repo.CloneURL, nil
+}
+
+func (f *GiteaForge) OpenPullRequest(runCtx ctx.Context, repo ForgeRepo, pr PullRequest) (*PullRequestResult, error) {
+	endpoint := "/repos/" + url.PathEscape(repo.Owner) + "/" + url.PathEscape(repo.Name) + "/pulls"
+	title := pr.Title
+	if pr.Draft {
+		// Gitea marks pull requests with a WIP title prefix as drafts.
+		title = "WIP: " + title
+	}
+	var created struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	err := f.request(runCtx, http.MethodPost, endpoint, map[string]string{
+		"head":  pr.Head,
+		"base":  pr.Base,
+		"title": title,
+		"body":  pr.Body,
+	}, &created)
+	if err == nil {
+		return &PullRequestResult{URL: created.HTMLURL, Number: created.Number, Created: true, Draft: pr.Draft}, nil
+	}
+	if !isForgeStatus(err, http.StatusConflict) {
+		return nil, fmt.Errorf("failed to create PR: %w", err)
+	}
+
+	var open []struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+		Title   string `json:"title"`
+		Head    struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	}
+	if listErr := f.request(runCtx, http.MethodGet, endpoint+"?state=open&limit=50", nil, &open); listErr == nil {
+		for _, candidate := range open {
+			if candidate.Head.Ref != pr.Head || candidate.Base.Ref != pr.Base {
+				continue
+			}
+			// Bring the reused pull request in line with the new commit,
+			// keeping the WIP prefix of an existing draft.
+			draft := pr.Draft || isGiteaDraftTitle(candidate.Title)
+			title := pr.Title
+			if draft {
+				title = "WIP: " + title
+			}
+			updated := false
+			pullPath := endpoint + "/" + strconv.Itoa(candidate.Number)
+			if err := f.request(runCtx, http.MethodPatch, pullPath, map[string]string{"title": title, "body": pr.Body}, nil); err != nil {
+				log.Warn().Err(err).Str("pr", candidate.HTMLURL).Msg("failed to update PR")
+				draft = isGiteaDraftTitle(candidate.Title)
+			} else {
+				updated = true
+			}
+			return &PullRequestResult{URL: candidate.HTMLURL, Number: candidate.Number, Updated: updated, Draft: draft}, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to create PR: %w", err)
+}
+
+// isGiteaDraftTitle reports whether title has one of Gitea's default
+// work-in-progress prefixes.
+func isGiteaDraftTitle(title string) bool {
+	upper := strings.ToUpper(strings.TrimSpace(title))
+	return strings.HasPrefix(upper, "WIP:") || strings.HasPrefix(upper, "[WIP]")
+}
+
+func (f *GiteaForge) request(runCtx ctx.Context, method, path string, in, out any) error {
+	if f.Token == "" {
+		return errors.New("GITEA_TOKEN is not set")
+	}
+	header := http.Header{"Authorization": {"token " + f.Token}}
+	return forgeRequest(runCtx, f.Client, f.Name(), method, strings.TrimRight(f.BaseURL, "/")+"/api/v1"+path, header, in, out)
+}
@@ -0,0 +1,417 @@
+package services
+
+import (
+	ctx "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeForgeAPI serves canned JSON responses keyed by "METHOD escaped-path"
+// and records the request bodies it received.
+type fakeForgeAPI struct {
+	t         *testing.T
+	header    string
+	token     string
+	responses map[string]fakeForgeResponse
+	bodies    map[string]map[string]any
+}
+
+type fakeForgeResponse struct {
+	status int
+	body   string
+}
+
+func newFakeForgeAPI(t *testing.T, header, token string, responses map[string]fakeForgeResponse) (*fakeForgeAPI, *httptest.Server) {
+	api := &fakeForgeAPI{t: t, header: header, token: token, responses: responses, bodies: map[string]map[string]any{}}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return api, server
+}
+
+func (api *fakeForgeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if got := r.Header.Get(api.header); got != api.token {
+		api.t.Errorf("%s %s: %s header = %q, want %q", r.Method, r.URL, api.header, got, api.token)
+	}
+	key := r.Method + " " + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		key += "?" + r.URL.RawQuery
+	}
+	if r.Body != nil {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+			api.bodies[key] = body
+		}
+	}
+	resp, ok := api.responses[key]
+	if !ok {
+		api.t.Errorf("unexpected request %s", key)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	w.Write([]byte(resp.body))
+}
+
+func TestGitLabForge_CreateRepoAndMergeRequest(t *testing.T) {
+	api, server := newFakeForgeAPI(t, "PRIVATE-TOKEN", "glpat-test", map[string]fakeForgeResponse{
+		"GET /api/v4/namespaces/platform%2Ftools":                     {http.StatusOK, `{"id": 42}`},
+		"POST /api/v4/projects":                                       {http.StatusCreated, `{"http_url_to_repo": "https://gitlab.example.com/platform/tools/app.git"}`},
+		"POST /api/v4/projects/platform%2Ftools%2Fapp/merge_requests": {http.StatusCreated, `{"iid": 3, "draft": true, "web_url": "https://gitlab.example.com/platform/tools/app/-/merge_requests/3"}`},
+	})
+	forge := &GitLabForge{BaseURL: server.URL, Token: "glpat-test"}
+
+	repoURL, err := forge.CreateRepo(ctx.Background(), "platform/tools", "app")
+	if err != nil {
+		t.Fatalf("CreateRepo returned error: %v", err)
+	}
+	if repoURL != "https://gitlab.example.com/platform/tools/app.git" {
+		t.Fatalf("CreateRepo() = %q", repoURL)
+	}
+	created := api.bodies["POST /api/v4/projects"]
+	if created["namespace_id"] != float64(42) || created["visibility"] != "private" || created["path"] != "app" {
+		t.Fatalf("unexpected project request: %#v", created)
+	}
+
+	result, err := forge.OpenPullRequest(ctx.Background(), ForgeRepo{Owner: "platform/tools", Name: "app"}, PullRequest{Head: "feature/login", Base: "main", Title: "Add login", Body: "Details", Draft: true, Labels: []string{"bot", "auth"}})
+	if err != nil {
+		t.Fatalf("OpenPullRequest returned error: %v", err)
+	}
+	if result.URL != "https://gitlab.example.com/platform/tools/app/-/merge_requests/3" || result.Number != 3 || !result.Created || !result.Draft {
+		t.Fatalf("OpenPullRequest() = %#v", result)
+	}
+	mr := api.bodies["POST /api/v4/projects/platform%2Ftools%2Fapp/merge_requests"]
+	if mr["source_branch"] != "feature/login" || mr["target_branch"] != "main" || mr["description"] != "Details" ||
+		mr["title"] != "Draft: Add login" || mr["labels"] != "bot,auth" {
+		t.Fatalf("unexpected merge request: %#v", mr)
+	}
+}
+
+func TestGitLabForge_ReturnsExistingMergeRequest(t *testing.T) {
+	api, server := newFakeForgeAPI(t, "PRIVATE-TOKEN", "glpat-test", map[string]fakeForgeResponse{
+		"POST /api/v4/projects/acme%2Fapp/merge_requests":                                                      {http.StatusConflict, `{"message": ["Another open merge request already exists for this source branch: !7"]}`},
+		"GET /api/v4/projects/acme%2Fapp/merge_requests?source_branch=feature&state=opened&target_branch=main": {http.StatusOK, `[{"iid": 7, "web_url": "https://gitlab.com/acme/app/-/merge_requests/7", "draft": true}]`},
+		"PUT /api/v4/projects/acme%2Fapp/merge_requests/7":                                                     {http.StatusOK, `{"iid": 7, "web_url": "https://gitlab.com/acme/app/-/merge_requests/7", "draft": true}`},
+	})
+	forge := &GitLabForge{BaseURL: server.URL, Token: "glpat-test"}
+
+	got, err := forge.OpenPullRequest(ctx.Background(), ForgeRepo{Owner: "acme", Name: "app"}, PullRequest{Head: "feature", Base: "main", Title: "t", Body: "b", Labels: []string{"bot"}})
+	if err != nil {
+		t.Fatalf("OpenPullRequest returned error: %v", err)
+	}
+	if got.URL != "https://gitlab.com/acme/app/-/merge_requests/7" || got.Number != 7 || got.Created || !got.Updated || !got.Draft {
+		t.Fatalf("OpenPullRequest() = %#v", got)
+	}
+	update := api.bodies["PUT /api/v4/projects/acme%2Fapp/merge_requests/7"]
+	if update["title"] != "Draft: t" || update["description"] != "b" || update["add_labels"] != "bot" {
+		t.Fatalf("unexpected merge request update: %#v", update)
+	}
+}
+
+func TestGitHubForge_CreateRepo(t *testing.T) {
+	api, server := newFakeForgeAPI(t, "Authorization", "Bearer ghp-test", map[string]fakeForgeResponse{
+		"GET /user":             {http.StatusOK, `{"login": "octocat"}`},
+		"POST /orgs/acme/repos": {http.StatusCreated, `{"clone_url": "https://github.com/acme/app.git"}`},
+		"POST /user/repos":      {http.StatusCreated, `{"clone_url": "https://github.com/octocat/notes.git"}`},
+	})
+	forge := &GitHubForge{APIURL: server.URL, Token: "ghp-test"}
+
+	got, err := forge.CreateRepo(ctx.Background(), "acme", "app")
+	if err != nil || got != "https://github.com/acme/app.git" {
+		t.Fatalf("CreateRepo for an organization = %q, %v", got, err)
+	}
+	if body := api.bodies["POST /orgs/acme/repos"]; body["name"] != "app" || body["private"] != true {
+		t.Fatalf("unexpected repo request: %#v", body)
+	}
+	got, err = forge.CreateRepo(ctx.Background(), "OctoCat", "notes")
+	if err != nil || got != "https://github.com/octocat/notes.git" {
+		t.Fatalf("CreateRepo for the token owner = %q, %v", got, err)
+	}
+}
+
+func TestGitHubForge_OpenPullRequest(t *testing.T) {
+	api, server := newFakeForgeAPI(t, "Authorization", "Bearer ghp-test", map[string]fakeForgeResponse{
+		"POST /repos/acme/app/pulls":                        {http.StatusCreated, `{"number": 12, "draft": true, "html_url": "https://github.com/acme/app/pull/12"}`},
+		"POST /repos/acme/app/issues/12/labels":             {http.StatusOK, `[]`},
+		"POST /repos/acme/app/pulls/12/requested_reviewers": {http.StatusCreated, `{}`},
+	})
+	forge := &GitHubForge{APIURL: server.URL, Token: "ghp-test"}
+
+	result, err := forge.OpenPullRequest(ctx.Background(), ForgeRepo{Owner: "acme", Name: "app"}, PullRequest{
+		Head: "feature", Base: "main", Title: "Add login", Body: "Details", Draft: true,
+		Labels: []string{"bot"}, Reviewers: []string{"alice", "acme/backend"},
+	})
+	if err != nil {
+		t.Fatalf("OpenPullRequest returned error: %v", err)
+	}
+	want := PullRequestResult{URL: "https://github.com/acme/app/pull/12", Number: 12, Created: true, Draft: true}
+	if *result != want {
+		t.Fatalf("OpenPullRequest() = %#v, want %#v", *result, want)
+	}
+	if body := api.bodies["POST /repos/acme/app/pulls"]; body["draft"] != true || body["head"] != "feature" || body["title"] != "Add login" {
+		t.Fatalf("unexpected pull request: %#v", body)
+	}
+	if body := api.bodies["POST /repos/acme/app/issues/12/labels"]; fmt.Sprint(body["labels"]) != "[bot]" {
+		t.Fatalf("unexpected labels request: %#v", body)
+	}
+	body := api.bodies["POST /repos/acme/app/pulls/12/requested_reviewers"]
+	if fmt.Sprint(body["reviewers"]) != "[alice]" || fmt.Sprint(body["team_reviewers"]) != "[backend]" {
+		t.Fatalf("unexpected reviewers request: %#v", body)
+	}
+}
+
+func TestGitHubForge_ReusesOpenPullRequest(t *testing.T) {
+	api, server := newFakeForgeAPI(t, "Authorization", "Bearer ghp-test", map[string]fakeForgeResponse{
+		"POST /repos/acme/app/pulls":                                         {http.StatusUnprocessableEntity, `{"message": "Validation Failed", "errors": [{"message": "A pull request already exists for acme:feature."}]}`},
+		"GET /repos/acme/app/pulls?base=main&head=acme%3Afeature&state=open": {http.StatusOK, `[{"number": 9, "node_id": "PR_kw9", "html_url": "https://github.com/acme/app/pull/9"}]`},
+		"PATCH /repos/acme/app/pulls/9":                                      {http.StatusOK, `{"number": 9, "node_id": "PR_kw9", "html_url": "https://github.com/acme/app/pull/9"}`},
+		"POST /graphql":                                                      {http.StatusOK, `{"data": {"convertPullRequestToDraft": {"pullRequest": {"isDraft": true}}}}`},
+		"POST /repos/acme/lib/pulls":                                         {http.StatusUnprocessableEntity, `{"message": "Validation Failed", "errors": [{"message": "No commits between main and feature"}]}`},
+		"GET /repos/acme/lib/pulls?base=main&head=acme%3Afeature&state=open": {http.StatusOK, `[]`},
+	})
+	forge := &GitHubForge{APIURL: server.URL, Token: "ghp-test"}
+	pr := PullRequest{Head: "feature", Base: "main", Title: "Add login", Body: "Details", Draft: true}
+
+	result, err := forge.OpenPullRequest(ctx.Background(), ForgeRepo{Owner: "acme", Name: "app"}, pr)
+	if err != nil {
+		t.Fatalf("OpenPullRequest returned error: %v", err)
+	}
+	want := PullRequestResult{URL: "https://github.com/acme/app/pull/9", Number: 9, Updated: true, Draft: true}
+	if *result != want {
+		t.Fatalf("OpenPullRequest() = %#v, want %#v", *result, want)
+	}
+	if body := api.bodies["PATCH /repos/acme/app/pulls/9"]; body["title"] != "Add login" || body["body"] != "Details" {
+		t.Fatalf("unexpected pull request update: %#v", body)
+	}
+	if body := api.bodies["POST /graphql"]; !strings.Contains(fmt.Sprint(body["query"]), "convertPullRequestToDraft") || fmt.Sprint(body["variables"]) != "map[id:PR_kw9]" {
+		t.Fatalf("unexpected draft conversion: %#v", body)
+	}
+
+	_, err = forge.OpenPullRequest(ctx.Background(), ForgeRepo{Owner: "acme", Name: "lib"}, pr)
+	if err == nil || !strings.Contains(err.Error(), "No commits between main and feature") {
+		t.Fatalf("expected the validation error to be reported, got %v", err)
+	}
+}
+
+func TestGiteaForge_CreateRepo(t *testing.T) {
+	api, server := newFakeForgeAPI(t, "Authorization", "token gitea-test", map[string]fakeForgeResponse{
+		"GET /api/v1/user":             {http.StatusOK, `{"login": "alice"}`},
+		"POST /api/v1/user/repos":      {http.StatusCreated, `{"clone_url": "https://git.example.com/alice/notes.git"}`},
+		"POST /api/v1/orgs/team/repos": {http.StatusCreated, `{"clone_url": "https://git.example.com/team/app.git"}`},
+	})
+	forge := &GiteaForge{BaseURL: server.URL, Token: "gitea-test"}
+
+	got, err := forge.CreateRepo(ctx.Background(), "Alice", "notes")
+	if err != nil || got != "https://git.example.com/alice/notes.git" {
+		t.Fatalf("CreateRepo for the token owner = %q, %v", got, err)
+	}
+	got, err = forge.CreateRepo(ctx.Background(), "team", "app")
+	if err != nil || got != "https://git.example.com/team/app.git" {
+		t.Fatalf("CreateRepo for an organization = %q, %v", got, err)
+	}
+	if body := api.bodies["POST /api/v1/orgs/team/repos"]; body["name"] != "app" || body["private"] != true {
+		t.Fatalf("unexpected repo request: %#v", body)
+	}
+}
+
+func TestGiteaForge_PullRequests(t *testing.T) {
+	api, server := newFakeForgeAPI(t, "Authorization", "token gitea-test", map[string]fakeForgeResponse{
+		"POST /api/v1/repos/team/app/pulls":    {http.StatusConflict, `{"message": "pull request already exists for these targets"}`},
+		"PATCH /api/v1/repos/team/app/pulls/2": {http.StatusCreated, `{"number": 2}`},
+		"GET /api/v1/repos/team/app/pulls?state=open&limit=50": {http.StatusOK, `[
+			{"html_url": "https://git.example.com/team/app/pulls/1", "head": {"ref": "other"}, "base": {"ref": "main"}},
+			{"number": 2, "html_url": "https://git.example.com/team/app/pulls/2", "head": {"ref": "feature"}, "base": {"ref": "main"}}
+		]`},
+		"POST /api/v1/repos/team/lib/pulls": {http.StatusForbidden, `{"message": "user does not have write access"}`},
+	})
+	forge := &GiteaForge{BaseURL: server.URL, Token: "gitea-test"}
+	pr := PullRequest{Head: "feature", Base: "main", Title: "t", Body: "b"}
+
+	got, err := forge.OpenPullRequest(ctx.Background(), ForgeRepo{Owner: "team", Name: "app"}, pr)
+	if err != nil || got.URL != "https://git.example.com/team/app/pulls/2" || got.Created || !got.Updated {
+		t.Fatalf("expected the existing PR to be updated, got %#v, %v", got, err)
+	}
+	if update := api.bodies["PATCH /api/v1/repos/team/app/pulls/2"]; update["title"] != "t" || update["body"] != "b" {
+		t.Fatalf("unexpected PR update: %#v", update)
+	}
+
+	_, err = forge.OpenPullRequest(ctx.Background(), ForgeRepo{Owner: "team", Name: "lib"}, pr)
+	if err == nil || !isForgeStatus(err, http.StatusForbidden) || !strings.Contains(err.Error(), "write access") {
+		t.Fatalf("expected the API error to be reported, got %v", err)
+	}
+}
+
+func TestGiteaForge_RequiresToken(t *testing.T) {
+	forge := &GiteaForge{BaseURL: "http://127.0.0.1:1"}
+	if _, err := forge.CreateRepo(ctx.Background(), "", "app"); err == nil || !strings.Contains(err.Error(), "GITEA_TOKEN") {
+		t.Fatalf("expected a missing token error, got %v", err)
+	}
+}
+
+func TestParseRemoteURL(t *testing.T) {
+	tests := []struct {
+		remote, host, path string
+	}{
+		{"https://github.com/acme/app.git", "github.com", "acme/app"},
+		{"git@git.example.com:team/app.git", "git.example.com", "team/app"},
+		{"ssh://git@git.example.com:2222/team/app.git", "git.example.com", "team/app"},
+		{"https://GitLab.example.com/group/sub/app/", "gitlab.example.com", "group/sub/app"},
+	}
+	for _, tt := range tests {
+		host, path, err := parseRemoteURL(tt.remote)
+		if err != nil || host != tt.host || path != tt.path {
+			t.Fatalf("parseRemoteURL(%q) = %q, %q, %v", tt.remote, host, path, err)
+		}
+	}
+	if _, _, err := parseRemoteURL("/srv/repos/app"); err == nil {
+		t.Fatalf("expected a local path to be rejected")
+	}
+}
+
+func TestForgeForRemote(t *testing.T) {
+	t.Setenv("GITEA_URL", "https://git.example.com/gitea")
+	t.Setenv("GITLAB_URL", "")
+	t.Setenv("FORGE_HOSTS", "code.internal=gitlab")
+
+	forge, repo, err := forgeForRemote("https://git.example.com/gitea/team/app.git")
+	if err != nil {
+		t.Fatalf("forgeForRemote returned error: %v", err)
+	}
+	gitea, ok := forge.(*GiteaForge)
+	if !ok || gitea.BaseURL != "https://git.example.com/gitea" || repo.FullName() != "team/app" {
+		t.Fatalf("unexpected Gitea forge %#v for %#v", forge, repo)
+	}
+
+	forge, repo, err = forgeForRemote("git@code.internal:platform/tools/app.git")
+	if err != nil {
+		t.Fatalf("forgeForRemote returned error: %v", err)
+	}
+	gitlab, ok := forge.(*GitLabForge)
+	if !ok || gitlab.BaseURL != "https://code.internal" || repo.Owner != "platform/tools" || repo.Name != "app" {
+		t.Fatalf("unexpected GitLab forge %#v for %#v", forge, repo)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "ghp-test")
+	if forge, _, err := forgeForRemote("git@github.com:acme/app.git"); err != nil {
+		t.Fatalf("forgeForRemote returned error: %v", err)
+	} else if github, ok := forge.(*GitHubForge); !ok || github.APIURL != "" {
+		t.Fatalf("expected the GitHub API for github.com, got %#v", forge)
+	}
+	t.Setenv("GITHUB_URL", "https://ghe.example.com")
+	if forge, _, err := forgeForRemote("https://ghe.example.com/acme/app.git"); err != nil {
+		t.Fatalf("forgeForRemote returned error: %v", err)
+	} else if github, ok := forge.(*GitHubForge); !ok || github.APIURL != "https://ghe.example.com/api/v3" || github.Token != "ghp-test" {
+		t.Fatalf("expected the GitHub Enterprise API, got %#v", forge)
+	}
+	if _, _, err := forgeForRemote("https://unknown.example.org/acme/app.git"); err == nil || !strings.Contains(err.Error(), "FORGE_HOSTS") {
+		t.Fatalf("expected unknown hosts to be rejected, got %v", err)
+	}
+}
+
+func TestForgeTokens_OnlyGoToTheirOwnInstance(t *testing.T) {
+	t.Setenv("GITLAB_URL", "https://gitlab.internal")
+	t.Setenv("GITLAB_TOKEN", "glpat-test")
+	t.Setenv("GITEA_URL", "https://git.example.com/gitea")
+	t.Setenv("GITEA_TOKEN", "gitea-test")
+	t.Setenv("GITHUB_URL", "")
+	t.Setenv("GITHUB_TOKEN", "ghp-test")
+	t.Setenv("FORGE_HOSTS", "code.internal=gitlab,ghe.example.com=github")
+
+	tokens := map[string]string{
+		"https://gitlab.internal/team/app.git":       "glpat-test",
+		"https://git.example.com/gitea/team/app.git": "gitea-test",
+		"https://gitlab.com/team/app.git":            "",
+		"https://code.internal/team/app.git":         "",
+		"https://github.com/acme/app.git":            "",
+	}
+	for repoURL, want := range tokens {
+		if got := forgeCloneToken(repoURL); got != want {
+			t.Fatalf("forgeCloneToken(%q) = %q, want %q", repoURL, got, want)
+		}
+	}
+
+	forge, _, err := forgeForRemote("https://gitlab.com/team/app.git")
+	if err != nil {
+		t.Fatalf("forgeForRemote returned error: %v", err)
+	}
+	if gitlab, ok := forge.(*GitLabForge); !ok || gitlab.Token != "" {
+		t.Fatalf("expected no token for gitlab.com when GITLAB_URL is elsewhere, got %#v", forge)
+	}
+
+	forge, _, err = forgeForRemote("https://ghe.example.com/acme/app.git")
+	if err != nil {
+		t.Fatalf("forgeForRemote returned error: %v", err)
+	}
+	if github, ok := forge.(*GitHubForge); ok && github.Token != "" {
+		t.Fatalf("expected no GITHUB_TOKEN for a FORGE_HOSTS GitHub host, got %#v", forge)
+	}
+	forge, _, err = forgeForRemote("https://github.com/acme/app.git")
+	if err != nil {
+		t.Fatalf("forgeForRemote returned error: %v", err)
+	}
+	if github, ok := forge.(*GitHubForge); !ok || github.Token != "ghp-test" {
+		t.Fatalf("expected GITHUB_TOKEN for github.com, got %#v", forge)
+	}
+
+	t.Setenv("GITLAB_URL", "")
+	if got := forgeCloneToken("https://gitlab.com/team/app.git"); got != "glpat-test" {
+		t.Fatalf("expected GITLAB_TOKEN for gitlab.com when GITLAB_URL is unset, got %q", got)
+	}
+}
+
+func TestConvertToSSH(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/acme/app.git":        "git@github.com:acme/app.git",
+		"https://git.example.com/team/app":       "git@git.example.com:team/app",
+		"https://git.example.com:3000/team/app":  "https://git.example.com:3000/team/app",
+		"git@gitlab.com:acme/app.git":            "git@gitlab.com:acme/app.git",
+		"ssh://git@git.example.com/team/app.git": "ssh://git@git.example.com/team/app.git",
+	}
+	for in, want := range tests {
+		if got := convertToSSH(in); got != want {
+			t.Fatalf("convertToSSH(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCommitPushAndOpenPR_UsesGiteaForRemoteHost(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+	_, server := newFakeForgeAPI(t, "Authorization", "token gitea-test", map[string]fakeForgeResponse{
+		"POST /api/v1/repos/team/app/pulls": {http.StatusCreated, `{"number": 5, "html_url": "https://git.example.com/team/app/pulls/5"}`},
+	})
+	t.Setenv("GITEA_URL", server.URL)
+	t.Setenv("GITEA_TOKEN", "gitea-test")
+	t.Setenv("FORGE_HOSTS", "")
+
+	// Fetch from the Gitea URL but push to a local bare repo.
+	bare := filepath.Join(t.TempDir(), "app.git")
+	if err := svc.runGit("", "init", "--bare", bare); err != nil {
+		t.Fatalf("git init --bare failed: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "remote", "add", "origin", server.URL+"/team/app.git"); err != nil {
+		t.Fatalf("git remote add failed: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "remote", "set-url", "--push", "origin", bare); err != nil {
+		t.Fatalf("git remote set-url failed: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "checkout", "-b", "feature"); err != nil {
+		t.Fatalf("git checkout failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo.Path, "notes.txt"), []byte("hi\n"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	result, err := svc.CommitPushAndOpenPR(repo, "Add notes", "", false)
+	if err != nil {
+		t.Fatalf("CommitPushAndOpenPR returned error: %v", err)
+	}
+	if result.PRURL != "https://git.example.com/team/app/pulls/5" || result.PRNumber != 5 || !result.PRCreated {
+		t.Fatalf("unexpected result: %#v", result)
+	}
+}
@@ -2,18 +2,24 @@ package services
 
 import (
 	"context"
+	"crypto/sha1"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	appctx "github.com/requiem-ai/gocode/context"
+	"github.com/rs/zerolog/log"
 )
 
 const GIT_SVC = "git_svc"
@@ -37,10 +43,24 @@ type GitService struct {
 	repos map[string]*GitRepo
 }
 
+// Worktree is a checkout of one branch of a topic repo. The topic repo itself
+// is listed as a worktree too.
+type Worktree struct {
+	Path string
+	// Branch is empty for a detached HEAD.
+	Branch string
+}
+
 type CommitPRResult struct {
 	Branch        string
 	CommitMessage string
 	PRURL         string
+	PRNumber      int
+	// PRCreated is false when the branch already had an open PR.
+	PRCreated bool
+	// PRUpdated reports that the open PR got the new title and body.
+	PRUpdated bool
+	PRDraft   bool
 }
 
 func (svc GitService) Id() string {
@@ -84,57 +104,31 @@ func (svc *GitService) EnsureTopicRepoFrom(chatID int64, threadID int, repoURL,
 	return svc.ensureTopicRepo(chatID, threadID, repoURL, token)
 }
 
-func (svc *GitService) CreateGitHubRepo(name string) (string, error) {
+// CreateRepo creates a private repository called name on the forge selected by
+// DEFAULT_FORGE, under GITHUB_OWNER, GITLAB_OWNER or GITEA_OWNER, and returns
+// its clone URL.
+func (svc *GitService) CreateRepo(name string) (string, error) {
 	repoName := strings.TrimSpace(name)
 	if repoName == "" {
 		return "", errors.New("repo name is required")
 	}
 	if strings.Contains(repoName, "/") {
-		return "", errors.New("repo name must not include owner; it is configured by GITHUB_OWNER")
-	}
-
-	owner := svc.GitHubOwner()
-	if owner == "" {
-		return "", errors.New("GITHUB_OWNER is not set")
-	}
-	fullName := owner + "/" + repoName
-
-	if _, err := exec.LookPath("gh"); err != nil {
-		return "", errors.New("GitHub CLI (gh) is required to create a repository")
+		return "", errors.New("repo name must not include owner; it is configured per forge (GITHUB_OWNER, GITLAB_OWNER, GITEA_OWNER)")
 	}
 
-	createCtx, createCancel := context.WithTimeout(context.Background(), 45*time.Second)
-	defer createCancel()
-
-	createCmd := exec.CommandContext(createCtx, "gh", "repo", "create", fullName, "--private")
-	createOut, createErr := createCmd.CombinedOutput()
-	if createErr != nil {
-		msg := strings.TrimSpace(string(createOut))
-		if msg == "" {
-			return "", fmt.Errorf("failed to create GitHub repository: %w", createErr)
-		}
-		return "", fmt.Errorf("failed to create GitHub repository: %s", msg)
+	forge, kind, err := defaultForge()
+	if err != nil {
+		return "", err
 	}
-
-	viewCtx, viewCancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer viewCancel()
-
-	viewCmd := exec.CommandContext(viewCtx, "gh", "repo", "view", fullName, "--json", "url", "--jq", ".url")
-	viewOut, viewErr := viewCmd.CombinedOutput()
-	if viewErr != nil {
-		msg := strings.TrimSpace(string(viewOut))
-		if msg == "" {
-			return "", fmt.Errorf("repository created, but failed to resolve its URL: %w", viewErr)
-		}
-		return "", fmt.Errorf("repository created, but failed to resolve its URL: %s", msg)
+	owner := svc.GitHubOwner()
+	if kind != ForgeGitHub {
+		owner = strings.TrimSpace(os.Getenv(strings.ToUpper(kind) + "_OWNER"))
 	}
 
-	repoURL := strings.TrimSpace(string(viewOut))
-	if repoURL == "" {
-		return "", errors.New("repository created, but returned an empty URL")
-	}
+	createCtx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
+	defer cancel()
 
-	return repoURL, nil
+	return forge.CreateRepo(createCtx, owner, repoName)
 }
 
 func (svc *GitService) GitHubOwner() string {
@@ -359,6 +353,9 @@ func (svc *GitService) DeleteTopicRepo(chatID int64, threadID int) error {
 	delete(svc.repos, key)
 	svc.mu.Unlock()
 
+	if err := os.RemoveAll(svc.topicWorktreesDir(chatID, threadID)); err != nil {
+		return err
+	}
 	return os.RemoveAll(cleanPath)
 }
 
@@ -438,28 +435,9 @@ func (svc *GitService) CreateFeatureBranch(repo *GitRepo, feature string) (strin
 	return branch, nil
 }
 
-func (svc *GitService) CreateWorkingBranch(repo *GitRepo, name string) (string, error) {
-	if repo == nil {
-		return "", errors.New("repo is nil")
-	}
-
-	branch := strings.TrimSpace(name)
-	if branch == "" {
-		return "", errors.New("branch name is required")
-	}
-
-	if err := svc.validateBranchName(repo.Path, branch); err != nil {
-		return "", err
-	}
-
-	if err := svc.checkoutBranch(repo.Path, branch); err != nil {
-		return "", err
-	}
-
-	return branch, nil
-}
-
-func (svc *GitService) CommitPushAndOpenPR(repo *GitRepo, message, prBody string) (*CommitPRResult, error) {
+// CommitPushAndOpenPR commits all changes, pushes the current branch and
+// opens a PR for it, as a draft when draft or PR_DRAFT is set.
+func (svc *GitService) CommitPushAndOpenPR(repo *GitRepo, message, prBody string, draft bool) (*CommitPRResult, error) {
 	if repo == nil {
 		return nil, errors.New("repo is nil")
 	}
@@ -501,7 +479,8 @@ func (svc *GitService) CommitPushAndOpenPR(repo *GitRepo, message, prBody string
 		return nil, err
 	}
 
-	if _, err := svc.runGitOutput(repo.Path, "remote", "get-url", "origin"); err != nil {
+	remoteURL, err := svc.runGitOutput(repo.Path, "remote", "get-url", "origin")
+	if err != nil {
 		return nil, errors.New("missing git remote 'origin'")
 	}
 
@@ -509,7 +488,13 @@ func (svc *GitService) CommitPushAndOpenPR(repo *GitRepo, message, prBody string
 		return nil, err
 	}
 
-	prURL, err := svc.createPullRequest(repo.Path, branch, baseBranch, commitMessage, prBody)
+	pr, err := svc.openPullRequest(repo.Path, remoteURL, PullRequest{
+		Head:  branch,
+		Base:  baseBranch,
+		Title: commitMessage,
+		Body:  prBody,
+		Draft: draft || isEnvTrue(os.Getenv("PR_DRAFT")),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -517,7 +502,11 @@ func (svc *GitService) CommitPushAndOpenPR(repo *GitRepo, message, prBody string
 	return &CommitPRResult{
 		Branch:        branch,
 		CommitMessage: commitMessage,
-		PRURL:         prURL,
+		PRURL:         pr.URL,
+		PRNumber:      pr.Number,
+		PRCreated:     pr.Created,
+		PRUpdated:     pr.Updated,
+		PRDraft:       pr.Draft,
 	}, nil
 }
 
@@ -567,6 +556,570 @@ func (svc *GitService) RunTopicGitCommand(repo *GitRepo, args ...string) (string
 	return trimmed, nil
 }
 
+// WorktreePath returns where GoCode keeps the worktree for branch of repo. A
+// short hash of the branch name keeps branches that slugify alike, such as
+// feat/a and feat-a, apart.
+func (svc *GitService) WorktreePath(repo *GitRepo, branch string) string {
+	sum := sha1.Sum([]byte(branch))
+	name := fmt.Sprintf("%s-%x", slugify(branch), sum[:3])
+	return filepath.Join(svc.topicWorktreesDir(repo.ChatID, repo.ThreadID), name)
+}
+
+func (svc *GitService) topicWorktreesDir(chatID int64, threadID int) string {
+	return filepath.Join(svc.BaseDir, ".worktrees", fmt.Sprintf("%d_%d", chatID, threadID))
+}
+
+// Worktrees lists the checkouts of repo, starting with the topic repo.
+func (svc *GitService) Worktrees(repo *GitRepo) ([]Worktree, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	out, err := svc.runGitOutput(repo.Path, "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	return parseWorktreeList(out), nil
+}
+
+// parseWorktreeList parses the output of git worktree list --porcelain.
+func parseWorktreeList(out string) []Worktree {
+	var worktrees []Worktree
+	for _, block := range strings.Split(out, "\n\n") {
+		var wt Worktree
+		for _, line := range strings.Split(block, "\n") {
+			if path, ok := strings.CutPrefix(line, "worktree "); ok {
+				wt.Path = path
+			} else if ref, ok := strings.CutPrefix(line, "branch "); ok {
+				wt.Branch = strings.TrimPrefix(ref, "refs/heads/")
+			}
+		}
+		if wt.Path != "" {
+			worktrees = append(worktrees, wt)
+		}
+	}
+	return worktrees
+}
+
+// EnsureBranchWorktree returns the checkout of branch, creating a worktree
+// for it when no checkout has it yet. A new branch starts from the repo's
+// default branch. created reports whether a worktree was added.
+func (svc *GitService) EnsureBranchWorktree(repo *GitRepo, branch string) (path string, created bool, err error) {
+	if repo == nil {
+		return "", false, errors.New("repo is nil")
+	}
+	branch = strings.TrimSpace(branch)
+	if branch == "" {
+		return "", false, errors.New("branch name is required")
+	}
+	if err := svc.validateBranchName(repo.Path, branch); err != nil {
+		return "", false, err
+	}
+
+	// Forget worktrees whose directories were deleted by hand.
+	if err := svc.runGit(repo.Path, "worktree", "prune"); err != nil {
+		return "", false, err
+	}
+	worktrees, err := svc.Worktrees(repo)
+	if err != nil {
+		return "", false, err
+	}
+	for _, wt := range worktrees {
+		if wt.Branch == branch {
+			return wt.Path, false, nil
+		}
+	}
+
+	path = svc.WorktreePath(repo, branch)
+	if err := os.MkdirAll(filepath.Dir(path), 0o775); err != nil {
+		return "", false, err
+	}
+	args := []string{"worktree", "add", path, branch}
+	if !svc.branchExists(repo.Path, branch) {
+		base := "HEAD"
+		if repo.DefaultBranch != "" && svc.branchExists(repo.Path, repo.DefaultBranch) {
+			base = repo.DefaultBranch
+		} else if _, err := svc.runGitOutput(repo.Path, "rev-parse", "--verify", "HEAD"); err != nil {
+			return "", false, errors.New("repo has no commits yet")
+		}
+		args = []string{"worktree", "add", "-b", branch, path, base}
+	}
+	if err := svc.runGit(repo.Path, args...); err != nil {
+		return "", false, fmt.Errorf("failed to create worktree for %s: %w", branch, err)
+	}
+	return path, true, nil
+}
+
+// Checkpoint is a snapshot of a checkout's working tree, taken before an
+// agent run so its changes can be undone.
+type Checkpoint struct {
+	// Ref is the per-worktree ref that keeps the snapshot commit alive.
+	Ref    string
+	Commit string
+	// Base is the commit HEAD pointed at when the snapshot was taken.
+	Base  string
+	Time  time.Time
+	Label string
+}
+
+const (
+	// checkpointRefPrefix lives under refs/worktree/ so every worktree of a
+	// repo keeps its own checkpoints.
+	checkpointRefPrefix = "refs/worktree/gocode/checkpoints/"
+	// maxCheckpoints is how many checkpoints each checkout keeps.
+	maxCheckpoints = 20
+)
+
+// checkpointEnv gives snapshot commits a fixed identity so they work on hosts
+// without a git user configured.
+var checkpointEnv = []string{
+	"GIT_AUTHOR_NAME=GoCode",
+	"GIT_AUTHOR_EMAIL=gocode@localhost",
+	"GIT_COMMITTER_NAME=GoCode",
+	"GIT_COMMITTER_EMAIL=gocode@localhost",
+}
+
+// CreateCheckpoint snapshots the tracked and untracked (but not ignored) files
+// in repoPath without touching the index, HEAD or the working tree.
+func (svc *GitService) CreateCheckpoint(repoPath, label string) (*Checkpoint, error) {
+	base, err := svc.runGitOutput(repoPath, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return nil, errors.New("repo has no commits yet")
+	}
+
+	tree, err := svc.snapshotTree(repoPath, base)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+
+	label = strings.Join(strings.Fields(label), " ")
+	if label == "" {
+		label = "checkpoint"
+	}
+	commit, err := svc.runGitOutputEnv(repoPath, checkpointEnv, "commit-tree", tree, "-p", base, "-m", label)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint: commit-tree: %w", err)
+	}
+
+	now := time.Now()
+	ref := checkpointRefPrefix + strconv.FormatInt(now.UnixNano(), 10)
+	if err := svc.runGit(repoPath, "update-ref", ref, commit); err != nil {
+		return nil, err
+	}
+	svc.pruneCheckpoints(repoPath)
+
+	return &Checkpoint{Ref: ref, Commit: commit, Base: base, Time: now, Label: label}, nil
+}
+
+// snapshotTree writes the tracked and untracked (but not ignored) files in
+// repoPath to a tree object using a throwaway index, so the real index is
+// left alone. The throwaway index starts as a copy of the real one so git can
+// reuse its stat cache instead of rehashing every file; without a real index
+// it starts from base, or empty when base is empty.
+func (svc *GitService) snapshotTree(repoPath, base string) (string, error) {
+	indexFile, err := os.CreateTemp("", "gocode-snapshot-index-")
+	if err != nil {
+		return "", err
+	}
+	indexPath := indexFile.Name()
+	defer os.Remove(indexPath)
+
+	seeded, err := svc.copyIndex(repoPath, indexFile)
+	indexFile.Close()
+	if err != nil {
+		return "", err
+	}
+
+	env := []string{"GIT_INDEX_FILE=" + indexPath}
+	if !seeded {
+		readTree := []string{"read-tree", "--empty"}
+		if base != "" {
+			readTree = []string{"read-tree", base}
+		}
+		if _, err := svc.runGitOutputEnv(repoPath, env, readTree...); err != nil {
+			return "", fmt.Errorf("read-tree: %w", err)
+		}
+	}
+	if _, err := svc.runGitOutputEnv(repoPath, env, "add", "-A"); err != nil {
+		return "", fmt.Errorf("add: %w", err)
+	}
+	tree, err := svc.runGitOutputEnv(repoPath, env, "write-tree")
+	if err != nil {
+		return "", fmt.Errorf("write-tree: %w", err)
+	}
+	return tree, nil
+}
+
+// copyIndex copies the index of repoPath into dst and reports whether there
+// was one to copy.
+func (svc *GitService) copyIndex(repoPath string, dst *os.File) (bool, error) {
+	path, err := svc.runGitOutput(repoPath, "rev-parse", "--git-path", "index")
+	if err != nil {
+		return false, fmt.Errorf("locate index: %w", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(repoPath, path)
+	}
+	src, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return false, fmt.Errorf("copy index: %w", err)
+	}
+	return true, nil
+}
+
+// emptyTree is git's well-known hash of the empty tree.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// FileChange is one file in a ChangeSummary.
+type FileChange struct {
+	Path string
+	// Status is "added", "modified" or "deleted".
+	Status     string
+	Insertions int
+	Deletions  int
+	Binary     bool
+	// Untracked marks an added file that is not in git yet.
+	Untracked bool
+}
+
+// ChangeSummary describes how a checkout differs from an earlier commit.
+type ChangeSummary struct {
+	Files      []FileChange
+	Insertions int
+	Deletions  int
+}
+
+// ChangeSummary compares the working tree of repoPath, including commits and
+// untracked files, with since. An empty since compares with HEAD.
+func (svc *GitService) ChangeSummary(repoPath, since string) (*ChangeSummary, error) {
+	since, tree, err := svc.diffTrees(repoPath, since)
+	if err != nil {
+		return nil, err
+	}
+	// -z keeps paths with spaces or non-ASCII characters unquoted.
+	out, err := svc.runGitOutput(repoPath, "diff", "--no-renames", "--raw", "--numstat", "-z", since, tree)
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := svc.runGitOutput(repoPath, "ls-files", "-z", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	return parseChangeSummary(out, strings.Split(untracked, "\x00")), nil
+}
+
+// FullDiff returns the unified diff between HEAD and the working tree of
+// repoPath, including untracked files, optionally limited to paths.
+func (svc *GitService) FullDiff(repoPath string, paths ...string) (string, error) {
+	since, tree, err := svc.diffTrees(repoPath, "")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"diff", "--no-renames", since, tree}
+	if len(paths) > 0 {
+		args = append(append(args, "--"), paths...)
+	}
+	return svc.runGitOutput(repoPath, args...)
+}
+
+// diffTrees resolves since (HEAD when empty, or the empty tree in a repo
+// without commits) and snapshots the working tree to compare it with.
+func (svc *GitService) diffTrees(repoPath, since string) (string, string, error) {
+	head, headErr := svc.runGitOutput(repoPath, "rev-parse", "--verify", "HEAD")
+	if since == "" {
+		since = head
+		if headErr != nil {
+			since = emptyTree
+		}
+	}
+	tree, err := svc.snapshotTree(repoPath, head)
+	if err != nil {
+		return "", "", fmt.Errorf("snapshot: %w", err)
+	}
+	return since, tree, nil
+}
+
+// parseChangeSummary parses git diff --raw --numstat -z output: a
+// ":<modes> <shas> <status>" record and its path for every file, followed by
+// an "<added>\t<deleted>\t<path>" record for every file, all NUL-terminated.
+func parseChangeSummary(out string, untracked []string) *ChangeSummary {
+	isUntracked := make(map[string]bool, len(untracked))
+	for _, path := range untracked {
+		if path != "" {
+			isUntracked[path] = true
+		}
+	}
+
+	summary := &ChangeSummary{}
+	statuses := make(map[string]string)
+	records := strings.Split(out, "\x00")
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		if strings.HasPrefix(record, ":") {
+			if i+1 >= len(records) {
+				break
+			}
+			i++
+			fields := strings.Fields(record)
+			switch fields[len(fields)-1] {
+			case "A":
+				statuses[records[i]] = "added"
+			case "D":
+				statuses[records[i]] = "deleted"
+			}
+			continue
+		}
+
+		fields := strings.SplitN(record, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		change := FileChange{Path: fields[2], Status: "modified", Untracked: isUntracked[fields[2]]}
+		if status, ok := statuses[change.Path]; ok {
+			change.Status = status
+		}
+		if fields[0] == "-" {
+			change.Binary = true
+		} else {
+			change.Insertions, _ = strconv.Atoi(fields[0])
+			change.Deletions, _ = strconv.Atoi(fields[1])
+		}
+		summary.Insertions += change.Insertions
+		summary.Deletions += change.Deletions
+		summary.Files = append(summary.Files, change)
+	}
+	return summary
+}
+
+// Checkpoints lists the checkpoints of repoPath, newest first.
+func (svc *GitService) Checkpoints(repoPath string) ([]Checkpoint, error) {
+	out, err := svc.runGitOutput(repoPath, "for-each-ref",
+		"--format=%(refname)%09%(objectname)%09%(parent)%09%(subject)", checkpointRefPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoints []Checkpoint
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.TrimPrefix(fields[0], checkpointRefPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		checkpoints = append(checkpoints, Checkpoint{
+			Ref:    fields[0],
+			Commit: fields[1],
+			Base:   fields[2],
+			Time:   time.Unix(0, nanos),
+			Label:  fields[3],
+		})
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Time.After(checkpoints[j].Time)
+	})
+	return checkpoints, nil
+}
+
+// pruneCheckpoints drops all but the newest maxCheckpoints checkpoints.
+func (svc *GitService) pruneCheckpoints(repoPath string) {
+	checkpoints, err := svc.Checkpoints(repoPath)
+	if err != nil || len(checkpoints) <= maxCheckpoints {
+		return
+	}
+	for _, cp := range checkpoints[maxCheckpoints:] {
+		if err := svc.runGit(repoPath, "update-ref", "-d", cp.Ref); err != nil {
+			log.Warn().Err(err).Str("ref", cp.Ref).Msg("failed to prune checkpoint")
+		}
+	}
+}
+
+// RestoreCheckpoint puts repoPath back to cp: the working tree is reset to
+// the snapshot, with the snapshot's changes left uncommitted. It refuses when
+// HEAD has moved since cp was taken, since resetting the branch would drop the
+// commits made since, which may already be pushed. The current state is
+// checkpointed first, so a restore can itself be undone. Ignored files are
+// left alone.
+func (svc *GitService) RestoreCheckpoint(repoPath string, cp Checkpoint) (*Checkpoint, error) {
+	head, err := svc.runGitOutput(repoPath, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if head != cp.Base {
+		return nil, fmt.Errorf("the branch has moved from %s to %s since this checkpoint; restoring it would drop the commits in between", shortHash(cp.Base), shortHash(head))
+	}
+
+	safety, err := svc.CreateCheckpoint(repoPath, "before restoring "+cp.Time.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkpoint the current state: %w", err)
+	}
+
+	if err := svc.runGit(repoPath, "reset", "-q", "--hard", cp.Base); err != nil {
+		return safety, err
+	}
+	if err := svc.runGit(repoPath, "clean", "-fdq"); err != nil {
+		return safety, err
+	}
+	if err := svc.runGit(repoPath, "read-tree", "--reset", "-u", cp.Commit); err != nil {
+		return safety, err
+	}
+	// Unstage the snapshot so files that were untracked stay untracked.
+	if err := svc.runGit(repoPath, "reset", "-q"); err != nil {
+		return safety, err
+	}
+	return safety, nil
+}
+
+// HasUncommittedChanges reports whether the checkout at path has staged,
+// unstaged or untracked changes.
+func (svc *GitService) HasUncommittedChanges(path string) (bool, error) {
+	out, err := svc.runGitOutput(path, "status", "--porcelain")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) != "", nil
+}
+
+// AddWorktree creates branch from the repo's current HEAD and checks it out in
+// a dedicated worktree, returning the worktree path.
+func (svc *GitService) AddWorktree(repo *GitRepo, branch string) (string, error) {
+	if repo == nil {
+		return "", errors.New("repo is nil")
+	}
+	if err := svc.validateBranchName(repo.Path, branch); err != nil {
+		return "", err
+	}
+	if _, err := svc.runGitOutput(repo.Path, "rev-parse", "--verify", "HEAD"); err != nil {
+		return "", errors.New("repo has no commits yet")
+	}
+
+	path := svc.WorktreePath(repo, branch)
+	if err := os.MkdirAll(filepath.Dir(path), 0o775); err != nil {
+		return "", err
+	}
+	if err := svc.runGit(repo.Path, "worktree", "add", "-b", branch, path, "HEAD"); err != nil {
+		return "", fmt.Errorf("failed to create worktree for %s: %w", branch, err)
+	}
+	return path, nil
+}
+
+// RemoveWorktree deletes the worktree checkout but keeps its branch.
+func (svc *GitService) RemoveWorktree(repo *GitRepo, path string) error {
+	if repo == nil {
+		return errors.New("repo is nil")
+	}
+	return svc.runGit(repo.Path, "worktree", "remove", "--force", path)
+}
+
+// CommitWorktreeChanges stages everything in path, commits it when anything
+// changed, and returns the diff stat against base.
+func (svc *GitService) CommitWorktreeChanges(path, base, message string) (string, error) {
+	if err := svc.runGit(path, "add", "-A"); err != nil {
+		return "", err
+	}
+
+	stat, err := svc.runGitOutput(path, "diff", "--cached", "--stat", base)
+	if err != nil {
+		return "", err
+	}
+
+	changed, err := svc.stagedFiles(path)
+	if err != nil {
+		return stat, err
+	}
+	if len(changed) == 0 {
+		return stat, nil
+	}
+	return stat, svc.runGit(path, "commit", "-m", message)
+}
+
+// WorkingDiff returns the uncommitted changes in repoPath as a unified diff
+// against HEAD, followed by the names of any new untracked files.
+func (svc *GitService) WorkingDiff(repoPath string) (string, error) {
+	diff, err := svc.runGitOutput(repoPath, "diff", "HEAD")
+	if err != nil {
+		// No commits yet: fall back to the unstaged diff.
+		diff, err = svc.runGitOutput(repoPath, "diff")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	untracked, err := svc.runGitOutput(repoPath, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(untracked) == "" {
+		return diff, nil
+	}
+
+	var b strings.Builder
+	b.WriteString(diff)
+	if diff != "" {
+		b.WriteString("\n\n")
+	}
+	b.WriteString("Untracked files:")
+	for _, file := range strings.Split(untracked, "\n") {
+		if file = strings.TrimSpace(file); file != "" {
+			b.WriteString("\n")
+			b.WriteString(file)
+		}
+	}
+	return b.String(), nil
+}
+
+// ExcludeLocally adds pattern to the repo's info/exclude file so files the bot
+// manages inside the repo never show up in diffs or commits.
+func (svc *GitService) ExcludeLocally(repoPath, pattern string) error {
+	excludePath, err := svc.runGitOutput(repoPath, "rev-parse", "--git-path", "info/exclude")
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(excludePath) {
+		excludePath = filepath.Join(repoPath, excludePath)
+	}
+
+	data, err := os.ReadFile(excludePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == pattern {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(excludePath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(excludePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	entry := pattern + "\n"
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		entry = "\n" + entry
+	}
+	if _, err := f.WriteString(entry); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HeadCommit returns the commit hash checked out in repoPath.
+func (svc *GitService) HeadCommit(repoPath string) (string, error) {
+	return svc.runGitOutput(repoPath, "rev-parse", "HEAD")
+}
+
 func (svc *GitService) initRepo(repoPath string) error {
 	if err := os.MkdirAll(repoPath, 0o775); err != nil {
 		return err
@@ -609,7 +1162,10 @@ func (svc *GitService) cloneRepo(repoURL, repoPath, token string) error {
 		if strings.TrimSpace(keyPath) == "" {
 			return errors.New("GITHUB_SSH_KEY_PATH not set")
 		}
-		repoURL = convertGitHubToSSH(repoURL)
+		repoURL = convertToSSH(repoURL)
+	}
+	if strings.TrimSpace(token) == "" {
+		token = forgeCloneToken(repoURL)
 	}
 
 	args := []string{"clone", repoURL, repoPath}
@@ -701,67 +1257,30 @@ func (svc *GitService) stagedFiles(repoPath string) ([]string, error) {
 	return files, nil
 }
 
-func (svc *GitService) createPullRequest(repoPath, headBranch, baseBranch, title, body string) (string, error) {
-	if _, err := exec.LookPath("gh"); err != nil {
-		return "", errors.New("GitHub CLI (gh) is required to open a PR")
+// openPullRequest opens pr on the forge hosting remoteURL, with the labels
+// and reviewers listed in PR_LABELS and PR_REVIEWERS.
+func (svc *GitService) openPullRequest(repoPath, remoteURL string, pr PullRequest) (*PullRequestResult, error) {
+	forge, forgeRepo, err := forgeForRemote(remoteURL)
+	if err != nil {
+		return nil, err
 	}
+	forgeRepo.Dir = repoPath
 
-	prTitle := strings.TrimSpace(title)
-	if prTitle == "" {
-		prTitle = "Update changes"
+	pr.Title = strings.TrimSpace(pr.Title)
+	if pr.Title == "" {
+		pr.Title = "Update changes"
 	}
-	prBody := strings.TrimSpace(body)
-	if prBody == "" {
-		prBody = "Automated PR created by GoCode."
+	pr.Body = strings.TrimSpace(pr.Body)
+	if pr.Body == "" {
+		pr.Body = "Automated PR created by GoCode."
 	}
+	pr.Labels = envList("PR_LABELS")
+	pr.Reviewers = envList("PR_REVIEWERS")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "gh", "pr", "create",
-		"--base", baseBranch,
-		"--head", headBranch,
-		"--title", prTitle,
-		"--body", prBody,
-	)
-	cmd.Dir = repoPath
-	output, err := cmd.CombinedOutput()
-	out := strings.TrimSpace(string(output))
-	if url := extractGitHubURL(out); url != "" {
-		return url, nil
-	}
-	if err == nil {
-		return "", errors.New("failed to create PR: empty response")
-	}
-
-	existingURL, viewErr := svc.existingPullRequestURL(repoPath, headBranch, baseBranch)
-	if viewErr == nil && existingURL != "" {
-		return existingURL, nil
-	}
-
-	if out == "" && err != nil {
-		return "", fmt.Errorf("failed to create PR: %w", err)
-	}
-	return "", fmt.Errorf("failed to create PR: %s", out)
-}
-
-func (svc *GitService) existingPullRequestURL(repoPath, headBranch, baseBranch string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, "gh", "pr", "list",
-		"--head", headBranch,
-		"--base", baseBranch,
-		"--state", "open",
-		"--json", "url",
-		"--jq", ".[0].url",
-	)
-	cmd.Dir = repoPath
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(string(output)), nil
+	return forge.OpenPullRequest(ctx, forgeRepo, pr)
 }
 
 var githubURLRe = regexp.MustCompile(`https://github\.com/\S+`)
@@ -800,6 +1319,11 @@ func (svc *GitService) runGit(repoPath string, args ...string) error {
 }
 
 func (svc *GitService) runGitOutput(repoPath string, args ...string) (string, error) {
+	return svc.runGitOutputEnv(repoPath, nil, args...)
+}
+
+// runGitOutputEnv is runGitOutput with extra KEY=VALUE environment entries.
+func (svc *GitService) runGitOutputEnv(repoPath string, env []string, args ...string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), gitCommandTimeout)
 	defer cancel()
 
@@ -808,6 +1332,7 @@ func (svc *GitService) runGitOutput(repoPath string, args ...string) (string, er
 		"GIT_TERMINAL_PROMPT=0",
 		"GCM_INTERACTIVE=never",
 	)
+	cmd.Env = append(cmd.Env, env...)
 	output, err := cmd.Output()
 	if err != nil {
 		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
@@ -837,6 +1362,14 @@ func (svc *GitService) defaultBranch(repoPath string) string {
 
 var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
 
+// shortHash abbreviates a commit hash for messages.
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
+
 func slugify(in string) string {
 	in = strings.ToLower(strings.TrimSpace(in))
 	if in == "" {
@@ -871,21 +1404,22 @@ func gitSSHConfig() (bool, string) {
 	return use, keyPath
 }
 
-func convertGitHubToSSH(repoURL string) string {
+// convertToSSH rewrites an https clone URL such as
+// "https://git.example.com/team/app.git" to "git@git.example.com:team/app.git".
+// URLs with an explicit port are left alone since the SSH port is unknown.
+func convertToSSH(repoURL string) string {
 	if strings.HasPrefix(repoURL, "git@") || strings.HasPrefix(repoURL, "ssh://") {
 		return repoURL
 	}
-	if strings.HasPrefix(repoURL, "https://github.com/") {
-		path := strings.TrimPrefix(repoURL, "https://github.com/")
-		path = strings.TrimPrefix(path, "/")
-		return "git@github.com:" + path
+	u, err := url.Parse(repoURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Port() != "" {
+		return repoURL
 	}
-	if strings.HasPrefix(repoURL, "http://github.com/") {
-		path := strings.TrimPrefix(repoURL, "http://github.com/")
-		path = strings.TrimPrefix(path, "/")
-		return "git@github.com:" + path
+	path := strings.TrimPrefix(u.Path, "/")
+	if path == "" {
+		return repoURL
 	}
-	return repoURL
+	return "git@" + u.Hostname() + ":" + path
 }
 
 func boolEnv(v bool) string {
@@ -1,6 +1,44 @@
 package services
 
-import "testing"
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestGitRepo creates a repo with one commit under a fresh GitService.
+func newTestGitRepo(t *testing.T) (*GitService, *GitRepo) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	svc := &GitService{BaseDir: t.TempDir()}
+	repo := &GitRepo{ChatID: 1, ThreadID: 2, Path: filepath.Join(svc.BaseDir, "1_2")}
+	if err := os.MkdirAll(repo.Path, 0o755); err != nil {
+		t.Fatalf("mkdir repo: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "init", "-q"); err != nil {
+		t.Fatalf("git init: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo.Path, "README.md"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "add", "-A"); err != nil {
+		t.Fatalf("git add: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "commit", "-q", "-m", "init"); err != nil {
+		t.Fatalf("git commit: %v", err)
+	}
+	return svc, repo
+}
 
 func TestExtractGitHubURL_ExactURL(t *testing.T) {
 	got := extractGitHubURL("https://github.com/acme/repo/pull/42")
@@ -32,3 +70,378 @@ func TestExtractGitHubURL_NoMatch(t *testing.T) {
 		t.Fatalf("extractGitHubURL() = %q, want empty", got)
 	}
 }
+
+func TestWorktree_CommitKeepsBranchAfterRemove(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+
+	base, err := svc.HeadCommit(repo.Path)
+	if err != nil {
+		t.Fatalf("HeadCommit: %v", err)
+	}
+	path, err := svc.AddWorktree(repo, "ask-all/codex-1")
+	if err != nil {
+		t.Fatalf("AddWorktree: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "new.txt"), []byte("change\n"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	stat, err := svc.CommitWorktreeChanges(path, base, "answer")
+	if err != nil {
+		t.Fatalf("CommitWorktreeChanges: %v", err)
+	}
+	if !strings.Contains(stat, "new.txt") {
+		t.Fatalf("stat = %q, want it to mention new.txt", stat)
+	}
+	if err := svc.RemoveWorktree(repo, path); err != nil {
+		t.Fatalf("RemoveWorktree: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected worktree dir to be removed, stat err = %v", err)
+	}
+	if _, err := svc.runGitOutput(repo.Path, "rev-parse", "--verify", "ask-all/codex-1"); err != nil {
+		t.Fatalf("expected branch to survive worktree removal: %v", err)
+	}
+}
+
+func TestWorkingDiff_IncludesUntrackedFiles(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+
+	if err := os.WriteFile(filepath.Join(repo.Path, "README.md"), []byte("hello world\n"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo.Path, "new.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	diff, err := svc.WorkingDiff(repo.Path)
+	if err != nil {
+		t.Fatalf("WorkingDiff: %v", err)
+	}
+	if !strings.Contains(diff, "+hello world") || !strings.Contains(diff, "Untracked files:\nnew.go") {
+		t.Fatalf("unexpected diff: %q", diff)
+	}
+}
+
+func TestExcludeLocally_HidesBotFilesFromGit(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+
+	dir := filepath.Join(repo.Path, ".gocode", "attachments")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir attachments: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "shot.jpg"), []byte("jpg"), 0o644); err != nil {
+		t.Fatalf("write attachment: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := svc.ExcludeLocally(repo.Path, "/.gocode/"); err != nil {
+			t.Fatalf("ExcludeLocally returned error: %v", err)
+		}
+	}
+
+	status, err := svc.runGitOutput(repo.Path, "status", "--porcelain")
+	if err != nil {
+		t.Fatalf("git status: %v", err)
+	}
+	if status != "" {
+		t.Fatalf("expected attachments to be ignored, got status %q", status)
+	}
+	exclude, err := os.ReadFile(filepath.Join(repo.Path, ".git", "info", "exclude"))
+	if err != nil {
+		t.Fatalf("read exclude: %v", err)
+	}
+	if strings.Count(string(exclude), "/.gocode/") != 1 {
+		t.Fatalf("expected a single exclude entry, got %q", exclude)
+	}
+}
+
+func TestEnsureBranchWorktree_CreatesAndReusesCheckouts(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+	defaultBranch, err := svc.currentBranch(repo.Path)
+	if err != nil {
+		t.Fatalf("currentBranch: %v", err)
+	}
+	repo.DefaultBranch = defaultBranch
+
+	path, created, err := svc.EnsureBranchWorktree(repo, defaultBranch)
+	if err != nil || created || path != repo.Path {
+		t.Fatalf("expected the default branch to stay in the topic repo, got %q %v %v", path, created, err)
+	}
+
+	path, created, err = svc.EnsureBranchWorktree(repo, "feature/login")
+	if err != nil || !created {
+		t.Fatalf("EnsureBranchWorktree(new) = %q %v %v", path, created, err)
+	}
+	if path != svc.WorktreePath(repo, "feature/login") {
+		t.Fatalf("unexpected worktree path %q", path)
+	}
+	if branch, _ := svc.currentBranch(path); branch != "feature/login" {
+		t.Fatalf("worktree is on %q, want feature/login", branch)
+	}
+	if branch, _ := svc.currentBranch(repo.Path); branch != defaultBranch {
+		t.Fatalf("topic repo switched to %q", branch)
+	}
+
+	again, created, err := svc.EnsureBranchWorktree(repo, "feature/login")
+	if err != nil || created || again != path {
+		t.Fatalf("expected existing worktree to be reused, got %q %v %v", again, created, err)
+	}
+
+	worktrees, err := svc.Worktrees(repo)
+	if err != nil || len(worktrees) != 2 || worktrees[0].Path != repo.Path || worktrees[1].Branch != "feature/login" {
+		t.Fatalf("unexpected worktrees: %#v %v", worktrees, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(path, "login.go"), []byte("package login\n"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if dirty, err := svc.HasUncommittedChanges(path); err != nil || !dirty {
+		t.Fatalf("expected uncommitted changes in the worktree, got %v %v", dirty, err)
+	}
+	if dirty, err := svc.HasUncommittedChanges(repo.Path); err != nil || dirty {
+		t.Fatalf("expected the topic repo to stay clean, got %v %v", dirty, err)
+	}
+
+	// A worktree deleted by hand is recreated for its existing branch.
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("remove worktree dir: %v", err)
+	}
+	path, created, err = svc.EnsureBranchWorktree(repo, "feature/login")
+	if err != nil || !created {
+		t.Fatalf("expected the worktree to be recreated, got %q %v %v", path, created, err)
+	}
+}
+
+func TestEnsureBranchWorktree_SeparatesBranchesWithTheSameSlug(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+
+	slashed, created, err := svc.EnsureBranchWorktree(repo, "feat/a")
+	if err != nil || !created {
+		t.Fatalf("EnsureBranchWorktree(feat/a) = %q %v %v", slashed, created, err)
+	}
+	dashed, created, err := svc.EnsureBranchWorktree(repo, "feat-a")
+	if err != nil || !created {
+		t.Fatalf("EnsureBranchWorktree(feat-a) = %q %v %v", dashed, created, err)
+	}
+	if slashed == dashed {
+		t.Fatalf("expected separate worktrees, both at %q", slashed)
+	}
+	if branch, _ := svc.currentBranch(dashed); branch != "feat-a" {
+		t.Fatalf("worktree is on %q, want feat-a", branch)
+	}
+}
+
+func TestParseWorktreeList(t *testing.T) {
+	out := "worktree /repos/1_2\nHEAD abc\nbranch refs/heads/main\n\n" +
+		"worktree /repos/.worktrees/1_2/fix\nHEAD def\nbranch refs/heads/fix/login\n\n" +
+		"worktree /repos/.worktrees/1_2/tmp\nHEAD 123\ndetached"
+	got := parseWorktreeList(out)
+	if len(got) != 3 || got[1].Branch != "fix/login" || got[2].Branch != "" || got[2].Path != "/repos/.worktrees/1_2/tmp" {
+		t.Fatalf("parseWorktreeList() = %#v", got)
+	}
+}
+
+func TestCheckpoint_RestoreUndoesAgentChanges(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repo.Path, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(repo.Path, name))
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+
+	write(".gitignore", "build/\n")
+	if err := svc.runGit(repo.Path, "add", ".gitignore"); err != nil {
+		t.Fatalf("git add: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "commit", "-q", "-m", "ignore build"); err != nil {
+		t.Fatalf("git commit: %v", err)
+	}
+	base, _ := svc.HeadCommit(repo.Path)
+
+	// Work in progress before the agent runs.
+	write("README.md", "hello, edited\n")
+	write("notes.txt", "draft\n")
+	cp, err := svc.CreateCheckpoint(repo.Path, "before: refactor\neverything")
+	if err != nil {
+		t.Fatalf("CreateCheckpoint: %v", err)
+	}
+	if cp.Base != base || cp.Label != "before: refactor everything" {
+		t.Fatalf("unexpected checkpoint: %#v", cp)
+	}
+	if status, _ := svc.runGitOutput(repo.Path, "status", "--porcelain"); status != "M README.md\n?? notes.txt" {
+		t.Fatalf("checkpoint changed the index or tree: %q", status)
+	}
+
+	// The agent rewrites files and leaves build output behind.
+	write("README.md", "wrecked\n")
+	write("agent.go", "package main\n")
+	if err := os.Remove(filepath.Join(repo.Path, "notes.txt")); err != nil {
+		t.Fatalf("remove notes: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "add", "-A"); err != nil {
+		t.Fatalf("git add: %v", err)
+	}
+	write("scratch.txt", "tmp\n")
+	if err := os.MkdirAll(filepath.Join(repo.Path, "build"), 0o755); err != nil {
+		t.Fatalf("mkdir build: %v", err)
+	}
+	write("build/out.bin", "bin\n")
+
+	checkpoints, err := svc.Checkpoints(repo.Path)
+	if err != nil || len(checkpoints) != 1 || checkpoints[0].Commit != cp.Commit {
+		t.Fatalf("unexpected checkpoints: %#v %v", checkpoints, err)
+	}
+
+	if _, err := svc.RestoreCheckpoint(repo.Path, checkpoints[0]); err != nil {
+		t.Fatalf("RestoreCheckpoint: %v", err)
+	}
+	if head, _ := svc.HeadCommit(repo.Path); head != base {
+		t.Fatalf("HEAD = %s, want %s", head, base)
+	}
+	if got := read("README.md"); got != "hello, edited\n" {
+		t.Fatalf("README.md = %q", got)
+	}
+	if read("notes.txt") != "draft\n" || read("agent.go") != "<missing>" || read("scratch.txt") != "<missing>" {
+		t.Fatalf("working tree not restored: notes=%q agent=%q scratch=%q", read("notes.txt"), read("agent.go"), read("scratch.txt"))
+	}
+	if read("build/out.bin") != "bin\n" {
+		t.Fatalf("ignored files should be left alone")
+	}
+	if status, _ := svc.runGitOutput(repo.Path, "status", "--porcelain"); status != "M README.md\n?? notes.txt" {
+		t.Fatalf("unexpected status after restore: %q", status)
+	}
+
+	// The restore checkpointed the agent's state, so restoring the newest
+	// checkpoint again brings it back.
+	checkpoints, err = svc.Checkpoints(repo.Path)
+	if err != nil || len(checkpoints) != 2 || !strings.HasPrefix(checkpoints[0].Label, "before restoring") {
+		t.Fatalf("expected a safety checkpoint first, got %#v %v", checkpoints, err)
+	}
+	if _, err := svc.RestoreCheckpoint(repo.Path, checkpoints[0]); err != nil {
+		t.Fatalf("RestoreCheckpoint(redo): %v", err)
+	}
+	if read("README.md") != "wrecked\n" || read("scratch.txt") != "tmp\n" {
+		t.Fatalf("redo did not bring back the agent's changes")
+	}
+}
+
+func TestCheckpoint_RestoreRefusesWhenTheBranchMoved(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+	cp, err := svc.CreateCheckpoint(repo.Path, "before: agent")
+	if err != nil {
+		t.Fatalf("CreateCheckpoint: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(repo.Path, "agent.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatalf("write agent.go: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "add", "-A"); err != nil {
+		t.Fatalf("git add: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "commit", "-q", "-m", "agent"); err != nil {
+		t.Fatalf("git commit: %v", err)
+	}
+	agentHead, _ := svc.HeadCommit(repo.Path)
+
+	if _, err := svc.RestoreCheckpoint(repo.Path, *cp); err == nil || !strings.Contains(err.Error(), "has moved") {
+		t.Fatalf("expected the restore to be refused, got %v", err)
+	}
+	if head, _ := svc.HeadCommit(repo.Path); head != agentHead {
+		t.Fatalf("HEAD = %s, want the agent's commit %s", head, agentHead)
+	}
+	if checkpoints, _ := svc.Checkpoints(repo.Path); len(checkpoints) != 1 {
+		t.Fatalf("expected no safety checkpoint for a refused restore, got %d", len(checkpoints))
+	}
+}
+
+func TestCheckpoint_KeepsNewestOnly(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+	for i := 0; i < maxCheckpoints+3; i++ {
+		if _, err := svc.CreateCheckpoint(repo.Path, fmt.Sprintf("run %d", i)); err != nil {
+			t.Fatalf("CreateCheckpoint: %v", err)
+		}
+	}
+	checkpoints, err := svc.Checkpoints(repo.Path)
+	if err != nil || len(checkpoints) != maxCheckpoints {
+		t.Fatalf("expected %d checkpoints, got %d (%v)", maxCheckpoints, len(checkpoints), err)
+	}
+	if checkpoints[0].Label != fmt.Sprintf("run %d", maxCheckpoints+2) {
+		t.Fatalf("newest checkpoint = %q", checkpoints[0].Label)
+	}
+}
+
+func TestChangeSummary_SinceCheckpoint(t *testing.T) {
+	svc, repo := newTestGitRepo(t)
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repo.Path, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	// Edits made before the run are not part of its summary.
+	write("draft.txt", "mine\n")
+	write("old.txt", "a\nb\n")
+	if err := svc.runGit(repo.Path, "add", "old.txt"); err != nil {
+		t.Fatalf("git add: %v", err)
+	}
+	if err := svc.runGit(repo.Path, "commit", "-q", "-m", "old"); err != nil {
+		t.Fatalf("git commit: %v", err)
+	}
+	cp, err := svc.CreateCheckpoint(repo.Path, "before: run")
+	if err != nil {
+		t.Fatalf("CreateCheckpoint: %v", err)
+	}
+
+	write("README.md", "hello\nworld\n")
+	write("new.go", "package x\n")
+	write("notes café.md", "one\ntwo\n")
+	if err := os.Remove(filepath.Join(repo.Path, "old.txt")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	summary, err := svc.ChangeSummary(repo.Path, cp.Commit)
+	if err != nil {
+		t.Fatalf("ChangeSummary: %v", err)
+	}
+	byPath := make(map[string]FileChange)
+	for _, file := range summary.Files {
+		byPath[file.Path] = file
+	}
+	if len(summary.Files) != 4 || summary.Insertions != 4 || summary.Deletions != 2 {
+		t.Fatalf("unexpected summary: %#v", summary)
+	}
+	if f := byPath["README.md"]; f.Status != "modified" || f.Insertions != 1 || f.Deletions != 0 || f.Untracked {
+		t.Fatalf("unexpected README change: %#v", f)
+	}
+	if f := byPath["new.go"]; f.Status != "added" || !f.Untracked {
+		t.Fatalf("unexpected new.go change: %#v", f)
+	}
+	if f := byPath["old.txt"]; f.Status != "deleted" || f.Deletions != 2 {
+		t.Fatalf("unexpected old.txt change: %#v", f)
+	}
+	if f := byPath["notes café.md"]; f.Status != "added" || f.Insertions != 2 || !f.Untracked {
+		t.Fatalf("unexpected change for a path with a space and non-ASCII name: %#v", f)
+	}
+
+	diff, err := svc.FullDiff(repo.Path, "new.go")
+	if err != nil {
+		t.Fatalf("FullDiff: %v", err)
+	}
+	if !strings.Contains(diff, "+++ b/new.go") || strings.Contains(diff, "README.md") {
+		t.Fatalf("expected only the untracked file in the diff, got %q", diff)
+	}
+	if status, _ := svc.runGitOutput(repo.Path, "status", "--porcelain"); !strings.Contains(status, "?? new.go") {
+		t.Fatalf("diffing must not stage files, status %q", status)
+	}
+}
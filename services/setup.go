@@ -297,10 +297,22 @@ func (svc *SetupService) registerTelegramBotCommands(secret string) error {
 		{Text: "delete", Description: "Delete the current topic and repo"},
 		{Text: "github", Description: "Configure GitHub auth (/github ssh|status|logout)"},
 		{Text: "git", Description: "Run git in the topic repo (/git <args...>)"},
-		{Text: "branch", Description: "Create/switch working branch (/branch <name>)"},
-		{Text: "commit", Description: "Commit, push, and open PR (/commit [message])"},
+		{Text: "branch", Description: "Switch to a branch worktree or list them (/branch [name] | remove <name>)"},
+		{Text: "commit", Description: "Commit, push, and open PR (/commit [--draft] [message])"},
 		{Text: "pull", Description: "Checkout main and run git pull"},
 		{Text: "preview", Description: "Start/stop web preview (/preview [start|status|stop])"},
+		{Text: "agent", Description: "Show or switch the topic agent (/agent [id|default] [model])"},
+		{Text: "mode", Description: "Show or set the topic sandbox (/mode [read-only|workspace-write|full|default])"},
+		{Text: "isolation", Description: "Show or set how agents are executed (/isolation [host|bwrap|container|default])"},
+		{Text: "stop", Description: "Stop the running agent (/stop [all] also drops queued requests)"},
+		{Text: "review", Description: "Implement with the topic agent and loop with a reviewer (/review <prompt>)"},
+		{Text: "diff", Description: "Show uncommitted changes, sent as a file when long (/diff [path])"},
+		{Text: "undo", Description: "Restore the working tree from before the last agent run"},
+		{Text: "checkpoints", Description: "List checkpoints or restore one (/checkpoints [n])"},
+		{Text: "history", Description: "Show or export the topic transcript (/history [n|export])"},
+		{Text: "usage", Description: "Show agent token, cost and time usage (/usage [today|week])"},
+		{Text: "budget", Description: "Show or raise agent budgets (/budget [global] <tokens|minutes|hops> <n>)"},
+		{Text: "ask_all", Description: "Ask every enabled agent in parallel (/ask_all <prompt>)"},
 	}
 
 	if err := bot.SetCommands(commands, tb.CommandScope{Type: tb.CommandScopeDefault}); err != nil {
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
@@ -12,15 +13,18 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/requiem-ai/gocode/context"
+	"github.com/requiem-ai/gocode/llm"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	tb "gopkg.in/telebot.v3"
@@ -34,15 +38,21 @@ type TelegramService struct {
 	git     *GitService
 	agent   *AgentService
 	preview *PreviewService
+	// transcriber turns voice messages into prompts; nil disables voice.
+	transcriber Transcriber
+	transcripts *TranscriptStore
 
 	mu                sync.Mutex
 	topicContexts     map[string]*TopicContext
 	topicContextsPath string
 	allowedUserID     int64
+	adminUserIDs      map[int64]struct{}
 	port              int
 	pingServer        *http.Server
 	runQueueMu        sync.Mutex
 	runQueues         map[string]chan func()
+	activeRunsMu      sync.Mutex
+	activeRuns        map[string]*activeAgentRun
 	outboundQueue     chan *telegramOutboundTask
 	outboundStop      chan struct{}
 	outboundWG        sync.WaitGroup
@@ -53,9 +63,33 @@ type TelegramService struct {
 }
 
 type TopicContext struct {
+	// Deprecated: Messages is no longer written; transcripts are kept in the
+	// topic's history log. It stays so older topic files load and save
+	// without losing their messages.
 	Messages []string
 	RepoURL  string
 	RepoPath string
+	// Agent is the topic's preferred starting agent; empty uses DEFAULT_AGENT.
+	Agent string
+	// Model optionally overrides the preferred agent's model.
+	Model string
+	// Sandbox is the topic's sandbox mode; empty uses AGENT_SANDBOX.
+	Sandbox llm.SandboxMode
+	// Isolation is how the topic's agents are executed; empty uses
+	// AGENT_ISOLATION.
+	Isolation llm.IsolationMode
+	// Worktree is the checkout that agents and git commands use, selected
+	// with /branch; empty uses the topic repo. Branch is checked out there.
+	Worktree string
+	Branch   string
+}
+
+// activeAgentRun tracks the in-flight agent run of a topic so /stop can
+// cancel it.
+type activeAgentRun struct {
+	prompt  string
+	started time.Time
+	cancel  ctx.CancelFunc
 }
 
 type detectedFileURI struct {
@@ -149,6 +183,16 @@ func (svc *TelegramService) Configure(ctx *context.Context) (err error) {
 	}
 	svc.allowedUserID = allowedUserID
 
+	svc.adminUserIDs, err = parseAdminUserIDs(os.Getenv("ADMIN_USER_IDS"))
+	if err != nil {
+		return err
+	}
+
+	svc.transcriber, err = loadTranscriber()
+	if err != nil {
+		return err
+	}
+
 	port, err := strconv.Atoi(os.Getenv("TELEGRAM_PORT"))
 	if err != nil {
 		return fmt.Errorf("invalid TELEGRAM_PORT %w", err)
@@ -181,6 +225,7 @@ func (svc *TelegramService) Configure(ctx *context.Context) (err error) {
 
 	svc.topicContexts = make(map[string]*TopicContext)
 	svc.runQueues = make(map[string]chan func())
+	svc.activeRuns = make(map[string]*activeAgentRun)
 	svc.outboundQueue = make(chan *telegramOutboundTask, 256)
 	svc.outboundStop = make(chan struct{})
 	path := strings.TrimSpace(os.Getenv("TELEGRAM_TOPIC_CONTEXTS_PATH"))
@@ -193,6 +238,16 @@ func (svc *TelegramService) Configure(ctx *context.Context) (err error) {
 	}
 	svc.topicContextsPath = absPath
 
+	transcriptsDir := strings.TrimSpace(os.Getenv("TELEGRAM_TRANSCRIPTS_DIR"))
+	if transcriptsDir == "" {
+		transcriptsDir = filepath.Join(filepath.Dir(absPath), "transcripts")
+	}
+	transcriptsDir, err = filepath.Abs(transcriptsDir)
+	if err != nil {
+		return err
+	}
+	svc.transcripts = NewTranscriptStore(transcriptsDir)
+
 	return svc.DefaultService.Configure(ctx)
 }
 
@@ -246,8 +301,23 @@ func (svc *TelegramService) setupHandlers() {
 	svc.Bot.Handle("/branch", svc.guardHandler(svc.onBranch))
 	svc.Bot.Handle("/commit", svc.guardHandler(svc.onCommit))
 	svc.Bot.Handle("/restart", svc.guardHandler(svc.onRestart))
+	svc.Bot.Handle("/stop", svc.guardHandler(svc.onStop))
+	svc.Bot.Handle("/agent", svc.guardHandler(svc.onAgent))
+	svc.Bot.Handle("/mode", svc.guardHandler(svc.onMode))
+	svc.Bot.Handle("/isolation", svc.guardHandler(svc.onIsolation))
+	svc.Bot.Handle("/ask_all", svc.guardHandler(svc.onAskAll))
+	svc.Bot.Handle("/review", svc.guardHandler(svc.onReview))
+	svc.Bot.Handle("/usage", svc.guardHandler(svc.onUsage))
+	svc.Bot.Handle("/history", svc.guardHandler(svc.onHistory))
+	svc.Bot.Handle("/diff", svc.guardHandler(svc.onDiff))
+	svc.Bot.Handle("/undo", svc.guardHandler(svc.onUndo))
+	svc.Bot.Handle("/checkpoints", svc.guardHandler(svc.onCheckpoints))
+	svc.Bot.Handle("/budget", svc.guardHandler(svc.onBudget))
 
 	svc.Bot.Handle(tb.OnText, svc.guardHandler(svc.onText))
+	svc.Bot.Handle(tb.OnPhoto, svc.guardHandler(svc.onAttachment))
+	svc.Bot.Handle(tb.OnDocument, svc.guardHandler(svc.onAttachment))
+	svc.Bot.Handle(tb.OnVoice, svc.guardHandler(svc.onVoice))
 
 	svc.deleteTopicMarkup = &tb.ReplyMarkup{}
 	svc.deleteTopicConfirm = svc.deleteTopicMarkup.Data("Delete", "topic_delete_confirm")
@@ -399,6 +469,36 @@ func (svc *TelegramService) isAllowedUser(c tb.Context) (bool, string) {
 	return true, ""
 }
 
+// isAdmin reports whether the sender may change budgets and sandbox modes.
+// ADMIN_USER_IDS lists admins; when unset, every allowed user is an admin.
+func (svc *TelegramService) isAdmin(c tb.Context) bool {
+	if len(svc.adminUserIDs) == 0 {
+		return true
+	}
+	sender := c.Sender()
+	if sender == nil {
+		return false
+	}
+	_, ok := svc.adminUserIDs[sender.ID]
+	return ok
+}
+
+func parseAdminUserIDs(raw string) (map[int64]struct{}, error) {
+	ids := make(map[int64]struct{})
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ADMIN_USER_IDS entry %q: %w", part, err)
+		}
+		ids[id] = struct{}{}
+	}
+	return ids, nil
+}
+
 func (svc *TelegramService) parseAllowedUserID() (int64, error) {
 	raw := strings.TrimSpace(os.Getenv("USER_ID"))
 	if raw == "" {
@@ -582,6 +682,7 @@ func (svc *TelegramService) onText(c tb.Context) error {
 	threadID := 0
 	msgRef := c.Message()
 	opts := &tb.SendOptions{}
+	reply, hasReply := inboundReply(msg, svc.Bot.Me.ID)
 
 	if msg.TopicMessage && msg.ThreadID != 0 {
 		threadID = msg.ThreadID
@@ -605,7 +706,7 @@ func (svc *TelegramService) onText(c tb.Context) error {
 
 		repoPath := ""
 		if threadID != 0 {
-			repo, err := svc.ensureRepo(chat, threadID)
+			repo, err := svc.ensureWorktree(chat, threadID)
 			if err != nil {
 				logger.Error().Err(err).Msg("onText: failed to ensure repo")
 				if _, sendErr := svc.sendWithRetry(chat, "Couldn't prepare the repo for this topic.", opts); sendErr != nil {
@@ -616,11 +717,373 @@ func (svc *TelegramService) onText(c tb.Context) error {
 			repoPath = repo.Path
 		}
 
-		svc.runAgentWithPendingUpdates(chat, opts, repoPath, text)
+		req := svc.topicRunRequest(chat.ID, threadID, repoPath, text)
+		if hasReply {
+			req.Prompt = formatReplyPrompt(reply, req.Prompt)
+			if reply.HasFile && repoPath != "" && reply.File.FileSize <= maxAttachmentSize {
+				attachment, err := svc.saveAttachment(repoPath, reply.File, reply.FileName, reply.FileMIME)
+				if err != nil {
+					logger.Warn().Err(err).Str("file", reply.FileName).Msg("onText: failed to download replied-to file")
+				} else {
+					req.Attachments = append(req.Attachments, attachment)
+				}
+			}
+		}
+		svc.runAgentWithPendingUpdates(chat, opts, req)
+	})
+	return nil
+}
+
+// maxReplyContextLen caps how much of a replied-to message goes into the
+// prompt.
+const maxReplyContextLen = 3000
+
+// replyContext is the message a prompt was sent in reply to.
+type replyContext struct {
+	// FromBot is set when the user replied to one of the bot's messages.
+	FromBot bool
+	// Text is the part the user quoted, or the whole text or caption.
+	Text   string
+	Quoted bool
+	// File is the photo or document attached to the replied-to message.
+	File     tb.File
+	FileName string
+	FileMIME string
+	HasFile  bool
+}
+
+// inboundReply returns what msg replies to. In forum topics Telegram marks
+// every message as a reply to the topic's first message, so that is ignored.
+func inboundReply(msg *tb.Message, botID int64) (replyContext, bool) {
+	replyTo := msg.ReplyTo
+	if replyTo == nil || replyTo.TopicCreated != nil || (msg.TopicMessage && replyTo.ID == msg.ThreadID) {
+		return replyContext{}, false
+	}
+
+	reply := replyContext{FromBot: replyTo.Sender != nil && replyTo.Sender.ID == botID}
+	switch {
+	case msg.Quote != nil && strings.TrimSpace(msg.Quote.Text) != "":
+		reply.Text = strings.TrimSpace(msg.Quote.Text)
+		reply.Quoted = true
+	case strings.TrimSpace(replyTo.Text) != "":
+		reply.Text = strings.TrimSpace(replyTo.Text)
+	default:
+		reply.Text = strings.TrimSpace(replyTo.Caption)
+	}
+	reply.File, reply.FileName, reply.FileMIME, reply.HasFile = inboundAttachment(replyTo)
+
+	if reply.Text == "" && !reply.HasFile {
+		return replyContext{}, false
+	}
+	return reply, true
+}
+
+// formatReplyPrompt puts the replied-to message in front of prompt so short
+// follow-ups such as "fix this" have something to refer to.
+func formatReplyPrompt(reply replyContext, prompt string) string {
+	source := "an earlier message"
+	if reply.FromBot {
+		source = "your earlier answer"
+	}
+
+	var b strings.Builder
+	switch {
+	case reply.Quoted:
+		fmt.Fprintf(&b, "The user is replying to this part of %s:\n", source)
+	case reply.Text != "":
+		fmt.Fprintf(&b, "The user is replying to %s:\n", source)
+	default:
+		fmt.Fprintf(&b, "The user is replying to %s.\n", source)
+	}
+	if reply.Text != "" {
+		text := reply.Text
+		if len(text) > maxReplyContextLen {
+			cut := maxReplyContextLen
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			text = text[:cut] + "\n...[truncated]"
+		}
+		for _, line := range strings.Split(text, "\n") {
+			b.WriteString("> " + line + "\n")
+		}
+	}
+	if reply.HasFile {
+		fmt.Fprintf(&b, "That message had the file %s attached.\n", reply.FileName)
+	}
+	b.WriteString("\n")
+	b.WriteString(prompt)
+	return b.String()
+}
+
+// topicRunRequest builds the agent request for a user prompt in a topic. It
+// applies the topic's agent, sandbox and isolation, and routes a prompt that
+// starts with @<agent> to that agent.
+func (svc *TelegramService) topicRunRequest(chatID int64, threadID int, repoPath, text string) AgentRunRequest {
+	agentID, model := svc.topicAgent(chatID, threadID)
+	prompt := text
+	if addressedID, addressedPrompt, ok := svc.agent.ParseAddressedAgent(text); ok {
+		log.Info().Int64("chat_id", chatID).Int("thread_id", threadID).Str("agent", addressedID).Msg("message addressed to agent")
+		if addressedID != agentID {
+			model = ""
+		}
+		agentID = addressedID
+		prompt = addressedPrompt
+	}
+	return AgentRunRequest{
+		RepoPath:  repoPath,
+		Prompt:    prompt,
+		Agent:     agentID,
+		Model:     model,
+		Topic:     topicKey(chatID, threadID),
+		Sandbox:   svc.topicSandbox(chatID, threadID),
+		Isolation: svc.topicIsolation(chatID, threadID),
+	}
+}
+
+// maxAttachmentSize is the largest file the Bot API lets bots download.
+const maxAttachmentSize = 20 << 20
+
+// attachmentsDir is where inbound files are saved, relative to the topic repo,
+// so isolated agents can read them. botDataExclude keeps it out of git.
+const (
+	attachmentsDir = ".gocode/attachments"
+	botDataExclude = "/.gocode/"
+)
+
+var attachmentNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// onAttachment saves a photo or document sent to a topic and runs the topic
+// agent with the caption as the prompt and the file attached.
+func (svc *TelegramService) onAttachment(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onAttachment: nil message, ignoring")
+		return nil
+	}
+	file, name, mimeType, ok := inboundAttachment(msg)
+	if !ok {
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Send files inside a topic so they can be saved with its repo.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
+	}
+	if file.FileSize > maxAttachmentSize {
+		return c.Send(fmt.Sprintf("%s is too large to download (Telegram bots are limited to %d MB).", name, maxAttachmentSize>>20), opts)
+	}
+
+	chat := c.Chat()
+	threadID := msg.ThreadID
+	caption := strings.TrimSpace(msg.Caption)
+	log.Info().Int("topic", threadID).Str("file", name).Str("mime", mimeType).Msg("onAttachment")
+
+	svc.enqueueWork(chat, threadID, func() {
+		logger := log.With().Int64("chat_id", chat.ID).Int("thread_id", threadID).Logger()
+
+		if err := svc.reactWithRetry(chat, msg, tb.ReactionOptions{Reactions: []tb.Reaction{{
+			Type:  "emoji",
+			Emoji: "👍",
+		}}}); err != nil {
+			logger.Warn().Err(err).Msg("onAttachment: failed to react")
+		}
+
+		repo, err := svc.ensureWorktree(chat, threadID)
+		if err != nil {
+			logger.Error().Err(err).Msg("onAttachment: failed to ensure repo")
+			if _, sendErr := svc.sendWithRetry(chat, "Couldn't prepare the repo for this topic.", opts); sendErr != nil {
+				logger.Warn().Err(sendErr).Msg("onAttachment: failed to send repo error")
+			}
+			return
+		}
+
+		attachment, err := svc.saveAttachment(repo.Path, file, name, mimeType)
+		if err != nil {
+			logger.Error().Err(err).Str("file", name).Msg("onAttachment: failed to download")
+			if _, sendErr := svc.sendWithRetry(chat, fmt.Sprintf("Couldn't download %s.", name), opts); sendErr != nil {
+				logger.Warn().Err(sendErr).Msg("onAttachment: failed to send download error")
+			}
+			return
+		}
+
+		prompt := caption
+		if prompt == "" {
+			prompt = fmt.Sprintf("I sent you %s. Look at it and tell me what stands out in the context of this repo.", name)
+		}
+		req := svc.topicRunRequest(chat.ID, threadID, repo.Path, prompt)
+		req.Attachments = []llm.Attachment{attachment}
+		svc.runAgentWithPendingUpdates(chat, opts, req)
+	})
+	return nil
+}
+
+// voiceTranscribeTimeout bounds a single transcription.
+const voiceTranscribeTimeout = 5 * time.Minute
+
+func (svc *TelegramService) onVoice(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil || msg.Voice == nil {
+		log.Warn().Msg("onVoice: nil voice message, ignoring")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Send voice messages inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
+	}
+	if svc.transcriber == nil {
+		return c.Send("Voice messages are disabled. Set WHISPER_MODEL to transcribe them with whisper.cpp.", opts)
+	}
+	if msg.Voice.FileSize > maxAttachmentSize {
+		return c.Send(fmt.Sprintf("Voice message is too large to download (Telegram bots are limited to %d MB).", maxAttachmentSize>>20), opts)
+	}
+
+	chat := c.Chat()
+	threadID := msg.ThreadID
+	voice := msg.Voice.File
+	log.Info().Int("topic", threadID).Int("duration", msg.Voice.Duration).Str("transcriber", svc.transcriber.Name()).Msg("onVoice")
+
+	svc.enqueueWork(chat, threadID, func() {
+		logger := log.With().Int64("chat_id", chat.ID).Int("thread_id", threadID).Logger()
+
+		if err := svc.reactWithRetry(chat, msg, tb.ReactionOptions{Reactions: []tb.Reaction{{
+			Type:  "emoji",
+			Emoji: "👍",
+		}}}); err != nil {
+			logger.Warn().Err(err).Msg("onVoice: failed to react")
+		}
+
+		// Register the transcription like an agent run so /stop can
+		// cancel it.
+		runCtx, cancelRun := ctx.WithCancel(ctx.Background())
+		runKey := topicKey(chat.ID, threadID)
+		svc.registerActiveRun(runKey, "voice message transcription", time.Now(), cancelRun)
+		text, err := svc.transcribeVoice(runCtx, voice)
+		stopped := errors.Is(runCtx.Err(), ctx.Canceled)
+		svc.unregisterActiveRun(runKey)
+		cancelRun()
+		if stopped {
+			logger.Info().Msg("onVoice: transcription stopped")
+			return
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("onVoice: failed to transcribe")
+			if _, sendErr := svc.sendWithRetry(chat, "Couldn't transcribe the voice message.", opts); sendErr != nil {
+				logger.Warn().Err(sendErr).Msg("onVoice: failed to send transcription error")
+			}
+			return
+		}
+		if text == "" {
+			if _, sendErr := svc.sendWithRetry(chat, "Couldn't hear anything in the voice message.", opts); sendErr != nil {
+				logger.Warn().Err(sendErr).Msg("onVoice: failed to send empty transcript notice")
+			}
+			return
+		}
+
+		echoOpts := cloneSendOptions(opts)
+		echoOpts.ReplyTo = msg
+		if _, err := svc.sendWithRetry(chat, formatVoiceTranscript(text), echoOpts); err != nil {
+			logger.Warn().Err(err).Msg("onVoice: failed to echo transcript")
+		}
+
+		repo, err := svc.ensureWorktree(chat, threadID)
+		if err != nil {
+			logger.Error().Err(err).Msg("onVoice: failed to ensure repo")
+			if _, sendErr := svc.sendWithRetry(chat, "Couldn't prepare the repo for this topic.", opts); sendErr != nil {
+				logger.Warn().Err(sendErr).Msg("onVoice: failed to send repo error")
+			}
+			return
+		}
+
+		svc.runAgentWithPendingUpdates(chat, opts, svc.topicRunRequest(chat.ID, threadID, repo.Path, text))
 	})
 	return nil
 }
 
+// transcribeVoice downloads a voice note to a temporary file and transcribes
+// it under parent. The audio is not kept.
+func (svc *TelegramService) transcribeVoice(parent ctx.Context, file tb.File) (string, error) {
+	tmp, err := os.CreateTemp("", "gocode-voice-*.ogg")
+	if err != nil {
+		return "", err
+	}
+	path := tmp.Name()
+	tmp.Close()
+	defer os.Remove(path)
+
+	if err := svc.Bot.Download(&file, path); err != nil {
+		return "", fmt.Errorf("download voice message: %w", err)
+	}
+
+	runCtx, cancel := ctx.WithTimeout(parent, voiceTranscribeTimeout)
+	defer cancel()
+	return svc.transcriber.Transcribe(runCtx, path)
+}
+
+func formatVoiceTranscript(text string) string {
+	return "🎙️ Transcript:\n" + text
+}
+
+// inboundAttachment returns the file, a display name and the MIME type of a
+// photo or document message.
+func inboundAttachment(msg *tb.Message) (tb.File, string, string, bool) {
+	switch {
+	case msg.Photo != nil:
+		// Telegram re-encodes photos as JPEG.
+		return msg.Photo.File, "photo-" + msg.Photo.UniqueID + ".jpg", "image/jpeg", true
+	case msg.Document != nil:
+		name := strings.TrimSpace(msg.Document.FileName)
+		if name == "" {
+			name = "document-" + msg.Document.UniqueID
+		}
+		mimeType := msg.Document.MIME
+		if mimeType == "" {
+			mimeType = mime.TypeByExtension(filepath.Ext(name))
+		}
+		return msg.Document.File, name, mimeType, true
+	default:
+		return tb.File{}, "", "", false
+	}
+}
+
+// saveAttachment downloads file into the repo's attachments directory.
+func (svc *TelegramService) saveAttachment(repoPath string, file tb.File, name, mimeType string) (llm.Attachment, error) {
+	dir := filepath.Join(repoPath, filepath.FromSlash(attachmentsDir))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return llm.Attachment{}, err
+	}
+	if svc.git != nil {
+		if err := svc.git.ExcludeLocally(repoPath, botDataExclude); err != nil {
+			log.Warn().Err(err).Str("repo", repoPath).Msg("failed to exclude attachments from git")
+		}
+	}
+
+	path := filepath.Join(dir, time.Now().Format("20060102-150405")+"-"+sanitizeAttachmentName(name))
+	if err := svc.Bot.Download(&file, path); err != nil {
+		return llm.Attachment{}, err
+	}
+	return llm.Attachment{Path: path, Name: name, MIME: mimeType}, nil
+}
+
+// sanitizeAttachmentName makes a user-supplied file name safe to use as a
+// single path element.
+func sanitizeAttachmentName(name string) string {
+	name = attachmentNameUnsafe.ReplaceAllString(filepath.Base(name), "_")
+	name = strings.Trim(name, "._")
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
 func (svc *TelegramService) dispatchTextCommand(c tb.Context) (bool, error) {
 	msg := c.Message()
 	if msg == nil {
@@ -656,6 +1119,30 @@ func (svc *TelegramService) dispatchTextCommand(c tb.Context) (bool, error) {
 		return true, svc.onCommit(c)
 	case "/restart":
 		return true, svc.onRestart(c)
+	case "/stop":
+		return true, svc.onStop(c)
+	case "/agent":
+		return true, svc.onAgent(c)
+	case "/mode":
+		return true, svc.onMode(c)
+	case "/isolation":
+		return true, svc.onIsolation(c)
+	case "/ask-all", "/ask_all":
+		return true, svc.onAskAll(c)
+	case "/review":
+		return true, svc.onReview(c)
+	case "/usage":
+		return true, svc.onUsage(c)
+	case "/history":
+		return true, svc.onHistory(c)
+	case "/diff":
+		return true, svc.onDiff(c)
+	case "/undo":
+		return true, svc.onUndo(c)
+	case "/checkpoints":
+		return true, svc.onCheckpoints(c)
+	case "/budget":
+		return true, svc.onBudget(c)
 	default:
 		return false, nil
 	}
@@ -684,15 +1171,18 @@ func parseCommandText(text string) (command string, payload string, ok bool) {
 	return commandToken, payload, true
 }
 
-func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.SendOptions, repoPath, prompt string) {
+func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.SendOptions, req AgentRunRequest) {
 	if opts == nil {
 		opts = &tb.SendOptions{}
 	}
+	repoPath := req.RepoPath
+	prompt := req.Prompt
 
 	logger := log.With().
 		Int64("chat_id", chat.ID).
 		Int("thread_id", opts.ThreadID).
 		Str("repo", repoPath).
+		Str("agent", req.Agent).
 		Logger()
 
 	logger.Info().Msg("runAgentWithPendingUpdates: starting")
@@ -711,15 +1201,20 @@ func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.S
 	var pendingMessageID atomic.Int64
 	pendingOpts := cloneSendOptions(opts)
 	pendingOpts.DisableNotification = true
+	output := &agentOutputTail{}
 
 	stopUpdates := make(chan struct{})
 	updatesDone := make(chan struct{})
 	go func() {
 		defer close(updatesDone)
 
-		ticker := time.NewTicker(1 * time.Minute)
+		ticker := time.NewTicker(agentStreamEditInterval)
 		defer ticker.Stop()
 
+		// Edits are rate limited by Telegram, so the message is only edited
+		// when there is new output, or once a minute while there is none.
+		var lastSeq uint64
+		lastEdit := started
 		for {
 			select {
 			case <-stopUpdates:
@@ -727,7 +1222,17 @@ func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.S
 				return
 			case <-ticker.C:
 				elapsed := int(time.Since(started).Seconds())
-				updateText := fmt.Sprintf("Still thinking... (%ds elapsed)", elapsed)
+				agentID, tail, seq := output.Snapshot()
+				updateText := ""
+				if tail != "" && seq != lastSeq {
+					updateText = formatPendingAgentOutput(agentID, elapsed, tail)
+				} else if tail == "" && time.Since(lastEdit) >= time.Minute {
+					updateText = fmt.Sprintf("Still thinking... (%ds elapsed)", elapsed)
+				}
+				if updateText == "" {
+					continue
+				}
+
 				currentPendingMessageID := int(pendingMessageID.Load())
 				nextMessageID, updateErr := svc.editOrSendByMessageID(chat, pendingOpts, currentPendingMessageID, updateText, "")
 				if updateErr != nil {
@@ -735,12 +1240,63 @@ func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.S
 					continue
 				}
 				pendingMessageID.Store(int64(nextMessageID))
+				lastSeq = seq
+				lastEdit = time.Now()
 			}
 		}
 	}()
 
+	runCtx, cancelRun := ctx.WithCancel(ctx.Background())
+	runKey := topicKey(chat.ID, opts.ThreadID)
+	svc.registerActiveRun(runKey, prompt, started, cancelRun)
+	defer func() {
+		svc.unregisterActiveRun(runKey)
+		cancelRun()
+	}()
+
+	answeredBy := req.Agent
+	if answeredBy == "" {
+		answeredBy = svc.agent.DefaultAgent()
+	}
+	promptEntry := TranscriptEntry{Kind: TranscriptPrompt, Agent: answeredBy, Text: prompt}
+	for _, attachment := range req.Attachments {
+		promptEntry.Attachments = append(promptEntry.Attachments, attachment.Path)
+	}
+	svc.recordTranscript(runKey, promptEntry)
+
+	var checkpoint *Checkpoint
+	if repoPath != "" && svc.git != nil {
+		cp, err := svc.git.CreateCheckpoint(repoPath, checkpointLabel(prompt))
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to checkpoint the working tree before the agent run")
+		}
+		checkpoint = cp
+	}
+
+	// Retries and fallbacks are summarized in the final reply rather than
+	// posted as they happen. Output events arrive from the agent's pipe
+	// goroutines, so stateMu guards answeredBy and recoveryNotes.
+	var stateMu sync.Mutex
+	var recoveryNotes []string
 	logger.Info().Msg("calling agent.RunWithEvents")
-	resp, runErr := svc.agent.RunWithEvents(repoPath, prompt, func(event AgentEvent) {
+	resp, runErr := svc.agent.RunWithEvents(runCtx, req, func(event AgentEvent) {
+		stateMu.Lock()
+		answeredBy = answeringAgent(answeredBy, event)
+		if event.Type == AgentEventRetry || event.Type == AgentEventFallback {
+			recoveryNotes = append(recoveryNotes, formatRecoveryNote(event))
+		}
+		stateMu.Unlock()
+
+		if event.Type == AgentEventOutput {
+			output.Append(event.From, event.Text)
+			return
+		}
+		// Every other event starts a new hop, which may rerun the same agent.
+		output.Reset()
+		svc.recordTranscript(runKey, TranscriptEntry{Kind: string(event.Type), Agent: event.From, To: event.To, Text: event.Text})
+		if event.Type == AgentEventRetry || event.Type == AgentEventFallback {
+			return
+		}
 		evtText := formatAgentEventMessage(event)
 		if strings.TrimSpace(evtText) == "" {
 			return
@@ -750,16 +1306,40 @@ func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.S
 		}
 	})
 	elapsed := time.Since(started)
+	stateMu.Lock()
+	finalAgent, notes := answeredBy, recoveryNotes
+	stateMu.Unlock()
 	close(stopUpdates)
 	select {
 	case <-updatesDone:
 	case <-time.After(2 * time.Second):
 		logger.Warn().Msg("timed out waiting for pending updates loop to stop")
 	}
+	changes := svc.runChanges(repoPath, checkpoint)
 
+	if runErr != nil && errors.Is(runErr, ctx.Canceled) {
+		logger.Info().Dur("elapsed", elapsed).Msg("agent.Run stopped by user")
+		stoppedText := appendChangeSummary("Agent run stopped.", changes)
+		svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptStopped, Agent: finalAgent, Text: stoppedText})
+		if err := svc.sendFinalResponse(chat, opts, int(pendingMessageID.Load()), stoppedText, ""); err != nil {
+			logger.Warn().Err(err).Msg("failed to send agent stopped response")
+		}
+		return
+	}
+	var budgetErr *BudgetExceededError
+	if runErr != nil && errors.As(runErr, &budgetErr) {
+		logger.Info().Err(runErr).Dur("elapsed", elapsed).Msg("agent.Run stopped by budget")
+		svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptFailure, Agent: finalAgent, Text: runErr.Error()})
+		budgetText := appendChangeSummary(formatBudgetExceeded(budgetErr, resp), changes)
+		if err := svc.sendFinalResponse(chat, opts, int(pendingMessageID.Load()), budgetText, ""); err != nil {
+			logger.Warn().Err(err).Msg("failed to send budget exceeded response")
+		}
+		return
+	}
 	if runErr != nil {
 		logger.Error().Err(runErr).Dur("elapsed", elapsed).Msg("agent.Run failed")
-		failureText := formatAgentFailureResponse(runErr, resp)
+		failureText := appendChangeSummary(appendRecoveryNotes(formatAgentFailureResponse(runErr, resp), notes), changes)
+		svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptFailure, Agent: finalAgent, Text: failureText})
 		if err := svc.sendFinalResponse(chat, opts, int(pendingMessageID.Load()), failureText, ""); err != nil {
 			logger.Warn().Err(err).Msg("failed to send agent failure response")
 		}
@@ -767,6 +1347,8 @@ func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.S
 	}
 
 	logger.Info().Dur("elapsed", elapsed).Int("response_len", len(resp)).Msg("agent.Run completed")
+	resp = appendChangeSummary(appendRecoveryNotes(resp, notes), changes)
+	svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptAnswer, Agent: finalAgent, Text: resp})
 
 	fileURIs := detectFileURIs(resp)
 	responseText := resp
@@ -813,6 +1395,83 @@ func (svc *TelegramService) runAgentWithPendingUpdates(chat *tb.Chat, opts *tb.S
 
 const maxAgentFailureDetailsLen = 3000
 
+// agentStreamEditInterval bounds how often the pending message is edited with
+// live agent output, keeping well under Telegram's edit rate limits.
+const agentStreamEditInterval = 5 * time.Second
+
+// maxAgentStreamTailLen is the amount of trailing agent output shown in the
+// pending message; the header keeps the edit under telegramMaxMessageLength.
+const maxAgentStreamTailLen = 3000
+
+// agentOutputTail keeps the most recent output of the agent currently running.
+// Output is reset whenever a different agent starts producing output and at
+// the start of every hop.
+type agentOutputTail struct {
+	mu      sync.Mutex
+	agentID string
+	text    string
+	// seq counts changes so callers can tell whether there is new output.
+	seq uint64
+}
+
+func (t *agentOutputTail) Append(agentID, chunk string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if agentID != t.agentID {
+		t.agentID = agentID
+		t.text = ""
+	}
+	t.seq++
+	t.text += chunk
+	if len(t.text) > maxAgentStreamTailLen {
+		cut := len(t.text) - maxAgentStreamTailLen
+		for cut < len(t.text) && !utf8.RuneStart(t.text[cut]) {
+			cut++
+		}
+		t.text = t.text[cut:]
+	}
+}
+
+// Reset drops the buffered output.
+func (t *agentOutputTail) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.agentID = ""
+	t.text = ""
+	t.seq++
+}
+
+// Snapshot returns the agent, its trimmed output and the change counter.
+func (t *agentOutputTail) Snapshot() (string, string, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.agentID, strings.TrimSpace(t.text), t.seq
+}
+
+func formatPendingAgentOutput(agentID string, elapsedSeconds int, tail string) string {
+	header := fmt.Sprintf("Working... (%ds elapsed)", elapsedSeconds)
+	if agentID != "" {
+		header = fmt.Sprintf("@%s working... (%ds elapsed)", agentID, elapsedSeconds)
+	}
+	return header + "\n\n" + tail
+}
+
+// answeringAgent returns the agent whose response the run will return after
+// event, given current. Output and fallbacks move it to the agent now working,
+// while review verdicts hand it back to the author, since a review run returns
+// the author's response rather than the reviewer's.
+func answeringAgent(current string, event AgentEvent) string {
+	switch event.Type {
+	case AgentEventOutput:
+		return event.From
+	case AgentEventFallback, AgentEventReview, AgentEventApproved:
+		return event.To
+	default:
+		return current
+	}
+}
+
 func formatAgentEventMessage(event AgentEvent) string {
 	body := strings.TrimSpace(event.Text)
 	if body == "" {
@@ -824,46 +1483,137 @@ func formatAgentEventMessage(event AgentEvent) string {
 		return fmt.Sprintf("[Agent handoff] %s -> @%s\n\n%s", event.From, event.To, body)
 	case AgentEventResponse:
 		return fmt.Sprintf("[Agent response] @%s -> %s\n\n%s", event.From, event.To, body)
+	case AgentEventReview:
+		return fmt.Sprintf("[Review round %d] @%s -> @%s\n\n%s", event.Round, event.From, event.To, body)
+	case AgentEventApproved:
+		return fmt.Sprintf("[Review round %d] @%s approved\n\n%s", event.Round, event.From, body)
 	default:
 		return ""
 	}
 }
 
-func formatAgentFailureResponse(runErr error, output string) string {
-	lines := []string{"Agent failed to run."}
-	if runErr != nil {
-		lines = append(lines, "Error: "+strings.TrimSpace(runErr.Error()))
+// formatRecoveryNote describes a retry or fallback for the final reply.
+func formatRecoveryNote(event AgentEvent) string {
+	switch event.Type {
+	case AgentEventRetry:
+		return fmt.Sprintf("@%s %s on attempt %d and was retried.", event.From, event.Kind.Describe(), event.Round)
+	case AgentEventFallback:
+		return fmt.Sprintf("@%s %s; fell back to @%s.", event.From, event.Kind.Describe(), event.To)
+	default:
+		return ""
 	}
+}
 
-	cleaned := strings.TrimSpace(output)
-	if cleaned == "" {
-		return strings.Join(lines, "\n")
+func appendRecoveryNotes(text string, notes []string) string {
+	if len(notes) == 0 {
+		return text
 	}
-
-	if runErr != nil && cleaned == strings.TrimSpace(runErr.Error()) {
-		return strings.Join(lines, "\n")
+	lines := make([]string, 0, len(notes)+1)
+	lines = append(lines, "Recovered from agent errors:")
+	for _, note := range notes {
+		lines = append(lines, "- "+note)
 	}
+	return strings.TrimSpace(text) + "\n\n" + strings.Join(lines, "\n")
+}
 
-	if len(cleaned) > maxAgentFailureDetailsLen {
-		cleaned = cleaned[:maxAgentFailureDetailsLen] + "\n...[truncated]"
+// runChanges summarizes what an agent run changed in repoPath since the
+// checkpoint taken before it. It returns "" when nothing changed or there is
+// no checkpoint to compare with.
+func (svc *TelegramService) runChanges(repoPath string, checkpoint *Checkpoint) string {
+	if repoPath == "" || checkpoint == nil || svc.git == nil {
+		return ""
 	}
-
-	lines = append(lines, "", "Agent output:", cleaned)
-	return strings.Join(lines, "\n")
+	summary, err := svc.git.ChangeSummary(repoPath, checkpoint.Commit)
+	if err != nil {
+		log.Warn().Err(err).Str("repo", repoPath).Msg("failed to summarize agent changes")
+		return ""
+	}
+	return formatChangeSummary(summary)
 }
 
-func detectFileURIs(text string) []detectedFileURI {
-	if strings.TrimSpace(text) == "" {
-		return nil
-	}
+// maxChangeSummaryFiles caps the files listed after a run; /diff has the rest.
+const maxChangeSummaryFiles = 15
 
-	matches := fileURIPattern.FindAllString(text, -1)
-	if len(matches) == 0 {
-		return nil
+func formatChangeSummary(summary *ChangeSummary) string {
+	if summary == nil || len(summary.Files) == 0 {
+		return ""
 	}
-
-	seen := make(map[string]struct{}, len(matches))
-	files := make([]detectedFileURI, 0, len(matches))
+	noun := "files"
+	if len(summary.Files) == 1 {
+		noun = "file"
+	}
+	lines := []string{fmt.Sprintf("Changed %d %s (+%d -%d):", len(summary.Files), noun, summary.Insertions, summary.Deletions)}
+	for i, file := range summary.Files {
+		if i == maxChangeSummaryFiles {
+			lines = append(lines, fmt.Sprintf("…and %d more, see /diff", len(summary.Files)-i))
+			break
+		}
+		marker := "M"
+		switch file.Status {
+		case "added":
+			marker = "A"
+		case "deleted":
+			marker = "D"
+		}
+		line := fmt.Sprintf("%s %s", marker, file.Path)
+		if file.Binary {
+			line += " (binary)"
+		} else {
+			line += fmt.Sprintf(" +%d -%d", file.Insertions, file.Deletions)
+		}
+		if file.Untracked {
+			line += " (untracked)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func appendChangeSummary(text, changes string) string {
+	if changes == "" {
+		return text
+	}
+	return strings.TrimSpace(text) + "\n\n" + changes
+}
+
+func formatAgentFailureResponse(runErr error, output string) string {
+	lines := []string{"Agent failed to run."}
+	if kind := llm.KindOf(runErr); kind != "" && kind != llm.ErrorCanceled {
+		lines[0] = fmt.Sprintf("Agent failed to run (%s).", kind.Describe())
+	}
+	if runErr != nil {
+		lines = append(lines, "Error: "+strings.TrimSpace(runErr.Error()))
+	}
+
+	cleaned := strings.TrimSpace(output)
+	if cleaned == "" {
+		return strings.Join(lines, "\n")
+	}
+
+	if runErr != nil && cleaned == strings.TrimSpace(runErr.Error()) {
+		return strings.Join(lines, "\n")
+	}
+
+	if len(cleaned) > maxAgentFailureDetailsLen {
+		cleaned = cleaned[:maxAgentFailureDetailsLen] + "\n...[truncated]"
+	}
+
+	lines = append(lines, "", "Agent output:", cleaned)
+	return strings.Join(lines, "\n")
+}
+
+func detectFileURIs(text string) []detectedFileURI {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	matches := fileURIPattern.FindAllString(text, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(matches))
+	files := make([]detectedFileURI, 0, len(matches))
 	for _, match := range matches {
 		candidate := trimFileURI(match)
 		if candidate == "" {
@@ -1101,6 +1851,105 @@ func (svc *TelegramService) safeRunTask(logger zerolog.Logger, task func()) {
 	task()
 }
 
+func (svc *TelegramService) registerActiveRun(key, prompt string, started time.Time, cancel ctx.CancelFunc) {
+	svc.activeRunsMu.Lock()
+	defer svc.activeRunsMu.Unlock()
+	svc.activeRuns[key] = &activeAgentRun{
+		prompt:  prompt,
+		started: started,
+		cancel:  cancel,
+	}
+}
+
+func (svc *TelegramService) unregisterActiveRun(key string) {
+	svc.activeRunsMu.Lock()
+	defer svc.activeRunsMu.Unlock()
+	delete(svc.activeRuns, key)
+}
+
+// cancelActiveRun cancels the in-flight agent run for key, if any, and
+// returns what was interrupted.
+func (svc *TelegramService) cancelActiveRun(key string) (*activeAgentRun, bool) {
+	svc.activeRunsMu.Lock()
+	run, ok := svc.activeRuns[key]
+	delete(svc.activeRuns, key)
+	svc.activeRunsMu.Unlock()
+
+	if !ok || run == nil {
+		return nil, false
+	}
+	run.cancel()
+	return run, true
+}
+
+// dropQueuedWork discards work waiting in the topic run queue without touching
+// the task currently executing. It returns the number of dropped tasks.
+func (svc *TelegramService) dropQueuedWork(key string) int {
+	svc.runQueueMu.Lock()
+	queue, ok := svc.runQueues[key]
+	svc.runQueueMu.Unlock()
+	if !ok {
+		return 0
+	}
+
+	dropped := 0
+	for {
+		select {
+		case <-queue:
+			dropped++
+		default:
+			return dropped
+		}
+	}
+}
+
+func (svc *TelegramService) onStop(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onStop: nil message")
+		return nil
+	}
+
+	opts := &tb.SendOptions{}
+	threadID := 0
+	if msg.TopicMessage && msg.ThreadID != 0 {
+		threadID = msg.ThreadID
+		opts.ThreadID = threadID
+	}
+
+	payload := strings.ToLower(strings.TrimSpace(msg.Payload))
+	if payload != "" && payload != "all" {
+		return c.Send("Usage: /stop [all]", opts)
+	}
+
+	key := topicKey(c.Chat().ID, threadID)
+	dropped := 0
+	if payload == "all" {
+		dropped = svc.dropQueuedWork(key)
+	}
+	run, stopped := svc.cancelActiveRun(key)
+
+	log.Info().Str("queue_key", key).Bool("stopped", stopped).Int("dropped", dropped).Msg("onStop")
+	return c.Send(formatStopSummary(run, stopped, dropped, time.Now()), opts)
+}
+
+func formatStopSummary(run *activeAgentRun, stopped bool, dropped int, now time.Time) string {
+	lines := make([]string, 0, 2)
+	if stopped && run != nil {
+		prompt := strings.TrimSpace(run.prompt)
+		if runes := []rune(prompt); len(runes) > 200 {
+			prompt = strings.TrimSpace(string(runes[:200])) + "..."
+		}
+		lines = append(lines, fmt.Sprintf("Stopped agent run after %s: %s", now.Sub(run.started).Round(time.Second), prompt))
+	} else {
+		lines = append(lines, "No agent run in progress.")
+	}
+	if dropped > 0 {
+		lines = append(lines, fmt.Sprintf("Dropped %d queued request(s).", dropped))
+	}
+	return strings.Join(lines, "\n")
+}
+
 func (svc *TelegramService) sendFinalResponse(chat *tb.Chat, baseOpts *tb.SendOptions, pendingMessageID int, text, parseMode string) error {
 	log.Debug().Int("pending_msg_id", pendingMessageID).Int("text_len", len(text)).Str("parse_mode", parseMode).Msg("sendFinalResponse")
 
@@ -1340,7 +2189,7 @@ func (svc *TelegramService) onClear(c tb.Context) error {
 
 	log.Info().Int("topic", msg.ThreadID).Msg("onClear")
 
-	repo, err := svc.ensureRepo(c.Chat(), msg.ThreadID)
+	repo, err := svc.ensureWorktree(c.Chat(), msg.ThreadID)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to ensure repo for clear")
 		return c.Send("Couldn't prepare the repo for this topic.")
@@ -1351,7 +2200,7 @@ func (svc *TelegramService) onClear(c tb.Context) error {
 		return c.Send("Failed to clear the context.", &tb.SendOptions{ThreadID: msg.ThreadID})
 	}
 
-	_, err = svc.sendWithRetry(c.Chat(), "Context cleared.", &tb.SendOptions{ThreadID: msg.ThreadID})
+	_, err = svc.sendWithRetry(c.Chat(), "Context cleared. The transcript is kept; see /history.", &tb.SendOptions{ThreadID: msg.ThreadID})
 	return err
 }
 
@@ -1413,10 +2262,10 @@ func (svc *TelegramService) onTopic(c tb.Context) error {
 			return c.Send("Git service is not available.")
 		}
 
-		createdRepoURL, err := svc.git.CreateGitHubRepo(name)
+		createdRepoURL, err := svc.git.CreateRepo(name)
 		if err != nil {
-			log.Error().Err(err).Str("name", name).Msg("failed to create github repo for topic")
-			return c.Send(fmt.Sprintf("Failed to create GitHub repo: %s", err.Error()))
+			log.Error().Err(err).Str("name", name).Msg("failed to create repo for topic")
+			return c.Send(fmt.Sprintf("Failed to create repo: %s", err.Error()))
 		}
 		repoURL = createdRepoURL
 	}
@@ -1505,6 +2354,32 @@ func (svc *TelegramService) ensureRepo(chat *tb.Chat, threadID int) (*GitRepo, e
 	return svc.git.EnsureTopicRepo(chat.ID, threadID)
 }
 
+// ensureWorktree returns the topic repo with Path pointing at the topic's
+// active worktree. A worktree that no longer exists falls back to the topic
+// repo.
+func (svc *TelegramService) ensureWorktree(chat *tb.Chat, threadID int) (*GitRepo, error) {
+	repo, err := svc.ensureRepo(chat, threadID)
+	if err != nil {
+		return nil, err
+	}
+	ctx := svc.getTopicContext(chat.ID, threadID)
+	if ctx == nil || ctx.Worktree == "" || ctx.Worktree == repo.Path {
+		return repo, nil
+	}
+	if _, err := os.Stat(filepath.Join(ctx.Worktree, ".git")); err != nil {
+		log.Warn().Err(err).Str("worktree", ctx.Worktree).Msg("topic worktree is gone, using the topic repo")
+		svc.updateTopicContext(chat.ID, threadID, func(ctx *TopicContext) {
+			ctx.Worktree = ""
+			ctx.Branch = ""
+		})
+		return repo, nil
+	}
+
+	worktree := *repo
+	worktree.Path = ctx.Worktree
+	return &worktree, nil
+}
+
 func (svc *TelegramService) ensureRepoFrom(chat *tb.Chat, threadID int, repoURL, repoPath, token string) (*GitRepo, error) {
 	if svc.git == nil {
 		log.Error().Msg("ensure repo from: git service not available")
@@ -1568,6 +2443,60 @@ func (svc *TelegramService) setTopicContext(chatID int64, threadID int, ctx *Top
 	}
 }
 
+// updateTopicContext applies fn to the topic's context, creating an empty one
+// when the topic has none yet, and persists the result.
+func (svc *TelegramService) updateTopicContext(chatID int64, threadID int, fn func(ctx *TopicContext)) {
+	key := topicKey(chatID, threadID)
+	svc.mu.Lock()
+	ctx := svc.topicContexts[key]
+	if ctx == nil {
+		ctx = &TopicContext{}
+		svc.topicContexts[key] = ctx
+	}
+	fn(ctx)
+	svc.mu.Unlock()
+	if err := svc.saveTopicContexts(); err != nil {
+		log.Error().Err(err).Msg("failed to save topic contexts")
+	}
+}
+
+// topicAgent returns the topic's preferred agent and model. An agent that is
+// no longer enabled falls back to the service default.
+func (svc *TelegramService) topicAgent(chatID int64, threadID int) (string, string) {
+	svc.mu.Lock()
+	ctx := svc.topicContexts[topicKey(chatID, threadID)]
+	agentID, model := "", ""
+	if ctx != nil {
+		agentID, model = ctx.Agent, ctx.Model
+	}
+	svc.mu.Unlock()
+
+	if agentID == "" || svc.agent == nil || !svc.agent.HasAgent(agentID) {
+		return "", ""
+	}
+	return agentID, model
+}
+
+// topicSandbox returns the topic's sandbox mode, or "" to use the default.
+func (svc *TelegramService) topicSandbox(chatID int64, threadID int) llm.SandboxMode {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if ctx := svc.topicContexts[topicKey(chatID, threadID)]; ctx != nil {
+		return ctx.Sandbox
+	}
+	return ""
+}
+
+// topicIsolation returns the topic's isolation mode, or "" to use the default.
+func (svc *TelegramService) topicIsolation(chatID int64, threadID int) llm.IsolationMode {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if ctx := svc.topicContexts[topicKey(chatID, threadID)]; ctx != nil {
+		return ctx.Isolation
+	}
+	return ""
+}
+
 func (svc *TelegramService) deleteTopicContext(chatID int64, threadID int) {
 	key := topicKey(chatID, threadID)
 	svc.mu.Lock()
@@ -1669,20 +2598,12 @@ func (svc *TelegramService) createFeatureBranch(repo *GitRepo, feature string) (
 	return svc.git.CreateFeatureBranch(repo, feature)
 }
 
-func (svc *TelegramService) createWorkingBranch(repo *GitRepo, branch string) (string, error) {
-	if svc.git == nil {
-		return "", errors.New("git service not available")
-	}
-
-	return svc.git.CreateWorkingBranch(repo, branch)
-}
-
-func (svc *TelegramService) commitAndOpenPR(repo *GitRepo, message, prBody string) (*CommitPRResult, error) {
+func (svc *TelegramService) commitAndOpenPR(repo *GitRepo, message, prBody string, draft bool) (*CommitPRResult, error) {
 	if svc.git == nil {
 		return nil, errors.New("git service not available")
 	}
 
-	return svc.git.CommitPushAndOpenPR(repo, message, prBody)
+	return svc.git.CommitPushAndOpenPR(repo, message, prBody, draft)
 }
 
 func (svc *TelegramService) parseTopicArgs(payload string) (string, string, string) {
@@ -1958,7 +2879,7 @@ func (svc *TelegramService) onPreview(c tb.Context) error {
 		}
 		return c.Send("Preview stopped.", &tb.SendOptions{ThreadID: msg.ThreadID})
 	default:
-		repo, err := svc.ensureRepo(c.Chat(), msg.ThreadID)
+		repo, err := svc.ensureWorktree(c.Chat(), msg.ThreadID)
 		if err != nil {
 			log.Error().Err(err).Msg("failed to ensure repo for preview")
 			return c.Send("Couldn't prepare the repo for preview.", &tb.SendOptions{ThreadID: msg.ThreadID})
@@ -1982,126 +2903,1185 @@ func (svc *TelegramService) onBranch(c tb.Context) error {
 	if !msg.TopicMessage || msg.ThreadID == 0 {
 		return c.Send("Use /branch inside a topic.")
 	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	chat := c.Chat()
 
-	branch := strings.TrimSpace(msg.Payload)
-	if branch == "" {
-		return c.Send("Usage: /branch <name>", &tb.SendOptions{ThreadID: msg.ThreadID})
-	}
-
-	repo, err := svc.ensureRepo(c.Chat(), msg.ThreadID)
+	repo, err := svc.ensureRepo(chat, msg.ThreadID)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to ensure repo for branch")
-		return c.Send("Couldn't prepare the repo for this topic.", &tb.SendOptions{ThreadID: msg.ThreadID})
+		return c.Send("Couldn't prepare the repo for this topic.", opts)
+	}
+
+	args := strings.Fields(msg.Payload)
+	switch {
+	case len(args) == 0:
+		worktrees, err := svc.git.Worktrees(repo)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to list worktrees")
+			return c.Send(fmt.Sprintf("Failed to list worktrees: %s", err.Error()), opts)
+		}
+		active, _ := svc.ensureWorktree(chat, msg.ThreadID)
+		activePath := repo.Path
+		if active != nil {
+			activePath = active.Path
+		}
+		return c.Send(formatWorktreeList(worktrees, repo.Path, activePath), opts)
+	case len(args) == 2 && (args[0] == "remove" || args[0] == "rm"):
+		return svc.removeBranchWorktree(c, repo, args[1])
+	case len(args) > 1:
+		return c.Send(branchUsage, opts)
 	}
 
-	selectedBranch, err := svc.createWorkingBranch(repo, branch)
+	branch := args[0]
+	path, created, err := svc.git.EnsureBranchWorktree(repo, branch)
 	if err != nil {
-		log.Error().Err(err).Str("branch", branch).Msg("failed to create working branch")
-		return c.Send(fmt.Sprintf("Failed to create branch: %s", err.Error()), &tb.SendOptions{ThreadID: msg.ThreadID})
+		log.Error().Err(err).Str("branch", branch).Msg("failed to prepare branch worktree")
+		return c.Send(fmt.Sprintf("Failed to switch to branch: %s", err.Error()), opts)
+	}
+
+	worktree := path
+	if path == repo.Path {
+		worktree = ""
 	}
+	svc.updateTopicContext(chat.ID, msg.ThreadID, func(ctx *TopicContext) {
+		ctx.Worktree = worktree
+		ctx.Branch = branch
+	})
 
-	return c.Send(fmt.Sprintf("Checked out branch %s.", selectedBranch), &tb.SendOptions{ThreadID: msg.ThreadID})
+	switch {
+	case worktree == "":
+		return c.Send(fmt.Sprintf("Switched to branch %s in the topic repo.", branch), opts)
+	case created:
+		return c.Send(fmt.Sprintf("Created a worktree for branch %s. Agents and git commands in this topic now run there.", branch), opts)
+	default:
+		return c.Send(fmt.Sprintf("Switched to the worktree for branch %s.", branch), opts)
+	}
 }
 
-func (svc *TelegramService) onPull(c tb.Context) error {
+const branchUsage = "Usage: /branch [name] or /branch remove <name>"
+
+// removeBranchWorktree deletes the worktree of branch, keeping the branch.
+// Worktrees with uncommitted changes are kept.
+func (svc *TelegramService) removeBranchWorktree(c tb.Context, repo *GitRepo, branch string) error {
 	msg := c.Message()
-	if msg == nil || !msg.TopicMessage || msg.ThreadID == 0 {
-		return c.Send("Use /pull inside a topic.")
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+
+	worktrees, err := svc.git.Worktrees(repo)
+	if err != nil {
+		return c.Send(fmt.Sprintf("Failed to list worktrees: %s", err.Error()), opts)
+	}
+	path := ""
+	for _, wt := range worktrees {
+		if wt.Branch == branch {
+			path = wt.Path
+			break
+		}
+	}
+	switch {
+	case path == "":
+		return c.Send(fmt.Sprintf("Branch %s has no worktree.", branch), opts)
+	case path == repo.Path:
+		return c.Send(fmt.Sprintf("Branch %s is checked out in the topic repo, which can't be removed.", branch), opts)
 	}
 
-	repo, err := svc.ensureRepo(c.Chat(), msg.ThreadID)
+	dirty, err := svc.git.HasUncommittedChanges(path)
 	if err != nil {
-		log.Error().Err(err).Msg("failed to ensure repo for pull")
-		return c.Send("Couldn't prepare the repo for this topic.", &tb.SendOptions{ThreadID: msg.ThreadID})
+		return c.Send(fmt.Sprintf("Failed to check the worktree: %s", err.Error()), opts)
+	}
+	if dirty {
+		return c.Send(fmt.Sprintf("The worktree for %s has uncommitted changes. Commit or discard them first.", branch), opts)
+	}
+	if err := svc.git.RemoveWorktree(repo, path); err != nil {
+		log.Error().Err(err).Str("branch", branch).Msg("failed to remove worktree")
+		return c.Send(fmt.Sprintf("Failed to remove the worktree: %s", err.Error()), opts)
+	}
+	if err := svc.agent.ForgetRepo(path); err != nil {
+		log.Warn().Err(err).Str("branch", branch).Msg("failed to clear worktree sessions")
 	}
 
-	if err := svc.git.PullMain(repo); err != nil {
-		log.Error().Err(err).Str("repo_path", repo.Path).Msg("failed to pull main")
-		return c.Send(fmt.Sprintf("Failed to pull main: %s", err.Error()), &tb.SendOptions{ThreadID: msg.ThreadID})
+	reply := fmt.Sprintf("Removed the worktree for %s. The branch is kept.", branch)
+	if ctx := svc.getTopicContext(c.Chat().ID, msg.ThreadID); ctx != nil && ctx.Worktree == path {
+		svc.updateTopicContext(c.Chat().ID, msg.ThreadID, func(ctx *TopicContext) {
+			ctx.Worktree = ""
+			ctx.Branch = ""
+		})
+		reply += " This topic is back on the topic repo."
 	}
+	return c.Send(reply, opts)
+}
 
-	return c.Send("Pulled latest changes on main.", &tb.SendOptions{ThreadID: msg.ThreadID})
+// formatWorktreeList lists the checkouts of a topic repo, marking the one the
+// topic uses.
+func formatWorktreeList(worktrees []Worktree, repoPath, activePath string) string {
+	lines := []string{"Worktrees:"}
+	for _, wt := range worktrees {
+		branch := wt.Branch
+		if branch == "" {
+			branch = "(detached)"
+		}
+		line := "- " + branch
+		if wt.Path == activePath {
+			line = "* " + branch
+		}
+		var notes []string
+		if wt.Path == repoPath {
+			notes = append(notes, "topic repo")
+		}
+		if wt.Path == activePath {
+			notes = append(notes, "active")
+		}
+		if len(notes) > 0 {
+			line += " (" + strings.Join(notes, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "", branchUsage)
+	return strings.Join(lines, "\n")
 }
 
-func (svc *TelegramService) onGit(c tb.Context) error {
+func (svc *TelegramService) onAgent(c tb.Context) error {
 	msg := c.Message()
 	if msg == nil {
-		log.Warn().Msg("onGit: nil message")
+		log.Warn().Msg("onAgent: nil message")
 		return nil
 	}
 	if !msg.TopicMessage || msg.ThreadID == 0 {
-		return c.Send("Use /git inside a topic.")
+		return c.Send("Use /agent inside a topic.")
 	}
-
-	args := strings.Fields(strings.TrimSpace(msg.Payload))
-	if len(args) == 0 {
-		return c.Send("Usage: /git <args...>\nExample: /git status", &tb.SendOptions{ThreadID: msg.ThreadID})
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
 	}
 
-	repo, err := svc.ensureRepo(c.Chat(), msg.ThreadID)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to ensure repo for git command")
-		return c.Send("Couldn't prepare the repo for this topic.", &tb.SendOptions{ThreadID: msg.ThreadID})
+	fields := strings.Fields(strings.TrimSpace(msg.Payload))
+	if len(fields) == 0 {
+		agentID, model := svc.topicAgent(c.Chat().ID, msg.ThreadID)
+		return c.Send(formatTopicAgentStatus(agentID, model, svc.agent.DefaultAgent(), svc.agent.EnabledAgents()), opts)
+	}
+	if len(fields) > 2 {
+		return c.Send("Usage: /agent [id|default] [model]", opts)
 	}
 
-	output, runErr := svc.git.RunTopicGitCommand(repo, args...)
-	commandLine := "git " + strings.Join(args, " ")
+	agentID := strings.ToLower(fields[0])
+	model := ""
+	if len(fields) == 2 {
+		model = fields[1]
+	}
 
-	if runErr != nil {
-		log.Error().
-			Err(runErr).
-			Str("repo_path", repo.Path).
-			Str("git_args", strings.Join(args, " ")).
-			Msg("git command failed")
+	if agentID == "default" {
+		svc.updateTopicContext(c.Chat().ID, msg.ThreadID, func(ctx *TopicContext) {
+			ctx.Agent = ""
+			ctx.Model = ""
+		})
+		return c.Send(fmt.Sprintf("Topic agent reset to default (@%s).", svc.agent.DefaultAgent()), opts)
+	}
 
-		resp := fmt.Sprintf("Command failed: %s\nError: %s", commandLine, runErr.Error())
-		if strings.TrimSpace(output) != "" {
-			resp += "\n\n" + truncateTelegramText(output)
-		}
-		return c.Send(resp, &tb.SendOptions{ThreadID: msg.ThreadID})
+	if !svc.agent.HasAgent(agentID) {
+		return c.Send(fmt.Sprintf("Unknown agent %q. Enabled agents: %s", agentID, strings.Join(svc.agent.EnabledAgents(), ", ")), opts)
 	}
 
-	if strings.TrimSpace(output) == "" {
-		return c.Send(fmt.Sprintf("Command succeeded: %s\n(no output)", commandLine), &tb.SendOptions{ThreadID: msg.ThreadID})
+	svc.updateTopicContext(c.Chat().ID, msg.ThreadID, func(ctx *TopicContext) {
+		ctx.Agent = agentID
+		ctx.Model = model
+	})
+	log.Info().Int("topic", msg.ThreadID).Str("agent", agentID).Str("model", model).Msg("onAgent: topic agent updated")
+
+	if model != "" {
+		return c.Send(fmt.Sprintf("Topic agent set to @%s (model %s).", agentID, model), opts)
 	}
+	return c.Send(fmt.Sprintf("Topic agent set to @%s.", agentID), opts)
+}
 
-	return c.Send(truncateTelegramText(output), &tb.SendOptions{ThreadID: msg.ThreadID})
+func formatTopicAgentStatus(agentID, model, defaultAgent string, enabled []string) string {
+	current := fmt.Sprintf("@%s (default)", defaultAgent)
+	if agentID != "" {
+		current = "@" + agentID
+		if model != "" {
+			current += fmt.Sprintf(" (model %s)", model)
+		}
+	}
+	return fmt.Sprintf("Topic agent: %s\nEnabled agents: %s\nUsage: /agent [id|default] [model]", current, strings.Join(enabled, ", "))
 }
 
-func (svc *TelegramService) onCommit(c tb.Context) error {
+func (svc *TelegramService) onMode(c tb.Context) error {
 	msg := c.Message()
 	if msg == nil {
-		log.Warn().Msg("onCommit: nil message")
+		log.Warn().Msg("onMode: nil message")
 		return nil
 	}
 	if !msg.TopicMessage || msg.ThreadID == 0 {
-		return c.Send("Use /commit inside a topic.")
+		return c.Send("Use /mode inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
 	}
 
-	repo, err := svc.ensureRepo(c.Chat(), msg.ThreadID)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to ensure repo for commit")
-		return c.Send("Couldn't prepare the repo for this topic.", &tb.SendOptions{ThreadID: msg.ThreadID})
+	defaultMode := svc.agent.DefaultSandbox()
+	arg := strings.ToLower(strings.TrimSpace(msg.Payload))
+	if arg == "" {
+		return c.Send(formatTopicSandboxStatus(svc.topicSandbox(c.Chat().ID, msg.ThreadID), defaultMode), opts)
+	}
+	if !svc.isAdmin(c) {
+		return c.Send("Only admins can change the sandbox mode.", opts)
 	}
 
-	commitMessage := strings.TrimSpace(msg.Payload)
-	if commitMessage == "" {
-		generated, genErr := svc.generateCommitMessage(repo)
-		if genErr != nil {
-			log.Warn().Err(genErr).Str("repo_path", repo.Path).Msg("failed to generate commit message with agent; using fallback")
-		} else {
-			commitMessage = generated
+	mode := llm.SandboxMode("")
+	if arg != "default" {
+		parsed, err := llm.ParseSandboxMode(arg)
+		if err != nil {
+			return c.Send(err.Error()+"\n"+sandboxUsage, opts)
 		}
+		mode = parsed
 	}
-	prBody := ""
-	generatedPRBody, prBodyErr := svc.generatePRDescription(repo, commitMessage)
-	if prBodyErr != nil {
-		log.Warn().Err(prBodyErr).Str("repo_path", repo.Path).Msg("failed to generate pr description with agent; using fallback")
-	} else {
-		prBody = generatedPRBody
+
+	svc.updateTopicContext(c.Chat().ID, msg.ThreadID, func(ctx *TopicContext) {
+		ctx.Sandbox = mode
+	})
+	log.Info().Int("topic", msg.ThreadID).Str("sandbox", string(mode)).Msg("onMode: topic sandbox updated")
+
+	if mode == "" {
+		return c.Send(fmt.Sprintf("Topic sandbox reset to default (%s).", defaultMode), opts)
 	}
+	return c.Send(fmt.Sprintf("Topic sandbox set to %s.", mode), opts)
+}
 
-	pendingID := 0
+const sandboxUsage = "Usage: /mode [read-only|workspace-write|full|default]"
+
+func formatTopicSandboxStatus(mode, defaultMode llm.SandboxMode) string {
+	current := fmt.Sprintf("%s (default)", defaultMode)
+	if mode != "" {
+		current = string(mode)
+	}
+	return fmt.Sprintf("Topic sandbox: %s\n"+
+		"read-only: agents can read the repo but not change it.\n"+
+		"workspace-write: agents can edit files but not run unapproved commands.\n"+
+		"full: no restrictions.\n%s", current, sandboxUsage)
+}
+
+func (svc *TelegramService) onIsolation(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onIsolation: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /isolation inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
+	}
+
+	defaultMode := svc.agent.DefaultIsolation()
+	arg := strings.ToLower(strings.TrimSpace(msg.Payload))
+	if arg == "" {
+		return c.Send(formatTopicIsolationStatus(svc.topicIsolation(c.Chat().ID, msg.ThreadID), defaultMode), opts)
+	}
+	if !svc.isAdmin(c) {
+		return c.Send("Only admins can change the isolation mode.", opts)
+	}
+
+	mode := llm.IsolationMode("")
+	if arg != "default" {
+		parsed, err := llm.ParseIsolationMode(arg)
+		if err != nil {
+			return c.Send(err.Error()+"\n"+isolationUsage, opts)
+		}
+		if err := svc.agent.CheckIsolation(parsed); err != nil {
+			return c.Send(fmt.Sprintf("Can't use %s isolation: %v", parsed, err), opts)
+		}
+		mode = parsed
+	}
+
+	svc.updateTopicContext(c.Chat().ID, msg.ThreadID, func(ctx *TopicContext) {
+		ctx.Isolation = mode
+	})
+	log.Info().Int("topic", msg.ThreadID).Str("isolation", string(mode)).Msg("onIsolation: topic isolation updated")
+
+	if mode == "" {
+		return c.Send(fmt.Sprintf("Topic isolation reset to default (%s).", defaultMode), opts)
+	}
+	return c.Send(fmt.Sprintf("Topic isolation set to %s.", mode), opts)
+}
+
+const isolationUsage = "Usage: /isolation [host|bwrap|container|default]"
+
+func formatTopicIsolationStatus(mode, defaultMode llm.IsolationMode) string {
+	current := fmt.Sprintf("%s (default)", defaultMode)
+	if mode != "" {
+		current = string(mode)
+	}
+	return fmt.Sprintf("Topic isolation: %s\n"+
+		"host: agents run directly on the bot host.\n"+
+		"bwrap: agents run in a bubblewrap sandbox that only sees the repo.\n"+
+		"container: agents run in a throwaway container with the repo mounted.\n%s", current, isolationUsage)
+}
+
+func (svc *TelegramService) onAskAll(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onAskAll: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /ask-all inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
+	}
+
+	prompt := strings.TrimSpace(msg.Payload)
+	if prompt == "" {
+		return c.Send("Usage: /ask-all <prompt>", opts)
+	}
+
+	chat := c.Chat()
+	threadID := msg.ThreadID
+	svc.enqueueWork(chat, threadID, func() {
+		svc.runAskAll(chat, opts, prompt)
+	})
+	return nil
+}
+
+func (svc *TelegramService) onReview(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onReview: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /review inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
+	}
+
+	chat := c.Chat()
+	threadID := msg.ThreadID
+	agentID, model := svc.topicAgent(chat.ID, threadID)
+	if agentID == "" {
+		agentID = svc.agent.DefaultAgent()
+	}
+	reviewerID, ok := svc.agent.ReviewerFor(agentID)
+	if !ok {
+		return c.Send(fmt.Sprintf("Review mode needs a reviewer other than @%s: enable a second agent or set REVIEWER_AGENT to a different one.", agentID), opts)
+	}
+
+	prompt := strings.TrimSpace(msg.Payload)
+	if prompt == "" {
+		return c.Send(fmt.Sprintf("Usage: /review <prompt>\n@%s implements the change and @%s reviews it until approved.", agentID, reviewerID), opts)
+	}
+
+	svc.enqueueWork(chat, threadID, func() {
+		repo, err := svc.ensureWorktree(chat, threadID)
+		if err != nil {
+			log.Error().Err(err).Int("topic", threadID).Msg("onReview: failed to ensure repo")
+			if _, sendErr := svc.sendWithRetry(chat, "Couldn't prepare the repo for this topic.", opts); sendErr != nil {
+				log.Warn().Err(sendErr).Msg("onReview: failed to send repo error")
+			}
+			return
+		}
+		svc.runAgentWithPendingUpdates(chat, opts, AgentRunRequest{
+			RepoPath:  repo.Path,
+			Prompt:    prompt,
+			Agent:     agentID,
+			Model:     model,
+			Topic:     topicKey(chat.ID, threadID),
+			Sandbox:   svc.topicSandbox(chat.ID, threadID),
+			Isolation: svc.topicIsolation(chat.ID, threadID),
+			Review:    true,
+		})
+	})
+	return nil
+}
+
+// runAskAll fans prompt out to every enabled agent, each on its own branch in
+// a throwaway worktree, and posts the answers with their diff summaries.
+func (svc *TelegramService) runAskAll(chat *tb.Chat, opts *tb.SendOptions, prompt string) {
+	threadID := opts.ThreadID
+	logger := log.With().Int64("chat_id", chat.ID).Int("thread_id", threadID).Logger()
+
+	repo, err := svc.ensureWorktree(chat, threadID)
+	if err != nil {
+		logger.Error().Err(err).Msg("runAskAll: failed to ensure repo")
+		if _, sendErr := svc.sendWithRetry(chat, "Couldn't prepare the repo for this topic.", opts); sendErr != nil {
+			logger.Warn().Err(sendErr).Msg("runAskAll: failed to send repo error")
+		}
+		return
+	}
+
+	base, err := svc.git.HeadCommit(repo.Path)
+	if err != nil {
+		logger.Error().Err(err).Msg("runAskAll: failed to resolve HEAD")
+		if _, sendErr := svc.sendWithRetry(chat, "Couldn't start /ask-all: the repo has no commits yet.", opts); sendErr != nil {
+			logger.Warn().Err(sendErr).Msg("runAskAll: failed to send HEAD error")
+		}
+		return
+	}
+
+	stamp := time.Now().UTC().Format("20060102-150405")
+	targets := make(map[string]string)
+	branches := make(map[string]string)
+	var failures []string
+	for _, id := range svc.agent.EnabledAgents() {
+		branch := askAllBranchName(id, stamp)
+		path, err := svc.git.AddWorktree(repo, branch)
+		if err != nil {
+			logger.Error().Err(err).Str("agent", id).Msg("runAskAll: failed to create worktree")
+			failures = append(failures, fmt.Sprintf("@%s: %s", id, err.Error()))
+			continue
+		}
+		targets[id] = path
+		branches[id] = branch
+	}
+	// Worktrees whose changes could not be committed are kept so nothing an
+	// agent wrote is lost.
+	kept := make(map[string]bool)
+	defer func() {
+		for id, path := range targets {
+			if kept[id] {
+				continue
+			}
+			if err := svc.git.RemoveWorktree(repo, path); err != nil {
+				logger.Warn().Err(err).Str("agent", id).Msg("runAskAll: failed to remove worktree")
+			}
+			if err := svc.agent.ForgetRepo(path); err != nil {
+				logger.Warn().Err(err).Str("agent", id).Msg("runAskAll: failed to clear worktree sessions")
+			}
+		}
+	}()
+
+	if len(targets) == 0 {
+		text := "Couldn't create a worktree for any agent."
+		if len(failures) > 0 {
+			text += "\n" + strings.Join(failures, "\n")
+		}
+		if _, err := svc.sendWithRetry(chat, text, opts); err != nil {
+			logger.Warn().Err(err).Msg("runAskAll: failed to send worktree error")
+		}
+		return
+	}
+
+	ids := make([]string, 0, len(targets))
+	for id := range targets {
+		ids = append(ids, "@"+id)
+	}
+	sort.Strings(ids)
+
+	pendingOpts := cloneSendOptions(opts)
+	pendingOpts.DisableNotification = true
+	pendingMessageID := 0
+	if pending, err := svc.sendWithRetry(chat, fmt.Sprintf("Asking %s in parallel...", strings.Join(ids, ", ")), pendingOpts); err != nil {
+		logger.Warn().Err(err).Msg("runAskAll: failed to send pending message")
+	} else if pending != nil {
+		pendingMessageID = pending.ID
+	}
+
+	started := time.Now()
+	runCtx, cancelRun := ctx.WithCancel(ctx.Background())
+	runKey := topicKey(chat.ID, threadID)
+	svc.registerActiveRun(runKey, prompt, started, cancelRun)
+	defer func() {
+		svc.unregisterActiveRun(runKey)
+		cancelRun()
+	}()
+	svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptPrompt, Text: prompt})
+
+	agentID, model := svc.topicAgent(chat.ID, threadID)
+	answers, runErr := svc.agent.AskAll(runCtx, AgentRunRequest{
+		Prompt:    prompt,
+		Agent:     agentID,
+		Model:     model,
+		Topic:     runKey,
+		Sandbox:   svc.topicSandbox(chat.ID, threadID),
+		Isolation: svc.topicIsolation(chat.ID, threadID),
+	}, targets)
+
+	// commit saves what an agent wrote to its branch, including the partial
+	// work of a failed or stopped agent, and returns the diff stat and the
+	// kept worktree path when committing failed.
+	commit := func(answer AgentAnswer, partial bool) (string, string) {
+		message := fmt.Sprintf("Ask-all answer from %s", answer.Agent)
+		if partial {
+			message = fmt.Sprintf("Partial ask-all changes from %s", answer.Agent)
+		}
+		stat, err := svc.git.CommitWorktreeChanges(answer.RepoPath, base, message)
+		if err != nil {
+			logger.Warn().Err(err).Str("agent", answer.Agent).Msg("runAskAll: failed to commit worktree changes, keeping the worktree")
+			kept[answer.Agent] = true
+			return stat, answer.RepoPath
+		}
+		return stat, ""
+	}
+
+	if runErr != nil && errors.Is(runErr, ctx.Canceled) {
+		logger.Info().Dur("elapsed", time.Since(started)).Msg("runAskAll: stopped by user")
+		lines := []string{"Ask-all run stopped."}
+		for _, answer := range answers {
+			stat, keptPath := commit(answer, true)
+			switch {
+			case keptPath != "":
+				lines = append(lines, fmt.Sprintf("@%s: couldn't commit its changes; the worktree is kept at %s", answer.Agent, keptPath))
+			case strings.TrimSpace(stat) != "":
+				lines = append(lines, fmt.Sprintf("@%s: partial changes committed to %s", answer.Agent, branches[answer.Agent]))
+			}
+		}
+		stoppedText := strings.Join(lines, "\n")
+		svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptStopped, Text: stoppedText})
+		if err := svc.sendFinalResponse(chat, opts, pendingMessageID, stoppedText, ""); err != nil {
+			logger.Warn().Err(err).Msg("runAskAll: failed to send stopped response")
+		}
+		return
+	}
+	if runErr != nil {
+		logger.Error().Err(runErr).Msg("runAskAll: failed")
+		svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptFailure, Text: runErr.Error()})
+		if err := svc.sendFinalResponse(chat, opts, pendingMessageID, formatAgentFailureResponse(runErr, ""), ""); err != nil {
+			logger.Warn().Err(err).Msg("runAskAll: failed to send failure response")
+		}
+		return
+	}
+
+	for _, answer := range answers {
+		if answer.Err != nil {
+			svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptFailure, Agent: answer.Agent, Text: answer.Err.Error()})
+		} else {
+			svc.recordTranscript(runKey, TranscriptEntry{Kind: TranscriptAnswer, Agent: answer.Agent, Text: answer.Text})
+		}
+		diffStat, keptPath := commit(answer, answer.Err != nil)
+		text := formatAskAllAnswer(answer, branches[answer.Agent], diffStat, keptPath)
+		if err := svc.sendFinalResponse(chat, opts, 0, text, ""); err != nil {
+			logger.Warn().Err(err).Str("agent", answer.Agent).Msg("runAskAll: failed to send answer")
+		}
+	}
+
+	summary := formatAskAllSummary(answers, branches, failures)
+	if err := svc.sendFinalResponse(chat, opts, pendingMessageID, summary, ""); err != nil {
+		logger.Warn().Err(err).Msg("runAskAll: failed to send summary")
+	}
+}
+
+func askAllBranchName(agentID, stamp string) string {
+	return fmt.Sprintf("ask-all/%s-%s", agentID, stamp)
+}
+
+// formatAskAllAnswer renders one agent's /ask-all answer with the branch its
+// changes were committed to. keptPath is set when committing failed and the
+// worktree was kept instead.
+func formatAskAllAnswer(answer AgentAnswer, branch, diffStat, keptPath string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "@%s (%s)\n", answer.Agent, answer.Elapsed.Round(time.Second))
+	stat := strings.TrimSpace(diffStat)
+	if answer.Err != nil {
+		b.WriteString(formatAgentFailureResponse(answer.Err, answer.Text))
+		switch {
+		case keptPath != "":
+			b.WriteString("\n\nCouldn't commit its changes; the worktree is kept at " + keptPath)
+		case stat != "":
+			b.WriteString("\n\nPartial changes committed to " + branch + "\n" + stat)
+		}
+		return b.String()
+	}
+
+	text := strings.TrimSpace(answer.Text)
+	if text == "" {
+		text = "(no answer)"
+	}
+	b.WriteString(text)
+	b.WriteString("\n\nBranch: ")
+	b.WriteString(branch)
+	switch {
+	case keptPath != "":
+		b.WriteString("\nCouldn't commit the changes; the worktree is kept at " + keptPath)
+	case stat != "":
+		b.WriteString("\n")
+		b.WriteString(stat)
+	default:
+		b.WriteString("\nNo file changes.")
+	}
+	return b.String()
+}
+
+func formatAskAllSummary(answers []AgentAnswer, branches map[string]string, failures []string) string {
+	lines := []string{"Ask-all finished."}
+	for _, answer := range answers {
+		status := "ok"
+		if answer.Err != nil {
+			status = "failed"
+		}
+		lines = append(lines, fmt.Sprintf("@%s: %s, %s", answer.Agent, status, branches[answer.Agent]))
+	}
+	for _, failure := range failures {
+		lines = append(lines, failure)
+	}
+	lines = append(lines, "Pick a winner with /git merge <branch> or /branch <branch>.")
+	return strings.Join(lines, "\n")
+}
+
+// checkpointLabel names the checkpoint taken before running prompt.
+func checkpointLabel(prompt string) string {
+	line := strings.TrimSpace(prompt)
+	if idx := strings.IndexByte(line, '\n'); idx >= 0 {
+		line = strings.TrimSpace(line[:idx])
+	}
+	if runes := []rune(line); len(runes) > 60 {
+		line = string(runes[:60]) + "…"
+	}
+	return "before: " + line
+}
+
+func (svc *TelegramService) onUndo(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onUndo: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /undo inside a topic.")
+	}
+	svc.restoreCheckpoint(c.Chat(), msg.ThreadID, 1)
+	return nil
+}
+
+// maxListedCheckpoints is how many checkpoints /checkpoints shows.
+const maxListedCheckpoints = 10
+
+const checkpointsUsage = "Usage: /checkpoints [n] (restore the n-th newest checkpoint)"
+
+func (svc *TelegramService) onCheckpoints(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onCheckpoints: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /checkpoints inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+
+	if payload := strings.TrimSpace(msg.Payload); payload != "" {
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 1 {
+			return c.Send(checkpointsUsage, opts)
+		}
+		svc.restoreCheckpoint(c.Chat(), msg.ThreadID, n)
+		return nil
+	}
+
+	repo, err := svc.ensureWorktree(c.Chat(), msg.ThreadID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to ensure repo for checkpoints")
+		return c.Send("Couldn't prepare the repo for this topic.", opts)
+	}
+	checkpoints, err := svc.git.Checkpoints(repo.Path)
+	if err != nil {
+		log.Error().Err(err).Str("repo_path", repo.Path).Msg("failed to list checkpoints")
+		return c.Send(fmt.Sprintf("Failed to list checkpoints: %s", err.Error()), opts)
+	}
+	return c.Send(formatCheckpointList(checkpoints, time.Local), opts)
+}
+
+// restoreCheckpoint restores the n-th newest checkpoint of the topic's
+// active worktree. It is queued behind any agent run in the topic so the
+// tree is not reset under a running agent.
+func (svc *TelegramService) restoreCheckpoint(chat *tb.Chat, threadID, n int) {
+	opts := &tb.SendOptions{ThreadID: threadID}
+	svc.enqueueWork(chat, threadID, func() {
+		logger := log.With().Int64("chat_id", chat.ID).Int("thread_id", threadID).Int("checkpoint", n).Logger()
+		reply := func(text string) {
+			if _, err := svc.sendWithRetry(chat, text, opts); err != nil {
+				logger.Warn().Err(err).Msg("restoreCheckpoint: failed to send reply")
+			}
+		}
+
+		repo, err := svc.ensureWorktree(chat, threadID)
+		if err != nil {
+			logger.Error().Err(err).Msg("restoreCheckpoint: failed to ensure repo")
+			reply("Couldn't prepare the repo for this topic.")
+			return
+		}
+		checkpoints, err := svc.git.Checkpoints(repo.Path)
+		if err != nil {
+			logger.Error().Err(err).Msg("restoreCheckpoint: failed to list checkpoints")
+			reply(fmt.Sprintf("Failed to list checkpoints: %s", err.Error()))
+			return
+		}
+		if len(checkpoints) == 0 {
+			reply("No checkpoints yet. One is taken before every agent run.")
+			return
+		}
+		if n > len(checkpoints) {
+			reply(fmt.Sprintf("There are only %d checkpoints.", len(checkpoints)))
+			return
+		}
+
+		cp := checkpoints[n-1]
+		if _, err := svc.git.RestoreCheckpoint(repo.Path, cp); err != nil {
+			logger.Error().Err(err).Msg("restoreCheckpoint: failed to restore")
+			reply(fmt.Sprintf("Failed to restore the checkpoint: %s", err.Error()))
+			return
+		}
+		svc.recordTranscript(topicKey(chat.ID, threadID), TranscriptEntry{Kind: TranscriptRestored, Text: cp.Label})
+		reply(fmt.Sprintf("Restored the checkpoint from %s (%s). The state before the restore was checkpointed, so /undo puts it back.",
+			cp.Time.In(time.Local).Format("2006-01-02 15:04:05"), cp.Label))
+	})
+}
+
+func formatCheckpointList(checkpoints []Checkpoint, loc *time.Location) string {
+	if len(checkpoints) == 0 {
+		return "No checkpoints yet. One is taken before every agent run."
+	}
+	lines := []string{"Checkpoints (newest first):"}
+	for i, cp := range checkpoints {
+		if i == maxListedCheckpoints {
+			lines = append(lines, fmt.Sprintf("…and %d older", len(checkpoints)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s %s", i+1, cp.Time.In(loc).Format("2006-01-02 15:04:05"), cp.Label))
+	}
+	lines = append(lines, "", "Restore one with /checkpoints <n>; /undo restores #1.")
+	return strings.Join(lines, "\n")
+}
+
+// recordTranscript appends entry to the topic transcript, logging failures so
+// they never interrupt a run.
+func (svc *TelegramService) recordTranscript(topic string, entry TranscriptEntry) {
+	if err := svc.transcripts.Append(topic, entry); err != nil {
+		log.Warn().Err(err).Str("topic", topic).Str("kind", entry.Kind).Msg("failed to record transcript entry")
+	}
+}
+
+const (
+	defaultHistoryEntries = 10
+	maxHistoryEntries     = 50
+	// maxHistoryEntryLen shortens long answers in /history; exports keep
+	// them whole.
+	maxHistoryEntryLen = 500
+)
+
+const historyUsage = "Usage: /history [n|export]"
+
+func (svc *TelegramService) onHistory(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onHistory: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /history inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+	chat := c.Chat()
+	topic := topicKey(chat.ID, msg.ThreadID)
+
+	payload := strings.ToLower(strings.TrimSpace(msg.Payload))
+	if payload == "export" {
+		return svc.exportHistory(chat, opts, topic, msg.ThreadID)
+	}
+
+	n := defaultHistoryEntries
+	if payload != "" {
+		value, err := strconv.Atoi(payload)
+		if err != nil || value < 1 {
+			return c.Send(historyUsage, opts)
+		}
+		n = min(value, maxHistoryEntries)
+	}
+
+	entries, err := svc.transcripts.Recent(topic, n)
+	if err != nil {
+		log.Error().Err(err).Str("topic", topic).Msg("onHistory: failed to read transcript")
+		return c.Send("Couldn't read the transcript for this topic.", opts)
+	}
+	if len(entries) == 0 {
+		return c.Send("No history for this topic yet.", opts)
+	}
+
+	text := fmt.Sprintf("Last %d transcript entries:\n\n%s", len(entries), formatTranscript(entries, maxHistoryEntryLen, time.Local))
+	for _, chunk := range splitMessage(text, telegramMaxMessageLength) {
+		if _, err := svc.sendWithRetry(chat, chunk, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportHistory sends the whole topic transcript as a text file.
+func (svc *TelegramService) exportHistory(chat *tb.Chat, opts *tb.SendOptions, topic string, threadID int) error {
+	entries, err := svc.transcripts.Recent(topic, 0)
+	if err != nil {
+		log.Error().Err(err).Str("topic", topic).Msg("exportHistory: failed to read transcript")
+		_, sendErr := svc.sendWithRetry(chat, "Couldn't read the transcript for this topic.", opts)
+		return sendErr
+	}
+	if len(entries) == 0 {
+		_, sendErr := svc.sendWithRetry(chat, "No history for this topic yet.", opts)
+		return sendErr
+	}
+
+	dir, err := os.MkdirTemp("", "gocode-transcript-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	name := fmt.Sprintf("transcript-%d-%s.txt", threadID, time.Now().Format("20060102-150405"))
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(formatTranscript(entries, 0, time.Local)+"\n"), 0o644); err != nil {
+		return err
+	}
+
+	doc := &tb.Document{
+		File:     tb.FromDisk(path),
+		FileName: name,
+		Caption:  fmt.Sprintf("%d transcript entries.", len(entries)),
+	}
+	_, err = svc.sendDocumentWithRetry(chat, doc, opts)
+	return err
+}
+
+func (svc *TelegramService) onUsage(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onUsage: nil message")
+		return nil
+	}
+
+	opts := &tb.SendOptions{}
+	topic := ""
+	scope := "all topics"
+	if msg.TopicMessage && msg.ThreadID != 0 {
+		opts.ThreadID = msg.ThreadID
+		topic = topicKey(c.Chat().ID, msg.ThreadID)
+		scope = "this topic"
+	}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
+	}
+
+	period := strings.ToLower(strings.TrimSpace(msg.Payload))
+	since, ok := usagePeriodStart(period, time.Now())
+	if !ok {
+		return c.Send("Usage: /usage [today|week]", opts)
+	}
+	if period == "" {
+		period = "today"
+	}
+
+	summary := svc.agent.Usage(topic, since)
+	return c.Send(formatUsageSummary(summary, period, scope), opts)
+}
+
+// usagePeriodStart maps a /usage period to the start of the window: local
+// midnight for "today" (the default) and the last seven days for "week".
+func usagePeriodStart(period string, now time.Time) (time.Time, bool) {
+	switch period {
+	case "", "today":
+		year, month, day := now.Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, now.Location()), true
+	case "week":
+		return now.AddDate(0, 0, -7), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func formatUsageSummary(summary UsageSummary, period, scope string) string {
+	if summary.Calls == 0 {
+		return fmt.Sprintf("No agent usage %s for %s.", usagePeriodLabel(period), scope)
+	}
+
+	lines := []string{
+		fmt.Sprintf("Agent usage %s for %s:", usagePeriodLabel(period), scope),
+		fmt.Sprintf("Requests: %d, agent calls: %d", summary.Requests, summary.Calls),
+		formatUsageTotals("Total", summary.UsageTotals),
+	}
+	for _, id := range summary.Agents() {
+		lines = append(lines, formatUsageTotals("@"+id, summary.ByAgent[id]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func usagePeriodLabel(period string) string {
+	if period == "week" {
+		return "over the last 7 days"
+	}
+	return "today"
+}
+
+func formatUsageTotals(label string, totals UsageTotals) string {
+	line := fmt.Sprintf("%s: %d in / %d out tokens, %s agent time", label, totals.InputTokens, totals.OutputTokens, totals.Duration.Round(time.Second))
+	if totals.CostUSD > 0 {
+		line += fmt.Sprintf(", $%.2f", totals.CostUSD)
+	}
+	return line
+}
+
+func (svc *TelegramService) onBudget(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onBudget: nil message")
+		return nil
+	}
+
+	opts := &tb.SendOptions{}
+	topic := ""
+	if msg.TopicMessage && msg.ThreadID != 0 {
+		opts.ThreadID = msg.ThreadID
+		topic = topicKey(c.Chat().ID, msg.ThreadID)
+	}
+	if svc.agent == nil {
+		return c.Send("Agent service not available.", opts)
+	}
+
+	fields := strings.Fields(strings.ToLower(strings.TrimSpace(msg.Payload)))
+	global := len(fields) > 0 && fields[0] == "global"
+	if global {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		topicBudget, globalBudget := svc.agent.Budgets(topic)
+		return c.Send(formatBudgetStatus(topic != "", topicBudget, globalBudget), opts)
+	}
+	if len(fields) != 2 {
+		return c.Send("Usage: /budget [global] <tokens|minutes|hops> <n> (0 = unlimited)", opts)
+	}
+	if !global && topic == "" {
+		return c.Send("Use /budget inside a topic, or /budget global ... for the global budget.", opts)
+	}
+	if !svc.isAdmin(c) {
+		return c.Send("Only admins can change budgets.", opts)
+	}
+
+	scope := topic
+	if global {
+		scope = ""
+	}
+	value, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return c.Send(fmt.Sprintf("Invalid budget value %q.", fields[1]), opts)
+	}
+	updated, err := svc.agent.SetBudget(scope, fields[0], value)
+	if err != nil {
+		return c.Send(fmt.Sprintf("Failed to update budget: %s", err.Error()), opts)
+	}
+
+	label := "Topic"
+	if scope == "" {
+		label = "Global"
+	}
+	log.Info().Str("scope", scope).Str("limit", fields[0]).Int("value", value).Msg("onBudget: budget updated")
+	return c.Send(fmt.Sprintf("%s budget updated: %s", label, formatAgentBudget(updated)), opts)
+}
+
+func formatAgentBudget(budget AgentBudget) string {
+	limit := func(value int) string {
+		if value == 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(value)
+	}
+	return fmt.Sprintf("tokens/day %s, agent-minutes/day %s, hops/request %s",
+		limit(budget.TokensPerDay), limit(budget.AgentMinutesPerDay), limit(budget.HopsPerRequest))
+}
+
+func formatBudgetStatus(inTopic bool, topicBudget, globalBudget AgentBudget) string {
+	lines := make([]string, 0, 3)
+	if inTopic {
+		lines = append(lines, "Topic: "+formatAgentBudget(topicBudget))
+	}
+	lines = append(lines,
+		"Global: "+formatAgentBudget(globalBudget),
+		"Usage: /budget [global] <tokens|minutes|hops> <n> (0 = unlimited)",
+	)
+	return strings.Join(lines, "\n")
+}
+
+func formatBudgetExceeded(budgetErr *BudgetExceededError, output string) string {
+	scope := "this topic's"
+	command := "/budget"
+	if budgetErr.Scope == "global" {
+		scope = "the global"
+		command = "/budget global"
+	}
+	text := fmt.Sprintf("Agent run stopped: %s budget is used up (%d/%d %s). An admin can raise it with %s %s <n>.",
+		scope, budgetErr.Used, budgetErr.Max, budgetUnit(budgetErr.Limit), command, budgetErr.Limit)
+	if output = strings.TrimSpace(output); output != "" {
+		text += "\n\nLast agent output:\n" + truncateTelegramText(output)
+	}
+	return text
+}
+
+func (svc *TelegramService) onPull(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil || !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /pull inside a topic.")
+	}
+
+	repo, err := svc.ensureRepo(c.Chat(), msg.ThreadID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to ensure repo for pull")
+		return c.Send("Couldn't prepare the repo for this topic.", &tb.SendOptions{ThreadID: msg.ThreadID})
+	}
+
+	if err := svc.git.PullMain(repo); err != nil {
+		log.Error().Err(err).Str("repo_path", repo.Path).Msg("failed to pull main")
+		return c.Send(fmt.Sprintf("Failed to pull main: %s", err.Error()), &tb.SendOptions{ThreadID: msg.ThreadID})
+	}
+
+	return c.Send("Pulled latest changes on main.", &tb.SendOptions{ThreadID: msg.ThreadID})
+}
+
+func (svc *TelegramService) onGit(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onGit: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /git inside a topic.")
+	}
+
+	args := strings.Fields(strings.TrimSpace(msg.Payload))
+	if len(args) == 0 {
+		return c.Send("Usage: /git <args...>\nExample: /git status", &tb.SendOptions{ThreadID: msg.ThreadID})
+	}
+
+	repo, err := svc.ensureWorktree(c.Chat(), msg.ThreadID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to ensure repo for git command")
+		return c.Send("Couldn't prepare the repo for this topic.", &tb.SendOptions{ThreadID: msg.ThreadID})
+	}
+
+	output, runErr := svc.git.RunTopicGitCommand(repo, args...)
+	commandLine := "git " + strings.Join(args, " ")
+
+	if runErr != nil {
+		log.Error().
+			Err(runErr).
+			Str("repo_path", repo.Path).
+			Str("git_args", strings.Join(args, " ")).
+			Msg("git command failed")
+
+		resp := fmt.Sprintf("Command failed: %s\nError: %s", commandLine, runErr.Error())
+		if strings.TrimSpace(output) != "" {
+			resp += "\n\n" + truncateTelegramText(output)
+		}
+		return c.Send(resp, &tb.SendOptions{ThreadID: msg.ThreadID})
+	}
+
+	if strings.TrimSpace(output) == "" {
+		return c.Send(fmt.Sprintf("Command succeeded: %s\n(no output)", commandLine), &tb.SendOptions{ThreadID: msg.ThreadID})
+	}
+
+	return c.Send(truncateTelegramText(output), &tb.SendOptions{ThreadID: msg.ThreadID})
+}
+
+func (svc *TelegramService) onDiff(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onDiff: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /diff inside a topic.")
+	}
+	opts := &tb.SendOptions{ThreadID: msg.ThreadID}
+
+	repo, err := svc.ensureWorktree(c.Chat(), msg.ThreadID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to ensure repo for diff")
+		return c.Send("Couldn't prepare the repo for this topic.", opts)
+	}
+
+	paths := strings.Fields(msg.Payload)
+	diff, err := svc.git.FullDiff(repo.Path, paths...)
+	if err != nil {
+		log.Error().Err(err).Str("repo_path", repo.Path).Strs("paths", paths).Msg("failed to compute diff")
+		return c.Send(fmt.Sprintf("Failed to compute the diff: %s", err.Error()), opts)
+	}
+	if strings.TrimSpace(diff) == "" {
+		if len(paths) > 0 {
+			return c.Send(fmt.Sprintf("No uncommitted changes in %s.", strings.Join(paths, " ")), opts)
+		}
+		return c.Send("No uncommitted changes.", opts)
+	}
+
+	if truncateTelegramText(diff) == strings.TrimSpace(diff) {
+		return c.Send(diff, opts)
+	}
+
+	dir, err := os.MkdirTemp("", "gocode-diff-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	branch, _ := svc.git.currentBranch(repo.Path)
+	name := diffFileName(branch, paths)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(diff+"\n"), 0o644); err != nil {
+		return err
+	}
+	doc := &tb.Document{
+		File:     tb.FromDisk(path),
+		FileName: name,
+		Caption:  fmt.Sprintf("Uncommitted changes (%d lines).", strings.Count(diff, "\n")+1),
+	}
+	_, err = svc.sendDocumentWithRetry(c.Chat(), doc, opts)
+	return err
+}
+
+// diffFileName names the /diff document after the checked out branch and the
+// first path the diff was limited to.
+func diffFileName(branch string, paths []string) string {
+	name := slugify(branch)
+	if name == "" || branch == "HEAD" {
+		name = "changes"
+	}
+	if len(paths) > 0 {
+		name += "-" + sanitizeAttachmentName(paths[0])
+	}
+	return name + ".diff"
+}
+
+func (svc *TelegramService) onCommit(c tb.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		log.Warn().Msg("onCommit: nil message")
+		return nil
+	}
+	if !msg.TopicMessage || msg.ThreadID == 0 {
+		return c.Send("Use /commit inside a topic.")
+	}
+
+	repo, err := svc.ensureWorktree(c.Chat(), msg.ThreadID)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to ensure repo for commit")
+		return c.Send("Couldn't prepare the repo for this topic.", &tb.SendOptions{ThreadID: msg.ThreadID})
+	}
+
+	draft, commitMessage := parseCommitArgs(msg.Payload)
+	if commitMessage == "" {
+		generated, genErr := svc.generateCommitMessage(repo)
+		if genErr != nil {
+			log.Warn().Err(genErr).Str("repo_path", repo.Path).Msg("failed to generate commit message with agent; using fallback")
+		} else {
+			commitMessage = generated
+		}
+	}
+	prBody := ""
+	generatedPRBody, prBodyErr := svc.generatePRDescription(repo, commitMessage)
+	if prBodyErr != nil {
+		log.Warn().Err(prBodyErr).Str("repo_path", repo.Path).Msg("failed to generate pr description with agent; using fallback")
+	} else {
+		prBody = generatedPRBody
+	}
+
+	pendingID := 0
 	pendingOpts := &tb.SendOptions{ThreadID: msg.ThreadID, DisableNotification: true}
 	pendingID, err = svc.editOrSendByMessageID(c.Chat(), pendingOpts, pendingID, "Running commit flow...", "")
 	if err != nil {
@@ -2109,16 +4089,46 @@ func (svc *TelegramService) onCommit(c tb.Context) error {
 		pendingID = 0
 	}
 
-	result, err := svc.commitAndOpenPR(repo, commitMessage, prBody)
+	result, err := svc.commitAndOpenPR(repo, commitMessage, prBody, draft)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to commit and open pr")
 		return svc.sendFinalResponse(c.Chat(), &tb.SendOptions{ThreadID: msg.ThreadID}, pendingID, fmt.Sprintf("Commit flow failed: %s", err.Error()), "")
 	}
 
-	resp := fmt.Sprintf("Committed and pushed to %s\nMessage: %s\nPR: %s", result.Branch, result.CommitMessage, result.PRURL)
+	resp := fmt.Sprintf("Committed and pushed to %s\nMessage: %s\n%s", result.Branch, result.CommitMessage, formatPRLine(result))
 	return svc.sendFinalResponse(c.Chat(), &tb.SendOptions{ThreadID: msg.ThreadID}, pendingID, resp, "")
 }
 
+// parseCommitArgs splits a leading --draft flag off the /commit payload.
+func parseCommitArgs(payload string) (bool, string) {
+	payload = strings.TrimSpace(payload)
+	if rest, ok := strings.CutPrefix(payload, "--draft"); ok && (rest == "" || unicode.IsSpace(rune(rest[0]))) {
+		return true, strings.TrimSpace(rest)
+	}
+	return false, payload
+}
+
+// formatPRLine describes the PR a commit was pushed to, e.g.
+// "Draft PR #12 opened: <url>", "PR #12 updated: <url>" or, when a reused PR
+// could not be updated (as through the gh CLI), "PR #12 already open: <url>".
+func formatPRLine(result *CommitPRResult) string {
+	label := "PR"
+	if result.PRDraft {
+		label = "Draft PR"
+	}
+	if result.PRNumber > 0 {
+		label += fmt.Sprintf(" #%d", result.PRNumber)
+	}
+	switch {
+	case result.PRCreated:
+		return label + " opened: " + result.PRURL
+	case result.PRUpdated:
+		return label + " updated: " + result.PRURL
+	default:
+		return label + " already open: " + result.PRURL
+	}
+}
+
 func (svc *TelegramService) generateCommitMessage(repo *GitRepo) (string, error) {
 	if repo == nil {
 		return "", errors.New("repo is nil")
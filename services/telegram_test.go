@@ -2,12 +2,17 @@ package services
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/requiem-ai/gocode/llm"
+	tb "gopkg.in/telebot.v3"
 )
 
 func TestEscapeMarkdownV2_PlainText(t *testing.T) {
@@ -559,6 +564,32 @@ func TestFormatAgentFailureResponse_DeduplicatesErrorText(t *testing.T) {
 	}
 }
 
+func TestFormatAgentFailureResponse_NamesErrorKind(t *testing.T) {
+	err := &llm.Error{Kind: llm.ErrorRateLimited, Err: errors.New("exit status 1")}
+	got := formatAgentFailureResponse(err, "")
+	want := "Agent failed to run (rate limited).\nError: exit status 1"
+	if got != want {
+		t.Fatalf("formatAgentFailureResponse() = %q, want %q", got, want)
+	}
+}
+
+func TestAppendRecoveryNotes(t *testing.T) {
+	notes := []string{
+		formatRecoveryNote(AgentEvent{Type: AgentEventRetry, From: "codex", Round: 1, Kind: llm.ErrorRateLimited}),
+		formatRecoveryNote(AgentEvent{Type: AgentEventFallback, From: "codex", To: "claude", Kind: llm.ErrorRateLimited}),
+	}
+	got := appendRecoveryNotes("Done.\n", notes)
+	want := "Done.\n\nRecovered from agent errors:\n" +
+		"- @codex rate limited on attempt 1 and was retried.\n" +
+		"- @codex rate limited; fell back to @claude."
+	if got != want {
+		t.Fatalf("appendRecoveryNotes() = %q, want %q", got, want)
+	}
+	if got := appendRecoveryNotes("Done.", nil); got != "Done." {
+		t.Fatalf("expected text unchanged without notes, got %q", got)
+	}
+}
+
 func TestSanitizeAgentCommitMessage_SimpleLine(t *testing.T) {
 	got := sanitizeAgentCommitMessage("Add branch-aware commit flow")
 	want := "Add branch-aware commit flow"
@@ -620,3 +651,466 @@ func TestSanitizeAgentPRBody_Empty(t *testing.T) {
 		t.Fatalf("sanitizeAgentPRBody() = %q, want empty", got)
 	}
 }
+
+func TestAgentOutputTail_KeepsRecentOutput(t *testing.T) {
+	tail := &agentOutputTail{}
+	tail.Append("codex", strings.Repeat("a", maxAgentStreamTailLen))
+	tail.Append("codex", "latest")
+
+	agentID, text, _ := tail.Snapshot()
+	if agentID != "codex" {
+		t.Fatalf("agentID = %q, want codex", agentID)
+	}
+	if len(text) != maxAgentStreamTailLen {
+		t.Fatalf("tail len = %d, want %d", len(text), maxAgentStreamTailLen)
+	}
+	if !strings.HasSuffix(text, "latest") {
+		t.Fatalf("expected tail to end with latest output, got %q", text[len(text)-10:])
+	}
+}
+
+func TestAgentOutputTail_ResetsOnAgentChange(t *testing.T) {
+	tail := &agentOutputTail{}
+	tail.Append("codex", "codex output")
+	tail.Append("claude", "claude output")
+
+	agentID, text, _ := tail.Snapshot()
+	if agentID != "claude" || text != "claude output" {
+		t.Fatalf("unexpected snapshot: %q %q", agentID, text)
+	}
+}
+
+func TestAgentOutputTail_ResetsPerHop(t *testing.T) {
+	tail := &agentOutputTail{}
+	tail.Append("codex", "first hop")
+	_, _, seq := tail.Snapshot()
+	if _, _, again := tail.Snapshot(); again != seq {
+		t.Fatalf("expected no change without new output, got %d then %d", seq, again)
+	}
+
+	tail.Reset()
+	tail.Append("codex", "second hop")
+	agentID, text, next := tail.Snapshot()
+	if agentID != "codex" || text != "second hop" || next == seq {
+		t.Fatalf("expected the tail to restart for the next hop, got %q %q %d", agentID, text, next)
+	}
+}
+
+func TestFormatPendingAgentOutput(t *testing.T) {
+	got := formatPendingAgentOutput("codex", 42, "running tests")
+	want := "@codex working... (42s elapsed)\n\nrunning tests"
+	if got != want {
+		t.Fatalf("formatPendingAgentOutput() = %q, want %q", got, want)
+	}
+}
+
+func TestCancelActiveRun_CancelsAndUnregisters(t *testing.T) {
+	svc := &TelegramService{activeRuns: make(map[string]*activeAgentRun)}
+
+	cancelled := false
+	svc.registerActiveRun("1:2", "build it", time.Now(), func() { cancelled = true })
+
+	run, ok := svc.cancelActiveRun("1:2")
+	if !ok || run == nil {
+		t.Fatalf("expected active run to be cancelled")
+	}
+	if !cancelled {
+		t.Fatalf("expected cancel func to be invoked")
+	}
+	if _, ok := svc.cancelActiveRun("1:2"); ok {
+		t.Fatalf("expected run to be unregistered after cancel")
+	}
+}
+
+func TestDropQueuedWork_DrainsPendingTasks(t *testing.T) {
+	queue := make(chan func(), 4)
+	queue <- func() {}
+	queue <- func() {}
+	svc := &TelegramService{runQueues: map[string]chan func(){"1:2": queue}}
+
+	if dropped := svc.dropQueuedWork("1:2"); dropped != 2 {
+		t.Fatalf("dropped = %d, want 2", dropped)
+	}
+	if len(queue) != 0 {
+		t.Fatalf("expected queue to be empty, got %d", len(queue))
+	}
+	if dropped := svc.dropQueuedWork("missing"); dropped != 0 {
+		t.Fatalf("dropped = %d for missing queue, want 0", dropped)
+	}
+}
+
+func TestAnsweringAgent_ReviewReturnsToAuthor(t *testing.T) {
+	events := []AgentEvent{
+		{Type: AgentEventOutput, From: "codex", Text: "Implemented."},
+		{Type: AgentEventOutput, From: "claude", Text: "Looks wrong."},
+		{Type: AgentEventReview, From: "claude", To: "codex", Round: 1},
+		{Type: AgentEventOutput, From: "codex", Text: "Fixed."},
+		{Type: AgentEventOutput, From: "claude", Text: ReviewApprovalMarker},
+		{Type: AgentEventApproved, From: "claude", To: "codex", Round: 2},
+	}
+	answeredBy := "codex"
+	for _, event := range events {
+		answeredBy = answeringAgent(answeredBy, event)
+	}
+	if answeredBy != "codex" {
+		t.Fatalf("expected the approved answer to be recorded under the author, got %q", answeredBy)
+	}
+
+	if got := answeringAgent("codex", AgentEvent{Type: AgentEventFallback, From: "codex", To: "claude"}); got != "claude" {
+		t.Fatalf("expected a fallback to move the answer to its target, got %q", got)
+	}
+	if got := answeringAgent("codex", AgentEvent{Type: AgentEventRetry, From: "codex"}); got != "codex" {
+		t.Fatalf("expected a retry to keep the answering agent, got %q", got)
+	}
+}
+
+func TestFormatStopSummary(t *testing.T) {
+	now := time.Now()
+	run := &activeAgentRun{prompt: "refactor parser", started: now.Add(-90 * time.Second)}
+
+	got := formatStopSummary(run, true, 2, now)
+	want := "Stopped agent run after 1m30s: refactor parser\nDropped 2 queued request(s)."
+	if got != want {
+		t.Fatalf("formatStopSummary() = %q, want %q", got, want)
+	}
+
+	long := &activeAgentRun{prompt: strings.Repeat("é", 250), started: now}
+	got = formatStopSummary(long, true, 0, now)
+	if !utf8.ValidString(got) || !strings.HasSuffix(got, strings.Repeat("é", 200)+"...") {
+		t.Fatalf("expected the prompt cut on a rune boundary, got %q", got)
+	}
+
+	got = formatStopSummary(nil, false, 0, now)
+	if got != "No agent run in progress." {
+		t.Fatalf("formatStopSummary() = %q, want no-run message", got)
+	}
+}
+
+func TestTopicAgent_FallsBackWhenAgentDisabled(t *testing.T) {
+	svc := &TelegramService{
+		topicContexts: map[string]*TopicContext{
+			"1:2": {Agent: "claude", Model: "opus"},
+			"1:3": {Agent: "retired"},
+		},
+		agent: &AgentService{
+			clients: map[string]llm.Client{"claude": &fakeAgentClient{id: "claude"}},
+		},
+	}
+
+	agentID, model := svc.topicAgent(1, 2)
+	if agentID != "claude" || model != "opus" {
+		t.Fatalf("topicAgent() = %q, %q; want claude, opus", agentID, model)
+	}
+	if agentID, _ := svc.topicAgent(1, 3); agentID != "" {
+		t.Fatalf("expected disabled agent to fall back to default, got %q", agentID)
+	}
+	if agentID, _ := svc.topicAgent(1, 4); agentID != "" {
+		t.Fatalf("expected missing topic to use default, got %q", agentID)
+	}
+}
+
+func TestUpdateTopicContext_CreatesAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topics.json")
+	svc := &TelegramService{
+		topicContexts:     make(map[string]*TopicContext),
+		topicContextsPath: path,
+	}
+
+	svc.updateTopicContext(1, 2, func(ctx *TopicContext) {
+		ctx.Agent = "claude"
+	})
+
+	reloaded := &TelegramService{topicContextsPath: path}
+	if err := reloaded.loadTopicContexts(); err != nil {
+		t.Fatalf("loadTopicContexts returned error: %v", err)
+	}
+	if ctx := reloaded.getTopicContext(1, 2); ctx == nil || ctx.Agent != "claude" {
+		t.Fatalf("expected persisted topic agent, got %#v", ctx)
+	}
+}
+
+func TestFormatTopicAgentStatus(t *testing.T) {
+	got := formatTopicAgentStatus("", "", "codex", []string{"claude", "codex"})
+	if !strings.HasPrefix(got, "Topic agent: @codex (default)\nEnabled agents: claude, codex") {
+		t.Fatalf("unexpected default status: %q", got)
+	}
+	got = formatTopicAgentStatus("claude", "opus", "codex", []string{"claude", "codex"})
+	if !strings.HasPrefix(got, "Topic agent: @claude (model opus)") {
+		t.Fatalf("unexpected custom status: %q", got)
+	}
+}
+
+func TestFormatAskAllAnswer_IncludesBranchAndDiffStat(t *testing.T) {
+	answer := AgentAnswer{Agent: "codex", Text: "Done.", Elapsed: 3 * time.Second}
+	got := formatAskAllAnswer(answer, "ask-all/codex-1", " a.go | 2 +-\n 1 file changed", "")
+	want := "@codex (3s)\nDone.\n\nBranch: ask-all/codex-1\na.go | 2 +-\n 1 file changed"
+	if got != want {
+		t.Fatalf("formatAskAllAnswer() = %q, want %q", got, want)
+	}
+
+	got = formatAskAllAnswer(AgentAnswer{Agent: "claude", Text: "Nothing to do."}, "ask-all/claude-1", "", "")
+	if !strings.HasSuffix(got, "No file changes.") {
+		t.Fatalf("expected no-changes note, got %q", got)
+	}
+
+	failed := AgentAnswer{Agent: "gemini", Err: errors.New("agent timed out"), Elapsed: time.Minute}
+	got = formatAskAllAnswer(failed, "ask-all/gemini-1", " b.go | 4 ++++\n 1 file changed", "")
+	if !strings.Contains(got, "Partial changes committed to ask-all/gemini-1\nb.go | 4 ++++") {
+		t.Fatalf("expected partial changes note, got %q", got)
+	}
+
+	got = formatAskAllAnswer(failed, "ask-all/gemini-1", "", "/tmp/ask-all-gemini")
+	if !strings.Contains(got, "the worktree is kept at /tmp/ask-all-gemini") {
+		t.Fatalf("expected kept worktree note, got %q", got)
+	}
+}
+
+func TestUsagePeriodStart(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 30, 0, 0, time.UTC)
+
+	today, ok := usagePeriodStart("", now)
+	if !ok || !today.Equal(time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("today = %v, %v", today, ok)
+	}
+	week, ok := usagePeriodStart("week", now)
+	if !ok || !week.Equal(now.AddDate(0, 0, -7)) {
+		t.Fatalf("week = %v, %v", week, ok)
+	}
+	if _, ok := usagePeriodStart("month", now); ok {
+		t.Fatalf("expected unknown period to be rejected")
+	}
+}
+
+func TestFormatUsageSummary(t *testing.T) {
+	summary := UsageSummary{
+		UsageTotals: UsageTotals{Calls: 2, InputTokens: 150, OutputTokens: 15, CostUSD: 0.25, Duration: 3 * time.Second},
+		Requests:    1,
+		ByAgent: map[string]UsageTotals{
+			"codex":  {Calls: 1, InputTokens: 100, OutputTokens: 10, Duration: 2 * time.Second},
+			"claude": {Calls: 1, InputTokens: 50, OutputTokens: 5, CostUSD: 0.25, Duration: time.Second},
+		},
+	}
+
+	got := formatUsageSummary(summary, "today", "this topic")
+	want := "Agent usage today for this topic:\n" +
+		"Requests: 1, agent calls: 2\n" +
+		"Total: 150 in / 15 out tokens, 3s agent time, $0.25\n" +
+		"@claude: 50 in / 5 out tokens, 1s agent time, $0.25\n" +
+		"@codex: 100 in / 10 out tokens, 2s agent time"
+	if got != want {
+		t.Fatalf("formatUsageSummary() = %q, want %q", got, want)
+	}
+
+	if got := formatUsageSummary(UsageSummary{}, "week", "all topics"); got != "No agent usage over the last 7 days for all topics." {
+		t.Fatalf("unexpected empty summary: %q", got)
+	}
+}
+
+func TestFormatBudgetExceeded(t *testing.T) {
+	got := formatBudgetExceeded(&BudgetExceededError{Scope: "global", Limit: BudgetTokens, Used: 1200, Max: 1000}, "")
+	want := "Agent run stopped: the global budget is used up (1200/1000 tokens today). An admin can raise it with /budget global tokens <n>."
+	if got != want {
+		t.Fatalf("formatBudgetExceeded() = %q, want %q", got, want)
+	}
+
+	got = formatBudgetExceeded(&BudgetExceededError{Scope: "topic", Limit: BudgetHops, Used: 3, Max: 3}, "partial answer")
+	if !strings.Contains(got, "this topic's budget") || !strings.HasSuffix(got, "Last agent output:\npartial answer") {
+		t.Fatalf("unexpected message: %q", got)
+	}
+}
+
+func TestParseAdminUserIDs(t *testing.T) {
+	ids, err := parseAdminUserIDs(" 1, 22 ,")
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("parseAdminUserIDs() = %v, %v", ids, err)
+	}
+	if _, err := parseAdminUserIDs("abc"); err == nil {
+		t.Fatalf("expected invalid id to be rejected")
+	}
+}
+
+func TestInboundAttachment(t *testing.T) {
+	photo := &tb.Message{Photo: &tb.Photo{File: tb.File{FileID: "p1", UniqueID: "abc"}}}
+	file, name, mimeType, ok := inboundAttachment(photo)
+	if !ok || file.FileID != "p1" || name != "photo-abc.jpg" || mimeType != "image/jpeg" {
+		t.Fatalf("unexpected photo attachment: %v %q %q %v", file, name, mimeType, ok)
+	}
+
+	doc := &tb.Message{Document: &tb.Document{File: tb.File{FileID: "d1"}, FileName: "screen.png"}}
+	_, name, mimeType, ok = inboundAttachment(doc)
+	if !ok || name != "screen.png" || mimeType != "image/png" {
+		t.Fatalf("unexpected document attachment: %q %q %v", name, mimeType, ok)
+	}
+
+	if _, _, _, ok := inboundAttachment(&tb.Message{Text: "hi"}); ok {
+		t.Fatalf("expected text message to have no attachment")
+	}
+}
+
+func TestSanitizeAttachmentName(t *testing.T) {
+	cases := map[string]string{
+		"Screen Shot 2024-01-01.png": "Screen_Shot_2024-01-01.png",
+		"../../etc/passwd":           "passwd",
+		"..":                         "file",
+		"":                           "file",
+		"résumé.pdf":                 "r_sum_.pdf",
+	}
+	for in, want := range cases {
+		if got := sanitizeAttachmentName(in); got != want {
+			t.Fatalf("sanitizeAttachmentName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestInboundReply(t *testing.T) {
+	const botID = 42
+	bot := &tb.User{ID: botID}
+
+	topicRoot := &tb.Message{TopicMessage: true, ThreadID: 7, Text: "hi", ReplyTo: &tb.Message{ID: 7, TopicCreated: &tb.Topic{Name: "repo"}}}
+	if _, ok := inboundReply(topicRoot, botID); ok {
+		t.Fatalf("expected the implicit reply to the topic root to be ignored")
+	}
+
+	answer := &tb.Message{TopicMessage: true, ThreadID: 7, Text: "fix this", ReplyTo: &tb.Message{ID: 9, Sender: bot, Text: "The tests fail in parser.go."}}
+	reply, ok := inboundReply(answer, botID)
+	if !ok || !reply.FromBot || reply.Quoted || reply.Text != "The tests fail in parser.go." {
+		t.Fatalf("unexpected reply context: %#v %v", reply, ok)
+	}
+
+	answer.Quote = &tb.TextQuote{Text: "parser.go"}
+	if reply, _ := inboundReply(answer, botID); !reply.Quoted || reply.Text != "parser.go" {
+		t.Fatalf("expected the quoted part to win, got %#v", reply)
+	}
+
+	doc := &tb.Message{Text: "what is wrong here?", ReplyTo: &tb.Message{ID: 3, Sender: &tb.User{ID: 1}, Document: &tb.Document{File: tb.File{FileID: "d1"}, FileName: "app.log"}}}
+	reply, ok = inboundReply(doc, botID)
+	if !ok || reply.FromBot || !reply.HasFile || reply.FileName != "app.log" || reply.Text != "" {
+		t.Fatalf("unexpected document reply context: %#v %v", reply, ok)
+	}
+}
+
+func TestFormatReplyPrompt(t *testing.T) {
+	got := formatReplyPrompt(replyContext{FromBot: true, Text: "Step one.\nStep two."}, "fix this")
+	want := "The user is replying to your earlier answer:\n> Step one.\n> Step two.\n\nfix this"
+	if got != want {
+		t.Fatalf("formatReplyPrompt() = %q, want %q", got, want)
+	}
+
+	got = formatReplyPrompt(replyContext{Text: "panic", Quoted: true, HasFile: true, FileName: "app.log"}, "why?")
+	want = "The user is replying to this part of an earlier message:\n> panic\nThat message had the file app.log attached.\n\nwhy?"
+	if got != want {
+		t.Fatalf("formatReplyPrompt() = %q, want %q", got, want)
+	}
+
+	long := formatReplyPrompt(replyContext{Text: strings.Repeat("é", maxReplyContextLen)}, "go")
+	if !strings.Contains(long, "...[truncated]") || !utf8.ValidString(long) {
+		t.Fatalf("expected long reply to be truncated on a rune boundary")
+	}
+}
+
+func TestFormatWorktreeList(t *testing.T) {
+	worktrees := []Worktree{
+		{Path: "/repos/1_2", Branch: "main"},
+		{Path: "/repos/.worktrees/1_2/login", Branch: "feature/login"},
+	}
+	got := formatWorktreeList(worktrees, "/repos/1_2", "/repos/.worktrees/1_2/login")
+	want := "Worktrees:\n- main (topic repo)\n* feature/login (active)\n\n" + branchUsage
+	if got != want {
+		t.Fatalf("formatWorktreeList() = %q, want %q", got, want)
+	}
+}
+
+func TestCheckpointLabel(t *testing.T) {
+	if got := checkpointLabel("  fix the login form\nand add tests"); got != "before: fix the login form" {
+		t.Fatalf("checkpointLabel() = %q", got)
+	}
+	if got := checkpointLabel(strings.Repeat("é", 70)); got != "before: "+strings.Repeat("é", 60)+"…" {
+		t.Fatalf("checkpointLabel() did not shorten a long prompt: %q", got)
+	}
+}
+
+func TestFormatCheckpointList(t *testing.T) {
+	if got := formatCheckpointList(nil, time.UTC); !strings.HasPrefix(got, "No checkpoints yet.") {
+		t.Fatalf("formatCheckpointList(nil) = %q", got)
+	}
+
+	at := time.Date(2025, 3, 1, 9, 5, 0, 0, time.UTC)
+	var checkpoints []Checkpoint
+	for i := 0; i < maxListedCheckpoints+2; i++ {
+		checkpoints = append(checkpoints, Checkpoint{Time: at.Add(-time.Duration(i) * time.Minute), Label: fmt.Sprintf("before: task %d", i)})
+	}
+	got := formatCheckpointList(checkpoints, time.UTC)
+	if !strings.HasPrefix(got, "Checkpoints (newest first):\n1. 2025-03-01 09:05:00 before: task 0\n2. 2025-03-01 09:04:00 before: task 1\n") {
+		t.Fatalf("unexpected checkpoint list: %q", got)
+	}
+	if !strings.Contains(got, "\n…and 2 older\n") || strings.Contains(got, "task 10") {
+		t.Fatalf("expected the list to be capped, got %q", got)
+	}
+}
+
+func TestFormatChangeSummary(t *testing.T) {
+	if got := formatChangeSummary(&ChangeSummary{}); got != "" {
+		t.Fatalf("expected no summary without changes, got %q", got)
+	}
+
+	summary := &ChangeSummary{
+		Files: []FileChange{
+			{Path: "services/git.go", Status: "modified", Insertions: 30, Deletions: 2},
+			{Path: "notes.md", Status: "added", Insertions: 10, Untracked: true},
+			{Path: "logo.png", Status: "deleted", Binary: true},
+		},
+		Insertions: 40,
+		Deletions:  2,
+	}
+	want := "Changed 3 files (+40 -2):\nM services/git.go +30 -2\nA notes.md +10 -0 (untracked)\nD logo.png (binary)"
+	if got := formatChangeSummary(summary); got != want {
+		t.Fatalf("formatChangeSummary() = %q, want %q", got, want)
+	}
+
+	if got := appendChangeSummary("Done.\n", want); got != "Done.\n\n"+want {
+		t.Fatalf("appendChangeSummary() = %q", got)
+	}
+}
+
+func TestDiffFileName(t *testing.T) {
+	if got := diffFileName("feature/Login", nil); got != "feature-login.diff" {
+		t.Fatalf("diffFileName() = %q", got)
+	}
+	if got := diffFileName("HEAD", []string{"services/git.go"}); got != "changes-git.go.diff" {
+		t.Fatalf("diffFileName() = %q", got)
+	}
+}
+
+func TestParseCommitArgsAndPRLine(t *testing.T) {
+	tests := []struct {
+		payload string
+		draft   bool
+		message string
+	}{
+		{"", false, ""},
+		{"Fix login", false, "Fix login"},
+		{"--draft", true, ""},
+		{" --draft Fix login ", true, "Fix login"},
+		{"--draft\nFix login\n\nDetails", true, "Fix login\n\nDetails"},
+		{"--drafty copy", false, "--drafty copy"},
+	}
+	for _, tt := range tests {
+		draft, message := parseCommitArgs(tt.payload)
+		if draft != tt.draft || message != tt.message {
+			t.Fatalf("parseCommitArgs(%q) = %v, %q", tt.payload, draft, message)
+		}
+	}
+
+	got := formatPRLine(&CommitPRResult{PRURL: "https://github.com/acme/app/pull/12", PRNumber: 12, PRCreated: true, PRDraft: true})
+	if got != "Draft PR #12 opened: https://github.com/acme/app/pull/12" {
+		t.Fatalf("formatPRLine() = %q", got)
+	}
+	got = formatPRLine(&CommitPRResult{PRURL: "https://github.com/acme/app/pull/9", PRNumber: 9, PRUpdated: true})
+	if got != "PR #9 updated: https://github.com/acme/app/pull/9" {
+		t.Fatalf("formatPRLine() = %q", got)
+	}
+	got = formatPRLine(&CommitPRResult{PRURL: "https://github.com/acme/app/pull/3", PRNumber: 3})
+	if got != "PR #3 already open: https://github.com/acme/app/pull/3" {
+		t.Fatalf("formatPRLine() = %q", got)
+	}
+}
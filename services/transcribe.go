@@ -0,0 +1,135 @@
+package services
+
+import (
+	"bytes"
+	ctx "context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Transcriber turns a recorded voice message into text.
+type Transcriber interface {
+	// Name identifies the backend in logs and status messages.
+	Name() string
+	// Transcribe returns the text spoken in the audio file at path.
+	Transcribe(runCtx ctx.Context, path string) (string, error)
+}
+
+const (
+	TranscriberNone       = "none"
+	TranscriberWhisperCpp = "whisper.cpp"
+
+	defaultWhisperBin = "whisper-cli"
+	defaultFFmpegBin  = "ffmpeg"
+)
+
+// loadTranscriber builds the transcriber selected by VOICE_TRANSCRIBER. When
+// it is unset, whisper.cpp is used if WHISPER_MODEL is set and voice messages
+// are disabled otherwise. A nil transcriber means voice is disabled.
+func loadTranscriber() (Transcriber, error) {
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("VOICE_TRANSCRIBER")))
+	model := strings.TrimSpace(os.Getenv("WHISPER_MODEL"))
+	if kind == "" {
+		if model == "" {
+			return nil, nil
+		}
+		kind = TranscriberWhisperCpp
+	}
+
+	switch kind {
+	case TranscriberNone:
+		return nil, nil
+	case TranscriberWhisperCpp, "whisper", "whispercpp":
+		if model == "" {
+			return nil, fmt.Errorf("VOICE_TRANSCRIBER=%s needs WHISPER_MODEL", TranscriberWhisperCpp)
+		}
+		return &WhisperCppTranscriber{
+			Bin:      strings.TrimSpace(os.Getenv("WHISPER_BIN")),
+			Model:    model,
+			Language: strings.TrimSpace(os.Getenv("WHISPER_LANGUAGE")),
+			FFmpeg:   strings.TrimSpace(os.Getenv("FFMPEG_BIN")),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown VOICE_TRANSCRIBER %q (use %s or %s)", kind, TranscriberWhisperCpp, TranscriberNone)
+	}
+}
+
+// WhisperCppTranscriber runs a local whisper.cpp binary. Telegram voice notes
+// are Opus in OGG, which whisper.cpp cannot read, so they are converted to
+// 16 kHz mono WAV with ffmpeg first.
+type WhisperCppTranscriber struct {
+	// Bin is the whisper.cpp CLI; empty uses "whisper-cli".
+	Bin string
+	// Model is the path to a ggml model file.
+	Model string
+	// Language is a whisper language code; empty lets whisper detect it.
+	Language string
+	// FFmpeg is the ffmpeg binary; empty uses "ffmpeg".
+	FFmpeg string
+}
+
+func (w *WhisperCppTranscriber) Name() string {
+	return TranscriberWhisperCpp
+}
+
+func (w *WhisperCppTranscriber) Transcribe(runCtx ctx.Context, path string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "gocode-voice-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	wavPath := filepath.Join(tmpDir, "voice.wav")
+	ffmpeg := w.FFmpeg
+	if ffmpeg == "" {
+		ffmpeg = defaultFFmpegBin
+	}
+	if _, err := runTranscriberCommand(runCtx, ffmpeg, "-nostdin", "-loglevel", "error", "-y", "-i", path, "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", wavPath); err != nil {
+		return "", fmt.Errorf("convert voice message: %w", err)
+	}
+
+	bin := w.Bin
+	if bin == "" {
+		bin = defaultWhisperBin
+	}
+	args := []string{"-m", w.Model, "-f", wavPath, "-nt", "-np"}
+	if w.Language != "" {
+		args = append(args, "-l", w.Language)
+	}
+	out, err := runTranscriberCommand(runCtx, bin, args...)
+	if err != nil {
+		return "", fmt.Errorf("transcribe voice message: %w", err)
+	}
+	return cleanTranscript(out), nil
+}
+
+func runTranscriberCommand(runCtx ctx.Context, bin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(runCtx, bin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return "", fmt.Errorf("%s: %w: %s", filepath.Base(bin), err, detail)
+		}
+		return "", fmt.Errorf("%s: %w", filepath.Base(bin), err)
+	}
+	return stdout.String(), nil
+}
+
+// cleanTranscript joins whisper's per-segment lines into one paragraph and
+// drops non-speech markers such as "[BLANK_AUDIO]".
+func cleanTranscript(raw string) string {
+	var parts []string
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]")) {
+			continue
+		}
+		parts = append(parts, line)
+	}
+	return strings.Join(parts, " ")
+}
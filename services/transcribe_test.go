@@ -0,0 +1,108 @@
+package services
+
+import (
+	ctx "context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWhisperCppTranscriber_ConvertsAndTranscribes(t *testing.T) {
+	dir := t.TempDir()
+	ffmpegArgs := filepath.Join(dir, "ffmpeg-args.txt")
+	whisperArgs := filepath.Join(dir, "whisper-args.txt")
+
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	// The stub writes the output file named by its last argument.
+	ffmpegScript := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > \"" + ffmpegArgs + "\"\n" +
+		"for last; do :; done\n" +
+		"touch \"$last\"\n"
+	if err := os.WriteFile(ffmpeg, []byte(ffmpegScript), 0o755); err != nil {
+		t.Fatalf("failed to write ffmpeg stub: %v", err)
+	}
+
+	whisper := filepath.Join(dir, "whisper-cli")
+	whisperScript := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > \"" + whisperArgs + "\"\n" +
+		"echo ' Add a health check endpoint'\n" +
+		"echo ''\n" +
+		"echo ' [BLANK_AUDIO]'\n" +
+		"echo ' and open a PR.'\n"
+	if err := os.WriteFile(whisper, []byte(whisperScript), 0o755); err != nil {
+		t.Fatalf("failed to write whisper stub: %v", err)
+	}
+
+	transcriber := &WhisperCppTranscriber{Bin: whisper, Model: "/models/ggml-base.en.bin", Language: "en", FFmpeg: ffmpeg}
+	got, err := transcriber.Transcribe(ctx.Background(), "/tmp/voice.ogg")
+	if err != nil {
+		t.Fatalf("Transcribe returned error: %v", err)
+	}
+	if got != "Add a health check endpoint and open a PR." {
+		t.Fatalf("Transcribe() = %q", got)
+	}
+
+	raw, err := os.ReadFile(ffmpegArgs)
+	if err != nil {
+		t.Fatalf("failed to read ffmpeg args: %v", err)
+	}
+	if !strings.Contains(string(raw), "-i\n/tmp/voice.ogg\n-ar\n16000\n") {
+		t.Fatalf("unexpected ffmpeg args: %q", raw)
+	}
+	raw, err = os.ReadFile(whisperArgs)
+	if err != nil {
+		t.Fatalf("failed to read whisper args: %v", err)
+	}
+	args := string(raw)
+	if !strings.HasPrefix(args, "-m\n/models/ggml-base.en.bin\n-f\n") || !strings.HasSuffix(args, "-nt\n-np\n-l\nen\n") {
+		t.Fatalf("unexpected whisper args: %q", args)
+	}
+}
+
+func TestWhisperCppTranscriber_ReportsFailure(t *testing.T) {
+	dir := t.TempDir()
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte("#!/bin/sh\necho 'Invalid data found' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatalf("failed to write ffmpeg stub: %v", err)
+	}
+
+	transcriber := &WhisperCppTranscriber{Model: "model.bin", FFmpeg: ffmpeg}
+	_, err := transcriber.Transcribe(ctx.Background(), "/tmp/voice.ogg")
+	if err == nil || !strings.Contains(err.Error(), "Invalid data found") {
+		t.Fatalf("expected ffmpeg stderr in error, got %v", err)
+	}
+}
+
+func TestLoadTranscriber(t *testing.T) {
+	t.Setenv("VOICE_TRANSCRIBER", "")
+	t.Setenv("WHISPER_MODEL", "")
+	if transcriber, err := loadTranscriber(); err != nil || transcriber != nil {
+		t.Fatalf("expected voice to be disabled by default, got %v, %v", transcriber, err)
+	}
+
+	t.Setenv("VOICE_TRANSCRIBER", "whisper.cpp")
+	if _, err := loadTranscriber(); err == nil {
+		t.Fatalf("expected whisper.cpp without a model to be rejected")
+	}
+
+	t.Setenv("VOICE_TRANSCRIBER", "")
+	t.Setenv("WHISPER_MODEL", "/models/ggml-base.bin")
+	transcriber, err := loadTranscriber()
+	if err != nil {
+		t.Fatalf("loadTranscriber returned error: %v", err)
+	}
+	if transcriber == nil || transcriber.Name() != TranscriberWhisperCpp {
+		t.Fatalf("expected whisper.cpp when WHISPER_MODEL is set, got %#v", transcriber)
+	}
+
+	t.Setenv("VOICE_TRANSCRIBER", "none")
+	if transcriber, err := loadTranscriber(); err != nil || transcriber != nil {
+		t.Fatalf("expected none to disable voice, got %v, %v", transcriber, err)
+	}
+
+	t.Setenv("VOICE_TRANSCRIBER", "deepgram")
+	if _, err := loadTranscriber(); err == nil {
+		t.Fatalf("expected unknown transcriber to be rejected")
+	}
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Transcript entry kinds besides the AgentEventType values recorded for
+// handoffs, reviews, retries and fallbacks.
+const (
+	TranscriptPrompt   = "prompt"
+	TranscriptAnswer   = "answer"
+	TranscriptFailure  = "failure"
+	TranscriptStopped  = "stopped"
+	TranscriptRestored = "restored"
+)
+
+// TranscriptEntry is one line of a topic transcript.
+type TranscriptEntry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Agent is the agent that received a prompt or produced the entry.
+	Agent string `json:"agent,omitempty"`
+	// To is the receiving agent of a handoff or review.
+	To          string   `json:"to,omitempty"`
+	Text        string   `json:"text"`
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+// TranscriptStore keeps an append-only JSONL transcript per topic, so what
+// the agents were asked and answered survives /clear and restarts. A store
+// with an empty dir records nothing.
+type TranscriptStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewTranscriptStore(dir string) *TranscriptStore {
+	return &TranscriptStore{dir: dir}
+}
+
+// Path returns the transcript file of topic.
+func (s *TranscriptStore) Path(topic string) string {
+	name := strings.NewReplacer(":", "_", string(filepath.Separator), "_").Replace(topic)
+	return filepath.Join(s.dir, name+".jsonl")
+}
+
+// Append adds entry to the transcript of topic.
+func (s *TranscriptStore) Append(topic string, entry TranscriptEntry) error {
+	if s == nil || s.dir == "" {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path(topic), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Recent returns the last n entries of topic, oldest first. n <= 0 returns
+// the whole transcript. Malformed lines are skipped.
+func (s *TranscriptStore) Recent(topic string, n int) ([]TranscriptEntry, error) {
+	if s == nil || s.dir == "" {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.Path(topic))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warn().Err(err).Str("topic", topic).Msg("skipping malformed transcript entry")
+			continue
+		}
+		entries = append(entries, entry)
+		if n > 0 && len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// transcriptSpeaker describes who wrote entry, e.g. "You -> @codex" or
+// "@codex -> @claude (handoff)".
+func transcriptSpeaker(entry TranscriptEntry) string {
+	switch entry.Kind {
+	case TranscriptPrompt:
+		if entry.Agent == "" {
+			return "You"
+		}
+		return "You -> @" + entry.Agent
+	case TranscriptAnswer:
+		return "@" + entry.Agent
+	case TranscriptFailure:
+		if entry.Agent == "" {
+			return "Failed"
+		}
+		return "@" + entry.Agent + " (failed)"
+	case TranscriptStopped:
+		return "Stopped"
+	case TranscriptRestored:
+		return "Restored checkpoint"
+	case string(AgentEventForward):
+		return fmt.Sprintf("@%s -> @%s (handoff)", entry.Agent, entry.To)
+	case string(AgentEventResponse):
+		return fmt.Sprintf("@%s -> @%s (handoff reply)", entry.Agent, entry.To)
+	case string(AgentEventReview), string(AgentEventApproved):
+		return fmt.Sprintf("@%s -> @%s (%s)", entry.Agent, entry.To, entry.Kind)
+	default:
+		if entry.To != "" {
+			return fmt.Sprintf("@%s -> @%s (%s)", entry.Agent, entry.To, entry.Kind)
+		}
+		return fmt.Sprintf("@%s (%s)", entry.Agent, entry.Kind)
+	}
+}
+
+// formatTranscript renders entries as plain text. Entry bodies longer than
+// maxEntryLen runes are shortened; 0 keeps them whole.
+func formatTranscript(entries []TranscriptEntry, maxEntryLen int, loc *time.Location) string {
+	var b strings.Builder
+	for i, entry := range entries {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		text := strings.TrimSpace(entry.Text)
+		if runes := []rune(text); maxEntryLen > 0 && len(runes) > maxEntryLen {
+			text = string(runes[:maxEntryLen]) + "…"
+		}
+		fmt.Fprintf(&b, "[%s] %s:\n%s", entry.Time.In(loc).Format("2006-01-02 15:04"), transcriptSpeaker(entry), text)
+		for _, path := range entry.Attachments {
+			fmt.Fprintf(&b, "\n(attached %s)", filepath.Base(path))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscriptStore_AppendAndRecent(t *testing.T) {
+	store := NewTranscriptStore(filepath.Join(t.TempDir(), "transcripts"))
+	topic := topicKey(-100123, 7)
+	base := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	entries := []TranscriptEntry{
+		{Time: base, Kind: TranscriptPrompt, Agent: "codex", Text: "add a health check"},
+		{Time: base.Add(time.Minute), Kind: string(AgentEventForward), Agent: "codex", To: "claude", Text: "please review"},
+		{Time: base.Add(2 * time.Minute), Kind: TranscriptAnswer, Agent: "codex", Text: "Done."},
+	}
+	for _, entry := range entries {
+		if err := store.Append(topic, entry); err != nil {
+			t.Fatalf("Append returned error: %v", err)
+		}
+	}
+	if err := store.Append(topicKey(-100123, 8), TranscriptEntry{Kind: TranscriptPrompt, Text: "other topic"}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+
+	// Survives a restart: a fresh store reads the same files.
+	reloaded := NewTranscriptStore(store.dir)
+	got, err := reloaded.Recent(topic, 2)
+	if err != nil {
+		t.Fatalf("Recent returned error: %v", err)
+	}
+	if len(got) != 2 || got[0].Kind != string(AgentEventForward) || got[1].Text != "Done." {
+		t.Fatalf("unexpected recent entries: %#v", got)
+	}
+
+	all, err := reloaded.Recent(topic, 0)
+	if err != nil || len(all) != 3 {
+		t.Fatalf("expected the whole transcript, got %d entries, %v", len(all), err)
+	}
+}
+
+func TestTranscriptStore_SkipsMalformedLines(t *testing.T) {
+	store := NewTranscriptStore(t.TempDir())
+	topic := topicKey(1, 2)
+	if err := store.Append(topic, TranscriptEntry{Kind: TranscriptPrompt, Text: "first"}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	f, err := os.OpenFile(store.Path(topic), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open transcript: %v", err)
+	}
+	f.WriteString("{not json\n")
+	f.Close()
+	if err := store.Append(topic, TranscriptEntry{Kind: TranscriptAnswer, Agent: "codex", Text: "second"}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+
+	got, err := store.Recent(topic, 0)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected malformed line to be skipped, got %#v, %v", got, err)
+	}
+}
+
+func TestTranscriptStore_DisabledWithoutDir(t *testing.T) {
+	store := NewTranscriptStore("")
+	if err := store.Append("1:2", TranscriptEntry{Kind: TranscriptPrompt, Text: "hi"}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	if got, err := store.Recent("1:2", 0); err != nil || len(got) != 0 {
+		t.Fatalf("expected nothing to be recorded, got %#v, %v", got, err)
+	}
+}
+
+func TestFormatTranscript(t *testing.T) {
+	at := time.Date(2025, 3, 1, 9, 5, 0, 0, time.UTC)
+	entries := []TranscriptEntry{
+		{Time: at, Kind: TranscriptPrompt, Agent: "codex", Text: "look at this", Attachments: []string{"/repo/.gocode/attachments/20250301-090500-shot.png"}},
+		{Time: at, Kind: string(AgentEventForward), Agent: "codex", To: "claude", Text: "check the tests"},
+		{Time: at, Kind: TranscriptAnswer, Agent: "claude", Text: strings.Repeat("x", 20)},
+	}
+
+	got := formatTranscript(entries, 15, time.UTC)
+	want := "[2025-03-01 09:05] You -> @codex:\nlook at this\n(attached 20250301-090500-shot.png)\n\n" +
+		"[2025-03-01 09:05] @codex -> @claude (handoff):\ncheck the tests\n\n" +
+		"[2025-03-01 09:05] @claude:\n" + strings.Repeat("x", 15) + "…"
+	if got != want {
+		t.Fatalf("formatTranscript() = %q, want %q", got, want)
+	}
+}
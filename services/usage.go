@@ -0,0 +1,263 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/requiem-ai/gocode/llm"
+	"github.com/rs/zerolog/log"
+)
+
+// UsageRecord is one agent call (one hop of a request) in the usage log.
+type UsageRecord struct {
+	Time         time.Time `json:"time"`
+	Topic        string    `json:"topic,omitempty"`
+	RepoPath     string    `json:"repo_path,omitempty"`
+	Request      string    `json:"request"`
+	Hop          int       `json:"hop"`
+	Agent        string    `json:"agent"`
+	Model        string    `json:"model,omitempty"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	CostUSD      float64   `json:"cost_usd,omitempty"`
+	DurationMS   int64     `json:"duration_ms"`
+	ExitCode     int       `json:"exit_code"`
+}
+
+func newUsageRecord(run *agentRun, repoPath, agentID string, usage llm.Usage, now time.Time) UsageRecord {
+	return UsageRecord{
+		Time:         now.UTC(),
+		Topic:        run.topic,
+		RepoPath:     repoPath,
+		Request:      run.id,
+		Hop:          run.hops,
+		Agent:        agentID,
+		Model:        usage.Model,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		CostUSD:      usage.CostUSD,
+		DurationMS:   usage.Duration.Milliseconds(),
+		ExitCode:     usage.ExitCode,
+	}
+}
+
+// UsageTotals adds up a set of usage records.
+type UsageTotals struct {
+	Calls        int
+	InputTokens  int
+	OutputTokens int
+	CostUSD      float64
+	Duration     time.Duration
+}
+
+func (t *UsageTotals) add(rec UsageRecord) {
+	t.Calls++
+	t.InputTokens += rec.InputTokens
+	t.OutputTokens += rec.OutputTokens
+	t.CostUSD += rec.CostUSD
+	t.Duration += time.Duration(rec.DurationMS) * time.Millisecond
+}
+
+// UsageSummary aggregates usage over a period, overall and per agent.
+type UsageSummary struct {
+	UsageTotals
+	Requests int
+	ByAgent  map[string]UsageTotals
+}
+
+// Agents returns the agent ids in the summary, sorted.
+func (s UsageSummary) Agents() []string {
+	ids := make([]string, 0, len(s.ByAgent))
+	for id := range s.ByAgent {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// UsageStore keeps an append-only JSONL log of agent usage. Only the running
+// totals for the current day, which the daily budgets check before every hop,
+// are kept in memory; Summary streams the log. A store with an empty path
+// keeps every record in memory instead.
+type UsageStore struct {
+	path string
+
+	mu sync.Mutex
+	// day is the local date ("2006-01-02") the running totals cover.
+	day    string
+	global UsageTotals
+	topics map[string]UsageTotals
+	// records is only kept by stores without a path.
+	records []UsageRecord
+}
+
+// NewUsageStore loads today's totals from the log at path, starting empty if
+// it does not exist. Malformed lines are skipped so one bad write cannot hide
+// the history.
+func NewUsageStore(path string) (*UsageStore, error) {
+	store := &UsageStore{path: path, day: usageDay(time.Now()), topics: make(map[string]UsageTotals)}
+	if path == "" {
+		return store, nil
+	}
+	if err := store.eachRecordLocked(store.addTodayLocked); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// usageDay is the local calendar day of t, the window of the daily budgets.
+func usageDay(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+// addTodayLocked adds rec to the running totals if it falls on the current
+// day, starting a new day when rec is the first record after midnight.
+func (s *UsageStore) addTodayLocked(rec UsageRecord) {
+	day := usageDay(rec.Time)
+	if day > s.day {
+		s.day = day
+		s.global = UsageTotals{}
+		s.topics = make(map[string]UsageTotals)
+	}
+	if day != s.day {
+		return
+	}
+	s.global.add(rec)
+	if rec.Topic != "" {
+		topic := s.topics[rec.Topic]
+		topic.add(rec)
+		s.topics[rec.Topic] = topic
+	}
+}
+
+// eachRecordLocked calls fn for every record in the log, oldest first.
+func (s *UsageStore) eachRecordLocked(fn func(UsageRecord)) error {
+	if s.path == "" {
+		for _, rec := range s.records {
+			fn(rec)
+		}
+		return nil
+	}
+
+	return readUsageLog(s.path, fn)
+}
+
+// readUsageLog calls fn for every record in the log at path, oldest first. It
+// needs no lock: Record only appends, and a line caught mid-write is skipped
+// like any other malformed one.
+func readUsageLog(path string, fn func(UsageRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("skipping malformed usage record")
+			continue
+		}
+		fn(rec)
+	}
+	return scanner.Err()
+}
+
+// Record appends rec to the log.
+func (s *UsageStore) Record(rec UsageRecord) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addTodayLocked(rec)
+	if s.path == "" {
+		s.records = append(s.records, rec)
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Today returns the usage of topic on the local day of now. An empty topic
+// covers every topic.
+func (s *UsageStore) Today(topic string, now time.Time) UsageTotals {
+	if s == nil {
+		return UsageTotals{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if usageDay(now) != s.day {
+		return UsageTotals{}
+	}
+	if topic == "" {
+		return s.global
+	}
+	return s.topics[topic]
+}
+
+// Summary aggregates records at or after since by reading the log. An empty
+// topic summarizes every topic.
+func (s *UsageStore) Summary(topic string, since time.Time) UsageSummary {
+	summary := UsageSummary{ByAgent: make(map[string]UsageTotals)}
+	if s == nil {
+		return summary
+	}
+	// The log is read without s.mu so a long scan does not hold up Record
+	// and the budget checks; only the in-memory records need copying.
+	s.mu.Lock()
+	records := append([]UsageRecord(nil), s.records...)
+	s.mu.Unlock()
+
+	requests := make(map[string]struct{})
+	add := func(rec UsageRecord) {
+		if rec.Time.Before(since) || (topic != "" && rec.Topic != topic) {
+			return
+		}
+		summary.add(rec)
+		byAgent := summary.ByAgent[rec.Agent]
+		byAgent.add(rec)
+		summary.ByAgent[rec.Agent] = byAgent
+		requests[rec.Request] = struct{}{}
+	}
+	var err error
+	if s.path == "" {
+		for _, rec := range records {
+			add(rec)
+		}
+	} else {
+		err = readUsageLog(s.path, add)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("path", s.path).Msg("failed to read usage log")
+	}
+	summary.Requests = len(requests)
+	return summary
+}
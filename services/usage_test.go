@@ -0,0 +1,104 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageStore_PersistsAndSummarizes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	store, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatalf("NewUsageStore returned error: %v", err)
+	}
+
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	records := []UsageRecord{
+		{Time: now, Topic: "1:2", Request: "a", Hop: 1, Agent: "codex", InputTokens: 100, OutputTokens: 10, DurationMS: 2000},
+		{Time: now, Topic: "1:2", Request: "a", Hop: 2, Agent: "claude", InputTokens: 50, OutputTokens: 5, CostUSD: 0.25, DurationMS: 1000},
+		{Time: now, Topic: "1:3", Request: "b", Hop: 1, Agent: "codex", InputTokens: 7, OutputTokens: 1, DurationMS: 500},
+		{Time: now.AddDate(0, 0, -3), Topic: "1:2", Request: "c", Hop: 1, Agent: "codex", InputTokens: 1000},
+	}
+	for _, rec := range records {
+		if err := store.Record(rec); err != nil {
+			t.Fatalf("Record returned error: %v", err)
+		}
+	}
+
+	reloaded, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatalf("NewUsageStore reload returned error: %v", err)
+	}
+
+	summary := reloaded.Summary("1:2", now.Add(-time.Hour))
+	if summary.Requests != 1 || summary.Calls != 2 {
+		t.Fatalf("unexpected counts: %#v", summary)
+	}
+	if summary.InputTokens != 150 || summary.OutputTokens != 15 || summary.CostUSD != 0.25 || summary.Duration != 3*time.Second {
+		t.Fatalf("unexpected totals: %#v", summary.UsageTotals)
+	}
+	if got := summary.ByAgent["codex"].InputTokens; got != 100 {
+		t.Fatalf("codex input tokens = %d, want 100", got)
+	}
+
+	all := reloaded.Summary("", now.AddDate(0, 0, -7))
+	if all.Requests != 3 || all.Calls != 4 {
+		t.Fatalf("unexpected all-topic counts: %#v", all)
+	}
+}
+
+func TestUsageStore_SkipsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	data := "{\"time\":\"2026-03-10T12:00:00Z\",\"request\":\"a\",\"agent\":\"codex\",\"input_tokens\":5}\nnot json\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write usage file: %v", err)
+	}
+
+	store, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatalf("NewUsageStore returned error: %v", err)
+	}
+	if got := store.Summary("", time.Time{}).InputTokens; got != 5 {
+		t.Fatalf("input tokens = %d, want 5", got)
+	}
+}
+
+func TestUsageStore_KeepsOnlyTodaysTotalsInMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	store, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatalf("NewUsageStore returned error: %v", err)
+	}
+	now := time.Now()
+	_ = store.Record(UsageRecord{Time: now.AddDate(0, 0, -2), Topic: "1:2", Request: "old", Agent: "codex", InputTokens: 5000})
+	_ = store.Record(UsageRecord{Time: now, Topic: "1:2", Request: "a", Agent: "codex", InputTokens: 100, OutputTokens: 10, DurationMS: 60_000})
+	_ = store.Record(UsageRecord{Time: now, Topic: "1:3", Request: "b", Agent: "claude", InputTokens: 7})
+
+	reloaded, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatalf("NewUsageStore reload returned error: %v", err)
+	}
+	if len(reloaded.records) != 0 {
+		t.Fatalf("expected a persisted store not to keep records, got %d", len(reloaded.records))
+	}
+	if got := reloaded.Today("1:2", now); got.InputTokens != 100 || got.Duration != time.Minute {
+		t.Fatalf("unexpected topic totals for today: %#v", got)
+	}
+	if got := reloaded.Today("", now); got.Calls != 2 || got.InputTokens != 107 {
+		t.Fatalf("unexpected global totals for today: %#v", got)
+	}
+	if got := reloaded.Today("", now.AddDate(0, 0, 1)); got.Calls != 0 {
+		t.Fatalf("expected no usage on the next day, got %#v", got)
+	}
+
+	// The first record after midnight starts a new day.
+	_ = reloaded.Record(UsageRecord{Time: now.AddDate(0, 0, 1), Topic: "1:2", Request: "c", Agent: "codex", InputTokens: 1})
+	if got := reloaded.Today("1:2", now.AddDate(0, 0, 1)); got.InputTokens != 1 {
+		t.Fatalf("expected totals to restart on a new day, got %#v", got)
+	}
+	if got := reloaded.Summary("", time.Time{}); got.Calls != 4 {
+		t.Fatalf("expected Summary to read the whole log, got %#v", got)
+	}
+}